@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/swerveaux/acmetest/internal/acmetest"
+)
+
+// runApply is the apply command: issue or renew whatever in a manifest
+// is missing from its store or due for renewal.   With --interval it
+// keeps doing that until it's killed, serving metrics if asked to.
+func runApply(args []string) {
+	flags := pflag.NewFlagSet("apply", pflag.ExitOnError)
+	common := addCommonFlags(flags)
+	var manifestPath string
+	var concurrency int
+	var interval time.Duration
+	var metricsAddr string
+	flags.StringVar(&manifestPath, "manifest", "certificates.yaml", "YAML or JSON manifest of certificates to reconcile.")
+	flags.IntVar(&concurrency, "concurrency", 4, "How many certificates to work on at once.")
+	flags.DurationVar(&interval, "interval", 0, "Reconcile again this often instead of exiting after one pass.")
+	flags.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics at /metrics on this address, e.g. :9090.")
+	flags.Parse(args)
+
+	cfg, err := common.load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flags.Changed("metrics-addr") {
+		cfg.MetricsAddr = metricsAddr
+	}
+
+	manifest, err := acmetest.LoadManifest(manifestPath)
+	if err != nil {
+		log.Fatalf("Failed loading manifest %s: %v", manifestPath, err)
+	}
+	if manifest.Defaults.Solver == "" {
+		manifest.Defaults.Solver = cfg.Solver.Type
+	}
+	if manifest.Defaults.Store == "" {
+		manifest.Defaults.Store = cfg.Store.Type
+	}
+	if manifest.Defaults.NameTemplate == "" {
+		manifest.Defaults.NameTemplate = cfg.Store.NameTemplate
+	}
+
+	// Tracing goes first so the directory and account requests newClient
+	// makes are traced too.
+	logger, err := cfg.logger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	flush, err := cfg.setupTracing(context.Background(), logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer flush()
+
+	// exit flushes the traces before exiting non-zero, which log.Fatal
+	// would skip.
+	exit := func(format string, v ...interface{}) {
+		log.Printf(format, v...)
+		flush()
+		os.Exit(1)
+	}
+
+	client, err := cfg.newClient(nil)
+	if err != nil {
+		exit("%v", err)
+	}
+	if cfg.MetricsAddr != "" {
+		client.Metrics, err = serveMetrics(cfg.MetricsAddr, client.Logger)
+		if err != nil {
+			exit("Failed serving metrics: %v", err)
+		}
+	}
+
+	stores, err := cfg.stores(client)
+	if err != nil {
+		exit("%v", err)
+	}
+
+	applier := acmetest.Applier{
+		Client:      &client,
+		Solvers:     cfg.solvers(client),
+		Stores:      stores,
+		Concurrency: concurrency,
+		Timeout:     cfg.Timeouts.Issue,
+	}
+
+	for {
+		results, err := applier.Apply(context.Background(), manifest)
+		if err != nil {
+			exit("%v", err)
+		}
+		failed := printResults(results)
+
+		if interval <= 0 {
+			if failed > 0 {
+				flush()
+				os.Exit(1)
+			}
+			return
+		}
+		client.Logger.Info("Waiting for the next pass", "interval", interval, "failed", failed)
+		time.Sleep(interval)
+	}
+}
+
+// printResults prints a line per certificate and returns how many failed.
+func printResults(results []acmetest.ApplyResult) int {
+	failed := 0
+	for _, r := range results {
+		line := fmt.Sprintf("%-8s %s/%s [%s]", r.Action, r.Store, r.Name, strings.Join(r.Domains, ","))
+		if r.Reason != "" {
+			line += " " + r.Reason
+		}
+		if !r.NotAfter.IsZero() {
+			line += fmt.Sprintf(", valid until %s", r.NotAfter.Format(time.RFC3339))
+		}
+		if r.Err != nil {
+			line += fmt.Sprintf(": %v", r.Err)
+			failed++
+		}
+		fmt.Println(line)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d certificates failed\n", failed, len(results))
+	}
+	return failed
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/spf13/pflag"
+	"github.com/swerveaux/acmetest/internal/acmetest"
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// config is everything the CLI can be told.   It comes from a YAML config
+// file, then ACMETEST_* environment variables, then flags, each
+// overriding the last.
+type config struct {
+	Directory          string          `yaml:"directory"`
+	Contacts           []string        `yaml:"contacts"`
+	AccountKey         string          `yaml:"account_key"`
+	EAB                eabConfig       `yaml:"eab"`
+	CABundle           string          `yaml:"ca_bundle"`
+	InsecureSkipVerify bool            `yaml:"insecure_skip_verify"`
+	AWSRegion          string          `yaml:"aws_region"`
+	PreferredChain     string          `yaml:"preferred_chain"`
+	Solver             solverConfig    `yaml:"solver"`
+	Store              storeConfig     `yaml:"store"`
+	Timeouts           timeoutConfig   `yaml:"timeouts"`
+	RateLimits         rateLimitConfig `yaml:"rate_limits"`
+	Polling            pollingConfig   `yaml:"polling"`
+	Log                logConfig       `yaml:"log"`
+	MetricsAddr        string          `yaml:"metrics_addr"`
+	Tracing            tracingConfig   `yaml:"tracing"`
+}
+
+type eabConfig struct {
+	KeyID   string `yaml:"key_id"`
+	HMACKey string `yaml:"hmac_key"`
+}
+
+type solverConfig struct {
+	Type             string        `yaml:"type"`
+	PropagationDelay time.Duration `yaml:"propagation_delay"`
+	Workers          int           `yaml:"workers"`
+	HTTPAddr         string        `yaml:"http_addr"`
+	Webroot          string        `yaml:"webroot"`
+	TLSALPNAddr      string        `yaml:"tls_alpn_addr"`
+}
+
+type storeConfig struct {
+	Type         string          `yaml:"type"`
+	NameTemplate string          `yaml:"name_template"`
+	ASM          asmStoreConfig  `yaml:"asm"`
+	Files        fileStoreConfig `yaml:"files"`
+	Kubernetes   kubeStoreConfig `yaml:"kubernetes"`
+	Vault        vaultConfig     `yaml:"vault"`
+	ACM          acmStoreConfig  `yaml:"acm"`
+}
+
+// asmStoreConfig sets up the asm store.   Without bundle it writes the
+// <name>.key and <name>.crt pair it always has.   resource_policy is
+// the JSON policy itself.
+type asmStoreConfig struct {
+	Bundle         bool              `yaml:"bundle"`
+	NamePrefix     string            `yaml:"name_prefix"`
+	PathTemplate   string            `yaml:"path_template"`
+	KMSKeyID       string            `yaml:"kms_key_id"`
+	Tags           map[string]string `yaml:"tags"`
+	ResourcePolicy string            `yaml:"resource_policy"`
+}
+
+// acmStoreConfig sets up the acm store.   Region defaults to aws_region,
+// and endpoint is only for pointing it at something standing in for ACM.
+type acmStoreConfig struct {
+	Region   string `yaml:"region"`
+	Endpoint string `yaml:"endpoint"`
+}
+
+// vaultConfig sets up the vault store.   Address, token and namespace
+// fall back to VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE.   Setting
+// role_id logs in with AppRole instead of using a token.
+type vaultConfig struct {
+	Address      string `yaml:"address"`
+	Namespace    string `yaml:"namespace"`
+	Mount        string `yaml:"mount"`
+	PathTemplate string `yaml:"path_template"`
+	Token        string `yaml:"token"`
+	AppRoleMount string `yaml:"approle_mount"`
+	RoleID       string `yaml:"role_id"`
+	SecretID     string `yaml:"secret_id"`
+}
+
+// kubeStoreConfig sets up the kubernetes store.   With no kubeconfig it
+// uses the in-cluster config, then KUBECONFIG and ~/.kube/config.
+type kubeStoreConfig struct {
+	Kubeconfig  string            `yaml:"kubeconfig"`
+	Context     string            `yaml:"context"`
+	Namespace   string            `yaml:"namespace"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// fileStoreConfig sets up the files store.   Modes are octal strings,
+// like "0640".
+type fileStoreConfig struct {
+	Dir           string             `yaml:"dir"`
+	KeyFile       string             `yaml:"key_file"`
+	CertFile      string             `yaml:"cert_file"`
+	ChainFile     string             `yaml:"chain_file"`
+	FullChainFile string             `yaml:"fullchain_file"`
+	CombinedFile  string             `yaml:"combined_file"`
+	KeyMode       string             `yaml:"key_mode"`
+	CertMode      string             `yaml:"cert_mode"`
+	Owner         string             `yaml:"owner"`
+	Group         string             `yaml:"group"`
+	Keep          int                `yaml:"keep"`
+	PostDeploy    []deployHookConfig `yaml:"post_deploy"`
+}
+
+// deployHookConfig is a command to run or a process to signal once a
+// certificate's files have been written.
+type deployHookConfig struct {
+	Command string `yaml:"command"`
+	PIDFile string `yaml:"pid_file"`
+	Signal  string `yaml:"signal"`
+}
+
+// rateLimitConfig holds the local issuance limits, which default to Let's
+// Encrypt's, and the longest Retry-After we'll wait out.
+type rateLimitConfig struct {
+	PerDomain     int           `yaml:"per_domain"`
+	DomainWindow  time.Duration `yaml:"domain_window"`
+	PerAccount    int           `yaml:"per_account"`
+	AccountWindow time.Duration `yaml:"account_window"`
+	MaxRetryAfter time.Duration `yaml:"max_retry_after"`
+}
+
+// pollingConfig is how we wait on orders and authorizations: starting
+// at interval and doubling up to max_interval, for at most max_attempts
+// polls or timeout, whichever comes first.
+type pollingConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// validate rejects polling settings that would make every wait zero, or
+// give up before the first poll.
+func (p pollingConfig) validate() error {
+	switch {
+	case p.Interval <= 0:
+		return fmt.Errorf("polling interval must be positive, got %v", p.Interval)
+	case p.MaxInterval <= 0:
+		return fmt.Errorf("polling max_interval must be positive, got %v", p.MaxInterval)
+	case p.Interval > p.MaxInterval:
+		return fmt.Errorf("polling interval %v is more than max_interval %v", p.Interval, p.MaxInterval)
+	case p.MaxAttempts <= 0:
+		return fmt.Errorf("polling max_attempts must be positive, got %d", p.MaxAttempts)
+	case p.Timeout <= 0:
+		return fmt.Errorf("polling timeout must be positive, got %v", p.Timeout)
+	}
+	return nil
+}
+
+// logConfig is where log lines go: stderr, as text or json, at level
+// and up.   Secrets are redacted unless secrets is set.
+type logConfig struct {
+	Level   string `yaml:"level"`
+	Format  string `yaml:"format"`
+	Secrets bool   `yaml:"secrets"`
+}
+
+// tracingConfig says where to send spans.   Leaving otlp_endpoint empty
+// still honors the standard OTEL_EXPORTER_OTLP_* variables.
+type tracingConfig struct {
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+}
+
+type timeoutConfig struct {
+	HTTP  time.Duration `yaml:"http"`
+	Issue time.Duration `yaml:"issue"`
+}
+
+// directoryAliases are the names that can be used instead of a URL.
+var directoryAliases = map[string]string{
+	"production": acmeURL,
+	"staging":    acmeStagingURL,
+	"pebble":     acmeLocalURL,
+}
+
+func defaultConfig() config {
+	return config{
+		Directory: "staging",
+		Contacts:  []string{"somebody@example.org"},
+		AWSRegion: "us-east-1",
+		Solver: solverConfig{
+			Type:             acmetest.DefaultSolver,
+			PropagationDelay: 30 * time.Second,
+			Workers:          10,
+		},
+		Store: storeConfig{
+			Type:         acmetest.DefaultStore,
+			NameTemplate: acmetest.DefaultNameTemplate,
+		},
+		Timeouts: timeoutConfig{
+			HTTP:  30 * time.Second,
+			Issue: 15 * time.Minute,
+		},
+		RateLimits: rateLimitConfig{
+			PerDomain:     acmetest.LetsEncryptLimits.PerDomain,
+			DomainWindow:  acmetest.LetsEncryptLimits.DomainWindow,
+			PerAccount:    acmetest.LetsEncryptLimits.PerAccount,
+			AccountWindow: acmetest.LetsEncryptLimits.AccountWindow,
+			MaxRetryAfter: acmetest.DefaultBackoff.MaxRetryAfter,
+		},
+		Log: logConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Polling: pollingConfig{
+			Interval:    acmetest.DefaultBackoff.Initial,
+			MaxInterval: acmetest.DefaultBackoff.Max,
+			MaxAttempts: acmetest.DefaultBackoff.MaxPolls,
+			Timeout:     acmetest.DefaultBackoff.PollTimeout,
+		},
+	}
+}
+
+// loadConfig reads the config file at path, if there is one, on top of
+// the defaults and then applies the environment.
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		err = yaml.UnmarshalStrict(b, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("Failed parsing %s: %v", path, err)
+		}
+	}
+
+	err := cfg.applyEnv(os.Getenv)
+	return cfg, err
+}
+
+// applyEnv overrides the config with any ACMETEST_* variables that are set.
+func (cfg *config) applyEnv(getenv func(string) string) error {
+	strs := map[string]*string{
+		"ACMETEST_DIRECTORY":       &cfg.Directory,
+		"ACMETEST_ACCOUNT_KEY":     &cfg.AccountKey,
+		"ACMETEST_EAB_KEY_ID":      &cfg.EAB.KeyID,
+		"ACMETEST_EAB_HMAC_KEY":    &cfg.EAB.HMACKey,
+		"ACMETEST_CA_BUNDLE":       &cfg.CABundle,
+		"ACMETEST_AWS_REGION":      &cfg.AWSRegion,
+		"ACMETEST_PREFERRED_CHAIN": &cfg.PreferredChain,
+		"ACMETEST_SOLVER":          &cfg.Solver.Type,
+		"ACMETEST_HTTP_ADDR":       &cfg.Solver.HTTPAddr,
+		"ACMETEST_WEBROOT":         &cfg.Solver.Webroot,
+		"ACMETEST_TLS_ALPN_ADDR":   &cfg.Solver.TLSALPNAddr,
+		"ACMETEST_STORE":           &cfg.Store.Type,
+		"ACMETEST_NAME_TEMPLATE":   &cfg.Store.NameTemplate,
+		"ACMETEST_FILES_DIR":       &cfg.Store.Files.Dir,
+		"ACMETEST_KUBE_NAMESPACE":  &cfg.Store.Kubernetes.Namespace,
+		"ACMETEST_VAULT_ROLE_ID":   &cfg.Store.Vault.RoleID,
+		"ACMETEST_VAULT_SECRET_ID": &cfg.Store.Vault.SecretID,
+		"ACMETEST_ASM_NAME_PREFIX": &cfg.Store.ASM.NamePrefix,
+		"ACMETEST_ASM_KMS_KEY_ID":  &cfg.Store.ASM.KMSKeyID,
+		"ACMETEST_ACM_REGION":      &cfg.Store.ACM.Region,
+		"ACMETEST_ACM_ENDPOINT":    &cfg.Store.ACM.Endpoint,
+		"ACMETEST_LOG_LEVEL":       &cfg.Log.Level,
+		"ACMETEST_LOG_FORMAT":      &cfg.Log.Format,
+		"ACMETEST_METRICS_ADDR":    &cfg.MetricsAddr,
+		"ACMETEST_OTLP_ENDPOINT":   &cfg.Tracing.OTLPEndpoint,
+	}
+	for name, field := range strs {
+		if v := getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	// Vault's own variables only fill in what the config left out.
+	for name, field := range map[string]*string{
+		"VAULT_ADDR":      &cfg.Store.Vault.Address,
+		"VAULT_TOKEN":     &cfg.Store.Vault.Token,
+		"VAULT_NAMESPACE": &cfg.Store.Vault.Namespace,
+	} {
+		if v := getenv(name); v != "" && *field == "" {
+			*field = v
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"ACMETEST_PROPAGATION_DELAY": &cfg.Solver.PropagationDelay,
+		"ACMETEST_HTTP_TIMEOUT":      &cfg.Timeouts.HTTP,
+		"ACMETEST_ISSUE_TIMEOUT":     &cfg.Timeouts.Issue,
+		"ACMETEST_MAX_RETRY_AFTER":   &cfg.RateLimits.MaxRetryAfter,
+		"ACMETEST_POLL_INTERVAL":     &cfg.Polling.Interval,
+		"ACMETEST_POLL_TIMEOUT":      &cfg.Polling.Timeout,
+	}
+	for name, field := range durations {
+		if v := getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("Bad %s: %v", name, err)
+			}
+			*field = d
+		}
+	}
+
+	if v := getenv("ACMETEST_CONTACTS"); v != "" {
+		cfg.Contacts = splitList(v)
+	}
+	if v := getenv("ACMETEST_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("Bad ACMETEST_WORKERS: %v", err)
+		}
+		cfg.Solver.Workers = n
+	}
+	if v := getenv("ACMETEST_ASM_BUNDLE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Bad ACMETEST_ASM_BUNDLE: %v", err)
+		}
+		cfg.Store.ASM.Bundle = b
+	}
+	if v := getenv("ACMETEST_INSECURE_SKIP_VERIFY"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Bad ACMETEST_INSECURE_SKIP_VERIFY: %v", err)
+		}
+		cfg.InsecureSkipVerify = b
+	}
+
+	return nil
+}
+
+// commonFlags are the flags every command takes.   They're applied over
+// the config file and environment with apply.
+type commonFlags struct {
+	flags *pflag.FlagSet
+
+	configPath       string
+	directory        string
+	contacts         string
+	preferredChain   string
+	workers          int
+	propagationDelay time.Duration
+	logLevel         string
+}
+
+func addCommonFlags(flags *pflag.FlagSet) *commonFlags {
+	cf := &commonFlags{flags: flags}
+	flags.StringVar(&cf.configPath, "config", os.Getenv("ACMETEST_CONFIG"), "YAML config file.")
+	flags.StringVar(&cf.directory, "directory", "", "ACME directory URL, or one of production, staging or pebble.")
+	flags.StringVar(&cf.contacts, "contacts", "", "Command separated list of email contacts")
+	flags.StringVar(&cf.preferredChain, "preferred-chain", "", "Issuer common name of the chain to use if the CA offers alternate chains.")
+	flags.IntVar(&cf.workers, "workers", 0, "How many challenges to work on at once.")
+	flags.DurationVar(&cf.propagationDelay, "propagation-delay", 0, "Extra time to wait for DNS changes to propagate once Route53 reports them in sync.")
+	flags.StringVar(&cf.logLevel, "log-level", "", "Log level: debug, info, warn or error.")
+	return cf
+}
+
+// load reads the config and applies whichever flags were given.
+func (cf *commonFlags) load() (config, error) {
+	cfg, err := loadConfig(cf.configPath)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cf.flags.Changed("directory") {
+		cfg.Directory = cf.directory
+	}
+	if cf.flags.Changed("contacts") {
+		cfg.Contacts = splitList(cf.contacts)
+	}
+	if cf.flags.Changed("preferred-chain") {
+		cfg.PreferredChain = cf.preferredChain
+	}
+	if cf.flags.Changed("workers") {
+		cfg.Solver.Workers = cf.workers
+	}
+	if cf.flags.Changed("propagation-delay") {
+		cfg.Solver.PropagationDelay = cf.propagationDelay
+	}
+	if cf.flags.Changed("log-level") {
+		cfg.Log.Level = cf.logLevel
+	}
+
+	return cfg, nil
+}
+
+// logger builds the logger from the log settings.
+func (cfg config) logger() (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(cfg.Log.Level))
+	if err != nil {
+		return nil, fmt.Errorf("Bad log level %q: %v", cfg.Log.Level, err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch cfg.Log.Format {
+	case "text", "":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("Bad log format %q, expected text or json", cfg.Log.Format)
+	}
+	if !cfg.Log.Secrets {
+		h = acmetest.NewRedactingHandler(h)
+	}
+	return slog.New(h), nil
+}
+
+// directoryURL resolves the directory setting, which may be an alias.
+func (cfg config) directoryURL() (string, error) {
+	if u, ok := directoryAliases[cfg.Directory]; ok {
+		return u, nil
+	}
+	u, err := url.Parse(cfg.Directory)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("Directory %q is neither a URL nor one of production, staging or pebble", cfg.Directory)
+	}
+	return cfg.Directory, nil
+}
+
+// httpClient builds the client used to talk to the CA, trusting the CA
+// bundle on top of the system roots if one is set.   Skipping
+// verification is only allowed against a CA on this machine, like
+// pebble, so it can't be left on by accident against a real CA.
+func (cfg config) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.CABundle != "" {
+		pemCerts, err := ioutil.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.InsecureSkipVerify {
+		dirURL, err := cfg.directoryURL()
+		if err != nil {
+			return nil, err
+		}
+		if !isLocal(dirURL) {
+			return nil, fmt.Errorf("insecure_skip_verify is only allowed for a local test CA, not %s", dirURL)
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport, Timeout: cfg.Timeouts.HTTP}, nil
+}
+
+// isLocal reports whether a URL points at this machine.
+func isLocal(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newClient sets up a client against the configured CA.   Without an
+// account key path a throwaway key is used, which means a new account.
+func (cfg config) newClient(certKey crypto.Signer) (acmetest.Client, error) {
+	dirURL, err := cfg.directoryURL()
+	if err != nil {
+		return acmetest.Client{}, err
+	}
+
+	err = cfg.Polling.validate()
+	if err != nil {
+		return acmetest.Client{}, err
+	}
+
+	httpClient, err := cfg.httpClient()
+	if err != nil {
+		return acmetest.Client{}, err
+	}
+
+	var key crypto.Signer
+	if cfg.AccountKey != "" {
+		key, err = acmetest.LoadAccountKey(cfg.AccountKey)
+	} else {
+		key, err = acmetest.GenerateKey(acmetest.KeyTypeEC256)
+	}
+	if err != nil {
+		return acmetest.Client{}, err
+	}
+	accountKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return acmetest.Client{}, fmt.Errorf("Account key must be ECDSA, got %T", key)
+	}
+
+	contacts := make([]string, 0, len(cfg.Contacts))
+	for _, c := range cfg.Contacts {
+		if !strings.HasPrefix(c, "mailto:") {
+			c = "mailto:" + c
+		}
+		contacts = append(contacts, c)
+	}
+
+	logger, err := cfg.logger()
+	if err != nil {
+		return acmetest.Client{}, err
+	}
+
+	client, err := acmetest.NewClientWithConfig(acmetest.Config{
+		DirectoryURL: dirURL,
+		AccountKey:   accountKey,
+		CertKey:      certKey,
+		Contacts:     contacts,
+		HTTPClient:   httpClient,
+		AWSRegion:    cfg.AWSRegion,
+		EAB: acmetest.ExternalAccountBinding{
+			KeyID:   cfg.EAB.KeyID,
+			HMACKey: cfg.EAB.HMACKey,
+		},
+		Logger:     logger,
+		LogSecrets: cfg.Log.Secrets,
+	})
+	if err != nil {
+		return client, err
+	}
+
+	client.PreferredChain = cfg.PreferredChain
+	client.Workers = cfg.Solver.Workers
+	client.Backoff = acmetest.Backoff{
+		Initial:       cfg.Polling.Interval,
+		Max:           cfg.Polling.MaxInterval,
+		Retries:       acmetest.DefaultBackoff.Retries,
+		MaxRetryAfter: cfg.RateLimits.MaxRetryAfter,
+		MaxPolls:      cfg.Polling.MaxAttempts,
+		PollTimeout:   cfg.Polling.Timeout,
+	}
+	client.Issuance = acmetest.NewIssuanceTracker(acmetest.IssuanceLimits{
+		PerDomain:     cfg.RateLimits.PerDomain,
+		DomainWindow:  cfg.RateLimits.DomainWindow,
+		PerAccount:    cfg.RateLimits.PerAccount,
+		AccountWindow: cfg.RateLimits.AccountWindow,
+	})
+	client.Issuance.Logger = logger
+
+	return client, nil
+}
+
+// solvers are the solvers a manifest can refer to, by name.
+func (cfg config) solvers(client acmetest.Client) map[string]acmetest.Solver {
+	return map[string]acmetest.Solver{
+		"route53": &acmetest.Route53Solver{
+			R53:              client.R53,
+			PropagationDelay: cfg.Solver.PropagationDelay,
+			Logger:           client.Logger,
+			Metrics:          client.Metrics,
+			TracerProvider:   client.TracerProvider,
+		},
+		"http-01":     &acmetest.HTTP01Solver{Addr: cfg.Solver.HTTPAddr, Webroot: cfg.Solver.Webroot},
+		"tls-alpn-01": &acmetest.TLSALPN01Solver{Addr: cfg.Solver.TLSALPNAddr},
+	}
+}
+
+// stores are the stores a manifest can refer to, by name.
+func (cfg config) stores(client acmetest.Client) (map[string]acmetest.CertStore, error) {
+	files, err := cfg.Store.Files.store(client)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]acmetest.CertStore{
+		"acm": cfg.Store.ACM.store(client),
+		"asm": &acmetest.SecretsManagerStore{
+			SM:             client.SecretsManager,
+			Bundle:         cfg.Store.ASM.Bundle,
+			NamePrefix:     cfg.Store.ASM.NamePrefix,
+			PathTemplate:   cfg.Store.ASM.PathTemplate,
+			KMSKeyID:       cfg.Store.ASM.KMSKeyID,
+			Tags:           cfg.Store.ASM.Tags,
+			ResourcePolicy: cfg.Store.ASM.ResourcePolicy,
+		},
+		"files":      files,
+		"kubernetes": cfg.Store.Kubernetes.store(),
+		"vault": &acmetest.VaultStore{
+			Address:      cfg.Store.Vault.Address,
+			Namespace:    cfg.Store.Vault.Namespace,
+			HTTPClient:   &http.Client{Timeout: cfg.Timeouts.HTTP},
+			Mount:        cfg.Store.Vault.Mount,
+			PathTemplate: cfg.Store.Vault.PathTemplate,
+			Token:        cfg.Store.Vault.Token,
+			AppRole: acmetest.VaultAppRole{
+				Mount:    cfg.Store.Vault.AppRoleMount,
+				RoleID:   cfg.Store.Vault.RoleID,
+				SecretID: cfg.Store.Vault.SecretID,
+			},
+		},
+	}, nil
+}
+
+// store builds the acm store on the client's AWS session.
+func (ac acmStoreConfig) store(client acmetest.Client) acmetest.CertStore {
+	if client.AWSSession == nil {
+		return unavailableStore{errors.New("No AWS session for the acm store")}
+	}
+	awsConfig := aws.NewConfig()
+	if ac.Region != "" {
+		awsConfig = awsConfig.WithRegion(ac.Region)
+	}
+	if ac.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(ac.Endpoint)
+	}
+	return &acmetest.ACMStore{
+		ACM:    acm.New(client.AWSSession, awsConfig),
+		Logger: client.Logger,
+	}
+}
+
+// store builds the kubernetes store.   Not being able to find a cluster
+// only matters if the store is used, so it's reported then.
+func (kc kubeStoreConfig) store() acmetest.CertStore {
+	restConfig, namespace, err := kc.restConfig()
+	if err != nil {
+		return unavailableStore{fmt.Errorf("No Kubernetes cluster for the kubernetes store: %v", err)}
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return unavailableStore{err}
+	}
+	if kc.Namespace != "" {
+		namespace = kc.Namespace
+	}
+	return &acmetest.KubernetesStore{
+		Client:      clientset,
+		Namespace:   namespace,
+		Labels:      kc.Labels,
+		Annotations: kc.Annotations,
+	}
+}
+
+// restConfig finds the cluster to talk to, and the namespace its config
+// says to use.
+func (kc kubeStoreConfig) restConfig() (*rest.Config, string, error) {
+	if kc.Kubeconfig == "" && kc.Context == "" {
+		if c, err := rest.InClusterConfig(); err == nil {
+			ns, _ := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+			return c, strings.TrimSpace(string(ns)), nil
+		}
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kc.Kubeconfig
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: kc.Context})
+	c, err := loader.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	ns, _, err := loader.Namespace()
+	return c, ns, err
+}
+
+// unavailableStore stands in for a store that couldn't be set up, and
+// fails with why whenever it's used.
+type unavailableStore struct {
+	err error
+}
+
+func (s unavailableStore) Store(ctx context.Context, bundle acmetest.CertBundle) error {
+	return s.err
+}
+
+func (s unavailableStore) Load(ctx context.Context, name string) (acmetest.CertBundle, error) {
+	return acmetest.CertBundle{Name: name}, s.err
+}
+
+// store builds the files store.
+func (fc fileStoreConfig) store(client acmetest.Client) (*acmetest.FileStore, error) {
+	fs := &acmetest.FileStore{
+		Dir:           fc.Dir,
+		KeyFile:       fc.KeyFile,
+		CertFile:      fc.CertFile,
+		ChainFile:     fc.ChainFile,
+		FullChainFile: fc.FullChainFile,
+		CombinedFile:  fc.CombinedFile,
+		Owner:         fc.Owner,
+		Group:         fc.Group,
+		Keep:          fc.Keep,
+		Logger:        client.Logger,
+	}
+
+	var err error
+	fs.KeyMode, err = parseMode(fc.KeyMode)
+	if err != nil {
+		return nil, fmt.Errorf("Bad files key_mode: %v", err)
+	}
+	fs.CertMode, err = parseMode(fc.CertMode)
+	if err != nil {
+		return nil, fmt.Errorf("Bad files cert_mode: %v", err)
+	}
+
+	for _, h := range fc.PostDeploy {
+		hook := acmetest.DeployHook{Command: h.Command, PIDFile: h.PIDFile}
+		if h.Command == "" && h.PIDFile == "" {
+			return nil, fmt.Errorf("A post_deploy hook needs a command or a pid_file")
+		}
+		if h.Signal != "" {
+			sig, ok := signals[strings.TrimPrefix(strings.ToUpper(h.Signal), "SIG")]
+			if !ok {
+				return nil, fmt.Errorf("Unknown post_deploy signal %q", h.Signal)
+			}
+			hook.Signal = sig
+		}
+		fs.PostDeploy = append(fs.PostDeploy, hook)
+	}
+
+	return fs, nil
+}
+
+// parseMode parses an octal file mode, with empty meaning the default.
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("%q isn't an octal file mode", s)
+	}
+	return os.FileMode(m), nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
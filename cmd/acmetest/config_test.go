@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/swerveaux/acmetest/internal/acmetest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acmetest.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+directory: production
+contacts: [ops@example.com]
+solver:
+  propagation_delay: 10s
+store:
+  name_template: "cert_{{.Domain}}"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loading config should not have error'd, but it did: %v", err)
+	}
+	if cfg.Directory != "production" || cfg.Solver.PropagationDelay != 10*time.Second || cfg.Store.NameTemplate != "cert_{{.Domain}}" {
+		t.Errorf("expected file settings, got %+v", cfg)
+	}
+	if cfg.Solver.Workers != 10 || cfg.Timeouts.Issue != 15*time.Minute {
+		t.Errorf("expected defaults for anything the file didn't set, got %+v", cfg)
+	}
+
+	err = ioutil.WriteFile(path, []byte("directroy: production\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Errorf("a misspelled setting should have error'd, but didn't.")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"ACMETEST_DIRECTORY":         "pebble",
+		"ACMETEST_CONTACTS":          "a@example.com, b@example.com",
+		"ACMETEST_WORKERS":           "3",
+		"ACMETEST_PROPAGATION_DELAY": "1m",
+		"ACMETEST_EAB_KEY_ID":        "kid-1",
+	}
+	cfg := defaultConfig()
+	err := cfg.applyEnv(func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("applying env should not have error'd, but it did: %v", err)
+	}
+
+	if cfg.Directory != "pebble" || cfg.Solver.Workers != 3 || cfg.Solver.PropagationDelay != time.Minute || cfg.EAB.KeyID != "kid-1" {
+		t.Errorf("expected env overrides, got %+v", cfg)
+	}
+	if strings.Join(cfg.Contacts, "|") != "a@example.com|b@example.com" {
+		t.Errorf("expected contacts split and trimmed, got %q", cfg.Contacts)
+	}
+
+	for name, value := range map[string]string{
+		"ACMETEST_WORKERS":              "lots",
+		"ACMETEST_ISSUE_TIMEOUT":        "forever",
+		"ACMETEST_INSECURE_SKIP_VERIFY": "maybe",
+	} {
+		cfg := defaultConfig()
+		if err := cfg.applyEnv(func(k string) string {
+			if k == name {
+				return value
+			}
+			return ""
+		}); err == nil {
+			t.Errorf("bad %s should have error'd, but didn't.", name)
+		}
+	}
+}
+
+func TestDirectoryURL(t *testing.T) {
+	tests := []struct {
+		Directory   string
+		Expected    string
+		ShouldError bool
+	}{
+		{"production", acmeURL, false},
+		{"staging", acmeStagingURL, false},
+		{"pebble", acmeLocalURL, false},
+		{"https://ca.internal.example.com/acme/directory", "https://ca.internal.example.com/acme/directory", false},
+		{"prod", "", true},
+	}
+
+	for _, test := range tests {
+		cfg := config{Directory: test.Directory}
+		u, err := cfg.directoryURL()
+		if test.ShouldError != (err != nil) {
+			t.Errorf("directory %q: expected error %v, got %v", test.Directory, test.ShouldError, err)
+		}
+		if u != test.Expected {
+			t.Errorf("directory %q: expected %q, got %q", test.Directory, test.Expected, u)
+		}
+	}
+}
+
+func TestInsecureSkipVerifyOnlyLocal(t *testing.T) {
+	tests := []struct {
+		Directory   string
+		ShouldError bool
+	}{
+		{"pebble", false},
+		{"https://127.0.0.1:14000/dir", false},
+		{"https://[::1]:14000/dir", false},
+		{"staging", true},
+		{"https://ca.internal.example.com/directory", true},
+	}
+
+	for _, test := range tests {
+		cfg := defaultConfig()
+		cfg.Directory = test.Directory
+		cfg.InsecureSkipVerify = true
+		client, err := cfg.httpClient()
+		if test.ShouldError != (err != nil) {
+			t.Errorf("directory %q: expected error %v, got %v", test.Directory, test.ShouldError, err)
+		}
+		if err == nil && client.Timeout != cfg.Timeouts.HTTP {
+			t.Errorf("directory %q: expected timeout %v, got %v", test.Directory, cfg.Timeouts.HTTP, client.Timeout)
+		}
+	}
+}
+
+func TestPollingConfigValidate(t *testing.T) {
+	tests := []struct {
+		Name        string
+		Change      func(*pollingConfig)
+		ShouldError bool
+	}{
+		{"defaults", func(p *pollingConfig) {}, false},
+		{"interval equal to max", func(p *pollingConfig) { p.Interval = p.MaxInterval }, false},
+		{"zero interval", func(p *pollingConfig) { p.Interval = 0 }, true},
+		{"zero max_interval", func(p *pollingConfig) { p.MaxInterval = 0 }, true},
+		{"interval over max_interval", func(p *pollingConfig) { p.Interval = 2 * p.MaxInterval }, true},
+		{"zero max_attempts", func(p *pollingConfig) { p.MaxAttempts = 0 }, true},
+		{"zero timeout", func(p *pollingConfig) { p.Timeout = 0 }, true},
+	}
+
+	for _, test := range tests {
+		cfg := defaultConfig()
+		test.Change(&cfg.Polling)
+		err := cfg.Polling.validate()
+		if test.ShouldError && err == nil {
+			t.Errorf("test %q should have error'd", test.Name)
+		}
+		if !test.ShouldError && err != nil {
+			t.Errorf("test %q should not have error'd: %v", test.Name, err)
+		}
+		if test.ShouldError {
+			if _, err := cfg.newClient(nil); err == nil {
+				t.Errorf("test %q: newClient should have error'd", test.Name)
+			}
+		}
+	}
+}
+
+func TestSolversUseClient(t *testing.T) {
+	client := acmetest.Client{TracerProvider: sdktrace.NewTracerProvider()}
+	cfg := defaultConfig()
+	client.Logger, _ = cfg.logger()
+
+	r53, ok := cfg.solvers(client)["route53"].(*acmetest.Route53Solver)
+	if !ok {
+		t.Fatal("expected a route53 solver")
+	}
+	if r53.TracerProvider != client.TracerProvider || r53.Logger != client.Logger {
+		t.Errorf("expected the route53 solver to use the client's tracer provider and logger")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		Level       string
+		Format      string
+		ShouldError bool
+	}{
+		{"info", "text", false},
+		{"debug", "json", false},
+		{"WARN", "", false},
+		{"loud", "text", true},
+		{"info", "xml", true},
+	}
+
+	for _, test := range tests {
+		cfg := defaultConfig()
+		cfg.Log.Level = test.Level
+		cfg.Log.Format = test.Format
+		_, err := cfg.logger()
+		if test.ShouldError && err == nil {
+			t.Errorf("test %q/%q should have error'd", test.Level, test.Format)
+		}
+		if !test.ShouldError && err != nil {
+			t.Errorf("test %q/%q should not have error'd: %v", test.Level, test.Format, err)
+		}
+	}
+}
+
+func TestFileStoreConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acmetest.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+store:
+  type: files
+  files:
+    dir: /srv/tls/{{.Name}}
+    combined_file: haproxy.pem
+    key_mode: "0640"
+    group: ssl-cert
+    keep: 3
+    post_deploy:
+      - command: systemctl reload nginx
+      - pid_file: /run/haproxy.pid
+        signal: sigusr2
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loading config should not have error'd, but it did: %v", err)
+	}
+	fs, err := cfg.Store.Files.store(acmetest.Client{})
+	if err != nil {
+		t.Fatalf("building the files store should not have error'd, but it did: %v", err)
+	}
+	if fs.Dir != "/srv/tls/{{.Name}}" || fs.CombinedFile != "haproxy.pem" || fs.KeyMode != 0640 || fs.Group != "ssl-cert" || fs.Keep != 3 {
+		t.Errorf("expected file settings, got %+v", fs)
+	}
+	if len(fs.PostDeploy) != 2 || fs.PostDeploy[0].Command != "systemctl reload nginx" || fs.PostDeploy[1].PIDFile != "/run/haproxy.pid" || fs.PostDeploy[1].Signal != signals["USR2"] {
+		t.Errorf("expected post-deploy hooks, got %+v", fs.PostDeploy)
+	}
+
+	for _, bad := range []fileStoreConfig{
+		{KeyMode: "rw-------"},
+		{CertMode: "01777"},
+		{PostDeploy: []deployHookConfig{{}}},
+		{PostDeploy: []deployHookConfig{{PIDFile: "/run/nginx.pid", Signal: "PLEASE"}}},
+	} {
+		if _, err := bad.store(acmetest.Client{}); err == nil {
+			t.Errorf("test %+v should have error'd", bad)
+		}
+	}
+}
+
+func TestKubernetesStoreConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	err := ioutil.WriteFile(kubeconfig, []byte(`
+apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster: {server: "https://127.0.0.1:6443"}
+users:
+- name: test
+  user: {token: abc}
+contexts:
+- name: test
+  context: {cluster: test, user: test, namespace: web}
+current-context: test
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, ok := kubeStoreConfig{Kubeconfig: kubeconfig}.store().(*acmetest.KubernetesStore)
+	if !ok {
+		t.Fatalf("expected a KubernetesStore from a good kubeconfig")
+	}
+	if store.Namespace != "web" {
+		t.Errorf("expected the kubeconfig's namespace, got %q", store.Namespace)
+	}
+	store = kubeStoreConfig{Kubeconfig: kubeconfig, Namespace: "certs"}.store().(*acmetest.KubernetesStore)
+	if store.Namespace != "certs" {
+		t.Errorf("expected the configured namespace to win, got %q", store.Namespace)
+	}
+
+	bad := kubeStoreConfig{Kubeconfig: filepath.Join(t.TempDir(), "missing")}.store()
+	if _, err := bad.Load(context.Background(), "ssl_example.org"); err == nil {
+		t.Errorf("a store without a cluster should have error'd when used")
+	}
+}
+
+func TestVaultEnv(t *testing.T) {
+	env := map[string]string{
+		"VAULT_ADDR":               "https://vault.example.com:8200",
+		"VAULT_TOKEN":              "hvs.fromenv",
+		"ACMETEST_VAULT_SECRET_ID": "s3cret",
+	}
+	cfg := defaultConfig()
+	cfg.Store.Vault.Token = "hvs.fromfile"
+	if err := cfg.applyEnv(func(k string) string { return env[k] }); err != nil {
+		t.Fatalf("applying env should not have error'd, but it did: %v", err)
+	}
+
+	if cfg.Store.Vault.Address != "https://vault.example.com:8200" {
+		t.Errorf("expected VAULT_ADDR to fill in the address, got %q", cfg.Store.Vault.Address)
+	}
+	if cfg.Store.Vault.Token != "hvs.fromfile" {
+		t.Errorf("expected the config's token to win over VAULT_TOKEN, got %q", cfg.Store.Vault.Token)
+	}
+	if cfg.Store.Vault.SecretID != "s3cret" {
+		t.Errorf("expected ACMETEST_VAULT_SECRET_ID, got %q", cfg.Store.Vault.SecretID)
+	}
+}
+
+func TestACMStoreConfig(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := acmetest.Client{AWSSession: sess}
+
+	store, ok := acmStoreConfig{Region: "eu-west-1", Endpoint: "http://localhost:4566"}.store(client).(*acmetest.ACMStore)
+	if !ok {
+		t.Fatalf("expected an ACMStore")
+	}
+	api, ok := store.ACM.(*acm.ACM)
+	if !ok {
+		t.Fatalf("expected the store to use the real ACM client, got %T", store.ACM)
+	}
+	if api.Endpoint != "http://localhost:4566" {
+		t.Errorf("expected the endpoint override, got %q", api.Endpoint)
+	}
+	if api.SigningRegion != "eu-west-1" {
+		t.Errorf("expected the region override, got %q", api.SigningRegion)
+	}
+
+	bad := acmStoreConfig{}.store(acmetest.Client{})
+	if err := bad.Store(context.Background(), acmetest.CertBundle{Name: "ssl_example.org"}); err == nil {
+		t.Errorf("a store without an AWS session should have error'd when used")
+	}
+}
+
+func TestASMStoreConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acmetest.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+store:
+  asm:
+    name_prefix: prod/
+    path_template: "certs/{{.Name}}"
+    kms_key_id: alias/certs
+    tags: {team: infra}
+    resource_policy: |
+      {"Version": "2012-10-17", "Statement": []}
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loading config should not have error'd, but it did: %v", err)
+	}
+	env := map[string]string{"ACMETEST_ASM_BUNDLE": "true"}
+	if err := cfg.applyEnv(func(k string) string { return env[k] }); err != nil {
+		t.Fatalf("applying env should not have error'd, but it did: %v", err)
+	}
+
+	stores, err := cfg.stores(acmetest.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, ok := stores["asm"].(*acmetest.SecretsManagerStore)
+	if !ok {
+		t.Fatalf("expected a SecretsManagerStore, got %T", stores["asm"])
+	}
+	if !store.Bundle || store.NamePrefix != "prod/" || store.PathTemplate != "certs/{{.Name}}" || store.KMSKeyID != "alias/certs" || store.Tags["team"] != "infra" {
+		t.Errorf("expected the asm settings on the store, got %+v", store)
+	}
+	if !strings.Contains(store.ResourcePolicy, `"2012-10-17"`) {
+		t.Errorf("expected the resource policy on the store, got %q", store.ResourcePolicy)
+	}
+
+	env = map[string]string{"ACMETEST_ASM_BUNDLE": "sometimes"}
+	if err := cfg.applyEnv(func(k string) string { return env[k] }); err == nil {
+		t.Errorf("a bad ACMETEST_ASM_BUNDLE should have error'd")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+// runDeactivate is the deactivate command: deactivate authorizations so
+// the CA won't reuse them, for when a domain changes hands.   Either
+// give the authorization URLs, or give domains, for which an order is
+// placed just to find out which authorizations the CA would use.   That
+// order counts against the CA's new-orders rate limit and is left
+// pending, so --authz is better when the URLs are known.
+func runDeactivate(args []string) {
+	flags := pflag.NewFlagSet("deactivate", pflag.ExitOnError)
+	common := addCommonFlags(flags)
+	var authzArg string
+	var domainsArg string
+	flags.StringVar(&authzArg, "authz", "", "Comma separated list of authorization URLs to deactivate.")
+	flags.StringVar(&domainsArg, "domains", "", "Comma separated list of domains whose current authorizations should be deactivated (places an order to find them; prefer --authz).")
+	flags.Parse(args)
+
+	if authzArg == "" && domainsArg == "" {
+		log.Fatal("Need --authz or --domains")
+	}
+
+	cfg, err := common.load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tracing goes first so the directory and account requests newClient
+	// makes are traced too.
+	logger, err := cfg.logger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	flush, err := cfg.setupTracing(context.Background(), logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer flush()
+
+	// exit flushes the traces before exiting non-zero, which log.Fatal
+	// would skip.
+	exit := func(format string, v ...interface{}) {
+		log.Printf(format, v...)
+		flush()
+		os.Exit(1)
+	}
+
+	client, err := cfg.newClient(nil)
+	if err != nil {
+		exit("%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Issue)
+	defer cancel()
+
+	authzURLs := splitList(authzArg)
+	if domains := splitList(domainsArg); len(domains) > 0 {
+		client.Logger.Warn("Placing an order to find authorizations; it counts against the new-orders rate limit and will be left pending", "domains", domainsArg)
+		order, err := client.CertApply(ctx, domains, "")
+		if err != nil {
+			exit("%v", err)
+		}
+		authzURLs = append(authzURLs, order.Authorizations...)
+	}
+
+	failed := false
+	for _, authzURL := range authzURLs {
+		authz, err := client.DeactivateAuthorization(ctx, authzURL)
+		if err != nil {
+			fmt.Printf("failed      %s: %v\n", authzURL, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("deactivated %s (%s)\n", authzURL, authz.Identifier.Value)
+	}
+
+	if failed {
+		flush()
+		os.Exit(1)
+	}
+}
@@ -1,19 +1,15 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
 	"strings"
-	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/swerveaux/acmetest/internal/acmetest"
+	"go.opentelemetry.io/otel"
 )
 
 const (
@@ -23,85 +19,117 @@ const (
 )
 
 func main() {
-	// key, err := rsa.GenerateKey(rand.Reader, 2048)
-	var contactsArg string
-	var domainsArg string
-	pflag.StringVar(&contactsArg, "contacts", "somebody@example.org", "Command separated list of email contacts")
-	pflag.StringVar(&domainsArg, "domains", "example.org", "Comma separated list of domains to request certs for.")
-	pflag.Parse()
-
-	contacts := strings.Split(contactsArg, ",")
-	domains := strings.Split(domainsArg, ",")
-	for i := range contacts {
-		contacts[i] = fmt.Sprintf("mailto:%s", strings.TrimSpace(contacts[i]))
+	command, args := "issue", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
-	for i := range domains {
-		domains[i] = strings.TrimSpace(domains[i])
+
+	switch command {
+	case "issue":
+		runIssue(args)
+	case "apply":
+		runApply(args)
+	case "preauthorize":
+		runPreauthorize(args)
+	case "deactivate":
+		runDeactivate(args)
+	default:
+		log.Fatalf("Unknown command %q, expected issue, apply, preauthorize or deactivate", command)
 	}
+}
 
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// runIssue is the issue command, and what happens with no command at
+// all: get one certificate for --domains and store it.
+func runIssue(args []string) {
+	flags := pflag.NewFlagSet("issue", pflag.ExitOnError)
+	common := addCommonFlags(flags)
+	var domainsArg string
+	var keyType string
+	var profile string
+	flags.StringVar(&domainsArg, "domains", "example.org", "Comma separated list of domains to request certs for.")
+	flags.StringVar(&keyType, "key-type", acmetest.DefaultKeyType, "Certificate key type: rsa2048, rsa4096, ec256 or ec384.")
+	flags.StringVar(&profile, "profile", "", "Certificate profile to ask for, if the CA offers profiles (e.g. classic, tlsserver, shortlived).")
+	flags.Parse(args)
+
+	cfg, err := common.load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	certKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	domains := splitList(domainsArg)
+
+	certKey, err := acmetest.GenerateKey(keyType)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	acmeURL := acmeStagingURL
-	if acmeURL == acmeLocalURL {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	keyPEM, err := acmetest.EncodeKeyPEM(certKey)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	client, err := acmetest.NewClient(acmeURL, key, certKey, contacts)
+	// Tracing goes first so the directory and account requests newClient
+	// makes are traced too.
+	logger, err := cfg.logger()
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	certApply, err := client.CertApply(domains)
+	flush, err := cfg.setupTracing(context.Background(), logger)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	challengeResponse, err := client.FetchChallenges(certApply.Authorizations[0])
-	fmt.Println(challengeResponse)
-	var challenge acmetest.Challenge
-	for _, c := range challengeResponse.Challenges {
-		if c.Type == "dns-01" {
-			challenge = c
-			break
-		}
+	defer flush()
+
+	// exit exits non-zero so scripts and cron can tell, but only once the
+	// traces have been flushed, which log.Fatal would skip.
+	exit := func(format string, v ...interface{}) {
+		log.Printf(format, v...)
+		flush()
+		os.Exit(1)
 	}
-	authHash, err := client.AcmeAuthHash(challenge.Token)
+
+	client, err := cfg.newClient(certKey)
 	if err != nil {
-		log.Fatal(err)
+		exit("%v", err)
 	}
-	fmt.Println(string(authHash))
 
-	err = client.AddTextRecord(domains[0], authHash)
+	solver, ok := cfg.solvers(client)[cfg.Solver.Type]
+	if !ok {
+		exit("Unknown solver %q", cfg.Solver.Type)
+	}
+	stores, err := cfg.stores(client)
 	if err != nil {
-		log.Fatal(err)
+		exit("%v", err)
+	}
+	store, ok := stores[cfg.Store.Type]
+	if !ok {
+		exit("Unknown store %q", cfg.Store.Type)
+	}
+	name, err := acmetest.CertName(cfg.Store.NameTemplate, domains)
+	if err != nil {
+		exit("%v", err)
 	}
 
-	defer func() {
-		err = client.RemoveTextRecord(domains[0], authHash)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Issue)
+	defer cancel()
+	ctx, span := otel.Tracer("acmetest").Start(ctx, "issue")
+	defer span.End()
 
-	<-time.After(1 * time.Minute)
+	// fail is exit once the span's ended.
+	fail := func(format string, v ...interface{}) {
+		span.End()
+		exit(format, v...)
+	}
 
-	err = client.ChallengeReady(challenge.URL)
+	chain, err := client.Issue(ctx, domains, profile, certKey, solver)
 	if err != nil {
-		log.Printf("Failed posting challenge: %v\n", err)
-		return
+		fail("Failed getting certificate: %v\n", err)
 	}
 
-	err = client.PollForStatus(domains[0])
+	storeCtx, storeSpan := otel.Tracer("acmetest").Start(ctx, "Store Save")
+	err = store.Store(storeCtx, acmetest.NewCertBundle(name, domains, keyPEM, chain))
+	storeSpan.End()
 	if err != nil {
-		log.Printf("Bad response when polling: %v\n", err)
+		fail("Failed saving certificate: %v\n", err)
 	}
-
+	fmt.Printf("Stored %s in %s, valid until %s\n", name, cfg.Store.Type, chain.Leaf.NotAfter)
 }
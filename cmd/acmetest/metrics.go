@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/swerveaux/acmetest/internal/acmetest"
+)
+
+// serveMetrics registers the metrics and serves them on addr at
+// /metrics in the background.
+func serveMetrics(addr string, logger *slog.Logger) (*acmetest.Metrics, error) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	metrics, err := acmetest.NewMetrics(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		err := http.Serve(l, mux)
+		logger.Error("Metrics server stopped", "error", err)
+	}()
+	logger.Info("Serving metrics", "url", "http://"+l.Addr().String()+"/metrics")
+
+	return metrics, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/pflag"
+	"github.com/swerveaux/acmetest/internal/acmetest"
+)
+
+// runPreauthorize is the preauthorize command: get --domains validated
+// ahead of time on a CA with newAuthz, so orders placed later don't have
+// to wait on challenges.
+func runPreauthorize(args []string) {
+	flags := pflag.NewFlagSet("preauthorize", pflag.ExitOnError)
+	common := addCommonFlags(flags)
+	var domainsArg string
+	flags.StringVar(&domainsArg, "domains", "example.org", "Comma separated list of domains to authorize.")
+	flags.Parse(args)
+
+	cfg, err := common.load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tracing goes first so the directory and account requests newClient
+	// makes are traced too.
+	logger, err := cfg.logger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	flush, err := cfg.setupTracing(context.Background(), logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer flush()
+
+	// exit flushes the traces before exiting non-zero, which log.Fatal
+	// would skip.
+	exit := func(format string, v ...interface{}) {
+		log.Printf(format, v...)
+		flush()
+		os.Exit(1)
+	}
+
+	client, err := cfg.newClient(nil)
+	if err != nil {
+		exit("%v", err)
+	}
+
+	solver, ok := cfg.solvers(client)[cfg.Solver.Type]
+	if !ok {
+		exit("Unknown solver %q", cfg.Solver.Type)
+	}
+
+	identifiers := acmetest.NewIdentifiers(splitList(domainsArg))
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Issue)
+	defer cancel()
+
+	authzs, err := client.PreAuthorizeAll(ctx, identifiers, solver)
+	if err != nil {
+		exit("%v", err)
+	}
+	for _, authz := range authzs {
+		fmt.Printf("%s %s, expires %s: %s\n", authz.Identifier.Value, authz.Status, authz.Expires, authz.URL)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "syscall"
+
+// signals are the signals a post-deploy hook can send, by name.   Outside
+// unix there's no SIGUSR1 or SIGUSR2.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+}
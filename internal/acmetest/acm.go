@@ -0,0 +1,281 @@
+package acmetest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/acm"
+)
+
+// Tags ACMStore puts on the certificates it imports.
+const (
+	ACMNameTag      = "acmetest:name"
+	ACMDomainSetTag = "acmetest:domain-set"
+)
+
+// ACMAPI is the part of ACM that ACMStore uses, so tests can swap in a
+// fake.
+type ACMAPI interface {
+	ImportCertificateWithContext(aws.Context, *acm.ImportCertificateInput, ...request.Option) (*acm.ImportCertificateOutput, error)
+	ListCertificatesWithContext(aws.Context, *acm.ListCertificatesInput, ...request.Option) (*acm.ListCertificatesOutput, error)
+	ListTagsForCertificateWithContext(aws.Context, *acm.ListTagsForCertificateInput, ...request.Option) (*acm.ListTagsForCertificateOutput, error)
+	AddTagsToCertificateWithContext(aws.Context, *acm.AddTagsToCertificateInput, ...request.Option) (*acm.AddTagsToCertificateOutput, error)
+	GetCertificateWithContext(aws.Context, *acm.GetCertificateInput, ...request.Option) (*acm.GetCertificateOutput, error)
+}
+
+// ACMStore imports certificates into AWS Certificate Manager, for load
+// balancers and CloudFront to use.   Each certificate is tagged with its
+// name and a hash of its domains, and a renewal under the same name for
+// the same domains is imported over it, so the ARN stays the same and
+// whatever uses it picks up the new certificate without being touched.
+// Two names with the same domains, say an RSA and an ECDSA certificate,
+// get an ARN each.
+//
+// ACM never gives a key back, so Load returns the certificate and chain
+// with no KeyPEM, and the ARN in Metadata["arn"].
+//
+// Finding a certificate means listing them all and their tags, so that's
+// done once per store, the first time it's needed, and kept up to date
+// by Store.   If a certificate turns out to have been deleted, the whole
+// index is thrown away and built again.
+type ACMStore struct {
+	ACM    ACMAPI
+	Logger *slog.Logger
+
+	mu    sync.Mutex
+	index *acmIndex
+}
+
+// acmIndex is where to find the certificates ACMStore has imported.
+type acmIndex struct {
+	byName map[string]acmEntry // the most recently imported for each name
+	byKey  map[acmKey]string   // ARNs by name and domain set
+}
+
+// acmKey is what a renewal has to match to be imported over a
+// certificate.
+type acmKey struct {
+	name string
+	set  string
+}
+
+type acmEntry struct {
+	arn      string
+	imported time.Time
+}
+
+// Store imports the bundle, over the certificate with the same name and
+// domains if there is one.
+func (s *ACMStore) Store(ctx context.Context, bundle CertBundle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := ACMDomainSet(bundle.Domains)
+	tags := map[string]string{}
+	for k, v := range bundle.Tags {
+		tags[k] = v
+	}
+	tags[ACMNameTag] = bundle.Name
+	tags[ACMDomainSetTag] = set
+
+	input := &acm.ImportCertificateInput{
+		Certificate: bundle.CertPEM,
+		PrivateKey:  bundle.KeyPEM,
+	}
+	if len(bundle.ChainPEM) > 0 {
+		input.CertificateChain = bundle.ChainPEM
+	}
+
+	index, err := s.loadIndex(ctx)
+	if err != nil {
+		return err
+	}
+	key := acmKey{name: bundle.Name, set: set}
+	arn := index.byKey[key]
+	if arn != "" {
+		input.CertificateArn = aws.String(arn)
+		_, err = s.ACM.ImportCertificateWithContext(ctx, input)
+		if isAWSError(err, acm.ErrCodeResourceNotFoundException) {
+			// Deleted since we last looked, so it's a new one, and
+			// whatever else the index says may be stale too.
+			s.index = nil
+			input.CertificateArn = nil
+			arn = ""
+		} else if err != nil {
+			return fmt.Errorf("Failed reimporting %s into %s: %w", bundle.Name, arn, err)
+		} else {
+			// A reimport can't set tags, so they're added after.
+			_, err = s.ACM.AddTagsToCertificateWithContext(ctx, &acm.AddTagsToCertificateInput{
+				CertificateArn: aws.String(arn),
+				Tags:           acmTags(tags),
+			})
+			if err != nil {
+				return fmt.Errorf("Reimported %s into %s but failed tagging it: %w", bundle.Name, arn, err)
+			}
+		}
+	}
+	if arn == "" {
+		input.Tags = acmTags(tags)
+		out, err := s.ACM.ImportCertificateWithContext(ctx, input)
+		if err != nil {
+			return fmt.Errorf("Failed importing %s: %w", bundle.Name, err)
+		}
+		arn = aws.StringValue(out.CertificateArn)
+	}
+
+	if s.index != nil {
+		s.index.byKey[key] = arn
+		s.index.byName[bundle.Name] = acmEntry{arn: arn, imported: time.Now()}
+	}
+	s.log().Info("Imported certificate", logKeyStep, "store", "name", bundle.Name, "arn", arn)
+	return nil
+}
+
+// Load reads back the most recently imported certificate stored under
+// name.   It has no key.
+func (s *ACMStore) Load(ctx context.Context, name string) (CertBundle, error) {
+	bundle := CertBundle{Name: name}
+
+	// If the certificate's been deleted, the index is rebuilt and the
+	// name looked up once more, in case there's an older one left.
+	var arn string
+	var out *acm.GetCertificateOutput
+	for attempt := 0; ; attempt++ {
+		s.mu.Lock()
+		index, err := s.loadIndex(ctx)
+		if err == nil {
+			arn = index.byName[name].arn
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return bundle, err
+		}
+		if arn == "" {
+			return bundle, ErrCertNotFound
+		}
+
+		out, err = s.ACM.GetCertificateWithContext(ctx, &acm.GetCertificateInput{CertificateArn: aws.String(arn)})
+		if isAWSError(err, acm.ErrCodeResourceNotFoundException) {
+			s.mu.Lock()
+			s.index = nil
+			s.mu.Unlock()
+			if attempt == 0 {
+				continue
+			}
+			return bundle, ErrCertNotFound
+		}
+		if err != nil {
+			return bundle, fmt.Errorf("Failed getting %s from ACM: %w", arn, err)
+		}
+		break
+	}
+	chain, err := ParseChain([]byte(aws.StringValue(out.Certificate) + aws.StringValue(out.CertificateChain)))
+	if err != nil {
+		return bundle, fmt.Errorf("Failed parsing %s from ACM: %v", arn, err)
+	}
+
+	bundle.Domains = certNames(chain.Leaf)
+	bundle.CertPEM = chain.LeafPEM()
+	bundle.ChainPEM = chain.ChainPEM()
+	bundle.Metadata = map[string]string{"arn": arn}
+	return bundle, nil
+}
+
+// loadIndex returns the index of imported certificates, building it if
+// it hasn't been yet.   s.mu must be held.
+func (s *ACMStore) loadIndex(ctx context.Context) (*acmIndex, error) {
+	if s.index != nil {
+		return s.index, nil
+	}
+	index := &acmIndex{byName: make(map[string]acmEntry), byKey: make(map[acmKey]string)}
+	err := s.eachCertificate(ctx, func(summary *acm.CertificateSummary, tags map[string]string) bool {
+		arn := aws.StringValue(summary.CertificateArn)
+		name := tags[ACMNameTag]
+		if name == "" {
+			return true
+		}
+		if key := (acmKey{name: name, set: tags[ACMDomainSetTag]}); key.set != "" {
+			if _, ok := index.byKey[key]; !ok {
+				index.byKey[key] = arn
+			}
+		}
+		imported := aws.TimeValue(summary.ImportedAt)
+		if e, ok := index.byName[name]; !ok || imported.After(e.imported) {
+			index.byName[name] = acmEntry{arn: arn, imported: imported}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.index = index
+	return index, nil
+}
+
+// eachCertificate calls fn with every imported certificate in ACM and its
+// tags, until fn returns false.
+func (s *ACMStore) eachCertificate(ctx context.Context, fn func(*acm.CertificateSummary, map[string]string) bool) error {
+	input := &acm.ListCertificatesInput{
+		// Without key types, ACM only lists RSA_2048 certificates.
+		Includes: &acm.Filters{KeyTypes: aws.StringSlice(acm.KeyAlgorithm_Values())},
+	}
+	for {
+		out, err := s.ACM.ListCertificatesWithContext(ctx, input)
+		if err != nil {
+			return fmt.Errorf("Failed listing ACM certificates: %w", err)
+		}
+		for _, summary := range out.CertificateSummaryList {
+			if summary.Type != nil && *summary.Type != acm.CertificateTypeImported {
+				continue
+			}
+			tagsOut, err := s.ACM.ListTagsForCertificateWithContext(ctx, &acm.ListTagsForCertificateInput{CertificateArn: summary.CertificateArn})
+			if isAWSError(err, acm.ErrCodeResourceNotFoundException) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("Failed listing tags on %s: %w", aws.StringValue(summary.CertificateArn), err)
+			}
+			tags := make(map[string]string, len(tagsOut.Tags))
+			for _, t := range tagsOut.Tags {
+				tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+			if !fn(summary, tags) {
+				return nil
+			}
+		}
+		if aws.StringValue(out.NextToken) == "" {
+			return nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+func (s *ACMStore) log() *slog.Logger {
+	return newLogger(s.Logger, false)
+}
+
+// ACMDomainSet is the value of the ACMDomainSetTag for a certificate's
+// domains: a hash of them, since every domain on a certificate wouldn't
+// fit in a tag.
+func ACMDomainSet(domains []string) string {
+	return domainSetHash(domains)
+}
+
+func acmTags(tags map[string]string) []*acm.Tag {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*acm.Tag, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, &acm.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return out
+}
@@ -0,0 +1,177 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/acm"
+
+	"github.com/swerveaux/acmetest/internal/awstest"
+)
+
+func TestACMStore(t *testing.T) {
+	testCertStore(t, func(t *testing.T) storeFixture {
+		fake := awstest.NewACM()
+		return storeFixture{
+			Store: &ACMStore{ACM: fake},
+			Deny: func(name string) {
+				fake.Deny("ImportCertificate")
+				fake.Deny("GetCertificate")
+			},
+			WriteOnlyKeys: true,
+		}
+	})
+}
+
+func TestACMStoreReimports(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	fake := awstest.NewACM()
+	store := &ACMStore{ACM: fake}
+
+	first := ca.bundle(t, "ssl_example.org", "example.org", "www.example.org")
+	first.Tags = map[string]string{"env": "staging"}
+	if err := store.Store(ctx, first); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	arns := fake.ARNs()
+	if len(arns) != 1 {
+		t.Fatalf("expected one certificate in ACM, got %v", arns)
+	}
+	arn := arns[0]
+
+	// A renewal for the same domains, in any order or case, goes into the
+	// same ARN, even from a store that hasn't seen it before.
+	renewed := ca.bundle(t, "ssl_example.org", "WWW.example.org", "example.org")
+	renewed.Tags = map[string]string{"env": "prod"}
+	store = &ACMStore{ACM: fake}
+	if err := store.Store(ctx, renewed); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	if got := fake.ARNs(); len(got) != 1 || got[0] != arn {
+		t.Errorf("expected the renewal to be imported into %s, got %v", arn, got)
+	}
+	if n := fake.Imports(arn); n != 2 {
+		t.Errorf("expected 2 imports into %s, got %d", arn, n)
+	}
+	if string(fake.PrivateKey(arn)) != string(renewed.KeyPEM) {
+		t.Errorf("expected the renewal's key to be imported")
+	}
+
+	tags, err := fake.ListTagsForCertificateWithContext(ctx, &acm.ListTagsForCertificateInput{CertificateArn: aws.String(arn)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, tag := range tags.Tags {
+		got[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	for k, v := range map[string]string{
+		ACMNameTag:      "ssl_example.org",
+		ACMDomainSetTag: ACMDomainSet([]string{"example.org", "www.example.org"}),
+		"env":           "prod",
+	} {
+		if got[k] != v {
+			t.Errorf("expected tag %s=%s, got %q", k, v, got[k])
+		}
+	}
+
+	loaded, err := store.Load(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load should not have error'd, but it did: %v", err)
+	}
+	if loaded.Metadata["arn"] != arn {
+		t.Errorf("expected the ARN %s in the metadata, got %q", arn, loaded.Metadata["arn"])
+	}
+	if string(loaded.CertPEM) != string(renewed.CertPEM) || loaded.KeyPEM != nil {
+		t.Errorf("expected the renewed certificate and no key back")
+	}
+
+	// Different domains are a different certificate.
+	if err := store.Store(ctx, ca.bundle(t, "ssl_example.net", "example.net")); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	if got := fake.ARNs(); len(got) != 2 {
+		t.Errorf("expected a second certificate in ACM, got %v", got)
+	}
+}
+
+func TestACMStoreDeletedCertificate(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	fake := awstest.NewACM()
+	store := &ACMStore{ACM: fake}
+
+	if err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org")); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+
+	// If the certificate we remembered has gone, the renewal is imported
+	// as a new one.
+	fake.FailNext("ImportCertificate", awserr.New(acm.ErrCodeResourceNotFoundException, "gone", nil))
+	if err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org")); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	if got := fake.ARNs(); len(got) != 2 {
+		t.Errorf("expected a new certificate in ACM, got %v", got)
+	}
+
+	// Anything else is returned.
+	fake.FailNext("ImportCertificate", awserr.New(acm.ErrCodeLimitExceededException, "too many", nil))
+	err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org"))
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != acm.ErrCodeLimitExceededException {
+		t.Errorf("expected LimitExceededException, got %v", err)
+	}
+}
+
+func TestACMStoreIndex(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	fake := awstest.NewACM()
+
+	names := []string{"ssl_example.org", "ssl_example.net", "ssl_example.com"}
+	writer := &ACMStore{ACM: fake}
+	for _, name := range names {
+		if err := writer.Store(ctx, ca.bundle(t, name, name[len("ssl_"):])); err != nil {
+			t.Fatalf("store should not have error'd, but it did: %v", err)
+		}
+	}
+
+	// A new store lists everything once, then answers from its index.
+	store := &ACMStore{ACM: fake}
+	lists, tags := fake.Calls("ListCertificates"), fake.Calls("ListTagsForCertificate")
+	for i := 0; i < 2; i++ {
+		for _, name := range names {
+			if _, err := store.Load(ctx, name); err != nil {
+				t.Fatalf("load should not have error'd, but it did: %v", err)
+			}
+		}
+	}
+	if err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org")); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	if n := fake.Calls("ListTagsForCertificate") - tags; n != len(names) {
+		t.Errorf("expected tags listed once per certificate, got %d calls", n)
+	}
+	lists = fake.Calls("ListCertificates") - lists
+	if lists != 2 {
+		t.Errorf("expected one listing of two pages, got %d calls", lists)
+	}
+	if n := len(fake.ARNs()); n != len(names) {
+		t.Errorf("expected the renewal to be reimported, got %d certificates", n)
+	}
+
+	// A certificate that's gone since makes the store look again.
+	before := fake.Calls("ListCertificates")
+	fake.FailNext("GetCertificate", awserr.New(acm.ErrCodeResourceNotFoundException, "gone", nil))
+	if _, err := store.Load(ctx, "ssl_example.net"); err != nil {
+		t.Fatalf("load should not have error'd, but it did: %v", err)
+	}
+	if fake.Calls("ListCertificates") == before {
+		t.Errorf("expected the index to be rebuilt after ResourceNotFoundException")
+	}
+}
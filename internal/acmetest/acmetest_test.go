@@ -40,3 +40,20 @@ func TestSplitHostname(t *testing.T) {
 		}
 	}
 }
+
+func TestChallengeRecordName(t *testing.T) {
+	tests := []struct {
+		Domain   string
+		Expected string
+	}{
+		{"example.org", "_acme-challenge.example.org"},
+		{"*.example.org", "_acme-challenge.example.org"},
+		{"www.example.org", "_acme-challenge.www.example.org"},
+	}
+
+	for _, test := range tests {
+		if name := challengeRecordName(test.Domain); name != test.Expected {
+			t.Errorf("failed %q: expected %q, got %q", test.Domain, test.Expected, name)
+		}
+	}
+}
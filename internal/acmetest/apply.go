@@ -0,0 +1,243 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// What Apply did about each certificate.
+const (
+	ActionIssued  = "issued"
+	ActionRenewed = "renewed"
+	ActionCurrent = "current"
+	ActionFailed  = "failed"
+)
+
+// defaultApplyConcurrency is how many certificates Apply works on at once
+// if the Applier doesn't say.
+const defaultApplyConcurrency = 4
+
+// Applier reconciles a Manifest against what's already been stored,
+// issuing whatever is missing and renewing whatever is due.   Solvers and
+// Stores map the names used in the manifest to the real thing.
+type Applier struct {
+	Client      *Client
+	Solvers     map[string]Solver
+	Stores      map[string]CertStore
+	Concurrency int
+
+	// Timeout caps how long any one certificate can take.   Zero means
+	// no limit beyond the context passed to Apply.
+	Timeout time.Duration
+
+	now func() time.Time
+}
+
+// ApplyResult is what happened to one certificate in the manifest.
+type ApplyResult struct {
+	Name     string
+	Store    string
+	Domains  []string
+	Action   string
+	Reason   string
+	NotAfter time.Time
+	Err      error
+}
+
+// Apply works through every certificate in the manifest, at most
+// a.Concurrency at a time.   It only returns an error if the manifest
+// itself is bad; problems with individual certificates are in their
+// results.
+func (a *Applier) Apply(ctx context.Context, m Manifest) ([]ApplyResult, error) {
+	specs, err := m.Specs()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, spec := range specs {
+		solver, ok := a.Solvers[spec.Solver]
+		if !ok {
+			return nil, fmt.Errorf("Certificate %d (%s) uses unknown solver %q", i, spec.Names[0], spec.Solver)
+		}
+		if err := CheckChallengeTypes(spec.Names, solver.ChallengeType()); err != nil {
+			return nil, fmt.Errorf("Certificate %d (%s): %v", i, spec.Names[0], err)
+		}
+		if _, ok := a.Stores[spec.Store]; !ok {
+			return nil, fmt.Errorf("Certificate %d (%s) uses unknown store %q", i, spec.Names[0], spec.Store)
+		}
+		if err := a.Client.CheckProfile(spec.Profile); err != nil {
+			return nil, fmt.Errorf("Certificate %d (%s): %v", i, spec.Names[0], err)
+		}
+	}
+
+	concurrency := a.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultApplyConcurrency
+	}
+
+	ctx, span := a.tracer().Start(ctx, "Apply", trace.WithAttributes(attribute.Int("certificates", len(specs))))
+	defer span.End()
+
+	results := make([]ApplyResult, len(specs))
+	forEach(ctx, concurrency, len(specs), func(i int) error {
+		results[i] = a.applyOne(ctx, specs[i])
+		return results[i].Err
+	})
+
+	// Anything forEach never got to because ctx was cancelled.
+	for i := range results {
+		if results[i].Action == "" {
+			results[i] = ApplyResult{Domains: specs[i].Names, Store: specs[i].Store, Action: ActionFailed, Err: ctx.Err()}
+		}
+	}
+
+	return results, nil
+}
+
+func (a *Applier) applyOne(ctx context.Context, spec CertSpec) ApplyResult {
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+
+	name, _ := spec.StoreName()
+	result := ApplyResult{Name: name, Store: spec.Store, Domains: spec.Names}
+
+	ctx, span := a.tracer().Start(ctx, "ApplyCertificate", trace.WithAttributes(
+		attrCertName.String(name), attrStore.String(spec.Store), attrDomains.StringSlice(spec.Names)))
+	defer func() {
+		span.SetAttributes(attribute.String("certificate.action", result.Action))
+		endSpan(span, result.Err)
+	}()
+
+	fail := func(err error) ApplyResult {
+		result.Action = ActionFailed
+		result.Err = err
+		return result
+	}
+
+	store := a.Stores[spec.Store]
+	loadCtx, loadSpan := a.tracer().Start(ctx, "Store Load", trace.WithAttributes(attrCertName.String(name), attrStore.String(spec.Store)))
+	existing, err := store.Load(loadCtx, name)
+	if errors.Is(err, ErrCertNotFound) {
+		endSpan(loadSpan, nil)
+	} else {
+		endSpan(loadSpan, err)
+	}
+	switch {
+	case errors.Is(err, ErrCertNotFound):
+		result.Action = ActionIssued
+		result.Reason = "not in store"
+	case err != nil:
+		return fail(fmt.Errorf("Failed loading %s: %v", name, err))
+	default:
+		renew, reason, notAfter := a.needsRenewal(existing, spec)
+		if !notAfter.IsZero() {
+			a.metrics().CertificateExpiry(name, existing.Domains, notAfter)
+		}
+		if !renew {
+			result.Action = ActionCurrent
+			result.Reason = reason
+			result.NotAfter = notAfter
+			return result
+		}
+		result.Action = ActionRenewed
+		result.Reason = reason
+	}
+
+	certKey, err := GenerateKey(spec.KeyType)
+	if err != nil {
+		return fail(err)
+	}
+	keyPEM, err := EncodeKeyPEM(certKey)
+	if err != nil {
+		return fail(err)
+	}
+
+	chain, err := a.Client.Issue(ctx, spec.Names, spec.Profile, certKey, a.Solvers[spec.Solver])
+	if err != nil {
+		return fail(err)
+	}
+
+	bundle := NewCertBundle(name, spec.Names, keyPEM, chain)
+	bundle.Tags = spec.Tags
+	storeCtx, storeSpan := a.tracer().Start(ctx, "Store Save", trace.WithAttributes(attrCertName.String(name), attrStore.String(spec.Store)))
+	err = store.Store(storeCtx, bundle)
+	endSpan(storeSpan, err)
+	if err != nil {
+		return fail(fmt.Errorf("Failed storing %s: %v", name, err))
+	}
+
+	result.NotAfter = chain.Leaf.NotAfter
+	a.metrics().CertificateExpiry(name, spec.Names, result.NotAfter)
+	return result
+}
+
+// metrics returns the Client's metrics, if there's a Client.
+func (a *Applier) metrics() *Metrics {
+	if a.Client == nil {
+		return nil
+	}
+	return a.Client.Metrics
+}
+
+// tracer returns the Client's tracer, or the global one if there's no
+// Client.
+func (a *Applier) tracer() trace.Tracer {
+	if a.Client == nil {
+		return tracer(nil)
+	}
+	return a.Client.tracer()
+}
+
+// needsRenewal decides whether a stored certificate should be replaced:
+// it's due if it expires within spec.RenewBefore, or if its names no
+// longer match the manifest.
+func (a *Applier) needsRenewal(bundle CertBundle, spec CertSpec) (bool, string, time.Time) {
+	leaf, err := bundle.Certificate()
+	if err != nil {
+		return true, fmt.Sprintf("stored certificate unreadable: %v", err), time.Time{}
+	}
+
+	var want []string
+	for _, id := range NewIdentifiers(spec.Names) {
+		want = append(want, id.Value)
+	}
+	if !sameNames(certNames(leaf), want) {
+		return true, "names changed", leaf.NotAfter
+	}
+
+	now := time.Now()
+	if a.now != nil {
+		now = a.now()
+	}
+	left := leaf.NotAfter.Sub(now)
+	if left < spec.RenewBefore {
+		return true, fmt.Sprintf("expires in %s", left.Round(time.Hour)), leaf.NotAfter
+	}
+
+	return false, fmt.Sprintf("expires in %s", left.Round(time.Hour)), leaf.NotAfter
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
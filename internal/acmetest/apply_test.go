@@ -0,0 +1,138 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a CertStore that keeps everything in a map.
+type memStore struct {
+	mu      sync.Mutex
+	bundles map[string]CertBundle
+}
+
+func (s *memStore) Store(ctx context.Context, bundle CertBundle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bundles == nil {
+		s.bundles = make(map[string]CertBundle)
+	}
+	s.bundles[bundle.Name] = bundle
+	return nil
+}
+
+func (s *memStore) Load(ctx context.Context, name string) (CertBundle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.bundles[name]
+	if !ok {
+		return b, ErrCertNotFound
+	}
+	return b, nil
+}
+
+func TestApplySkipsCurrentCertificates(t *testing.T) {
+	now := time.Now()
+	store := &memStore{}
+	store.Store(context.Background(), CertBundle{
+		Name:    "ssl_example.org",
+		CertPEM: encodeCerts([]*x509.Certificate{testLeaf(t, []string{"example.org"}, now.Add(60*24*time.Hour))}),
+	})
+
+	a := Applier{
+		Solvers: map[string]Solver{"route53": &Route53Solver{}},
+		Stores:  map[string]CertStore{"asm": store},
+		now:     func() time.Time { return now },
+	}
+	m := Manifest{Certificates: []CertSpec{{Names: []string{"example.org"}}}}
+
+	results, err := a.Apply(context.Background(), m)
+	if err != nil {
+		t.Fatalf("apply should not have error'd, but it did: %v", err)
+	}
+	if len(results) != 1 || results[0].Action != ActionCurrent {
+		t.Errorf("expected the certificate to be left alone, got %+v", results)
+	}
+}
+
+func TestApplyRejectsUnknownSolversStoresAndProfiles(t *testing.T) {
+	a := Applier{
+		Solvers: map[string]Solver{"route53": &Route53Solver{}},
+		Stores:  map[string]CertStore{"asm": &memStore{}},
+	}
+
+	a.Client = &Client{Directory: Directory{Meta: DirectoryMeta{Profiles: map[string]string{"classic": ""}}}}
+
+	for _, spec := range []CertSpec{
+		{Names: []string{"example.org"}, Solver: "carrier-pigeon"},
+		{Names: []string{"example.org"}, Store: "floppy"},
+		{Names: []string{"example.org"}, Profile: "shortlived"},
+	} {
+		_, err := a.Apply(context.Background(), Manifest{Certificates: []CertSpec{spec}})
+		if err == nil {
+			t.Errorf("apply of %+v should have error'd, but didn't.", spec)
+		}
+	}
+}
+
+func TestNeedsRenewal(t *testing.T) {
+	now := time.Now()
+	a := Applier{now: func() time.Time { return now }}
+	spec := CertSpec{Names: []string{"example.org", "www.example.org"}, RenewBefore: 30 * 24 * time.Hour}
+
+	tests := []struct {
+		Name     string
+		DNSNames []string
+		NotAfter time.Time
+		Expected bool
+	}{
+		{"Plenty of time left", []string{"www.example.org", "example.org"}, now.Add(60 * 24 * time.Hour), false},
+		{"Inside the renewal window", []string{"example.org", "www.example.org"}, now.Add(10 * 24 * time.Hour), true},
+		{"Names changed", []string{"example.org"}, now.Add(60 * 24 * time.Hour), true},
+	}
+
+	for _, test := range tests {
+		bundle := CertBundle{CertPEM: encodeCerts([]*x509.Certificate{testLeaf(t, test.DNSNames, test.NotAfter)})}
+		renew, reason, _ := a.needsRenewal(bundle, spec)
+		if renew != test.Expected {
+			t.Errorf("failed %q: expected renew %v, got %v (%s)", test.Name, test.Expected, renew, reason)
+		}
+	}
+
+	if renew, _, _ := a.needsRenewal(CertBundle{}, spec); !renew {
+		t.Errorf("an unreadable certificate should be renewed")
+	}
+}
+
+// testLeaf makes a self-signed certificate for names expiring at notAfter.
+func testLeaf(t *testing.T, names []string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
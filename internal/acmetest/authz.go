@@ -0,0 +1,260 @@
+package acmetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPreAuthorizationUnsupported is returned by PreAuthorize when the CA
+// has no newAuthz endpoint.
+var ErrPreAuthorizationUnsupported = errors.New("CA doesn't support pre-authorization")
+
+// NewAuthz is the payload for a newAuthz request.
+type NewAuthz struct {
+	Identifier CertIdentifier `json:"identifier"`
+}
+
+// PreAuthorize asks the CA for an authorization for identifier before
+// there's an order for it, and gets it validated with solver.   See
+// RFC8555 section 7.4.1.   Valid authorizations are cached until they
+// expire, and the order flow won't bother solving them again.
+func (c *Client) PreAuthorize(ctx context.Context, identifier CertIdentifier, solver Solver) (ChallengeResponse, error) {
+	authzs, err := c.PreAuthorizeAll(ctx, []CertIdentifier{identifier}, solver)
+	if err != nil {
+		return ChallengeResponse{}, err
+	}
+	return authzs[0], nil
+}
+
+// PreAuthorizeAll is PreAuthorize for a batch of identifiers, solving all
+// of their challenges together.   Wildcards can't be pre-authorized, since
+// RFC8555 section 7.4.1 doesn't allow them in newAuthz; they only get
+// authorized through an order.
+func (c *Client) PreAuthorizeAll(ctx context.Context, identifiers []CertIdentifier, solver Solver) ([]ChallengeResponse, error) {
+	for _, identifier := range identifiers {
+		if strings.HasPrefix(identifier.Value, "*.") {
+			return nil, fmt.Errorf("Can't pre-authorize %s: wildcards can only be authorized through an order", identifier.Value)
+		}
+	}
+	if !c.SupportsPreAuthorization() {
+		return nil, ErrPreAuthorizationUnsupported
+	}
+
+	authzs := make([]ChallengeResponse, len(identifiers))
+	err := forEach(ctx, c.workers(), len(identifiers), func(i int) error {
+		if cached, ok := c.authzs.forIdentifier(identifiers[i]); ok {
+			authzs[i] = cached
+			return nil
+		}
+
+		authz, err := c.newAuthz(ctx, identifiers[i])
+		authzs[i] = authz
+		return err
+	})
+	if err != nil {
+		return authzs, err
+	}
+
+	var unsolved []string
+	for _, authz := range authzs {
+		if authz.Status != StatusValid {
+			unsolved = append(unsolved, authz.URL)
+		}
+	}
+
+	err = c.SolveAuthorizations(ctx, unsolved, solver)
+	if err != nil {
+		return authzs, err
+	}
+
+	for i := range authzs {
+		if authzs[i].Status == StatusValid {
+			c.authzs.put(authzs[i])
+			continue
+		}
+		authzs[i], err = c.fetchAuthorization(ctx, authzs[i].URL)
+		if err != nil {
+			return authzs, err
+		}
+		c.authzs.put(authzs[i])
+	}
+
+	return authzs, nil
+}
+
+func (c *Client) newAuthz(ctx context.Context, identifier CertIdentifier) (ChallengeResponse, error) {
+	var authz ChallengeResponse
+	res, err := c.post(ctx, resourceNewAuthz, NewAuthz{Identifier: identifier}, c.Directory.NewAuthz, false, "")
+	if err != nil {
+		return authz, err
+	}
+	err = json.Unmarshal(res.Body, &authz)
+	if err != nil {
+		return authz, err
+	}
+
+	authz.URL = res.Header.Get("Location")
+	if authz.URL == "" {
+		return authz, fmt.Errorf("New authorization response from %s had no Location", c.Directory.NewAuthz)
+	}
+	return authz, nil
+}
+
+// DeactivateAuthorization tells the CA to stop honoring an authorization,
+// say because the domain has changed hands, per RFC8555 section 7.5.2.
+// It's dropped from the cache too.
+func (c *Client) DeactivateAuthorization(ctx context.Context, authzURL string) (ChallengeResponse, error) {
+	var authz ChallengeResponse
+	c.authzs.remove(authzURL)
+
+	res, err := c.post(ctx, resourceAuthz, authzStatusUpdate{Status: StatusDeactivated}, authzURL, false, "")
+	if err != nil {
+		return authz, err
+	}
+	err = json.Unmarshal(res.Body, &authz)
+	authz.URL = authzURL
+	if err != nil {
+		return authz, err
+	}
+
+	if authz.Status != StatusDeactivated {
+		return authz, fmt.Errorf("Authorization %s is %q after deactivating", authzURL, authz.Status)
+	}
+	return authz, nil
+}
+
+// AuthorizationError is why an authorization didn't become valid: the
+// status it ended up in and, if the CA gave one, the error from the
+// challenge that failed.
+type AuthorizationError struct {
+	URL        string
+	Identifier CertIdentifier
+	Status     string
+	Challenge  string
+	Problem    *Problem
+}
+
+func (e *AuthorizationError) Error() string {
+	if e.Problem != nil {
+		return fmt.Sprintf("Authorization for %s is %s: %s challenge failed: %v", e.Identifier.Value, e.Status, e.Challenge, e.Problem)
+	}
+	return fmt.Sprintf("Authorization for %s is %s", e.Identifier.Value, e.Status)
+}
+
+// Unwrap gives errors.As access to the challenge's Problem.
+func (e *AuthorizationError) Unwrap() error {
+	if e.Problem == nil {
+		return nil
+	}
+	return e.Problem
+}
+
+// authorizationError explains an authorization that is neither pending
+// nor valid, using the first challenge that has an error.
+func authorizationError(authz ChallengeResponse) *AuthorizationError {
+	e := &AuthorizationError{URL: authz.URL, Identifier: authz.Identifier, Status: authz.Status}
+	for _, ch := range authz.Challenges {
+		if ch.Error != nil {
+			e.Challenge = ch.Type
+			e.Problem = ch.Error
+			break
+		}
+	}
+	return e
+}
+
+// authzStatusUpdate is the payload to deactivate an authorization.
+type authzStatusUpdate struct {
+	Status string `json:"status"`
+}
+
+// CachedAuthorization returns a valid, unexpired authorization for
+// identifier if we have one from earlier.
+func (c *Client) CachedAuthorization(identifier CertIdentifier) (ChallengeResponse, bool) {
+	return c.authzs.forIdentifier(identifier)
+}
+
+// authzCache remembers valid authorizations, by URL and by identifier,
+// until they expire.
+type authzCache struct {
+	mu           sync.Mutex
+	byURL        map[string]ChallengeResponse
+	byIdentifier map[string]string
+}
+
+func authzKey(identifier CertIdentifier) string {
+	return identifier.Type + ":" + identifier.Value
+}
+
+// put remembers authz if it's valid.   Wildcard authorizations are kept
+// under *.<domain>, which is what the order asked for.
+func (ac *authzCache) put(authz ChallengeResponse) {
+	if ac == nil || authz.Status != StatusValid || authz.URL == "" {
+		return
+	}
+	identifier := authz.Identifier
+	if authz.Wildcard {
+		identifier.Value = "*." + identifier.Value
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.byURL == nil {
+		ac.byURL = make(map[string]ChallengeResponse)
+		ac.byIdentifier = make(map[string]string)
+	}
+	ac.byURL[authz.URL] = authz
+	ac.byIdentifier[authzKey(identifier)] = authz.URL
+}
+
+// get returns the authorization at url if it's cached and still good.
+func (ac *authzCache) get(url string) (ChallengeResponse, bool) {
+	if ac == nil {
+		return ChallengeResponse{}, false
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	authz, ok := ac.byURL[url]
+	if !ok {
+		return authz, false
+	}
+	if !authz.Expires.IsZero() && !time.Now().Before(authz.Expires) {
+		delete(ac.byURL, url)
+		return ChallengeResponse{}, false
+	}
+	return authz, true
+}
+
+func (ac *authzCache) forIdentifier(identifier CertIdentifier) (ChallengeResponse, bool) {
+	if ac == nil {
+		return ChallengeResponse{}, false
+	}
+	ac.mu.Lock()
+	url, ok := ac.byIdentifier[authzKey(identifier)]
+	ac.mu.Unlock()
+	if !ok {
+		return ChallengeResponse{}, false
+	}
+	return ac.get(url)
+}
+
+func (ac *authzCache) remove(url string) {
+	if ac == nil {
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	delete(ac.byURL, url)
+	for key, u := range ac.byIdentifier {
+		if u == url {
+			delete(ac.byIdentifier, key)
+		}
+	}
+}
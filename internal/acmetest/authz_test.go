@@ -0,0 +1,115 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthzCache(t *testing.T) {
+	ac := &authzCache{}
+	valid := ChallengeResponse{
+		URL:        "https://ca.example/authz/1",
+		Status:     StatusValid,
+		Expires:    time.Now().Add(time.Hour),
+		Identifier: CertIdentifier{"dns", "example.org"},
+	}
+	wildcard := ChallengeResponse{
+		URL:        "https://ca.example/authz/2",
+		Status:     StatusValid,
+		Expires:    time.Now().Add(time.Hour),
+		Identifier: CertIdentifier{"dns", "example.org"},
+		Wildcard:   true,
+	}
+	expired := ChallengeResponse{
+		URL:        "https://ca.example/authz/3",
+		Status:     StatusValid,
+		Expires:    time.Now().Add(-time.Minute),
+		Identifier: CertIdentifier{"dns", "old.example.org"},
+	}
+	pending := ChallengeResponse{
+		URL:        "https://ca.example/authz/4",
+		Status:     StatusPending,
+		Identifier: CertIdentifier{"dns", "new.example.org"},
+	}
+	for _, authz := range []ChallengeResponse{valid, wildcard, expired, pending} {
+		ac.put(authz)
+	}
+
+	if authz, ok := ac.get(valid.URL); !ok || authz.Identifier.Value != "example.org" {
+		t.Errorf("expected the valid authorization to be cached")
+	}
+	if authz, ok := ac.forIdentifier(CertIdentifier{"dns", "*.example.org"}); !ok || authz.URL != wildcard.URL {
+		t.Errorf("expected the wildcard authorization under *.example.org, got %+v", authz)
+	}
+	if authz, ok := ac.forIdentifier(CertIdentifier{"dns", "example.org"}); !ok || authz.URL != valid.URL {
+		t.Errorf("expected the plain authorization under example.org, got %+v", authz)
+	}
+	if _, ok := ac.get(expired.URL); ok {
+		t.Errorf("expired authorizations shouldn't be handed out")
+	}
+	if _, ok := ac.get(pending.URL); ok {
+		t.Errorf("pending authorizations shouldn't be cached")
+	}
+
+	ac.remove(valid.URL)
+	if _, ok := ac.forIdentifier(CertIdentifier{"dns", "example.org"}); ok {
+		t.Errorf("removed authorizations shouldn't be handed out")
+	}
+
+	var none *authzCache
+	none.put(valid)
+	if _, ok := none.get(valid.URL); ok {
+		t.Errorf("a nil cache should never have anything")
+	}
+}
+
+// failingSolver fails the test if anything tries to use it.
+type failingSolver struct {
+	t *testing.T
+}
+
+func (s failingSolver) ChallengeType() string { return "dns-01" }
+
+func (s failingSolver) Present(ctx context.Context, challenges []PendingChallenge) error {
+	s.t.Errorf("didn't expect to present %d challenges", len(challenges))
+	return errors.New("unexpected Present")
+}
+
+func (s failingSolver) CleanUp(ctx context.Context, challenges []PendingChallenge) error {
+	s.t.Errorf("didn't expect to clean up %d challenges", len(challenges))
+	return nil
+}
+
+func TestSolveAuthorizationsSkipsCached(t *testing.T) {
+	c := Client{authzs: &authzCache{}}
+	c.authzs.put(ChallengeResponse{
+		URL:        "https://ca.example/authz/1",
+		Status:     StatusValid,
+		Expires:    time.Now().Add(time.Hour),
+		Identifier: CertIdentifier{"dns", "example.org"},
+	})
+
+	err := c.SolveAuthorizations(context.Background(), []string{"https://ca.example/authz/1"}, failingSolver{t})
+	if err != nil {
+		t.Errorf("solving cached authorizations should not have error'd, but it did: %v", err)
+	}
+}
+
+func TestPreAuthorizeUnsupported(t *testing.T) {
+	c := Client{}
+	_, err := c.PreAuthorize(context.Background(), CertIdentifier{"dns", "example.org"}, failingSolver{t})
+	if err != ErrPreAuthorizationUnsupported {
+		t.Errorf("expected ErrPreAuthorizationUnsupported, got %v", err)
+	}
+}
+
+func TestPreAuthorizeRejectsWildcards(t *testing.T) {
+	c := Client{Directory: Directory{NewAuthz: "https://ca.example/new-authz"}}
+	_, err := c.PreAuthorizeAll(context.Background(), []CertIdentifier{{"dns", "example.org"}, {"dns", "*.example.org"}}, failingSolver{t})
+	if err == nil || !strings.Contains(err.Error(), "*.example.org") {
+		t.Errorf("pre-authorizing a wildcard should have error'd naming it, got %v", err)
+	}
+}
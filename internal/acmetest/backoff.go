@@ -0,0 +1,82 @@
+package acmetest
+
+import (
+	"net/http"
+	"time"
+)
+
+// Backoff is how long to wait between polls of an order or authorization,
+// and before resending a request the CA turned away with a 429 or 503.
+// Whatever the CA asks for in Retry-After wins; otherwise waits start at
+// Initial and double up to Max.   The Client fills in any of Initial,
+// Max, MaxPolls and PollTimeout left zero from DefaultBackoff.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+
+	// Retries is how many times a 429 or 503 is retried before giving up.
+	Retries int
+
+	// MaxRetryAfter is the longest Retry-After we'll sit out on a 429 or
+	// 503.   Rate limits can ask for hours, and it's better to fail that
+	// certificate and move on than to hang the whole run.
+	MaxRetryAfter time.Duration
+
+	// MaxPolls caps how many times an order or authorization is fetched
+	// while waiting on it, and PollTimeout how long the waiting can take
+	// in all.   Negative means no cap, leaving it to the context.
+	MaxPolls    int
+	PollTimeout time.Duration
+}
+
+// DefaultBackoff is used when the Client's Backoff is left zero, and for
+// the fields of it that are.
+var DefaultBackoff = Backoff{
+	Initial:       2 * time.Second,
+	Max:           30 * time.Second,
+	Retries:       3,
+	MaxRetryAfter: 5 * time.Minute,
+	MaxPolls:      100,
+	PollTimeout:   10 * time.Minute,
+}
+
+// Wait returns how long to wait before attempt (counting from zero),
+// ignoring any Retry-After.   A zero Max leaves the waits uncapped.
+func (b Backoff) Wait(attempt int) time.Duration {
+	d := b.Initial
+	for i := 0; i < attempt && (b.Max <= 0 || d < b.Max); i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// Delay is Wait unless the response said how long to wait in Retry-After.
+func (b Backoff) Delay(attempt int, h http.Header) time.Duration {
+	return retryAfter(h, b.Wait(attempt))
+}
+
+// backoff returns the Client's Backoff, or DefaultBackoff if it's unset.
+// A partly set Backoff gets the defaults for the timing fields it's
+// missing, so setting Retries alone doesn't make every wait zero.
+func (c *Client) backoff() Backoff {
+	if c.Backoff == (Backoff{}) {
+		return DefaultBackoff
+	}
+	b := c.Backoff
+	if b.Initial == 0 {
+		b.Initial = DefaultBackoff.Initial
+	}
+	if b.Max == 0 {
+		b.Max = DefaultBackoff.Max
+	}
+	if b.MaxPolls == 0 {
+		b.MaxPolls = DefaultBackoff.MaxPolls
+	}
+	if b.PollTimeout == 0 {
+		b.PollTimeout = DefaultBackoff.PollTimeout
+	}
+	return b
+}
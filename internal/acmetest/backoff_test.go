@@ -0,0 +1,136 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackoffWait(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for attempt, want := range expected {
+		if d := b.Wait(attempt); d != want {
+			t.Errorf("failed attempt %d: expected %v, got %v", attempt, want, d)
+		}
+	}
+
+	h := http.Header{}
+	h.Set("Retry-After", "42")
+	if d := b.Delay(0, h); d != 42*time.Second {
+		t.Errorf("expected Retry-After to win, got %v", d)
+	}
+	if d := b.Delay(1, http.Header{}); d != 2*time.Second {
+		t.Errorf("expected the backoff without Retry-After, got %v", d)
+	}
+}
+
+func TestClientBackoffDefaults(t *testing.T) {
+	c := &Client{}
+	if b := c.backoff(); b != DefaultBackoff {
+		t.Errorf("expected DefaultBackoff for an unset Backoff, got %+v", b)
+	}
+
+	// Setting some fields keeps the defaults for the timing ones left
+	// zero, rather than clamping every wait to nothing.
+	c.Backoff = Backoff{Retries: 5, MaxPolls: -1}
+	b := c.backoff()
+	if b.Initial != DefaultBackoff.Initial || b.Max != DefaultBackoff.Max || b.PollTimeout != DefaultBackoff.PollTimeout {
+		t.Errorf("expected the default timings, got %+v", b)
+	}
+	if b.Retries != 5 || b.MaxPolls != -1 {
+		t.Errorf("expected the fields that were set to be kept, got %+v", b)
+	}
+	if d := b.Wait(1); d != 2*DefaultBackoff.Initial {
+		t.Errorf("expected the second wait to be %v, got %v", 2*DefaultBackoff.Initial, d)
+	}
+
+	// Without a Max, Wait doesn't cap.
+	if d := (Backoff{Initial: time.Second}).Wait(3); d != 8*time.Second {
+		t.Errorf("expected an uncapped 8s wait, got %v", d)
+	}
+}
+
+// retryServer answers the first len(statuses) requests with those
+// statuses and a rateLimited problem, and 200 after that.
+func retryServer(t *testing.T, retryAfter string, statuses ...int) (*httptest.Server, *int) {
+	t.Helper()
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "HEAD" {
+			return
+		}
+		requests++
+		if requests <= len(statuses) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(statuses[requests-1])
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:rateLimited","detail":"slow down"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func testClient(t *testing.T, srv *httptest.Server) *Client {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Client{
+		KID:        srv.URL + "/acct/1",
+		Key:        key,
+		HTTPClient: srv.Client(),
+		Backoff:    Backoff{Initial: time.Millisecond, Max: time.Millisecond, Retries: 2, MaxRetryAfter: time.Second},
+		nonces:     &noncePool{url: srv.URL + "/nonce", httpClient: srv.Client()},
+	}
+}
+
+func TestPostRetriesRateLimits(t *testing.T) {
+	srv, requests := retryServer(t, "0", http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	c := testClient(t, srv)
+
+	_, err := c.post(context.Background(), resourceOrder, nil, srv.URL+"/order/1", true, "")
+	if err != nil {
+		t.Errorf("test of two rate limited responses should not have error'd: %v", err)
+	}
+	if *requests != 3 {
+		t.Errorf("expected 3 requests, got %d", *requests)
+	}
+}
+
+func TestPostGivesUpOnRateLimits(t *testing.T) {
+	tests := []struct {
+		Name       string
+		RetryAfter string
+		Statuses   []int
+		Requests   int
+	}{
+		{"Out of retries", "0", []int{429, 429, 429}, 3},
+		{"Retry-After too long", "3600", []int{429}, 1},
+	}
+
+	for _, test := range tests {
+		srv, requests := retryServer(t, test.RetryAfter, test.Statuses...)
+		c := testClient(t, srv)
+
+		_, err := c.post(context.Background(), resourceOrder, nil, srv.URL+"/order/1", true, "")
+		if !IsRateLimited(err) {
+			t.Errorf("test %q should have error'd with rateLimited, got %v", test.Name, err)
+		}
+		if *requests != test.Requests {
+			t.Errorf("test %q: expected %d requests, got %d", test.Name, test.Requests, *requests)
+		}
+	}
+}
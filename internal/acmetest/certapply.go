@@ -1,15 +1,16 @@
 package acmetest
 
 import (
-	"bufio"
+	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
-	"os"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 // EmptyRequest is an empty struct used for the "POST-as-GET" requests
@@ -22,13 +23,18 @@ type CertIdentifier struct {
 	Value string `json:"value"`
 }
 
-// CertApply lets us marshal the JSON cert application
+// CertApply lets us marshal the JSON cert application.   Profile is
+// only sent to CAs that advertise profiles in their directory.
 type CertApply struct {
 	Identifiers []CertIdentifier `json:"identifiers"`
+	Profile     string           `json:"profile,omitempty"`
 }
 
-// CertResponse lets us unmarshal the response for a cert application
+// CertResponse lets us unmarshal the response for a cert application,
+// which is the order object.   URL is where the order lives, taken from
+// the Location header of the new-order response.
 type CertResponse struct {
+	URL            string           `json:"-"`
 	Status         string           `json:"status"`
 	Expires        time.Time        `json:"expires"`
 	NotBefore      time.Time        `json:"notBefore"`
@@ -37,21 +43,29 @@ type CertResponse struct {
 	Authorizations []string         `json:"authorizations"`
 	Finalize       string           `json:"finalize"`
 	Certificate    string           `json:"certificate"`
+	Profile        string           `json:"profile,omitempty"`
+	Error          *Problem         `json:"error,omitempty"`
 }
 
-// Challenge lets us unmarshal challenge data from a JSON response
+// Challenge lets us unmarshal challenge data from a JSON response.
+// Error is why the CA failed the challenge, if it did.
 type Challenge struct {
-	Type  string `json:"type"`
-	URL   string `json:"url"`
-	Token string `json:"token"`
+	Type      string    `json:"type"`
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	Status    string    `json:"status,omitempty"`
+	Validated time.Time `json:"validated,omitempty"`
+	Error     *Problem  `json:"error,omitempty"`
 }
 
 // ChallengeResponse lets us unmarshal the response for the challenges for a domain
 type ChallengeResponse struct {
+	URL        string         `json:"-"`
 	Status     string         `json:"status"`
 	Expires    time.Time      `json:"expires"`
 	Identifier CertIdentifier `json:"identifier"`
 	Challenges []Challenge    `json:"challenges"`
+	Wildcard   bool           `json:"wildcard,omitempty"`
 }
 
 // CSRRequest is the payload we send to a finalize
@@ -59,137 +73,164 @@ type CSRRequest struct {
 	CSR string `json:"csr"`
 }
 
-// CertApply takes a slice of domain names and tries to appy for certs for them.
-func (c *Client) CertApply(domains []string) (CertResponse, error) {
-	identifiers := make([]CertIdentifier, 0, len(domains))
-	for _, domain := range domains {
-		identifiers = append(identifiers, CertIdentifier{"dns", domain})
+// CertApply takes a slice of domain names (or IP addresses) and tries to appy for certs for them,
+// with the named certificate profile if profile isn't empty.
+// The new order's URL and finalize URL are remembered on the Client.
+func (c *Client) CertApply(ctx context.Context, domains []string, profile string) (CertResponse, error) {
+	certRes, err := c.newOrder(ctx, domains, profile)
+	if err != nil {
+		return certRes, err
 	}
 
-	application := CertApply{
-		Identifiers: identifiers,
+	c.OrderURL = certRes.URL
+	if certRes.Finalize != "" {
+		c.Finalize = certRes.Finalize
 	}
 
-	res, err := c.makeRequest(application, c.Directory.NewOrder, false)
+	return certRes, nil
+}
 
-	fmt.Println(string(res))
+// newOrder does the work of CertApply without touching the Client, so
+// several orders can be in flight at once.
+func (c *Client) newOrder(ctx context.Context, domains []string, profile string) (CertResponse, error) {
 	var certRes CertResponse
-	err = json.Unmarshal(res, &certRes)
+	err := c.CheckProfile(profile)
+	if err != nil {
+		return certRes, err
+	}
 
-	if certRes.Finalize != "" {
-		c.Finalize = certRes.Finalize
+	reserved, err := c.Issuance.reserve(ctx, domains)
+	if err != nil {
+		return certRes, err
 	}
 
-	return certRes, err
+	application := CertApply{
+		Identifiers: NewIdentifiers(domains),
+		Profile:     profile,
+	}
+
+	res, err := c.post(ctx, resourceNewOrder, application, c.Directory.NewOrder, false, "")
+	if err != nil {
+		// No order, so it doesn't count against the limits.
+		c.Issuance.release(domains, reserved)
+		return certRes, err
+	}
+
+	err = json.Unmarshal(res.Body, &certRes)
+	if err != nil {
+		return certRes, err
+	}
+
+	certRes.URL = res.Header.Get("Location")
+	if certRes.URL == "" {
+		return certRes, fmt.Errorf("New order response from %s had no Location", c.Directory.NewOrder)
+	}
+	c.log().Info("Placed order", logKeyStep, "new-order", logKeyDomain, domains, logKeyOrder, certRes.URL, logKeyStatus, certRes.Status)
+
+	return certRes, nil
 }
 
-// FetchChallenges requests a URL from the CertApply response to find out what challenges are available to prove domain ownership.
-func (c *Client) FetchChallenges(url string) (ChallengeResponse, error) {
+// FetchChallenges requests an authorization URL from the CertApply response to find out what challenges are available to prove domain ownership.
+func (c *Client) FetchChallenges(ctx context.Context, url string) (ChallengeResponse, error) {
+	c.AuthzURL = url
+	return c.fetchAuthorization(ctx, url)
+}
+
+func (c *Client) fetchAuthorization(ctx context.Context, url string) (ChallengeResponse, error) {
 	var chRes ChallengeResponse
-	c.OrderURL = url
-	res, err := c.makeRequest(nil, url, true)
-	fmt.Println(string(res))
+	res, err := c.makeRequest(ctx, resourceAuthz, nil, url, true)
+	if err != nil {
+		return chRes, err
+	}
 	err = json.Unmarshal(res, &chRes)
+	chRes.URL = url
+	c.log().Debug("Fetched authorization", logKeyStep, "authorization", logKeyDomain, chRes.Identifier.Value, logKeyAuthz, url, logKeyStatus, chRes.Status)
 
 	return chRes, err
 }
 
 // ChallengeReady sends a POST to letsencrypt to let it know that
 // an authorization challenge is ready to validated.
-func (c *Client) ChallengeReady(challengeURL string) error {
-	_, err := c.makeRequest(EmptyRequest{}, challengeURL, false)
+func (c *Client) ChallengeReady(ctx context.Context, challengeURL string) error {
+	_, err := c.makeRequest(ctx, resourceChallenge, EmptyRequest{}, challengeURL, false)
 	return err
 }
 
-// PollForStatus is a PostAsGet request to the order URL waiting for a non-pending status
-func (c *Client) PollForStatus(domain string) error {
-	var res []byte
-	var err error
-	challengeFinished := false
-	var certRes CertResponse
-	for !challengeFinished {
-		<-time.After(5 * time.Second)
-		res, err = c.makeRequest(EmptyRequest{}, c.OrderURL, true)
-		if err != nil {
-			return err
-		}
-		fmt.Println("While polling, got...")
-		fmt.Println(string(res))
-		err = json.Unmarshal(res, &certRes)
-		if err != nil {
-			return err
-		}
-		if certRes.Status == "valid" || certRes.Status == "invalid" {
-			fmt.Printf("Setting challengeFinished to true because status was %q\n", certRes.Status)
-			challengeFinished = true
-		}
-	}
-
-	fmt.Println("Response after exiting loop")
-	fmt.Println(string(res))
-
-	if certRes.Status != "valid" {
-		return fmt.Errorf("Cert request status %q", certRes.Status)
-	}
-
-	csrTemplate := x509.CertificateRequest{
-		DNSNames: []string{domain},
-		// EmailAddresses: c.ContactEmails,
-	}
-	csr, err := x509.CreateCertificateRequest(rand.Reader, &csrTemplate, c.CertKey)
+// PollForStatus is a PostAsGet request to the authorization URL waiting for it to be valid.
+// Once the authorization is valid it finalizes the order at c.OrderURL and stores the certificate.
+func (c *Client) PollForStatus(ctx context.Context, domain string) error {
+	_, err := c.WaitForAuthorization(ctx, c.AuthzURL)
 	if err != nil {
 		return err
 	}
 
-	res, err = c.makeRequest(CSRRequest{CSR: base64.RawURLEncoding.EncodeToString(csr)}, c.Finalize, false)
+	chain, err := c.finishOrder(ctx, c.OrderURL, c.CertKey)
 	if err != nil {
 		return err
 	}
-	fmt.Println("After sending CSR request to finalize")
-	fmt.Println(string(res))
-	err = json.Unmarshal(res, &certRes)
+
+	return c.SaveCertificate(ctx, domain, chain)
+}
+
+// finishOrder finalizes an order whose authorizations are all done with
+// a CSR for the order's identifiers signed by certKey, then downloads
+// the certificate and picks the chain per c.PreferredChain.
+func (c *Client) finishOrder(ctx context.Context, orderURL string, certKey crypto.Signer) (CertChain, error) {
+	certRes, err := c.FetchOrder(ctx, orderURL)
 	if err != nil {
-		return err
+		return CertChain{}, err
 	}
 
-	keyfile, err := os.Create("cert.key")
+	tmpl := csrTemplate(certRes.Identifiers)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &tmpl, certKey)
 	if err != nil {
-		return err
+		return CertChain{}, err
 	}
-	defer keyfile.Close()
-	keywriter := bufio.NewWriter(keyfile)
-	pemdata := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(c.CertKey),
-	})
-	fmt.Println("Key PEM")
-	fmt.Println(string(pemdata))
-	_, err = keywriter.Write(pemdata)
-	keywriter.Flush()
-
-	certfile, err := os.Create("cert.crt")
+
+	finalizeCtx, span := c.tracer().Start(ctx, "Finalize", trace.WithAttributes(attrOrder.String(orderURL)))
+	certRes, err = c.FinalizeOrder(finalizeCtx, orderURL, csr)
+	endSpan(span, err)
 	if err != nil {
-		return err
+		return CertChain{}, err
 	}
-	defer certfile.Close()
+	c.log().Info("Order is valid", logKeyStep, "finalize", logKeyOrder, certRes.URL, logKeyURL, certRes.Certificate)
 
-	certwriter := bufio.NewWriter(certfile)
-	cert, err := c.makeRequest("", certRes.Certificate, true)
+	downloadCtx, span := c.tracer().Start(ctx, "Download", trace.WithAttributes(attrURL.String(certRes.Certificate)))
+	chains, err := c.DownloadCertificate(downloadCtx, certRes.Certificate)
+	endSpan(span, err)
 	if err != nil {
-		fmt.Printf("Failed downloading cert: %v\n", err)
-		return err
+		c.log().Error("Failed downloading certificate", logKeyStep, "download", logKeyOrder, certRes.URL, logKeyError, err)
+		return CertChain{}, err
 	}
 
-	fmt.Println("Cert PEM")
-	fmt.Println(string(cert))
+	chain, err := SelectChain(chains, c.PreferredChain)
+	if err != nil {
+		return chain, err
+	}
+	c.log().Info("Selected chain", logKeyStep, "download", logKeyOrder, certRes.URL, "issuer", chain.TopIssuer(), "offered", len(chains))
+
+	return chain, nil
+}
+
+// SaveCertificate stores c.CertKey and the chain in c.Store, named
+// with DefaultNameTemplate after the domain.
+func (c *Client) SaveCertificate(ctx context.Context, domain string, chain CertChain) error {
+	pemdata, err := EncodeKeyPEM(c.CertKey)
+	if err != nil {
+		return err
+	}
+	name, err := CertName(DefaultNameTemplate, []string{domain})
 	if err != nil {
-		fmt.Printf("Unable to read cert body: %v\n", err)
 		return err
 	}
-	certwriter.Write(cert)
-	certwriter.Flush()
 
-	err = c.addSecrets(string(pemdata), string(cert), domain)
+	store := c.Store
+	if store == nil {
+		store = &SecretsManagerStore{SM: c.SecretsManager}
+	}
+	return store.Store(ctx, NewCertBundle(name, []string{domain}, pemdata, chain))
+}
 
-	return err
+func encodeCSR(csr []byte) string {
+	return base64.RawURLEncoding.EncodeToString(csr)
 }
@@ -0,0 +1,212 @@
+package acmetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CertChain is a downloaded certificate chain split up into the leaf
+// certificate and whatever intermediates the CA sent along with it.
+type CertChain struct {
+	URL           string
+	Leaf          *x509.Certificate
+	Intermediates []*x509.Certificate
+}
+
+// LeafPEM returns just the end-entity certificate as PEM.
+func (ch CertChain) LeafPEM() []byte {
+	return encodeCerts([]*x509.Certificate{ch.Leaf})
+}
+
+// ChainPEM returns the intermediates as PEM, without the leaf.
+func (ch CertChain) ChainPEM() []byte {
+	return encodeCerts(ch.Intermediates)
+}
+
+// FullChainPEM returns the leaf followed by the intermediates, which is
+// what most web servers want to be pointed at.
+func (ch CertChain) FullChainPEM() []byte {
+	return append(ch.LeafPEM(), ch.ChainPEM()...)
+}
+
+// TopIssuer returns the issuer common name of the last certificate in
+// the chain, which is the root the chain expects clients to trust.
+func (ch CertChain) TopIssuer() string {
+	if len(ch.Intermediates) > 0 {
+		return ch.Intermediates[len(ch.Intermediates)-1].Issuer.CommonName
+	}
+	if ch.Leaf != nil {
+		return ch.Leaf.Issuer.CommonName
+	}
+	return ""
+}
+
+func encodeCerts(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// ParseChain splits a PEM encoded application/pem-certificate-chain body
+// into the leaf and intermediates.   The leaf is always the first
+// certificate in the body per RFC8555 section 9.1.
+func ParseChain(body []byte) (CertChain, error) {
+	var ch CertChain
+	for {
+		var block *pem.Block
+		block, body = pem.Decode(body)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return ch, err
+		}
+		if ch.Leaf == nil {
+			ch.Leaf = cert
+		} else {
+			ch.Intermediates = append(ch.Intermediates, cert)
+		}
+	}
+
+	if ch.Leaf == nil {
+		return ch, errors.New("No certificates found in chain")
+	}
+
+	return ch, nil
+}
+
+// DownloadCertificate fetches the certificate chain at certURL and, if
+// there's a PreferredChain to choose with, any alternate chains the
+// server advertises with Link: rel="alternate".   The chain from certURL
+// is always first in the result.   By now the order is finalized, so an
+// alternate that can't be downloaded is logged and left out rather than
+// failing the certificate.
+func (c *Client) DownloadCertificate(ctx context.Context, certURL string) ([]CertChain, error) {
+	chain, alternates, err := c.downloadChain(ctx, certURL)
+	if err != nil {
+		return nil, err
+	}
+
+	chains := []CertChain{chain}
+	if c.PreferredChain == "" {
+		return chains, nil
+	}
+	for _, alt := range alternates {
+		altChain, _, err := c.downloadChain(ctx, alt)
+		if err != nil {
+			c.log().Warn("Failed downloading alternate chain", logKeyStep, "download", logKeyURL, alt, logKeyError, err)
+			continue
+		}
+		chains = append(chains, altChain)
+	}
+
+	return chains, nil
+}
+
+func (c *Client) downloadChain(ctx context.Context, certURL string) (CertChain, []string, error) {
+	res, err := c.post(ctx, resourceCertificate, EmptyRequest{}, certURL, true, "application/pem-certificate-chain")
+	if err != nil {
+		return CertChain{}, nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return CertChain{}, nil, fmt.Errorf("Unexpected status %d downloading certificate: %s", res.StatusCode, res.Body)
+	}
+
+	chain, err := ParseChain(res.Body)
+	if err != nil {
+		return chain, nil, err
+	}
+	chain.URL = certURL
+
+	return chain, parseLinks(certURL, res.Header, "alternate"), nil
+}
+
+// SelectChain picks which of several chains to use.   If preferred is
+// set, the first chain whose top-most issuer has that common name wins,
+// then the first chain with any certificate issued by that name.
+// Otherwise, or if nothing matches, the first (default) chain is used.
+func SelectChain(chains []CertChain, preferred string) (CertChain, error) {
+	if len(chains) == 0 {
+		return CertChain{}, errors.New("No certificate chains to choose from")
+	}
+	if preferred == "" {
+		return chains[0], nil
+	}
+
+	for _, ch := range chains {
+		if ch.TopIssuer() == preferred {
+			return ch, nil
+		}
+	}
+
+	for _, ch := range chains {
+		for _, cert := range ch.Intermediates {
+			if cert.Issuer.CommonName == preferred {
+				return ch, nil
+			}
+		}
+	}
+
+	return chains[0], nil
+}
+
+// parseLinks pulls the targets of every Link header with the given rel
+// out of a response, resolved against the URL of the request.
+func parseLinks(base string, h http.Header, rel string) []string {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil
+	}
+
+	var links []string
+	for _, header := range h.Values("Link") {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			target = target[1 : len(target)-1]
+
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || strings.ToLower(kv[0]) != "rel" {
+					continue
+				}
+				if !hasRel(strings.Trim(kv[1], `"`), rel) {
+					continue
+				}
+				u, err := baseURL.Parse(target)
+				if err != nil {
+					continue
+				}
+				links = append(links, u.String())
+			}
+		}
+	}
+
+	return links
+}
+
+// hasRel reports whether a possibly space separated rel value contains rel.
+func hasRel(rels, rel string) bool {
+	for _, r := range strings.Fields(rels) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package acmetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLinks(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Links    []string
+		Rel      string
+		Expected []string
+	}{
+		{"No links", nil, "alternate", nil},
+		{"Single alternate", []string{`<https://ca.example/cert/1/1>;rel="alternate"`}, "alternate", []string{"https://ca.example/cert/1/1"}},
+		{"Relative alternate", []string{`</cert/1/2>; rel="alternate"`}, "alternate", []string{"https://ca.example/cert/1/2"}},
+		{"Several in one header", []string{`<https://ca.example/dir>;rel="index", <https://ca.example/cert/1/1>;rel="alternate"`}, "alternate", []string{"https://ca.example/cert/1/1"}},
+		{"Several headers", []string{`<https://ca.example/cert/1/1>;rel="alternate"`, `<https://ca.example/cert/1/2>;rel=alternate`}, "alternate", []string{"https://ca.example/cert/1/1", "https://ca.example/cert/1/2"}},
+		{"Space separated rels", []string{`<https://ca.example/cert/1/1>;rel="up alternate"`}, "alternate", []string{"https://ca.example/cert/1/1"}},
+		{"Other rel only", []string{`<https://ca.example/dir>;rel="index"`}, "alternate", nil},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		for _, l := range test.Links {
+			h.Add("Link", l)
+		}
+		links := parseLinks("https://ca.example/cert/1", h, test.Rel)
+		if !reflect.DeepEqual(links, test.Expected) {
+			t.Errorf("failed %q: expected %v, got %v", test.Name, test.Expected, links)
+		}
+	}
+}
+
+func TestSelectChain(t *testing.T) {
+	rootA := testCert(t, "Root A", "Root A")
+	crossA := testCert(t, "Intermediate", "Root A")
+	crossB := testCert(t, "Intermediate", "Root B")
+	leaf := testCert(t, "example.org", "Intermediate")
+
+	defaultChain := CertChain{URL: "default", Leaf: leaf, Intermediates: []*x509.Certificate{crossA, rootA}}
+	altChain := CertChain{URL: "alt", Leaf: leaf, Intermediates: []*x509.Certificate{crossB}}
+	chains := []CertChain{defaultChain, altChain}
+
+	tests := []struct {
+		Name      string
+		Preferred string
+		Expected  string
+	}{
+		{"No preference", "", "default"},
+		{"Top issuer of default", "Root A", "default"},
+		{"Top issuer of alternate", "Root B", "alt"},
+		{"Issuer further down the chain", "Intermediate", "default"},
+		{"No match falls back to default", "Root C", "default"},
+	}
+
+	for _, test := range tests {
+		ch, err := SelectChain(chains, test.Preferred)
+		if err != nil {
+			t.Errorf("test %q should not have error'd, but it did: %v", test.Name, err)
+		}
+		if ch.URL != test.Expected {
+			t.Errorf("failed %q: expected chain %q, got %q", test.Name, test.Expected, ch.URL)
+		}
+	}
+
+	if _, err := SelectChain(nil, ""); err == nil {
+		t.Errorf("selecting from no chains should have error'd, but didn't.")
+	}
+}
+
+func TestParseChain(t *testing.T) {
+	leaf := testCert(t, "example.org", "Intermediate")
+	inter := testCert(t, "Intermediate", "Root A")
+	body := encodeCerts([]*x509.Certificate{leaf, inter})
+
+	ch, err := ParseChain(body)
+	if err != nil {
+		t.Fatalf("parsing chain should not have error'd, but it did: %v", err)
+	}
+	if ch.Leaf.Subject.CommonName != "example.org" {
+		t.Errorf("expected leaf %q, got %q", "example.org", ch.Leaf.Subject.CommonName)
+	}
+	if len(ch.Intermediates) != 1 || ch.TopIssuer() != "Root A" {
+		t.Errorf("expected one intermediate issued by %q, got %d issued by %q", "Root A", len(ch.Intermediates), ch.TopIssuer())
+	}
+
+	if _, err := ParseChain([]byte("not a chain")); err == nil {
+		t.Errorf("parsing garbage should have error'd, but didn't.")
+	}
+}
+
+// testCert makes a self-signed certificate that claims the given subject
+// and issuer names, which is all the chain handling looks at.
+func testCert(t *testing.T, subject, issuer string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: subject},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	parent := &x509.Certificate{Subject: pkix.Name{CommonName: issuer}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
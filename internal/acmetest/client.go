@@ -2,62 +2,168 @@ package acmetest
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 
+	"go.opentelemetry.io/otel/trace"
 	jose "gopkg.in/square/go-jose.v2"
 )
 
 // Client acts as an ACME client for LetsEncrypt.   It keeps track
-// of the current Nonce, the ecdsa key for signing messages, and
-// the keyID.
+// of the nonces handed out by the server, the ecdsa key for signing
+// messages, and the keyID.   A Client is safe to use from several
+// goroutines at once once NewClient has returned.
 type Client struct {
-	Nonce          string
 	KID            string
 	Key            *ecdsa.PrivateKey
 	Directory      Directory
 	AWSSession     *session.Session
-	R53            *route53.Route53
-	SecretsManager *secretsmanager.SecretsManager
+	R53            Route53API
+	SecretsManager SecretsManagerAPI
 	OrderURL       string
+	AuthzURL       string
 	ContactEmails  []string
 	Finalize       string
-	CertKey        *rsa.PrivateKey
+	CertKey        crypto.Signer
+
+	// PreferredChain is the issuer common name of the chain to keep
+	// when the CA offers alternates.   Empty means the default chain.
+	PreferredChain string
+
+	// HTTPClient is what requests to the CA go through.
+	HTTPClient *http.Client
+
+	// Workers caps how many requests to the CA are in flight at once
+	// when solving authorizations.   Zero means defaultWorkers.
+	Workers int
+
+	// Backoff paces polling and retries of rate limited requests.   Zero
+	// means DefaultBackoff.
+	Backoff Backoff
+
+	// Issuance holds new orders to local rate limits.   Nil means no
+	// local limits, only the CA's.
+	Issuance *IssuanceTracker
+
+	// Logger is where the Client logs what it's doing.   Nil means
+	// slog.Default().   Nonces, signed requests and key authorizations
+	// are redacted unless LogSecrets is set, which is only meant for
+	// debugging against a test CA.
+	Logger     *slog.Logger
+	LogSecrets bool
+
+	// Store is where SaveCertificate puts certificates.   Nil means
+	// Secrets Manager, as ssl_<domain>.key and ssl_<domain>.crt.
+	Store CertStore
+
+	// Metrics, if set, counts orders and how they went.
+	Metrics *Metrics
+
+	// TracerProvider is where spans for requests to the CA, solving,
+	// finalizing and storing go.   Nil means the global TracerProvider.
+	TracerProvider trace.TracerProvider
+
+	nonces *noncePool
+	authzs *authzCache
+}
+
+// defaultWorkers is how many challenges we work on at once if the
+// Client doesn't say otherwise.
+const defaultWorkers = 10
+
+// badNonceRetries is how many times a request is resent with a fresh
+// nonce after the server rejects the one we used.
+const badNonceRetries = 3
+
+// Config is everything NewClientWithConfig needs to set up a Client.
+// Only DirectoryURL and AccountKey are required.
+type Config struct {
+	DirectoryURL string
+	AccountKey   *ecdsa.PrivateKey
+	CertKey      crypto.Signer
+	Contacts     []string
+
+	// HTTPClient is used for every request to the CA.   Nil means
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	// AWSRegion is the region for the AWS session.   Empty means us-east-1.
+	AWSRegion string
+
+	// EAB is the external account binding for CAs that want one.
+	EAB ExternalAccountBinding
+
+	// Logger and LogSecrets are as on Client.
+	Logger     *slog.Logger
+	LogSecrets bool
 }
 
 // NewClient takes a directory URL and *ecdsa.PrivateKey and sets up a client.   It will populate
-// the Directory from that URL and get a Nonce for the next request.
-func NewClient(dirURL string, key *ecdsa.PrivateKey, certKey *rsa.PrivateKey, contactEmails []string) (Client, error) {
-	c := Client{Key: key, CertKey: certKey, ContactEmails: contactEmails}
+// the Directory from that URL, get a Nonce for the first request and register the account.
+func NewClient(dirURL string, key *ecdsa.PrivateKey, certKey crypto.Signer, contactEmails []string) (Client, error) {
+	return NewClientWithConfig(Config{
+		DirectoryURL: dirURL,
+		AccountKey:   key,
+		CertKey:      certKey,
+		Contacts:     contactEmails,
+	})
+}
 
-	directory, err := queryDirectory(dirURL)
+// NewClientWithConfig is NewClient with all of the knobs.
+func NewClientWithConfig(cfg Config) (Client, error) {
+	c := Client{
+		Key:           cfg.AccountKey,
+		CertKey:       cfg.CertKey,
+		ContactEmails: cfg.Contacts,
+		HTTPClient:    cfg.HTTPClient,
+		Logger:        cfg.Logger,
+		LogSecrets:    cfg.LogSecrets,
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
+
+	ctx := context.Background()
+	directory, err := queryDirectory(ctx, c.HTTPClient, cfg.DirectoryURL)
 	if err != nil {
 		return c, err
 	}
 	c.Directory = directory
+	c.nonces = &noncePool{url: c.Directory.NewNonce, httpClient: c.HTTPClient}
+	c.authzs = &authzCache{}
 
-	nonce, err := GetNonce(c.Directory.NewNonce)
+	nonce, err := c.nonces.get(ctx)
 	if err != nil {
 		return c, err
 	}
-	fmt.Printf("Fetched nonce: %s\n", nonce)
-	c.Nonce = nonce
+	c.log().Debug("Fetched first nonce", logKeyURL, c.Directory.NewNonce, logKeyNonce, nonce)
+	c.nonces.put(nonce)
 
-	c.newAccount(contactEmails)
+	err = c.newAccount(ctx, cfg.Contacts, cfg.EAB)
+	if err != nil {
+		return c, err
+	}
 
+	region := cfg.AWSRegion
+	if region == "" {
+		region = "us-east-1"
+	}
 	c.AWSSession, err = session.NewSession(&aws.Config{
-		Region: aws.String("us-east-1"),
+		Region: aws.String(region),
 	})
 	if err != nil {
 		return c, err
@@ -69,49 +175,149 @@ func NewClient(dirURL string, key *ecdsa.PrivateKey, certKey *rsa.PrivateKey, co
 	return c, nil
 }
 
-func (c *Client) makeRequest(claimset interface{}, url string, postAsGet bool) ([]byte, error) {
-	var b []byte
-	token, err := c.JWSEncodeJSON(claimset, url, postAsGet)
+// acmeResponse holds the parts of a response to a signed request that
+// callers need: the status, the headers (Location, Link, Retry-After and
+// the like) and the body.
+type acmeResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func (c *Client) makeRequest(ctx context.Context, resource string, claimset interface{}, url string, postAsGet bool) ([]byte, error) {
+	res, err := c.post(ctx, resource, claimset, url, postAsGet, "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// post signs the claimset and sends it to url, the ACME resource named
+// by resource.   If accept is non-empty it's sent as the Accept header.
+// A badNonce rejection is retried with a fresh nonce, as RFC8555 section
+// 6.5 expects clients to do, and a 429 or 503 is retried after the wait
+// the server asked for, per c.Backoff.   The whole exchange, retries and
+// all, is one span.
+func (c *Client) post(ctx context.Context, resource string, claimset interface{}, url string, postAsGet bool, accept string) (res *acmeResponse, err error) {
+	ctx, span := c.tracer().Start(ctx, "ACME "+resource, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrResource.String(resource), attrURL.String(url)))
+	backoff := c.backoff()
+	nonceRetries, retries := 0, 0
+	defer func() {
+		span.SetAttributes(attrRetries.Int(nonceRetries + retries))
+		var p *Problem
+		switch {
+		case res != nil:
+			span.SetAttributes(attrStatusCode.Int(res.StatusCode))
+		case errors.As(err, &p):
+			span.SetAttributes(attrStatusCode.Int(p.Status))
+		}
+		endSpan(span, err)
+	}()
+
+	for {
+		res, err = c.postOnce(ctx, claimset, url, postAsGet, accept)
+		p, ok := err.(*Problem)
+		switch {
+		case !ok:
+			return res, err
+		case p.Type == ProblemBadNonce && nonceRetries < badNonceRetries:
+			nonceRetries++
+			c.log().Info("Server rejected our nonce, retrying", logKeyURL, url)
+		case p.retryable() && retries < backoff.Retries && p.RetryAfter <= backoff.MaxRetryAfter:
+			wait := p.RetryAfter
+			if wait <= 0 {
+				wait = backoff.Wait(retries)
+			}
+			retries++
+			c.log().Warn("Server turned the request away, retrying", logKeyURL, url, "problem", p.Type, "retry_in", wait)
+			if err = sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+		default:
+			return res, err
+		}
+	}
+}
+
+func (c *Client) postOnce(ctx context.Context, claimset interface{}, url string, postAsGet bool, accept string) (*acmeResponse, error) {
+	nonce, err := c.nonces.get(ctx)
 	if err != nil {
-		return b, err
+		return nil, err
 	}
 
-	fmt.Printf("Request token sent to %s\n", url)
-	fmt.Println(string(token))
+	token, err := c.JWSEncodeJSON(claimset, url, nonce, postAsGet)
+	if err != nil {
+		return nil, err
+	}
+
+	c.log().Debug("Sending request", logKeyURL, url, logKeyNonce, nonce, logKeyJWS, string(token))
 
 	req, err := http.NewRequest("POST", url, bytes.NewReader(token))
 	if err != nil {
-		fmt.Println("Failed on http.NewRequest")
-		return b, err
+		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/jose+json")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.HTTPClient.Do(req.WithContext(ctx))
 	if err != nil {
-		fmt.Println("Failed on executing http.DefaultClient.Do")
-		return b, err
+		c.log().Warn("Request failed", logKeyURL, url, logKeyError, err)
+		return nil, err
 	}
 	defer res.Body.Close()
 
-	b, err = ioutil.ReadAll(res.Body)
+	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		fmt.Println("Failed reading response body")
-		return b, err
+		c.log().Warn("Failed reading response", logKeyURL, url, logKeyError, err)
+		return nil, err
 	}
+	c.log().Debug("Got response", logKeyURL, url, logKeyStatus, res.StatusCode, logKeyResponse, string(b))
 
-	c.Nonce = res.Header.Get("Replay-Nonce")
-	if c.KID == "" {
-		c.KID = res.Header.Get("Location")
+	c.nonces.put(res.Header.Get("Replay-Nonce"))
+	if res.StatusCode >= 400 {
+		p := parseProblem(res.StatusCode, b)
+		if p.retryable() {
+			p.RetryAfter = retryAfter(res.Header, 0)
+		}
+		return nil, p
 	}
 
-	return b, nil
+	return &acmeResponse{StatusCode: res.StatusCode, Header: res.Header, Body: b}, nil
 }
 
-func queryDirectory(url string) (Directory, error) {
+// workers returns how many concurrent requests to allow.
+func (c *Client) workers() int {
+	if c.Workers > 0 {
+		return c.Workers
+	}
+	return defaultWorkers
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func queryDirectory(ctx context.Context, httpClient *http.Client, url string) (Directory, error) {
 	var d Directory
 
-	res, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return d, err
+	}
+
+	res, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return d, err
 	}
@@ -121,6 +327,9 @@ func queryDirectory(url string) (Directory, error) {
 	if err != nil {
 		return d, err
 	}
+	if res.StatusCode != http.StatusOK {
+		return d, fmt.Errorf("Unexpected status %d fetching directory %s", res.StatusCode, url)
+	}
 
 	d, err = Parse(dirJSON)
 	return d, err
@@ -137,22 +346,24 @@ func JWKThumbprint(key *ecdsa.PrivateKey, hash crypto.Hash) ([]byte, error) {
 func (c *Client) acmeAuthString(token string) (string, error) {
 	var thumb []byte
 	thumb, err := JWKThumbprint(c.Key, crypto.SHA256)
-	fmt.Printf("JWK Thumbprint as bytes: %v\n", thumb)
 	if err != nil {
 		return string(thumb), err
 	}
-	fmt.Printf("Generated JSONWebKey thumbprint %q\n", thumb)
 	return fmt.Sprintf("%s.%s", token, base64.RawURLEncoding.EncodeToString([]byte(thumb))), nil
 }
 
 // AcmeAuthHash generates the value that should be put into a DNS TXT record for _acme-challenge.{domain}
 func (c *Client) AcmeAuthHash(token string) (string, error) {
 	authString, err := c.acmeAuthString(token)
-	fmt.Printf("Sending token %q\n", authString)
 	if err != nil {
 		return authString, err
 	}
-	h := sha256.New()
-	h.Write([]byte(authString))
-	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+	return DNS01Value(authString), nil
+}
+
+// DNS01Value turns a key authorization into the TXT record value for a
+// dns-01 challenge, per RFC8555 section 8.4.
+func DNS01Value(keyAuth string) string {
+	h := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(h[:])
 }
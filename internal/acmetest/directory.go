@@ -1,14 +1,34 @@
 package acmetest
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
 
-// Directory encodes a Acme V2 directory as a struct
+// Directory encodes a Acme V2 directory as a struct.   NewAuthz and
+// RenewalInfo are optional and empty if the CA doesn't offer them.
 type Directory struct {
-	KeyChange  string `json:"keyChange"`
-	NewAccount string `json:"newAccount"`
-	NewNonce   string `json:"newNonce"`
-	NewOrder   string `json:"newOrder"`
-	RevokeCert string `json:"revokeCert"`
+	KeyChange   string        `json:"keyChange"`
+	NewAccount  string        `json:"newAccount"`
+	NewNonce    string        `json:"newNonce"`
+	NewOrder    string        `json:"newOrder"`
+	RevokeCert  string        `json:"revokeCert"`
+	NewAuthz    string        `json:"newAuthz,omitempty"`
+	RenewalInfo string        `json:"renewalInfo,omitempty"`
+	Meta        DirectoryMeta `json:"meta"`
+}
+
+// DirectoryMeta is the optional meta object in a directory, see RFC8555
+// section 7.1.1.   Profiles maps profile names to a description, for CAs
+// implementing the ACME profiles extension.
+type DirectoryMeta struct {
+	TermsOfService          string            `json:"termsOfService,omitempty"`
+	Website                 string            `json:"website,omitempty"`
+	CAAIdentities           []string          `json:"caaIdentities,omitempty"`
+	ExternalAccountRequired bool              `json:"externalAccountRequired"`
+	Profiles                map[string]string `json:"profiles,omitempty"`
 }
 
 // Parse gets a chunk of JSON and unmarshals it into a Directory, or else returns an error
@@ -17,3 +37,52 @@ func Parse(input []byte) (Directory, error) {
 	err := json.Unmarshal(input, &d)
 	return d, err
 }
+
+// SupportsPreAuthorization reports whether the CA has a newAuthz
+// endpoint, so identifiers can be authorized before ordering.
+func (c *Client) SupportsPreAuthorization() bool {
+	return c.Directory.NewAuthz != ""
+}
+
+// SupportsRenewalInfo reports whether the CA offers ACME Renewal
+// Information (ARI) to suggest when certificates should be renewed.
+func (c *Client) SupportsRenewalInfo() bool {
+	return c.Directory.RenewalInfo != ""
+}
+
+// RequiresExternalAccount reports whether the CA needs an external
+// account binding to create an account.
+func (c *Client) RequiresExternalAccount() bool {
+	return c.Directory.Meta.ExternalAccountRequired
+}
+
+// SupportsProfile reports whether the CA advertises the named
+// certificate profile.
+func (c *Client) SupportsProfile(name string) bool {
+	_, ok := c.Directory.Meta.Profiles[name]
+	return ok
+}
+
+// Profiles returns the names of the certificate profiles the CA
+// advertises, sorted.
+func (c *Client) Profiles() []string {
+	names := make([]string, 0, len(c.Directory.Meta.Profiles))
+	for name := range c.Directory.Meta.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckProfile returns an error if profile is set but the CA doesn't
+// advertise it.   An empty profile is always fine and means whatever the
+// CA's default is.
+func (c *Client) CheckProfile(profile string) error {
+	if profile == "" || c.SupportsProfile(profile) {
+		return nil
+	}
+	if len(c.Directory.Meta.Profiles) == 0 {
+		return fmt.Errorf("Profile %q requested, but the CA doesn't support profiles", profile)
+	}
+	return fmt.Errorf("Profile %q isn't one the CA offers (%s)", profile, strings.Join(c.Profiles(), ", "))
+}
@@ -0,0 +1,87 @@
+package acmetest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDirectory(t *testing.T) {
+	full := `{
+  "keyChange": "https://ca.example/acme/key-change",
+  "newAccount": "https://ca.example/acme/new-acct",
+  "newAuthz": "https://ca.example/acme/new-authz",
+  "newNonce": "https://ca.example/acme/new-nonce",
+  "newOrder": "https://ca.example/acme/new-order",
+  "renewalInfo": "https://ca.example/acme/renewal-info",
+  "revokeCert": "https://ca.example/acme/revoke-cert",
+  "meta": {
+    "caaIdentities": ["ca.example"],
+    "externalAccountRequired": true,
+    "profiles": {"classic": "The same profile you know", "shortlived": "Six days"},
+    "termsOfService": "https://ca.example/tos.pdf",
+    "website": "https://ca.example"
+  }
+}`
+	minimal := `{
+  "newAccount": "https://ca.example/acme/new-acct",
+  "newNonce": "https://ca.example/acme/new-nonce",
+  "newOrder": "https://ca.example/acme/new-order",
+  "revokeCert": "https://ca.example/acme/revoke-cert"
+}`
+
+	d, err := Parse([]byte(full))
+	if err != nil {
+		t.Fatalf("parsing directory should not have error'd, but it did: %v", err)
+	}
+	if d.Meta.TermsOfService != "https://ca.example/tos.pdf" || d.Meta.Website != "https://ca.example" {
+		t.Errorf("unexpected meta %+v", d.Meta)
+	}
+	if !reflect.DeepEqual(d.Meta.CAAIdentities, []string{"ca.example"}) {
+		t.Errorf("unexpected CAA identities %v", d.Meta.CAAIdentities)
+	}
+
+	c := Client{Directory: d}
+	if !c.SupportsPreAuthorization() || !c.SupportsRenewalInfo() || !c.RequiresExternalAccount() {
+		t.Errorf("expected every capability from the full directory")
+	}
+	if !c.SupportsProfile("shortlived") || c.SupportsProfile("tlsserver") {
+		t.Errorf("expected only the advertised profiles to be supported")
+	}
+	if !reflect.DeepEqual(c.Profiles(), []string{"classic", "shortlived"}) {
+		t.Errorf("unexpected profiles %v", c.Profiles())
+	}
+
+	d, err = Parse([]byte(minimal))
+	if err != nil {
+		t.Fatalf("parsing directory should not have error'd, but it did: %v", err)
+	}
+	c = Client{Directory: d}
+	if c.SupportsPreAuthorization() || c.SupportsRenewalInfo() || c.RequiresExternalAccount() || len(c.Profiles()) != 0 {
+		t.Errorf("expected no capabilities from the minimal directory")
+	}
+}
+
+func TestCheckProfile(t *testing.T) {
+	withProfiles := Client{Directory: Directory{Meta: DirectoryMeta{Profiles: map[string]string{"classic": "", "shortlived": ""}}}}
+	withoutProfiles := Client{}
+
+	tests := []struct {
+		Name        string
+		Client      Client
+		Profile     string
+		ShouldError bool
+	}{
+		{"Default profile", withProfiles, "", false},
+		{"Advertised profile", withProfiles, "shortlived", false},
+		{"Unknown profile", withProfiles, "tlsserver", true},
+		{"Default with no profiles", withoutProfiles, "", false},
+		{"Any profile with no profiles", withoutProfiles, "classic", true},
+	}
+
+	for _, test := range tests {
+		err := test.Client.CheckProfile(test.Profile)
+		if test.ShouldError != (err != nil) {
+			t.Errorf("failed %q: expected error %v, got %v", test.Name, test.ShouldError, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package acmetest
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrExternalAccountRequired is returned when the CA's directory says it
+// needs an external account binding and we weren't given one.
+var ErrExternalAccountRequired = errors.New("CA requires external account binding, but no EAB key ID and HMAC key were given")
+
+// ExternalAccountBinding holds the credentials a CA like ZeroSSL, Google
+// Trust Services or step-ca hands out to tie an ACME account to an
+// account in its own systems.   See RFC8555 section 7.3.4.
+type ExternalAccountBinding struct {
+	KeyID   string
+	HMACKey string // base64url encoded, as the CA gives it out
+}
+
+// IsZero reports whether there are no EAB credentials at all.
+func (eab ExternalAccountBinding) IsZero() bool {
+	return eab.KeyID == "" && eab.HMACKey == ""
+}
+
+// JWS builds the externalAccountBinding field of a newAccount request:
+// a JWS over the account's public JWK, MACed with HS256 using the
+// HMAC key, with the key ID as kid and the newAccount URL as url.
+func (eab ExternalAccountBinding) JWS(accountKey crypto.PublicKey, url string) (Message, error) {
+	if eab.KeyID == "" || eab.HMACKey == "" {
+		return Message{}, errors.New("External account binding needs both a key ID and an HMAC key")
+	}
+
+	macKey, err := decodeMACKey(eab.HMACKey)
+	if err != nil {
+		return Message{}, err
+	}
+
+	jwk, err := jwkEncode(accountKey)
+	if err != nil {
+		return Message{}, err
+	}
+
+	phead := fmt.Sprintf(`{"alg":"HS256","kid":%q,"url":%q}`, eab.KeyID, url)
+	phead = base64.RawURLEncoding.EncodeToString([]byte(phead))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(jwk))
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(phead + "." + payload))
+
+	return Message{
+		Protected: phead,
+		Payload:   payload,
+		Signature: base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+	}, nil
+}
+
+// decodeMACKey decodes the HMAC key.   It's supposed to be unpadded
+// base64url, but some CAs hand out padded or standard base64.
+func decodeMACKey(key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		if b, err := enc.DecodeString(key); err == nil && len(b) > 0 {
+			return b, nil
+		}
+	}
+	return nil, errors.New("EAB HMAC key isn't valid base64url")
+}
@@ -0,0 +1,81 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestExternalAccountBindingJWS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	macKey := []byte("a very secret mac key, 32 bytes.")
+	eab := ExternalAccountBinding{KeyID: "kid-1", HMACKey: base64.RawURLEncoding.EncodeToString(macKey)}
+
+	msg, err := eab.JWS(key.Public(), "https://ca.example/acme/new-account")
+	if err != nil {
+		t.Fatalf("building the EAB JWS should not have error'd, but it did: %v", err)
+	}
+
+	var protected map[string]string
+	b, _ := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err := json.Unmarshal(b, &protected); err != nil {
+		t.Fatalf("protected header isn't JSON: %v", err)
+	}
+	if protected["alg"] != "HS256" || protected["kid"] != "kid-1" || protected["url"] != "https://ca.example/acme/new-account" {
+		t.Errorf("unexpected protected header %v", protected)
+	}
+	if _, ok := protected["nonce"]; ok {
+		t.Errorf("the EAB JWS must not have a nonce")
+	}
+
+	jwk, _ := jwkEncode(key.Public())
+	payload, _ := base64.RawURLEncoding.DecodeString(msg.Payload)
+	if string(payload) != jwk {
+		t.Errorf("expected the account JWK as payload, got %s", payload)
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(msg.Protected + "." + msg.Payload))
+	if msg.Signature != base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature doesn't match an HS256 MAC over the protected header and payload")
+	}
+
+	if _, err := (ExternalAccountBinding{KeyID: "kid-1"}).JWS(key.Public(), "u"); err == nil {
+		t.Errorf("an EAB with no HMAC key should have error'd, but didn't.")
+	}
+	if _, err := (ExternalAccountBinding{KeyID: "kid-1", HMACKey: "!!!"}).JWS(key.Public(), "u"); err == nil {
+		t.Errorf("an EAB with a junk HMAC key should have error'd, but didn't.")
+	}
+}
+
+func TestDecodeMACKey(t *testing.T) {
+	raw := []byte{0xfb, 0xff, 0x01, 0x02, 0x03}
+	for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		b, err := decodeMACKey(enc.EncodeToString(raw))
+		if err != nil || string(b) != string(raw) {
+			t.Errorf("failed decoding %q: got %v, %v", enc.EncodeToString(raw), b, err)
+		}
+	}
+}
+
+func TestNewAccountRequiresEAB(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{Key: key, Directory: Directory{Meta: DirectoryMeta{ExternalAccountRequired: true}}}
+
+	err = c.newAccount(context.Background(), nil, ExternalAccountBinding{})
+	if err != ErrExternalAccountRequired {
+		t.Errorf("expected ErrExternalAccountRequired, got %v", err)
+	}
+}
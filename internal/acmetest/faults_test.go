@@ -0,0 +1,148 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swerveaux/acmetest/internal/acmetesting"
+)
+
+func TestIssueRetriesBadNonce(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Faults []acmetesting.Fault
+		Err    bool
+	}{
+		{"one", []acmetesting.Fault{acmetesting.BadNonce(3)}, false},
+		{"as many as we retry", []acmetesting.Fault{{After: 2, Times: badNonceRetries, Problem: &acmetesting.Problem{Type: acmetesting.ProblemBadNonce, Status: 400}}}, false},
+		{"too many", []acmetesting.Fault{{After: 2, Times: badNonceRetries + 1, Problem: &acmetesting.Problem{Type: acmetesting.ProblemBadNonce, Status: 400}}}, true},
+	}
+
+	for _, test := range tests {
+		srv, c := newTestCA(t)
+		srv.Inject(test.Faults...)
+
+		_, err := c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), &recordingSolver{challengeType: ChallengeDNS01})
+		if test.Err && err == nil {
+			t.Errorf("test %q should have error'd", test.Name)
+		}
+		if !test.Err && err != nil {
+			t.Errorf("test %q should not have error'd: %v", test.Name, err)
+		}
+	}
+}
+
+func TestIssueRateLimited(t *testing.T) {
+	srv, c := newTestCA(t)
+	srv.Inject(acmetesting.RateLimited(acmetesting.ResourceNewOrder, 2, 0))
+
+	_, err := c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), &recordingSolver{challengeType: ChallengeDNS01})
+	if err != nil {
+		t.Fatalf("test of retrying a rate limited order should not have error'd: %v", err)
+	}
+	if n := srv.Requests(acmetesting.ResourceNewOrder); n != 3 {
+		t.Errorf("expected 3 attempts at the order, got %d", n)
+	}
+
+	srv.Inject(acmetesting.RateLimited(acmetesting.ResourceNewOrder, 1, time.Hour))
+	start := time.Now()
+	_, err = c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), &recordingSolver{challengeType: ChallengeDNS01})
+	if !IsRateLimited(err) {
+		t.Fatalf("expected a rateLimited error, got %v", err)
+	}
+	var p *Problem
+	if errors.As(err, &p); p.RetryAfter != time.Hour {
+		t.Errorf("expected the error to say to retry after an hour, got %s", p.RetryAfter)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected to give up right away on a Retry-After past MaxRetryAfter, took %s", time.Since(start))
+	}
+}
+
+func TestIssueWaitsForProcessing(t *testing.T) {
+	tests := []struct {
+		Name            string
+		ValidationPolls int
+		ProcessingPolls int
+		Err             error
+	}{
+		{"slow validation", 3, 0, nil},
+		{"slow issuance", 0, 3, nil},
+		{"stuck validation", 1000, 0, ErrPollTimeout},
+		{"stuck processing", 0, 1000, ErrPollTimeout},
+	}
+
+	for _, test := range tests {
+		srv, c := newTestCA(t)
+		srv.ValidationPolls = test.ValidationPolls
+		srv.ProcessingPolls = test.ProcessingPolls
+		solver := &recordingSolver{challengeType: ChallengeDNS01}
+
+		_, err := c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), solver)
+		if test.Err == nil && err != nil {
+			t.Errorf("test %q should not have error'd: %v", test.Name, err)
+		}
+		if test.Err != nil && !errors.Is(err, test.Err) {
+			t.Errorf("test %q expected %v, got %v", test.Name, test.Err, err)
+		}
+		if len(solver.cleanedUp) != 1 {
+			t.Errorf("test %q expected the challenge cleaned up, got %d", test.Name, len(solver.cleanedUp))
+		}
+	}
+}
+
+func TestIssueCleansUpAfterFaults(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Fault acmetesting.Fault
+	}{
+		{"challenge 500", acmetesting.InternalError(acmetesting.ResourceChallenge, 1)},
+		{"truncated challenge", acmetesting.Truncated(acmetesting.ResourceChallenge)},
+		{"authorization 500", acmetesting.Fault{Resource: acmetesting.ResourceAuthz, After: 2, Times: acmetesting.Forever, Problem: &acmetesting.Problem{Type: acmetesting.ProblemServerInternal, Status: 500}}},
+		{"truncated authorization", acmetesting.Fault{Resource: acmetesting.ResourceAuthz, After: 2, Truncate: true}},
+		{"finalize 500", acmetesting.InternalError(acmetesting.ResourceFinalize, 1)},
+		{"truncated certificate", acmetesting.Truncated(acmetesting.ResourceCertificate)},
+	}
+
+	for _, test := range tests {
+		srv, c := newTestCA(t)
+		srv.Inject(test.Fault)
+		solver := &recordingSolver{challengeType: ChallengeDNS01}
+
+		_, err := c.Issue(context.Background(), []string{"example.org", "www.example.org"}, "", testCertKey(t), solver)
+		if err == nil {
+			t.Errorf("test %q should have error'd", test.Name)
+		}
+		if len(solver.cleanedUp) != len(solver.presented) {
+			t.Errorf("test %q presented %d challenges but cleaned up %d", test.Name, len(solver.presented), len(solver.cleanedUp))
+		}
+	}
+}
+
+func TestIssueInvalidChallengeSubproblems(t *testing.T) {
+	srv, c := newTestCA(t)
+	srv.Validate = func(v acmetesting.Validation) error {
+		return &acmetesting.Problem{
+			Type:   acmetesting.ProblemIncorrectResponse,
+			Detail: "No valid TXT records found",
+			Subproblems: []acmetesting.Problem{
+				{Type: acmetesting.ProblemDNS, Detail: "SERVFAIL from ns1", Identifier: &acmetesting.Identifier{Type: "dns", Value: v.Identifier.Value}},
+			},
+		}
+	}
+
+	_, err := c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), &recordingSolver{challengeType: ChallengeDNS01})
+	var authzErr *AuthorizationError
+	if !errors.As(err, &authzErr) || authzErr.Problem == nil {
+		t.Fatalf("expected an AuthorizationError with the challenge's problem, got %v", err)
+	}
+	if len(authzErr.Problem.Subproblems) != 1 || authzErr.Problem.Subproblems[0].Type != acmetesting.ProblemDNS {
+		t.Errorf("expected the dns subproblem, got %+v", authzErr.Problem.Subproblems)
+	}
+	if !strings.Contains(err.Error(), "SERVFAIL from ns1") {
+		t.Errorf("expected the subproblem in the error, got %q", err)
+	}
+}
@@ -0,0 +1,544 @@
+package acmetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Defaults for FileStore.
+const (
+	DefaultFileStoreDir  = "/etc/ssl/acme/{{.Name}}"
+	DefaultFileStoreKeep = 5
+)
+
+// FileStore keeps certificates on the local filesystem, one directory per
+// name, laid out the way nginx, haproxy and friends expect:
+//
+//	/etc/ssl/acme/<name>/privkey.pem
+//	/etc/ssl/acme/<name>/cert.pem
+//	/etc/ssl/acme/<name>/chain.pem
+//	/etc/ssl/acme/<name>/fullchain.pem
+//
+// Every file is written to a temporary file and renamed into place, so
+// nothing ever reads half a key.   All of them are written before any is
+// renamed, and if a rename fails the files already renamed are put back,
+// so a failed Store leaves the previous certificate whole rather than a
+// new key next to an old certificate.   The files a write replaces are kept
+// under archive/<n>/ in the same directory, and once everything is in
+// place the PostDeploy hooks run so servers pick up the new certificate.
+type FileStore struct {
+	// Dir is a template for the directory each certificate goes in,
+	// with .Name being the name it's stored under.   Empty means
+	// DefaultFileStoreDir.
+	Dir string
+
+	// KeyFile, CertFile, ChainFile and FullChainFile name the files
+	// in that directory, defaulting to privkey.pem, cert.pem,
+	// chain.pem and fullchain.pem.   CombinedFile, if set, also gets
+	// the key followed by the full chain, for haproxy.
+	KeyFile       string
+	CertFile      string
+	ChainFile     string
+	FullChainFile string
+	CombinedFile  string
+
+	// KeyMode and CertMode are the permissions for the key (and the
+	// combined file) and for the certificates, 0600 and 0644 if unset.
+	KeyMode  os.FileMode
+	CertMode os.FileMode
+
+	// Owner and Group, user and group names or IDs, are who the
+	// files are chowned to.   Empty leaves them as whoever we are.
+	Owner string
+	Group string
+
+	// Keep is how many replaced versions to keep in archive/.
+	// Zero means DefaultFileStoreKeep, negative keeps none.
+	Keep int
+
+	// PostDeploy runs, in order, after every successful Store.
+	PostDeploy []DeployHook
+
+	Logger *slog.Logger
+
+	mu sync.Mutex
+}
+
+// DeployHook tells something a certificate changed, by running Command
+// with sh -c or by sending Signal to the process in PIDFile, or both.
+// Command gets ACMETEST_CERT_NAME, ACMETEST_CERT_DIR and
+// ACMETEST_CERT_DOMAINS in its environment.
+type DeployHook struct {
+	Command string
+	PIDFile string
+	Signal  syscall.Signal // SIGHUP if unset
+}
+
+// Store writes the bundle's files, archives what they replaced, and runs
+// the post-deploy hooks.   If a hook fails the certificate has still been
+// stored, and the error says so.
+func (s *FileStore) Store(ctx context.Context, bundle CertBundle) error {
+	dir, err := s.dir(bundle.Name)
+	if err != nil {
+		return err
+	}
+	uid, gid, err := lookupOwner(s.Owner, s.Group)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	keyMode := s.KeyMode
+	if keyMode == 0 {
+		keyMode = 0600
+	}
+	certMode := s.CertMode
+	if certMode == 0 {
+		certMode = 0644
+	}
+
+	// The key goes first, so that by the time anything sees the new
+	// certificate its key is already there.
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{s.keyFile(), bundle.KeyPEM, keyMode},
+		{s.CombinedFile, append(append([]byte{}, bundle.KeyPEM...), bundle.FullChainPEM()...), keyMode},
+		{s.chainFile(), bundle.ChainPEM, certMode},
+		{s.fullChainFile(), bundle.FullChainPEM(), certMode},
+		{s.certFile(), bundle.CertPEM, certMode},
+	}
+	var staged []stagedFile
+	defer func() {
+		for _, f := range staged {
+			f.remove()
+		}
+	}()
+	for _, f := range files {
+		if f.name == "" {
+			continue
+		}
+		sf, err := stageFile(filepath.Join(dir, f.name), f.data, f.mode, uid, gid)
+		if err != nil {
+			return err
+		}
+		staged = append(staged, sf)
+	}
+	if err := commitFiles(staged); err != nil {
+		return fmt.Errorf("Failed storing %s, kept the previous files: %v", bundle.Name, err)
+	}
+	s.log().Info("Stored certificate", logKeyStep, "store", "name", bundle.Name, "dir", dir)
+
+	// Only now that the new files are in place is what they replaced
+	// archived, from the links staging kept to it, so a failed write
+	// never leaves the current certificate in the archive.
+	var errs []error
+	if err := s.archive(dir, staged); err != nil {
+		errs = append(errs, fmt.Errorf("Stored %s but failed archiving what it replaced: %v", bundle.Name, err))
+	}
+	if err := s.runHooks(ctx, bundle, dir); err != nil {
+		errs = append(errs, fmt.Errorf("Stored %s but post-deploy failed: %w", bundle.Name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// Load reads back the certificate stored under name.
+func (s *FileStore) Load(ctx context.Context, name string) (CertBundle, error) {
+	dir, err := s.dir(name)
+	if err != nil {
+		return CertBundle{Name: name}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(name, dir)
+}
+
+// LoadPrevious reads back the newest version in the archive.
+func (s *FileStore) LoadPrevious(ctx context.Context, name string) (CertBundle, error) {
+	dir, err := s.dir(name)
+	if err != nil {
+		return CertBundle{Name: name}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions, err := archiveVersions(dir)
+	if err != nil {
+		return CertBundle{Name: name}, err
+	}
+	if len(versions) == 0 {
+		return CertBundle{Name: name}, ErrCertNotFound
+	}
+	return s.load(name, filepath.Join(dir, "archive", strconv.Itoa(versions[len(versions)-1])))
+}
+
+func (s *FileStore) load(name, dir string) (CertBundle, error) {
+	bundle := CertBundle{Name: name}
+
+	certPEM, err := os.ReadFile(filepath.Join(dir, s.certFile()))
+	if errors.Is(err, os.ErrNotExist) {
+		return bundle, ErrCertNotFound
+	}
+	if err != nil {
+		return bundle, err
+	}
+	chainPEM, err := os.ReadFile(filepath.Join(dir, s.chainFile()))
+	if err != nil {
+		return bundle, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, s.keyFile()))
+	if err != nil {
+		return bundle, err
+	}
+
+	chain, err := ParseChain(certPEM)
+	if err != nil {
+		return bundle, fmt.Errorf("Failed parsing %s: %v", filepath.Join(dir, s.certFile()), err)
+	}
+
+	bundle.Domains = certNames(chain.Leaf)
+	bundle.KeyPEM = keyPEM
+	bundle.CertPEM = certPEM
+	bundle.ChainPEM = chainPEM
+
+	return bundle, nil
+}
+
+// dir works out the directory for name.   Names can't climb out of it.
+func (s *FileStore) dir(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("Bad certificate name %q for a file store", name)
+	}
+
+	dir, err := storePath(firstNonEmpty(s.Dir, DefaultFileStoreDir), name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(dir), nil
+}
+
+// archive hard links the files a Store just replaced, from the links to
+// them in staged, into the next archive/<n>/ directory and drops the
+// oldest versions beyond Keep.   Nothing is archived if there was no
+// certificate before.
+func (s *FileStore) archive(dir string, staged []stagedFile) error {
+	replacedCert := false
+	for _, f := range staged {
+		if f.old != "" && filepath.Base(f.path) == s.certFile() {
+			replacedCert = true
+		}
+	}
+	if !replacedCert {
+		return nil
+	}
+	keep := s.Keep
+	if keep == 0 {
+		keep = DefaultFileStoreKeep
+	}
+	if keep < 0 {
+		return nil
+	}
+
+	versions, err := archiveVersions(dir)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1] + 1
+	}
+
+	// The archive has keys in it, so only we get to look inside.
+	archiveDir := filepath.Join(dir, "archive")
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		return err
+	}
+	versionDir := filepath.Join(archiveDir, strconv.Itoa(next))
+	if err := os.Mkdir(versionDir, 0700); err != nil {
+		return err
+	}
+	for _, f := range staged {
+		if f.old == "" {
+			continue
+		}
+		if err := linkOrCopy(f.old, filepath.Join(versionDir, filepath.Base(f.path))); err != nil {
+			// Half a version is worse than none.
+			os.RemoveAll(versionDir)
+			return err
+		}
+	}
+
+	versions = append(versions, next)
+	for len(versions) > keep {
+		if err := os.RemoveAll(filepath.Join(archiveDir, strconv.Itoa(versions[0]))); err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// archiveVersions returns the version numbers in dir/archive, oldest
+// first.
+func archiveVersions(dir string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, "archive"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil && e.IsDir() {
+			versions = append(versions, n)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// runHooks runs every hook, even after one fails, and returns what went
+// wrong with all of them.
+func (s *FileStore) runHooks(ctx context.Context, bundle CertBundle, dir string) error {
+	var errs []error
+	for _, hook := range s.PostDeploy {
+		if hook.Command != "" {
+			cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook.Command)
+			cmd.Env = append(os.Environ(),
+				"ACMETEST_CERT_NAME="+bundle.Name,
+				"ACMETEST_CERT_DIR="+dir,
+				"ACMETEST_CERT_DOMAINS="+strings.Join(bundle.Domains, ","),
+			)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Command %q failed: %v: %s", hook.Command, err, bytes.TrimSpace(out)))
+				continue
+			}
+			s.log().Info("Ran post-deploy command", logKeyStep, "store", "name", bundle.Name, "command", hook.Command)
+		}
+		if hook.PIDFile != "" {
+			sig := hook.Signal
+			if sig == 0 {
+				sig = syscall.SIGHUP
+			}
+			pid, err := signalPIDFile(hook.PIDFile, sig)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			s.log().Info("Signalled process", logKeyStep, "store", "name", bundle.Name, "pid", pid, "signal", sig.String())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// signalPIDFile sends sig to the process whose PID is in path.
+func signalPIDFile(path string, sig syscall.Signal) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("No PID in %s", path)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return pid, err
+	}
+	if err := proc.Signal(sig); err != nil {
+		return pid, fmt.Errorf("Failed signalling %d from %s: %v", pid, path, err)
+	}
+	return pid, nil
+}
+
+// renameFile is os.Rename, swapped out by tests to fail part way through
+// a Store.
+var renameFile = os.Rename
+
+// stagedFile is a file written next to path but not yet renamed into
+// place, along with a link to the file it replaces, if there is one.
+type stagedFile struct {
+	path string
+	tmp  string
+	old  string
+}
+
+// remove cleans up whatever of the staged file is left over.
+func (f stagedFile) remove() {
+	os.Remove(f.tmp)
+	if f.old != "" {
+		os.Remove(f.old)
+	}
+}
+
+// commitFiles renames every staged file into place.   If one fails the
+// ones already renamed are rolled back to what they replaced, or removed
+// if they didn't replace anything.
+func commitFiles(staged []stagedFile) error {
+	for i, f := range staged {
+		err := renameFile(f.tmp, f.path)
+		if err == nil {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			done := staged[j]
+			if done.old != "" {
+				os.Rename(done.old, done.path)
+			} else {
+				os.Remove(done.path)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// stageFile writes data to a temporary file next to path, chowning it
+// unless uid and gid are -1, and links whatever is at path now to
+// another temporary file so it can be put back.
+func stageFile(path string, data []byte, mode os.FileMode, uid, gid int) (sf stagedFile, err error) {
+	sf.path = path
+	defer func() {
+		if err != nil {
+			sf.remove()
+		}
+	}()
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return sf, err
+	}
+	sf.tmp = f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil && (uid != -1 || gid != -1) {
+		err = f.Chown(uid, gid)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return sf, fmt.Errorf("Failed writing %s: %v", path, err)
+	}
+
+	if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+		return sf, nil
+	}
+	old, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".old*")
+	if err != nil {
+		return sf, err
+	}
+	old.Close()
+	os.Remove(old.Name())
+	if err := linkOrCopy(path, old.Name()); err != nil {
+		return sf, fmt.Errorf("Failed keeping a copy of %s: %v", path, err)
+	}
+	sf.old = old.Name()
+	return sf, nil
+}
+
+// linkOrCopy hard links src to dst, or copies it where links don't work.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil || errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// lookupOwner turns user and group names or IDs into IDs for chown, with
+// -1 for whichever is empty.
+func lookupOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		id := owner
+		if _, err := strconv.Atoi(owner); err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return uid, gid, err
+			}
+			id = u.Uid
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+	if group != "" {
+		id := group
+		if _, err := strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return uid, gid, err
+			}
+			id = g.Gid
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+	return uid, gid, nil
+}
+
+func (s *FileStore) keyFile() string {
+	return firstNonEmpty(s.KeyFile, "privkey.pem")
+}
+
+func (s *FileStore) certFile() string {
+	return firstNonEmpty(s.CertFile, "cert.pem")
+}
+
+func (s *FileStore) chainFile() string {
+	return firstNonEmpty(s.ChainFile, "chain.pem")
+}
+
+func (s *FileStore) fullChainFile() string {
+	return firstNonEmpty(s.FullChainFile, "fullchain.pem")
+}
+
+func (s *FileStore) log() *slog.Logger {
+	return newLogger(s.Logger, false)
+}
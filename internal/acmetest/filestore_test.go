@@ -0,0 +1,293 @@
+package acmetest
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	testCertStore(t, func(t *testing.T) storeFixture {
+		root := t.TempDir()
+		f := storeFixture{Store: &FileStore{Dir: filepath.Join(root, "{{.Name}}")}}
+		// Root can read anything, so there's no taking permissions away.
+		if os.Geteuid() != 0 && runtime.GOOS != "windows" {
+			f.Deny = func(name string) {
+				os.Chmod(filepath.Join(root, name), 0)
+				t.Cleanup(func() { os.Chmod(filepath.Join(root, name), 0755) })
+			}
+		}
+		return f
+	})
+}
+
+func TestFileStoreLayout(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	root := t.TempDir()
+	store := &FileStore{
+		Dir:          filepath.Join(root, "{{.Name}}"),
+		KeyFile:      "site.key",
+		CombinedFile: "haproxy.pem",
+		KeyMode:      0640,
+		Owner:        strconv.Itoa(os.Getuid()),
+		Group:        strconv.Itoa(os.Getgid()),
+		Keep:         2,
+	}
+
+	var bundles []CertBundle
+	for i := 0; i < 4; i++ {
+		b := ca.bundle(t, "ssl_example.org", "example.org")
+		if err := store.Store(ctx, b); err != nil {
+			t.Fatalf("store should not have error'd, but it did: %v", err)
+		}
+		bundles = append(bundles, b)
+	}
+
+	dir := filepath.Join(root, "ssl_example.org")
+	want := map[string]struct {
+		data []byte
+		mode os.FileMode
+	}{
+		"site.key":      {bundles[3].KeyPEM, 0640},
+		"cert.pem":      {bundles[3].CertPEM, 0644},
+		"chain.pem":     {bundles[3].ChainPEM, 0644},
+		"fullchain.pem": {bundles[3].FullChainPEM(), 0644},
+		"haproxy.pem":   {append(append([]byte{}, bundles[3].KeyPEM...), bundles[3].FullChainPEM()...), 0640},
+	}
+	for name, w := range want {
+		path := filepath.Join(dir, name)
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(w.data) {
+			t.Errorf("%s doesn't have what was stored", name)
+		}
+		if runtime.GOOS == "windows" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != w.mode {
+			t.Errorf("expected %s to be %o, got %o", name, w.mode, fi.Mode().Perm())
+		}
+	}
+
+	// Nothing should be left over from writing through temporary files.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+
+	// Three writes replaced something, but only two are kept.
+	versions, err := archiveVersions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0] != 2 || versions[1] != 3 {
+		t.Errorf("expected archive versions [2 3], got %v", versions)
+	}
+	old, err := os.ReadFile(filepath.Join(dir, "archive", "2", "site.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(old) != string(bundles[1].KeyPEM) {
+		t.Errorf("expected archive/2 to have the second key")
+	}
+}
+
+func TestFileStoreRollback(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	root := t.TempDir()
+	store := &FileStore{Dir: filepath.Join(root, "{{.Name}}")}
+	dir := filepath.Join(root, "ssl_example.org")
+
+	// failSecond makes the second rename of the next Store fail, after
+	// the key has already been renamed into place.
+	failSecond := func() {
+		renames := 0
+		renameFile = func(from, to string) error {
+			renames++
+			if renames == 2 {
+				return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EIO}
+			}
+			return os.Rename(from, to)
+		}
+	}
+	t.Cleanup(func() { renameFile = os.Rename })
+
+	// With nothing there before, nothing is left.
+	failSecond()
+	if err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org")); err == nil {
+		t.Fatal("store with a failing rename should have error'd")
+	}
+	if _, err := store.Load(ctx, "ssl_example.org"); err != ErrCertNotFound {
+		t.Errorf("expected ErrCertNotFound after a failed first store, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "privkey.pem")); !os.IsNotExist(err) {
+		t.Errorf("expected the key to be removed again, got %v", err)
+	}
+
+	renameFile = os.Rename
+	first := ca.bundle(t, "ssl_example.org", "example.org")
+	if err := store.Store(ctx, first); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+
+	// Otherwise the previous certificate is left whole, key and all.
+	failSecond()
+	if err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org")); err == nil {
+		t.Fatal("store with a failing rename should have error'd")
+	}
+	got, err := store.Load(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, got, first)
+	fullchain, err := os.ReadFile(filepath.Join(dir, "fullchain.pem"))
+	if err != nil || string(fullchain) != string(first.FullChainPEM()) {
+		t.Errorf("expected the previous fullchain.pem, got %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+func TestFileStoreFailedStoreKeepsArchive(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	root := t.TempDir()
+	store := &FileStore{Dir: filepath.Join(root, "{{.Name}}"), Keep: 1}
+	t.Cleanup(func() { renameFile = os.Rename })
+
+	first := ca.bundle(t, "ssl_example.org", "example.org")
+	second := ca.bundle(t, "ssl_example.org", "example.org")
+	for _, b := range []CertBundle{first, second} {
+		if err := store.Store(ctx, b); err != nil {
+			t.Fatalf("store should not have error'd, but it did: %v", err)
+		}
+	}
+
+	renameFile = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EIO}
+	}
+	if err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org")); err == nil {
+		t.Fatal("store with a failing rename should have error'd")
+	}
+	renameFile = os.Rename
+
+	// The failed write neither archived the current certificate nor
+	// pushed the real previous one out.
+	prev, err := store.LoadPrevious(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load previous should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, prev, first)
+	versions, err := archiveVersions(filepath.Join(root, "ssl_example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0] != 1 {
+		t.Errorf("expected archive versions [1], got %v", versions)
+	}
+	got, err := store.Load(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, got, second)
+}
+
+func TestFileStoreBadNames(t *testing.T) {
+	store := &FileStore{Dir: filepath.Join(t.TempDir(), "{{.Name}}")}
+	for _, name := range []string{"", "..", "../etc", "a/b"} {
+		if err := store.Store(context.Background(), CertBundle{Name: name}); err == nil {
+			t.Errorf("test %q should have error'd", name)
+		}
+	}
+}
+
+func TestFileStorePostDeploy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks need sh and signals")
+	}
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	root := t.TempDir()
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
+	pidFile := filepath.Join(root, "server.pid")
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(root, "hook.out")
+	store := &FileStore{
+		Dir: filepath.Join(root, "{{.Name}}"),
+		PostDeploy: []DeployHook{
+			{Command: `echo "$ACMETEST_CERT_NAME $ACMETEST_CERT_DOMAINS" > ` + out},
+			{PIDFile: pidFile},
+		},
+	}
+	if err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org", "www.example.org")); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(got)) != "ssl_example.org example.org,www.example.org" {
+		t.Errorf("expected the hook to see the certificate, got %q", got)
+	}
+	select {
+	case <-hups:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected a SIGHUP from the pid file hook")
+	}
+
+	// A failing hook is reported, but the certificate is still stored
+	// and the hooks after it still run.
+	store.PostDeploy = []DeployHook{
+		{Command: "echo nope >&2; exit 3"},
+		{Command: "touch " + filepath.Join(root, "second")},
+		{PIDFile: filepath.Join(root, "missing.pid")},
+	}
+	b := ca.bundle(t, "ssl_example.org", "example.org")
+	err = store.Store(ctx, b)
+	if err == nil || !strings.Contains(err.Error(), "nope") || !strings.Contains(err.Error(), "missing.pid") {
+		t.Errorf("expected both hook failures to be reported, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "second")); err != nil {
+		t.Errorf("expected the hook after the failing one to run: %v", err)
+	}
+	loaded, err := store.Load(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, loaded, b)
+}
@@ -0,0 +1,174 @@
+package acmetest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// http01Path is where the CA looks for the key authorization.
+const http01Path = "/.well-known/acme-challenge/"
+
+// HTTP01Solver answers http-01 challenges, for both dns and ip
+// identifiers.   With Webroot set it writes the key authorizations under
+// <Webroot>/.well-known/acme-challenge/ for a web server that's already
+// running to serve.   Otherwise it serves them itself on Addr (":80" if
+// empty) for as long as there are challenges outstanding.
+type HTTP01Solver struct {
+	Addr    string
+	Webroot string
+
+	mu       sync.Mutex
+	tokens   map[string]string
+	listener net.Listener
+	server   *http.Server
+}
+
+// ChallengeType returns http-01.
+func (s *HTTP01Solver) ChallengeType() string {
+	return ChallengeHTTP01
+}
+
+// Present makes every key authorization available over HTTP.
+func (s *HTTP01Solver) Present(ctx context.Context, challenges []PendingChallenge) error {
+	if s.Webroot != "" {
+		err := checkTokens(challenges)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(s.Webroot, filepath.FromSlash(http01Path))
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+		for _, ch := range challenges {
+			err = os.WriteFile(filepath.Join(dir, ch.Challenge.Token), []byte(ch.KeyAuth), 0644)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tokens == nil {
+		s.tokens = make(map[string]string)
+	}
+	for _, ch := range challenges {
+		s.tokens[ch.Challenge.Token] = ch.KeyAuth
+	}
+
+	if s.listener != nil {
+		return nil
+	}
+
+	addr := s.Addr
+	if addr == "" {
+		addr = ":80"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	s.server = &http.Server{Handler: http.HandlerFunc(s.serveHTTP)}
+	go s.server.Serve(l)
+
+	return nil
+}
+
+// CleanUp removes the key authorizations, and stops serving once there
+// are none left.
+func (s *HTTP01Solver) CleanUp(ctx context.Context, challenges []PendingChallenge) error {
+	if s.Webroot != "" {
+		if err := checkTokens(challenges); err != nil {
+			return err
+		}
+		dir := filepath.Join(s.Webroot, filepath.FromSlash(http01Path))
+		var firstErr error
+		for _, ch := range challenges {
+			err := os.Remove(filepath.Join(dir, ch.Challenge.Token))
+			if err != nil && !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ch := range challenges {
+		delete(s.tokens, ch.Challenge.Token)
+	}
+	if len(s.tokens) > 0 || s.server == nil {
+		return nil
+	}
+
+	err := s.server.Shutdown(ctx)
+	s.server = nil
+	s.listener = nil
+	return err
+}
+
+// checkTokens makes sure every token is base64url (RFC 8555 section 8.1)
+// before any of them is used as a file name, since they come from the
+// CA and something like "../" would write outside the webroot.
+func checkTokens(challenges []PendingChallenge) error {
+	for _, ch := range challenges {
+		if !validToken(ch.Challenge.Token) {
+			return fmt.Errorf("Bad http-01 token %q for %s", ch.Challenge.Token, ch.Identifier.Value)
+		}
+	}
+	return nil
+}
+
+func validToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, c := range token {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ListenAddr returns the address the solver is serving on, or nil if it
+// isn't.   Handy when Addr asks for port 0.
+func (s *HTTP01Solver) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *HTTP01Solver) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !strings.HasPrefix(r.URL.Path, http01Path) {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	keyAuth, ok := s.tokens[strings.TrimPrefix(r.URL.Path, http01Path)]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write([]byte(keyAuth))
+}
@@ -0,0 +1,122 @@
+package acmetest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTP01Solver(t *testing.T) {
+	ctx := context.Background()
+	s := &HTTP01Solver{Addr: "127.0.0.1:0"}
+	ch := PendingChallenge{
+		Identifier: NewIdentifier("192.0.2.1"),
+		Challenge:  Challenge{Type: ChallengeHTTP01, Token: "tok"},
+		KeyAuth:    "tok.thumb",
+	}
+
+	err := s.Present(ctx, []PendingChallenge{ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + s.ListenAddr().String() + http01Path
+
+	res, err := http.Get(base + "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "tok.thumb" {
+		t.Errorf("expected 200 with the key authorization, got %d %q", res.StatusCode, body)
+	}
+
+	res, err = http.Get(base + "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown token, got %d", res.StatusCode)
+	}
+
+	err = s.CleanUp(ctx, []PendingChallenge{ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ListenAddr() != nil {
+		t.Error("expected the server to stop once cleaned up")
+	}
+}
+
+func TestHTTP01SolverWebroot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := &HTTP01Solver{Webroot: dir}
+	ch := PendingChallenge{
+		Identifier: NewIdentifier("example.org"),
+		Challenge:  Challenge{Type: ChallengeHTTP01, Token: "tok"},
+		KeyAuth:    "tok.thumb",
+	}
+
+	err := s.Present(ctx, []PendingChallenge{ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, ".well-known", "acme-challenge", "tok")
+	b, err := ioutil.ReadFile(path)
+	if err != nil || string(b) != "tok.thumb" {
+		t.Errorf("expected the key authorization in %s, got %q (%v)", path, b, err)
+	}
+
+	err = s.CleanUp(ctx, []PendingChallenge{ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", path, err)
+	}
+}
+
+func TestHTTP01SolverWebrootBadToken(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	dir := filepath.Join(base, "www")
+	s := &HTTP01Solver{Webroot: dir}
+	good := PendingChallenge{
+		Identifier: NewIdentifier("example.org"),
+		Challenge:  Challenge{Type: ChallengeHTTP01, Token: "tok"},
+		KeyAuth:    "tok.thumb",
+	}
+	bad := PendingChallenge{
+		Identifier: NewIdentifier("example.net"),
+		Challenge:  Challenge{Type: ChallengeHTTP01, Token: "../../../evil"},
+		KeyAuth:    "evil.thumb",
+	}
+
+	err := s.Present(ctx, []PendingChallenge{good, bad})
+	if err == nil {
+		t.Fatal("present with a ../ token should have error'd")
+	}
+	if _, err := os.Stat(filepath.Join(base, "evil")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written outside the webroot, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".well-known", "acme-challenge", "tok")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written at all, got %v", err)
+	}
+
+	// CleanUp won't remove files outside the webroot either.
+	victim := filepath.Join(base, "evil")
+	if err := os.WriteFile(victim, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanUp(ctx, []PendingChallenge{bad}); err == nil {
+		t.Error("clean up with a ../ token should have error'd")
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Errorf("expected %s to be left alone, got %v", victim, err)
+	}
+}
@@ -0,0 +1,110 @@
+package acmetest
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Identifier types.   IP identifiers are from RFC8738.
+const (
+	IdentifierDNS = "dns"
+	IdentifierIP  = "ip"
+)
+
+// Challenge types.
+const (
+	ChallengeDNS01     = "dns-01"
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// NewIdentifier makes the identifier for a name on a certificate: an ip
+// identifier if it's an IP address, otherwise a dns one.
+func NewIdentifier(name string) CertIdentifier {
+	if ip := net.ParseIP(name); ip != nil {
+		return CertIdentifier{IdentifierIP, ip.String()}
+	}
+	return CertIdentifier{IdentifierDNS, name}
+}
+
+// NewIdentifiers is NewIdentifier for every name.
+func NewIdentifiers(names []string) []CertIdentifier {
+	identifiers := make([]CertIdentifier, 0, len(names))
+	for _, name := range names {
+		identifiers = append(identifiers, NewIdentifier(name))
+	}
+	return identifiers
+}
+
+// CheckChallengeType returns an error if a challenge type can't be used
+// for an identifier: dns-01 can't prove control of an IP address, and
+// wildcards can only be validated with dns-01.
+func CheckChallengeType(identifier CertIdentifier, challengeType string) error {
+	switch identifier.Type {
+	case IdentifierIP:
+		if challengeType == ChallengeDNS01 {
+			return fmt.Errorf("%s is an IP address and can't be validated with %s", identifier.Value, challengeType)
+		}
+	case IdentifierDNS:
+		if strings.HasPrefix(identifier.Value, "*.") && challengeType != ChallengeDNS01 {
+			return fmt.Errorf("%s is a wildcard and can only be validated with %s", identifier.Value, ChallengeDNS01)
+		}
+	default:
+		return fmt.Errorf("Unsupported identifier type %q for %s", identifier.Type, identifier.Value)
+	}
+	return nil
+}
+
+// CheckChallengeTypes is CheckChallengeType for every name.
+func CheckChallengeTypes(names []string, challengeType string) error {
+	for _, id := range NewIdentifiers(names) {
+		if err := CheckChallengeType(id, challengeType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csrTemplate puts dns identifiers in DNSNames and ip identifiers in
+// IPAddresses, as RFC8738 section 4 wants.
+func csrTemplate(identifiers []CertIdentifier) x509.CertificateRequest {
+	var tmpl x509.CertificateRequest
+	for _, id := range identifiers {
+		switch id.Type {
+		case IdentifierIP:
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(id.Value))
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, id.Value)
+		}
+	}
+	return tmpl
+}
+
+// certNames returns every name on a certificate, DNS names then IPs.
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// reverseDNSName is the in-addr.arpa or ip6.arpa name for an IP, which is
+// what the CA sends as SNI when validating an ip identifier with
+// tls-alpn-01, per RFC8738 section 6.
+func reverseDNSName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+
+	const hex = "0123456789abcdef"
+	ip = ip.To16()
+	labels := make([]string, 0, 2*len(ip)+1)
+	for i := len(ip) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[ip[i]&0x0f]), string(hex[ip[i]>>4]))
+	}
+	labels = append(labels, "ip6.arpa")
+	return strings.Join(labels, ".")
+}
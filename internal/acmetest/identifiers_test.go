@@ -0,0 +1,87 @@
+package acmetest
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNewIdentifier(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Expected CertIdentifier
+	}{
+		{"example.org", CertIdentifier{IdentifierDNS, "example.org"}},
+		{"*.example.org", CertIdentifier{IdentifierDNS, "*.example.org"}},
+		{"192.0.2.1", CertIdentifier{IdentifierIP, "192.0.2.1"}},
+		{"2001:DB8::0:1", CertIdentifier{IdentifierIP, "2001:db8::1"}},
+	}
+
+	for _, test := range tests {
+		id := NewIdentifier(test.Name)
+		if id != test.Expected {
+			t.Errorf("failed %q: expected %v, got %v", test.Name, test.Expected, id)
+		}
+	}
+}
+
+func TestCheckChallengeType(t *testing.T) {
+	tests := []struct {
+		Name          string
+		ChallengeType string
+		ShouldError   bool
+	}{
+		{"example.org", ChallengeDNS01, false},
+		{"example.org", ChallengeHTTP01, false},
+		{"example.org", ChallengeTLSALPN01, false},
+		{"*.example.org", ChallengeDNS01, false},
+		{"*.example.org", ChallengeHTTP01, true},
+		{"*.example.org", ChallengeTLSALPN01, true},
+		{"192.0.2.1", ChallengeDNS01, true},
+		{"192.0.2.1", ChallengeHTTP01, false},
+		{"2001:db8::1", ChallengeTLSALPN01, false},
+	}
+
+	for _, test := range tests {
+		err := CheckChallengeType(NewIdentifier(test.Name), test.ChallengeType)
+		if test.ShouldError && err == nil {
+			t.Errorf("test %q with %s should have error'd", test.Name, test.ChallengeType)
+		}
+		if !test.ShouldError && err != nil {
+			t.Errorf("test %q with %s should not have error'd: %v", test.Name, test.ChallengeType, err)
+		}
+	}
+
+	err := CheckChallengeType(CertIdentifier{"email", "somebody@example.org"}, ChallengeHTTP01)
+	if err == nil {
+		t.Error("test of an unknown identifier type should have error'd")
+	}
+}
+
+func TestReverseDNSName(t *testing.T) {
+	tests := []struct {
+		IP       string
+		Expected string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+
+	for _, test := range tests {
+		name := reverseDNSName(net.ParseIP(test.IP))
+		if name != test.Expected {
+			t.Errorf("failed %q: expected %q, got %q", test.IP, test.Expected, name)
+		}
+	}
+}
+
+func TestCSRTemplate(t *testing.T) {
+	tmpl := csrTemplate(NewIdentifiers([]string{"example.org", "192.0.2.1", "www.example.org", "2001:db8::1"}))
+
+	if !reflect.DeepEqual(tmpl.DNSNames, []string{"example.org", "www.example.org"}) {
+		t.Errorf("expected the DNS names in DNSNames, got %v", tmpl.DNSNames)
+	}
+	if len(tmpl.IPAddresses) != 2 || !tmpl.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")) || !tmpl.IPAddresses[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("expected the IPs in IPAddresses, got %v", tmpl.IPAddresses)
+	}
+}
@@ -0,0 +1,350 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/swerveaux/acmetest/internal/acmetesting"
+)
+
+// recordingSolver answers challenges without doing anything, as far as
+// the test CA is concerned, and remembers what it was asked to do.
+type recordingSolver struct {
+	challengeType string
+	presented     []PendingChallenge
+	cleanedUp     []PendingChallenge
+}
+
+func (s *recordingSolver) ChallengeType() string { return s.challengeType }
+
+func (s *recordingSolver) Present(ctx context.Context, challenges []PendingChallenge) error {
+	s.presented = append(s.presented, challenges...)
+	return nil
+}
+
+func (s *recordingSolver) CleanUp(ctx context.Context, challenges []PendingChallenge) error {
+	s.cleanedUp = append(s.cleanedUp, challenges...)
+	return nil
+}
+
+// newTestCA starts an acmetesting.Server and registers a Client with it.
+func newTestCA(t *testing.T) (*acmetesting.Server, *Client) {
+	t.Helper()
+	srv := acmetesting.NewServer(t)
+	return srv, testCAClient(t, srv, Config{})
+}
+
+func testCAClient(t *testing.T, srv *acmetesting.Server, cfg Config) *Client {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DirectoryURL = srv.DirectoryURL()
+	cfg.AccountKey = key
+	cfg.HTTPClient = srv.Client()
+	cfg.Contacts = []string{"mailto:ops@example.org"}
+
+	c, err := NewClientWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Backoff = Backoff{Initial: time.Millisecond, Max: time.Millisecond, Retries: 2, MaxRetryAfter: time.Second, MaxPolls: 10}
+	return &c
+}
+
+func testCertKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestIssue(t *testing.T) {
+	srv, c := newTestCA(t)
+	solver := &recordingSolver{challengeType: ChallengeDNS01}
+	domains := []string{"example.org", "*.example.org", "www.example.org"}
+
+	chain, err := c.Issue(context.Background(), domains, "", testCertKey(t), solver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(solver.presented) != 3 || len(solver.cleanedUp) != 3 {
+		t.Errorf("expected 3 challenges presented and cleaned up, got %d and %d", len(solver.presented), len(solver.cleanedUp))
+	}
+	if n := srv.Requests(acmetesting.ResourceNewOrder); n != 1 {
+		t.Errorf("expected one order, got %d", n)
+	}
+
+	_, err = chain.Leaf.Verify(x509.VerifyOptions{
+		DNSName:       "foo.example.org",
+		Roots:         srv.Roots(),
+		Intermediates: intermediatePool(chain),
+	})
+	if err != nil {
+		t.Errorf("issued certificate doesn't verify: %v", err)
+	}
+	if chain.TopIssuer() != acmetesting.RootName {
+		t.Errorf("expected the default chain to %q, got %q", acmetesting.RootName, chain.TopIssuer())
+	}
+}
+
+func TestIssueIPAddress(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Solver Solver
+		Check  func(addr string, v acmetesting.Validation) error
+	}{
+		{"http-01", &HTTP01Solver{Addr: "127.0.0.1:0"}, acmetesting.CheckHTTP01},
+		{"tls-alpn-01", &TLSALPN01Solver{Addr: "127.0.0.1:0"}, acmetesting.CheckTLSALPN01},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			srv, c := newTestCA(t)
+			srv.Validate = func(v acmetesting.Validation) error {
+				return test.Check(test.Solver.(interface{ ListenAddr() net.Addr }).ListenAddr().String(), v)
+			}
+
+			chain, err := c.Issue(context.Background(), []string{"192.0.2.10"}, "", testCertKey(t), test.Solver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chain.Leaf.IPAddresses) != 1 || chain.Leaf.IPAddresses[0].String() != "192.0.2.10" || len(chain.Leaf.DNSNames) != 0 {
+				t.Errorf("expected a certificate for just 192.0.2.10, got %v %v", chain.Leaf.DNSNames, chain.Leaf.IPAddresses)
+			}
+		})
+	}
+}
+
+func TestIssuePreferredChain(t *testing.T) {
+	_, c := newTestCA(t)
+	c.PreferredChain = acmetesting.AlternateRootName
+
+	chain, err := c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), &recordingSolver{challengeType: ChallengeHTTP01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain.TopIssuer() != acmetesting.AlternateRootName {
+		t.Errorf("expected the alternate chain, got one to %q", chain.TopIssuer())
+	}
+}
+
+func TestIssueAlternateChainFails(t *testing.T) {
+	// Only the first certificate download gets through.
+	brokenAlternates := acmetesting.InternalError(acmetesting.ResourceCertificate, acmetesting.Forever)
+	brokenAlternates.After = 1
+
+	// Without a preferred chain the alternates aren't fetched at all.
+	srv, c := newTestCA(t)
+	srv.Inject(brokenAlternates)
+	_, err := c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), &recordingSolver{challengeType: ChallengeHTTP01})
+	if err != nil {
+		t.Fatalf("issue should not have error'd, but it did: %v", err)
+	}
+	if n := srv.Requests(acmetesting.ResourceCertificate); n != 1 {
+		t.Errorf("expected only the default chain to be downloaded, got %d downloads", n)
+	}
+
+	// With one, a broken alternate falls back to the default chain.
+	srv, c = newTestCA(t)
+	srv.Inject(brokenAlternates)
+	c.PreferredChain = acmetesting.AlternateRootName
+	chain, err := c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), &recordingSolver{challengeType: ChallengeHTTP01})
+	if err != nil {
+		t.Fatalf("issue should not have error'd, but it did: %v", err)
+	}
+	if chain.TopIssuer() == acmetesting.AlternateRootName {
+		t.Errorf("expected the default chain when the alternate couldn't be downloaded")
+	}
+}
+
+func TestIssueReusesAuthorizations(t *testing.T) {
+	srv, c := newTestCA(t)
+	solver := &recordingSolver{challengeType: ChallengeDNS01}
+
+	for i := 0; i < 2; i++ {
+		_, err := c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), solver)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(solver.presented) != 1 {
+		t.Errorf("expected the second order to reuse the authorization, presented %d challenges", len(solver.presented))
+	}
+	if n := srv.Requests(acmetesting.ResourceChallenge); n != 1 {
+		t.Errorf("expected one challenge to be answered, got %d", n)
+	}
+}
+
+func TestIssueFailedChallenge(t *testing.T) {
+	srv, c := newTestCA(t)
+	srv.Validate = func(v acmetesting.Validation) error {
+		if v.Identifier.Value == "bad.example.org" {
+			return &acmetesting.Problem{Type: acmetesting.ProblemDNS, Detail: "NXDOMAIN looking up TXT"}
+		}
+		return nil
+	}
+	solver := &recordingSolver{challengeType: ChallengeDNS01}
+
+	_, err := c.Issue(context.Background(), []string{"example.org", "bad.example.org"}, "", testCertKey(t), solver)
+	var authzErr *AuthorizationError
+	if !errors.As(err, &authzErr) {
+		t.Fatalf("expected an AuthorizationError, got %v", err)
+	}
+	if authzErr.Identifier.Value != "bad.example.org" || authzErr.Status != StatusInvalid {
+		t.Errorf("expected bad.example.org to be invalid, got %s %q", authzErr.Identifier.Value, authzErr.Status)
+	}
+	if authzErr.Problem == nil || authzErr.Problem.Type != acmetesting.ProblemDNS {
+		t.Errorf("expected the challenge's dns problem, got %+v", authzErr.Problem)
+	}
+	if len(solver.cleanedUp) != 2 {
+		t.Errorf("expected both challenges cleaned up after failing, got %d", len(solver.cleanedUp))
+	}
+}
+
+func TestIssueProfile(t *testing.T) {
+	srv := acmetesting.NewServer(t)
+	srv.Profiles = map[string]string{"shortlived": "6 day certificates"}
+	srv.CertificateLifetime = 6 * 24 * time.Hour
+	c := testCAClient(t, srv, Config{})
+
+	chain, err := c.Issue(context.Background(), []string{"example.org"}, "shortlived", testCertKey(t), &recordingSolver{challengeType: ChallengeDNS01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := chain.Leaf.NotAfter.Sub(chain.Leaf.NotBefore); lifetime > 7*24*time.Hour {
+		t.Errorf("expected a short lived certificate, got one good for %s", lifetime)
+	}
+
+	_, err = c.Issue(context.Background(), []string{"example.org"}, "classic", testCertKey(t), &recordingSolver{challengeType: ChallengeDNS01})
+	if err == nil {
+		t.Errorf("test of a profile the CA doesn't offer should have error'd")
+	}
+}
+
+func TestPreAuthorizeAndDeactivate(t *testing.T) {
+	srv, c := newTestCA(t)
+	solver := &recordingSolver{challengeType: ChallengeDNS01}
+
+	authz, err := c.PreAuthorize(context.Background(), CertIdentifier{IdentifierDNS, "example.org"}, solver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authz.Status != StatusValid {
+		t.Errorf("expected a valid authorization, got %q", authz.Status)
+	}
+
+	_, err = c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), solver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(solver.presented) != 1 {
+		t.Errorf("expected the order to use the pre-authorization, presented %d challenges", len(solver.presented))
+	}
+
+	authz, err = c.DeactivateAuthorization(context.Background(), authz.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authz.Status != StatusDeactivated {
+		t.Errorf("expected the authorization to be deactivated, got %q", authz.Status)
+	}
+
+	_, err = c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), solver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(solver.presented) != 2 {
+		t.Errorf("expected a fresh challenge after deactivating, presented %d challenges", len(solver.presented))
+	}
+	if n := srv.Requests(acmetesting.ResourceNewAuthz); n != 1 {
+		t.Errorf("expected one newAuthz request, got %d", n)
+	}
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	srv, c := newTestCA(t)
+	chain, err := c.Issue(context.Background(), []string{"example.org"}, "", testCertKey(t), &recordingSolver{challengeType: ChallengeDNS01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.RevokeCertificate(context.Background(), chain.Leaf, ReasonSuperseded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason, ok := srv.Revoked(chain.Leaf); !ok || reason != ReasonSuperseded {
+		t.Errorf("expected the certificate to be revoked as superseded, got %v %d", ok, reason)
+	}
+
+	err = c.RevokeCertificate(context.Background(), chain.Leaf, ReasonSuperseded)
+	var p *Problem
+	if !errors.As(err, &p) || p.Type != acmetesting.ProblemAlreadyRevoked {
+		t.Errorf("expected alreadyRevoked revoking twice, got %v", err)
+	}
+
+	other := testCAClient(t, srv, Config{})
+	err = other.RevokeCertificate(context.Background(), chain.Leaf, ReasonUnspecified)
+	if err == nil {
+		t.Errorf("test of revoking another account's certificate should have error'd")
+	}
+}
+
+func TestNewAccountExternalBinding(t *testing.T) {
+	srv := acmetesting.NewServer(t)
+	srv.ExternalAccountKeys = map[string][]byte{"kid-1": []byte("0123456789abcdef0123456789abcdef")}
+	macKey := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY"
+
+	c := testCAClient(t, srv, Config{EAB: ExternalAccountBinding{KeyID: "kid-1", HMACKey: macKey}})
+	if c.KID == "" {
+		t.Errorf("expected an account URL")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Name string
+		EAB  ExternalAccountBinding
+		Err  error
+	}{
+		{"missing", ExternalAccountBinding{}, ErrExternalAccountRequired},
+		{"wrong key", ExternalAccountBinding{KeyID: "kid-1", HMACKey: "d3Jvbmcga2V5"}, nil},
+		{"unknown kid", ExternalAccountBinding{KeyID: "kid-2", HMACKey: macKey}, nil},
+	}
+	for _, test := range tests {
+		_, err := NewClientWithConfig(Config{
+			DirectoryURL: srv.DirectoryURL(),
+			AccountKey:   key,
+			HTTPClient:   srv.Client(),
+			EAB:          test.EAB,
+		})
+		if err == nil {
+			t.Errorf("test %q should have error'd", test.Name)
+		}
+		if test.Err != nil && !errors.Is(err, test.Err) {
+			t.Errorf("test %q expected %v, got %v", test.Name, test.Err, err)
+		}
+	}
+}
+
+func intermediatePool(chain CertChain) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range chain.Intermediates {
+		pool.AddCert(cert)
+	}
+	return pool
+}
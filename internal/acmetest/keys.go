@@ -0,0 +1,103 @@
+package acmetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Key types for certificate keys.
+const (
+	KeyTypeRSA2048 = "rsa2048"
+	KeyTypeRSA4096 = "rsa4096"
+	KeyTypeEC256   = "ec256"
+	KeyTypeEC384   = "ec384"
+)
+
+// DefaultKeyType is what certificates get if nobody asks for anything else.
+const DefaultKeyType = KeyTypeRSA2048
+
+// GenerateKey makes a new certificate key of the given type.
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA2048, "":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeEC256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEC384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("Unknown key type %q", keyType)
+}
+
+// EncodeKeyPEM PEM encodes a certificate key the way most servers expect
+// to find it: PKCS1 for RSA and SEC1 for ECDSA.
+func EncodeKeyPEM(key crypto.Signer) ([]byte, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}), nil
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: b,
+		}), nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %T", key)
+}
+
+// LoadAccountKey reads a PEM encoded ECDSA account key from path.   If
+// there's nothing there yet it generates a P-256 key and saves it, so
+// the same ACME account gets used from one run to the next.
+func LoadAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := EncodeKeyPEM(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, ioutil.WriteFile(path, keyPEM, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", path)
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if ecKey, ok := key.(*ecdsa.PrivateKey); ok {
+			return ecKey, nil
+		}
+		return nil, fmt.Errorf("Account key in %s is a %T, not ECDSA", path, key)
+	}
+	return nil, fmt.Errorf("Unexpected %q in %s", block.Type, path)
+}
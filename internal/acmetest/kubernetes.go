@@ -0,0 +1,223 @@
+package acmetest
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Labels and annotations KubernetesStore puts on its Secrets.
+const (
+	KubernetesManagedByLabel = "app.kubernetes.io/managed-by"
+	KubernetesManagedBy      = "acmetest"
+
+	KubernetesNameAnnotation     = "acmetest/name"
+	KubernetesDomainsAnnotation  = "acmetest/domains"
+	KubernetesIssuerAnnotation   = "acmetest/issuer"
+	KubernetesNotAfterAnnotation = "acmetest/not-after"
+	KubernetesSerialAnnotation   = "acmetest/serial"
+)
+
+// kubernetesCAKey is where the intermediates go in a TLS Secret.
+const kubernetesCAKey = "ca.crt"
+
+// KubernetesStore keeps certificates as kubernetes.io/tls Secrets, with
+// the full chain in tls.crt, the key in tls.key and the intermediates in
+// ca.crt, so Ingress controllers and anything else that mounts TLS
+// Secrets can use them as is.
+//
+// Stored names are turned into Secret names by lowercasing them and
+// replacing anything Kubernetes won't take, like the _ in ssl_example.org,
+// with -, as KubernetesSecretName does.   The original name is kept in an
+// annotation alongside the domains, issuer, expiry and serial, and since
+// two names can end up as the same Secret, a Secret holding a different
+// name is neither overwritten nor loaded.   A Secret that exists but
+// wasn't written by KubernetesStore is left alone rather than taken over.
+type KubernetesStore struct {
+	Client    kubernetes.Interface
+	Namespace string
+
+	// Labels and Annotations are put on every Secret, on top of the
+	// bundle's tags, which become labels and so have to be valid label
+	// keys and values.
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// secretNameInvalid is everything that can't go in a Secret's name.
+var secretNameInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// KubernetesSecretName is the Secret a certificate stored under name
+// goes in.   Each dot separated part has to start and end with a letter
+// or digit, so a wildcard's ssl__.example.org becomes ssl.example.org.
+func KubernetesSecretName(name string) string {
+	var labels []string
+	for _, label := range strings.Split(strings.ToLower(name), ".") {
+		label = strings.Trim(secretNameInvalid.ReplaceAllString(label, "-"), "-")
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	s := strings.Join(labels, ".")
+	if len(s) > 253 {
+		s = strings.TrimRight(s[:253], "-.")
+	}
+	return s
+}
+
+// Store creates or updates the Secret for the bundle.   If the Secret
+// already has exactly what would be written, it isn't touched.
+func (s *KubernetesStore) Store(ctx context.Context, bundle CertBundle) error {
+	want, err := s.secret(bundle)
+	if err != nil {
+		return err
+	}
+	secrets := s.Client.CoreV1().Secrets(s.namespace())
+
+	// Conflicts mean someone else wrote the Secret between our get and
+	// our write, and AlreadyExists that they created it first, so in
+	// both cases start over from what's there now.
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		existing, err := secrets.Get(ctx, want.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = secrets.Create(ctx, want, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if existing.Labels[KubernetesManagedByLabel] != KubernetesManagedBy {
+			return fmt.Errorf("Secret %s/%s exists and isn't managed by %s", existing.Namespace, existing.Name, KubernetesManagedBy)
+		}
+		if existing.Type != corev1.SecretTypeTLS {
+			return fmt.Errorf("Secret %s/%s is %s, not %s", existing.Namespace, existing.Name, existing.Type, corev1.SecretTypeTLS)
+		}
+		if stored := existing.Annotations[KubernetesNameAnnotation]; stored != bundle.Name {
+			return fmt.Errorf("Secret %s/%s holds %q, not %q", existing.Namespace, existing.Name, stored, bundle.Name)
+		}
+
+		updated := existing.DeepCopy()
+		if updated.Labels == nil {
+			updated.Labels = make(map[string]string)
+		}
+		if updated.Annotations == nil {
+			updated.Annotations = make(map[string]string)
+		}
+		maps.Copy(updated.Labels, want.Labels)
+		maps.Copy(updated.Annotations, want.Annotations)
+		updated.Data = want.Data
+
+		if maps.Equal(updated.Labels, existing.Labels) && maps.Equal(updated.Annotations, existing.Annotations) && sameData(updated.Data, existing.Data) {
+			return nil
+		}
+		_, err = secrets.Update(ctx, updated, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Load reads back the certificate in the Secret for name.
+func (s *KubernetesStore) Load(ctx context.Context, name string) (CertBundle, error) {
+	bundle := CertBundle{Name: name}
+
+	secret, err := s.Client.CoreV1().Secrets(s.namespace()).Get(ctx, KubernetesSecretName(name), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return bundle, ErrCertNotFound
+	}
+	if err != nil {
+		return bundle, err
+	}
+	// Another name that comes out as the same Secret isn't this one.
+	if secret.Annotations[KubernetesNameAnnotation] != name {
+		return bundle, ErrCertNotFound
+	}
+
+	chain, err := ParseChain(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return bundle, fmt.Errorf("Failed parsing %s in Secret %s/%s: %v", corev1.TLSCertKey, secret.Namespace, secret.Name, err)
+	}
+
+	bundle.Domains = certNames(chain.Leaf)
+	bundle.KeyPEM = secret.Data[corev1.TLSPrivateKeyKey]
+	bundle.CertPEM = chain.LeafPEM()
+	bundle.ChainPEM = chain.ChainPEM()
+
+	return bundle, nil
+}
+
+// secret builds the Secret a bundle should be stored as.
+func (s *KubernetesStore) secret(bundle CertBundle) (*corev1.Secret, error) {
+	leaf, err := bundle.Certificate()
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing certificate for %s: %v", bundle.Name, err)
+	}
+	name := KubernetesSecretName(bundle.Name)
+	if name == "" {
+		return nil, fmt.Errorf("Can't make a Secret name out of %q", bundle.Name)
+	}
+
+	labels := make(map[string]string)
+	maps.Copy(labels, bundle.Tags)
+	maps.Copy(labels, s.Labels)
+	for k, v := range labels {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return nil, fmt.Errorf("Tag %q on %s can't be a label: %s", k, bundle.Name, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			return nil, fmt.Errorf("Tag %s=%q on %s can't be a label: %s", k, v, bundle.Name, strings.Join(errs, "; "))
+		}
+	}
+	labels[KubernetesManagedByLabel] = KubernetesManagedBy
+
+	annotations := make(map[string]string)
+	maps.Copy(annotations, s.Annotations)
+	annotations[KubernetesNameAnnotation] = bundle.Name
+	annotations[KubernetesDomainsAnnotation] = strings.Join(bundle.Domains, ",")
+	annotations[KubernetesIssuerAnnotation] = leaf.Issuer.CommonName
+	annotations[KubernetesNotAfterAnnotation] = leaf.NotAfter.UTC().Format(time.RFC3339)
+	annotations[KubernetesSerialAnnotation] = leaf.SerialNumber.Text(16)
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   s.namespace(),
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       bundle.FullChainPEM(),
+			corev1.TLSPrivateKeyKey: bundle.KeyPEM,
+			kubernetesCAKey:         bundle.ChainPEM,
+		},
+	}, nil
+}
+
+func (s *KubernetesStore) namespace() string {
+	return firstNonEmpty(s.Namespace, metav1.NamespaceDefault)
+}
+
+// sameData reports whether two Secrets hold the same data.
+func sameData(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || string(v) != string(w) {
+			return false
+		}
+	}
+	return true
+}
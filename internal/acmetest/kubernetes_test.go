@@ -0,0 +1,234 @@
+package acmetest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// denySecrets makes the fake clientset refuse every request for the
+// Secrets named in denied, like missing RBAC would.
+func denySecrets(client *fake.Clientset) func(name string) {
+	var mu sync.Mutex
+	denied := make(map[string]bool)
+
+	client.PrependReactor("*", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		var name string
+		switch a := action.(type) {
+		case k8stesting.GetAction:
+			name = a.GetName()
+		case k8stesting.CreateAction:
+			name = a.GetObject().(*corev1.Secret).Name
+		case k8stesting.UpdateAction:
+			name = a.GetObject().(*corev1.Secret).Name
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if denied[name] {
+			return true, nil, apierrors.NewForbidden(corev1.Resource("secrets"), name, nil)
+		}
+		return false, nil, nil
+	})
+
+	return func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		denied[KubernetesSecretName(name)] = true
+	}
+}
+
+func TestKubernetesStore(t *testing.T) {
+	testCertStore(t, func(t *testing.T) storeFixture {
+		client := fake.NewSimpleClientset()
+		return storeFixture{
+			Store: &KubernetesStore{Client: client, Namespace: "web"},
+			Deny:  denySecrets(client),
+		}
+	})
+}
+
+func TestKubernetesStoreSecret(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	client := fake.NewSimpleClientset()
+	store := &KubernetesStore{
+		Client:      client,
+		Namespace:   "web",
+		Labels:      map[string]string{"team": "infra"},
+		Annotations: map[string]string{"owner": "ops@example.com"},
+	}
+
+	b := ca.bundle(t, "ssl_*.Example.org", "*.example.org", "example.org")
+	b.Tags = map[string]string{"env": "prod"}
+	if err := store.Store(ctx, b); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+
+	secret, err := client.CoreV1().Secrets("web").Get(ctx, "ssl.example.org", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected a Secret called ssl.example.org: %v", err)
+	}
+	if secret.Type != corev1.SecretTypeTLS {
+		t.Errorf("expected a %s Secret, got %s", corev1.SecretTypeTLS, secret.Type)
+	}
+	if string(secret.Data["tls.crt"]) != string(b.FullChainPEM()) || string(secret.Data["tls.key"]) != string(b.KeyPEM) || string(secret.Data["ca.crt"]) != string(b.ChainPEM) {
+		t.Errorf("expected tls.crt, tls.key and ca.crt to hold the chain, key and intermediates")
+	}
+
+	leaf, err := b.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		KubernetesManagedByLabel: KubernetesManagedBy,
+		"team":                   "infra",
+		"env":                    "prod",
+	} {
+		if secret.Labels[k] != v {
+			t.Errorf("expected label %s=%s, got %q", k, v, secret.Labels[k])
+		}
+	}
+	for k, v := range map[string]string{
+		KubernetesNameAnnotation:     "ssl_*.Example.org",
+		KubernetesDomainsAnnotation:  "*.example.org,example.org",
+		KubernetesIssuerAnnotation:   "store test CA",
+		KubernetesNotAfterAnnotation: leaf.NotAfter.UTC().Format(time.RFC3339),
+		KubernetesSerialAnnotation:   leaf.SerialNumber.Text(16),
+		"owner":                      "ops@example.com",
+	} {
+		if secret.Annotations[k] != v {
+			t.Errorf("expected annotation %s=%s, got %q", k, v, secret.Annotations[k])
+		}
+	}
+
+	// Storing the same thing again doesn't write anything.
+	client.ClearActions()
+	if err := store.Store(ctx, b); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	for _, a := range client.Actions() {
+		if a.GetVerb() != "get" {
+			t.Errorf("expected storing the same bundle again to only read, but it did a %s", a.GetVerb())
+		}
+	}
+
+	// Labels and annotations someone else added survive an update.
+	secret.Labels["added-by"] = "someone-else"
+	if _, err := client.CoreV1().Secrets("web").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	renewed := ca.bundle(t, "ssl_*.Example.org", "*.example.org", "example.org")
+	if err := store.Store(ctx, renewed); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	secret, err = client.CoreV1().Secrets("web").Get(ctx, "ssl.example.org", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Labels["added-by"] != "someone-else" {
+		t.Errorf("expected the update to keep other labels, got %v", secret.Labels)
+	}
+	if string(secret.Data["tls.key"]) != string(renewed.KeyPEM) {
+		t.Errorf("expected the update to write the new key")
+	}
+}
+
+func TestKubernetesStoreLeavesOtherSecretsAlone(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ssl-example.org", Namespace: "web"},
+		Type:       corev1.SecretTypeTLS,
+		Data:       map[string][]byte{"tls.crt": []byte("hand made")},
+	})
+	store := &KubernetesStore{Client: client, Namespace: "web"}
+
+	err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org"))
+	if err == nil || !strings.Contains(err.Error(), "isn't managed by") {
+		t.Errorf("expected to refuse to overwrite a Secret we didn't make, got %v", err)
+	}
+	secret, err := client.CoreV1().Secrets("web").Get(ctx, "ssl-example.org", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["tls.crt"]) != "hand made" {
+		t.Errorf("expected the Secret to be left alone")
+	}
+}
+
+func TestKubernetesStoreNameCollision(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	client := fake.NewSimpleClientset()
+	store := &KubernetesStore{Client: client, Namespace: "web"}
+
+	first := ca.bundle(t, "ssl_example.org", "example.org")
+	if err := store.Store(ctx, first); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+
+	// SSL-example.org is a different name that comes out as the same
+	// Secret, ssl-example.org.
+	err := store.Store(ctx, ca.bundle(t, "SSL-example.org", "other.example.org"))
+	if err == nil || !strings.Contains(err.Error(), "holds") {
+		t.Errorf("expected to refuse to overwrite another name's Secret, got %v", err)
+	}
+	if _, err := store.Load(ctx, "SSL-example.org"); err != ErrCertNotFound {
+		t.Errorf("expected ErrCertNotFound loading another name's Secret, got %v", err)
+	}
+	got, err := store.Load(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, got, first)
+}
+
+func TestKubernetesStoreBadTags(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	client := fake.NewSimpleClientset()
+	store := &KubernetesStore{Client: client, Namespace: "web"}
+
+	for _, tags := range []map[string]string{
+		{"env": "has spaces"},
+		{"bad key!": "prod"},
+		{"env": strings.Repeat("x", 64)},
+	} {
+		b := ca.bundle(t, "ssl_example.org", "example.org")
+		b.Tags = tags
+		if err := store.Store(ctx, b); err == nil {
+			t.Errorf("test %v should have error'd", tags)
+		}
+	}
+	if _, err := store.Load(ctx, "ssl_example.org"); err != ErrCertNotFound {
+		t.Errorf("expected nothing stored, got %v", err)
+	}
+}
+
+func TestKubernetesSecretName(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Expected string
+	}{
+		{"ssl_example.org", "ssl-example.org"},
+		{"ssl__.Example.org", "ssl.example.org"},
+		{"ssl_a b.example.org", "ssl-a-b.example.org"},
+		{"tls-www.example.org", "tls-www.example.org"},
+		{"_leading_", "leading"},
+	}
+
+	for _, test := range tests {
+		if got := KubernetesSecretName(test.Name); got != test.Expected {
+			t.Errorf("test %q: expected %q, got %q", test.Name, test.Expected, got)
+		}
+	}
+}
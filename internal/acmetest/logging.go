@@ -0,0 +1,109 @@
+package acmetest
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Log attribute keys, so the same thing is called the same thing
+// wherever it's logged.
+const (
+	logKeyDomain   = "domain"
+	logKeyOrder    = "order_url"
+	logKeyAuthz    = "authz_url"
+	logKeyURL      = "url"
+	logKeyStep     = "step"
+	logKeyStatus   = "status"
+	logKeyZone     = "zone"
+	logKeyError    = "error"
+	logKeyNonce    = "nonce"
+	logKeyJWS      = "jws"
+	logKeyKeyAuth  = "key_authorization"
+	logKeyResponse = "response"
+)
+
+// redactedKeys are the attributes whose values are secret or key
+// material.   They're replaced by redactedValue unless the Client is
+// told to log secrets.
+var redactedKeys = map[string]bool{
+	logKeyNonce:   true,
+	logKeyJWS:     true,
+	logKeyKeyAuth: true,
+	"private_key": true,
+	"hmac_key":    true,
+	"secret":      true,
+}
+
+const redactedValue = "REDACTED"
+
+// RedactingHandler wraps a slog.Handler and blanks out the values of
+// attributes that hold secrets, like nonces, signed requests and key
+// authorizations, wherever they turn up.
+type RedactingHandler struct {
+	slog.Handler
+}
+
+// NewRedactingHandler returns h wrapped in a RedactingHandler.
+func NewRedactingHandler(h slog.Handler) *RedactingHandler {
+	return &RedactingHandler{Handler: h}
+}
+
+// Handle redacts the record's attributes and passes it on.
+func (h *RedactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+// WithAttrs redacts attrs before handing them to the wrapped handler.
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &RedactingHandler{Handler: h.Handler.WithAttrs(redacted)}
+}
+
+// WithGroup keeps redacting inside the group.
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return &RedactingHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if redactedKeys[a.Key] {
+		return slog.String(a.Key, redactedValue)
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		redacted := make([]any, len(group))
+		for i, g := range group {
+			redacted[i] = redactAttr(g)
+		}
+		return slog.Group(a.Key, redacted...)
+	}
+	return a
+}
+
+// newLogger returns l, or slog's default logger if l is nil, with
+// secrets redacted unless logSecrets is set.
+func newLogger(l *slog.Logger, logSecrets bool) *slog.Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	if logSecrets {
+		return l
+	}
+	if _, ok := l.Handler().(*RedactingHandler); ok {
+		return l
+	}
+	return slog.New(NewRedactingHandler(l.Handler()))
+}
+
+// log returns the Client's logger.
+func (c *Client) log() *slog.Logger {
+	return newLogger(c.Logger, c.LogSecrets)
+}
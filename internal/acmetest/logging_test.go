@@ -0,0 +1,48 @@
+package acmetest
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewRedactingHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	logger.With(logKeyNonce, "with-nonce").Debug("sending",
+		logKeyURL, "https://ca.example/order/1",
+		logKeyJWS, "signed-request",
+		slog.Group("challenge", logKeyKeyAuth, "tok.thumb", "type", "dns-01"),
+	)
+
+	out := buf.String()
+	for _, secret := range []string{"with-nonce", "signed-request", "tok.thumb"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("expected %q to be redacted, got %s", secret, out)
+		}
+	}
+	for _, kept := range []string{"https://ca.example/order/1", "dns-01", redactedValue} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("expected %q in the log, got %s", kept, out)
+		}
+	}
+}
+
+func TestClientLogger(t *testing.T) {
+	var buf bytes.Buffer
+	c := &Client{Logger: slog.New(slog.NewTextHandler(&buf, nil))}
+
+	c.log().Info("sending", logKeyNonce, "the-nonce")
+	if strings.Contains(buf.String(), "the-nonce") {
+		t.Errorf("expected secrets redacted by default, got %s", buf.String())
+	}
+
+	buf.Reset()
+	c.LogSecrets = true
+	c.log().Info("sending", logKeyNonce, "the-nonce")
+	if !strings.Contains(buf.String(), "the-nonce") {
+		t.Errorf("expected secrets logged with LogSecrets, got %s", buf.String())
+	}
+}
@@ -0,0 +1,145 @@
+package acmetest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Defaults for anything a manifest leaves out.
+const (
+	DefaultSolver      = "route53"
+	DefaultStore       = "asm"
+	DefaultRenewBefore = 30 * 24 * time.Hour
+)
+
+// Manifest declares every certificate we want to exist.   It's YAML, but
+// since YAML is a superset of JSON a JSON manifest parses just the same.
+//
+//	defaults:
+//	  store: asm
+//	  tags: {team: infra}
+//	certificates:
+//	  - names: [example.org, www.example.org]
+//	  - names: ["*.internal.example.org"]
+//	    key_type: ec256
+//	    profile: shortlived
+//	    name_template: "internal_{{.Domain}}"
+type Manifest struct {
+	Defaults     CertSpec   `yaml:"defaults"`
+	Certificates []CertSpec `yaml:"certificates"`
+}
+
+// CertSpec is one certificate in a Manifest.   Anything left empty is
+// taken from the manifest's defaults, and tags are merged with them.
+type CertSpec struct {
+	Names        []string          `yaml:"names"`
+	KeyType      string            `yaml:"key_type"`
+	Solver       string            `yaml:"solver"`
+	Store        string            `yaml:"store"`
+	NameTemplate string            `yaml:"name_template"`
+	Profile      string            `yaml:"profile"`
+	Tags         map[string]string `yaml:"tags"`
+	RenewBefore  time.Duration     `yaml:"renew_before"`
+}
+
+// LoadManifest reads and parses a manifest file.
+func LoadManifest(path string) (Manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return ParseManifest(b)
+}
+
+// ParseManifest parses a YAML or JSON manifest.   Unknown fields are an
+// error, so a typo doesn't quietly fall back to a default.
+func ParseManifest(b []byte) (Manifest, error) {
+	var m Manifest
+	err := yaml.UnmarshalStrict(b, &m)
+	return m, err
+}
+
+// Specs returns every certificate in the manifest with the defaults
+// filled in, or an error if any of them don't make sense.
+func (m Manifest) Specs() ([]CertSpec, error) {
+	specs := make([]CertSpec, 0, len(m.Certificates))
+	seen := make(map[string]int)
+	for i, spec := range m.Certificates {
+		spec = m.withDefaults(spec)
+
+		if len(spec.Names) == 0 {
+			return nil, fmt.Errorf("Certificate %d has no names", i)
+		}
+		switch spec.KeyType {
+		case KeyTypeRSA2048, KeyTypeRSA4096, KeyTypeEC256, KeyTypeEC384:
+		default:
+			return nil, fmt.Errorf("Certificate %d (%s) has unknown key type %q", i, spec.Names[0], spec.KeyType)
+		}
+
+		name, err := spec.StoreName()
+		if err != nil {
+			return nil, fmt.Errorf("Certificate %d (%s) has a bad name template: %v", i, spec.Names[0], err)
+		}
+		key := spec.Store + "/" + name
+		if j, ok := seen[key]; ok {
+			return nil, fmt.Errorf("Certificates %d and %d would both be stored as %s in %s", j, i, name, spec.Store)
+		}
+		seen[key] = i
+
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func (m Manifest) withDefaults(spec CertSpec) CertSpec {
+	d := m.Defaults
+	if spec.KeyType == "" {
+		spec.KeyType = firstNonEmpty(d.KeyType, DefaultKeyType)
+	}
+	if spec.Solver == "" {
+		spec.Solver = firstNonEmpty(d.Solver, DefaultSolver)
+	}
+	if spec.Store == "" {
+		spec.Store = firstNonEmpty(d.Store, DefaultStore)
+	}
+	if spec.NameTemplate == "" {
+		spec.NameTemplate = firstNonEmpty(d.NameTemplate, DefaultNameTemplate)
+	}
+	if spec.Profile == "" {
+		spec.Profile = d.Profile
+	}
+	if spec.RenewBefore == 0 {
+		spec.RenewBefore = d.RenewBefore
+	}
+	if spec.RenewBefore == 0 {
+		spec.RenewBefore = DefaultRenewBefore
+	}
+
+	tags := make(map[string]string, len(d.Tags)+len(spec.Tags))
+	for k, v := range d.Tags {
+		tags[k] = v
+	}
+	for k, v := range spec.Tags {
+		tags[k] = v
+	}
+	spec.Tags = tags
+
+	return spec
+}
+
+// StoreName is what the certificate is called in its store.
+func (spec CertSpec) StoreName() (string, error) {
+	return CertName(spec.NameTemplate, spec.Names)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
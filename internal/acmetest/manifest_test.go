@@ -0,0 +1,93 @@
+package acmetest
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseManifest(t *testing.T) {
+	yamlManifest := `
+defaults:
+  store: asm
+  profile: classic
+  renew_before: 240h
+  tags: {team: infra, env: prod}
+certificates:
+  - names: [example.org, www.example.org]
+  - names: ["*.internal.example.org"]
+    key_type: ec256
+    profile: shortlived
+    name_template: "internal_{{.Domain}}"
+    tags: {env: dev}
+`
+	jsonManifest := `{"certificates": [{"names": ["example.org"], "store": "asm"}]}`
+
+	m, err := ParseManifest([]byte(yamlManifest))
+	if err != nil {
+		t.Fatalf("parsing YAML manifest should not have error'd, but it did: %v", err)
+	}
+	specs, err := m.Specs()
+	if err != nil {
+		t.Fatalf("specs should not have error'd, but it did: %v", err)
+	}
+	if len(specs) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(specs))
+	}
+
+	first, second := specs[0], specs[1]
+	if first.KeyType != DefaultKeyType || first.Solver != DefaultSolver || first.RenewBefore != 240*time.Hour {
+		t.Errorf("expected defaults filled in, got %+v", first)
+	}
+	if name, _ := first.StoreName(); name != "ssl_example.org" {
+		t.Errorf("expected default name %q, got %q", "ssl_example.org", name)
+	}
+	if name, _ := second.StoreName(); name != "internal__.internal.example.org" {
+		t.Errorf("expected templated name %q, got %q", "internal__.internal.example.org", name)
+	}
+	if first.Profile != "classic" || second.Profile != "shortlived" {
+		t.Errorf("expected profiles %q and %q, got %q and %q", "classic", "shortlived", first.Profile, second.Profile)
+	}
+	if second.KeyType != KeyTypeEC256 {
+		t.Errorf("expected key type %q, got %q", KeyTypeEC256, second.KeyType)
+	}
+	if second.Tags["team"] != "infra" || second.Tags["env"] != "dev" {
+		t.Errorf("expected tags merged over the defaults, got %v", second.Tags)
+	}
+
+	m, err = ParseManifest([]byte(jsonManifest))
+	if err != nil {
+		t.Fatalf("parsing JSON manifest should not have error'd, but it did: %v", err)
+	}
+	if len(m.Certificates) != 1 || m.Certificates[0].Names[0] != "example.org" {
+		t.Errorf("unexpected JSON manifest %+v", m)
+	}
+}
+
+func TestManifestErrors(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Manifest string
+		Expected string
+	}{
+		{"Unknown field", "certificates:\n  - names: [example.org]\n    colour: blue\n", "colour"},
+		{"No names", "certificates:\n  - key_type: rsa2048\n", "no names"},
+		{"Bad key type", "certificates:\n  - names: [example.org]\n    key_type: dsa\n", "unknown key type"},
+		{"Bad template", "certificates:\n  - names: [example.org]\n    name_template: \"{{.Nope}}\"\n", "bad name template"},
+		{"Duplicate names", "certificates:\n  - names: [example.org]\n  - names: [example.org, www.example.org]\n", "both be stored"},
+	}
+
+	for _, test := range tests {
+		m, err := ParseManifest([]byte(test.Manifest))
+		if err == nil {
+			_, err = m.Specs()
+		}
+		if err == nil {
+			t.Errorf("test %q should have error'd, but didn't.", test.Name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.Expected) {
+			t.Errorf("failed %q: expected error mentioning %q, got %v", test.Name, test.Expected, err)
+		}
+	}
+}
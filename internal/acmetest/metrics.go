@@ -0,0 +1,198 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are the Prometheus metrics for issuance, renewal and solver
+// health.   Every method is safe to call on a nil *Metrics, which is
+// what you get if you don't want metrics.
+type Metrics struct {
+	ordersCreated   prometheus.Counter
+	ordersSucceeded prometheus.Counter
+	ordersFailed    *prometheus.CounterVec
+	propagation     *prometheus.HistogramVec
+	orderDuration   prometheus.Histogram
+	dnsErrors       *prometheus.CounterVec
+	expiry          *expiryCollector
+}
+
+// NewMetrics makes the metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		ordersCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "acmetest_orders_created_total",
+			Help: "Orders placed with the CA.",
+		}),
+		ordersSucceeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "acmetest_orders_succeeded_total",
+			Help: "Orders that ended with a certificate.",
+		}),
+		ordersFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "acmetest_orders_failed_total",
+			Help: "Orders that failed, by ACME problem type.",
+		}, []string{"problem"}),
+		propagation: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "acmetest_challenge_propagation_seconds",
+			Help:    "Time from presenting challenges to their being ready for the CA to check, by challenge type.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"type"}),
+		orderDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "acmetest_order_duration_seconds",
+			Help:    "Time from placing an order to having the certificate.",
+			Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+		}),
+		dnsErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "acmetest_dns_api_errors_total",
+			Help: "Errors from the DNS provider's API, by operation.",
+		}, []string{"operation"}),
+		expiry: &expiryCollector{
+			desc: prometheus.NewDesc(
+				"acmetest_certificate_expiry_seconds",
+				"Seconds until the earliest expiring certificate covering the domain expires.",
+				[]string{"domain"}, nil,
+			),
+			certs: make(map[string]certExpiry),
+		},
+	}
+
+	for _, c := range []prometheus.Collector{m.ordersCreated, m.ordersSucceeded, m.ordersFailed, m.propagation, m.orderDuration, m.dnsErrors, m.expiry} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// OrderCreated counts a new order.
+func (m *Metrics) OrderCreated() {
+	if m == nil {
+		return
+	}
+	m.ordersCreated.Inc()
+}
+
+// OrderSucceeded counts an order that got its certificate, placed at
+// created.
+func (m *Metrics) OrderSucceeded(created time.Time) {
+	if m == nil {
+		return
+	}
+	m.ordersSucceeded.Inc()
+	m.orderDuration.Observe(time.Since(created).Seconds())
+}
+
+// OrderFailed counts a failed order by the type of problem behind err.
+func (m *Metrics) OrderFailed(err error) {
+	if m == nil {
+		return
+	}
+	m.ordersFailed.WithLabelValues(problemLabel(err)).Inc()
+}
+
+// ChallengesPresented records how long challenges of a type took to be
+// ready for the CA, propagation included.
+func (m *Metrics) ChallengesPresented(challengeType string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.propagation.WithLabelValues(challengeType).Observe(d.Seconds())
+}
+
+// DNSError counts an error from the DNS provider's API.
+func (m *Metrics) DNSError(operation string) {
+	if m == nil {
+		return
+	}
+	m.dnsErrors.WithLabelValues(operation).Inc()
+}
+
+// CertificateExpiry records when the certificate stored as name, which
+// covers domains, expires.   Each domain reports the earliest expiry of
+// the certificates covering it.
+func (m *Metrics) CertificateExpiry(name string, domains []string, notAfter time.Time) {
+	if m == nil {
+		return
+	}
+	m.expiry.set(name, domains, notAfter)
+}
+
+// problemLabel is the ACME problem type behind err for the failed
+// orders metric, or a short description for errors that aren't problems.
+func problemLabel(err error) string {
+	var p *Problem
+	var authzErr *AuthorizationError
+	switch {
+	case errors.As(err, &p):
+		return p.Type
+	case errors.As(err, &authzErr):
+		return "authorization:" + authzErr.Status
+	case errors.Is(err, ErrPollTimeout):
+		return "poll_timeout"
+	case errors.Is(err, ErrIssuanceLimit):
+		return "local_rate_limit"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return "aws:" + aerr.Code()
+	}
+	return "other"
+}
+
+type certExpiry struct {
+	domains  []string
+	notAfter time.Time
+}
+
+// expiryCollector works out seconds until expiry when it's scraped, so
+// the value doesn't go stale between runs.
+type expiryCollector struct {
+	desc *prometheus.Desc
+
+	mu    sync.Mutex
+	certs map[string]certExpiry
+	now   func() time.Time
+}
+
+func (e *expiryCollector) set(name string, domains []string, notAfter time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.certs[name] = certExpiry{domains: append([]string{}, domains...), notAfter: notAfter}
+}
+
+// Describe satisfies prometheus.Collector.
+func (e *expiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.desc
+}
+
+// Collect satisfies prometheus.Collector.
+func (e *expiryCollector) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	earliest := make(map[string]time.Time)
+	for _, cert := range e.certs {
+		for _, domain := range cert.domains {
+			if t, ok := earliest[domain]; !ok || cert.notAfter.Before(t) {
+				earliest[domain] = cert.notAfter
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	now := time.Now()
+	if e.now != nil {
+		now = e.now()
+	}
+	for domain, notAfter := range earliest {
+		ch <- prometheus.MustNewConstMetric(e.desc, prometheus.GaugeValue, notAfter.Sub(now).Seconds(), domain)
+	}
+}
@@ -0,0 +1,81 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProblemLabel(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Err      error
+		Expected string
+	}{
+		{"Problem", &Problem{Type: ProblemRateLimited}, ProblemRateLimited},
+		{"Wrapped problem", fmt.Errorf("Order is invalid: %w", &Problem{Type: "urn:ietf:params:acme:error:caa"}), "urn:ietf:params:acme:error:caa"},
+		{"Challenge problem", &AuthorizationError{Status: StatusInvalid, Problem: &Problem{Type: "urn:ietf:params:acme:error:dns"}}, "urn:ietf:params:acme:error:dns"},
+		{"Authorization without problem", &AuthorizationError{Status: StatusExpired}, "authorization:expired"},
+		{"Poll timeout", fmt.Errorf("still pending: %w", ErrPollTimeout), "poll_timeout"},
+		{"Deadline", context.DeadlineExceeded, "timeout"},
+		{"Anything else", errors.New("boom"), "other"},
+	}
+
+	for _, test := range tests {
+		if label := problemLabel(test.Err); label != test.Expected {
+			t.Errorf("failed %q: expected %q, got %q", test.Name, test.Expected, label)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.OrderCreated()
+	m.OrderCreated()
+	m.OrderSucceeded(time.Now().Add(-time.Minute))
+	m.OrderFailed(&Problem{Type: ProblemRateLimited})
+	m.DNSError("upsert")
+
+	if n := testutil.ToFloat64(m.ordersCreated); n != 2 {
+		t.Errorf("expected 2 orders created, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.ordersFailed.WithLabelValues(ProblemRateLimited)); n != 1 {
+		t.Errorf("expected 1 rate limited order, got %v", n)
+	}
+	if n := testutil.CollectAndCount(m.orderDuration); n != 1 {
+		t.Errorf("expected the order duration observed, got %d series", n)
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.expiry.now = func() time.Time { return now }
+	m.CertificateExpiry("ssl_example.org", []string{"example.org", "www.example.org"}, now.Add(48*time.Hour))
+	m.CertificateExpiry("ssl_www.example.org", []string{"www.example.org"}, now.Add(24*time.Hour))
+	m.CertificateExpiry("ssl_example.org", []string{"example.org", "www.example.org"}, now.Add(72*time.Hour))
+
+	expected := `
+# HELP acmetest_certificate_expiry_seconds Seconds until the earliest expiring certificate covering the domain expires.
+# TYPE acmetest_certificate_expiry_seconds gauge
+acmetest_certificate_expiry_seconds{domain="example.org"} 259200
+acmetest_certificate_expiry_seconds{domain="www.example.org"} 86400
+`
+	err = testutil.GatherAndCompare(reg, strings.NewReader(expected), "acmetest_certificate_expiry_seconds")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var nilMetrics *Metrics
+	nilMetrics.OrderCreated()
+	nilMetrics.OrderFailed(errors.New("boom"))
+	nilMetrics.CertificateExpiry("ssl_example.org", []string{"example.org"}, now)
+}
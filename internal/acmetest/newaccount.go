@@ -1,26 +1,48 @@
 package acmetest
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 // NewAccount encapsulates what we need to create a new account
 type NewAccount struct {
-	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
-	Contact              []string `json:"contact"`
+	TermsOfServiceAgreed   bool     `json:"termsOfServiceAgreed"`
+	Contact                []string `json:"contact"`
+	ExternalAccountBinding *Message `json:"externalAccountBinding,omitempty"`
 }
 
 // newAccount is the first thing to hit after creating a client.
 // If your public key matches a previous attempt, the server should
 // respond back with that account, otherwise it'll create a new one
-// for you.
-func (c *Client) newAccount(contactEmails []string) error {
+// for you.   Either way the Location it sends back is our KID.
+func (c *Client) newAccount(ctx context.Context, contactEmails []string, eab ExternalAccountBinding) error {
 	newAcct := NewAccount{
 		Contact:              contactEmails,
 		TermsOfServiceAgreed: true,
 	}
 
-	res, err := c.makeRequest(newAcct, c.Directory.NewAccount, false)
+	if c.RequiresExternalAccount() && eab.IsZero() {
+		return ErrExternalAccountRequired
+	}
+	if !eab.IsZero() {
+		binding, err := eab.JWS(c.Key.Public(), c.Directory.NewAccount)
+		if err != nil {
+			return err
+		}
+		newAcct.ExternalAccountBinding = &binding
+	}
 
-	fmt.Println(string(res))
+	res, err := c.post(ctx, resourceNewAccount, newAcct, c.Directory.NewAccount, false, "")
+	if err != nil {
+		return err
+	}
+
+	c.KID = res.Header.Get("Location")
+	if c.KID == "" {
+		return fmt.Errorf("New account response from %s had no Location", c.Directory.NewAccount)
+	}
+	c.log().Info("Using account", logKeyStep, "new-account", logKeyURL, c.KID)
 
-	return err
+	return nil
 }
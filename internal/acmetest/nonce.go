@@ -1,12 +1,27 @@
 package acmetest
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
 
 // GetNonce takes a URL to fetch a new nonce from the acme server and returns it or an error
 func GetNonce(url string) (string, error) {
+	return getNonce(context.Background(), http.DefaultClient, url)
+}
+
+func getNonce(ctx context.Context, httpClient *http.Client, url string) (string, error) {
 	var nonce string
 
-	res, err := http.Head(url)
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return nonce, err
+	}
+
+	res, err := httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return nonce, err
 	}
@@ -14,3 +29,41 @@ func GetNonce(url string) (string, error) {
 	nonce = res.Header.Get("Replay-Nonce")
 	return nonce, nil
 }
+
+// noncePool hands nonces out to requests that may be running
+// concurrently.   Every response carries a fresh Replay-Nonce that goes
+// back in the pool, and when the pool runs dry we fetch one from the
+// newNonce endpoint, under whatever span is in the context.
+type noncePool struct {
+	mu         sync.Mutex
+	url        string
+	httpClient *http.Client
+	nonces     []string
+}
+
+func (p *noncePool) get(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	if n := len(p.nonces); n > 0 {
+		nonce := p.nonces[n-1]
+		p.nonces = p.nonces[:n-1]
+		p.mu.Unlock()
+		return nonce, nil
+	}
+	p.mu.Unlock()
+
+	ctx, span := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, "ACME "+resourceNewNonce,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrResource.String(resourceNewNonce), attrURL.String(p.url)))
+	nonce, err := getNonce(ctx, p.httpClient, p.url)
+	endSpan(span, err)
+	return nonce, err
+}
+
+func (p *noncePool) put(nonce string) {
+	if nonce == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nonces = append(p.nonces, nonce)
+}
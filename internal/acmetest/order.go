@@ -0,0 +1,172 @@
+package acmetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Order and authorization statuses from RFC8555 section 7.1.6.
+const (
+	StatusPending     = "pending"
+	StatusReady       = "ready"
+	StatusProcessing  = "processing"
+	StatusValid       = "valid"
+	StatusInvalid     = "invalid"
+	StatusDeactivated = "deactivated"
+	StatusExpired     = "expired"
+	StatusRevoked     = "revoked"
+)
+
+// FetchOrder does a POST-as-GET on an order URL and returns the order.
+func (c *Client) FetchOrder(ctx context.Context, orderURL string) (CertResponse, error) {
+	order, _, err := c.fetchOrder(ctx, orderURL)
+	return order, err
+}
+
+func (c *Client) fetchOrder(ctx context.Context, orderURL string) (CertResponse, http.Header, error) {
+	var order CertResponse
+	res, err := c.post(ctx, resourceOrder, nil, orderURL, true, "")
+	if err != nil {
+		return order, nil, err
+	}
+	err = json.Unmarshal(res.Body, &order)
+	order.URL = orderURL
+	return order, res.Header, err
+}
+
+// WaitForOrder polls an order until it reaches the target status,
+// following the state machine in RFC8555 section 7.1.6:
+//
+//	pending -> ready -> processing -> valid
+//
+// with invalid possible from any of them.   Between polls it waits for
+// whatever the server asked for in Retry-After, or per c.Backoff, and
+// it gives up once c.Backoff's poll limits are reached.
+func (c *Client) WaitForOrder(ctx context.Context, orderURL, target string) (CertResponse, error) {
+	return c.waitForOrder(ctx, orderURL, target, false)
+}
+
+// waitForOrder is WaitForOrder, but if orLater is set an order that's
+// already past target is what it was waiting for rather than an error.
+func (c *Client) waitForOrder(ctx context.Context, orderURL, target string, orLater bool) (CertResponse, error) {
+	var order CertResponse
+	err := c.poll(ctx, func(ctx context.Context) (bool, http.Header, error) {
+		var header http.Header
+		var err error
+		order, header, err = c.fetchOrder(ctx, orderURL)
+		if err != nil {
+			return false, nil, err
+		}
+
+		switch order.Status {
+		case target:
+			return true, nil, nil
+		case StatusInvalid:
+			if order.Error != nil {
+				return false, nil, fmt.Errorf("Order %s is invalid: %w", orderURL, order.Error)
+			}
+			return false, nil, fmt.Errorf("Order %s is invalid", orderURL)
+		case StatusPending, StatusReady, StatusProcessing, StatusValid:
+			if statusRank(order.Status) > statusRank(target) {
+				if orLater {
+					return true, nil, nil
+				}
+				return false, nil, fmt.Errorf("Order %s is %q, already past %q", orderURL, order.Status, target)
+			}
+		default:
+			return false, nil, fmt.Errorf("Order %s has unexpected status %q", orderURL, order.Status)
+		}
+
+		c.log().Debug("Waiting on order", logKeyOrder, orderURL, logKeyStatus, order.Status, "target", target)
+		return false, header, nil
+	})
+	if errors.Is(err, ErrPollTimeout) {
+		err = fmt.Errorf("Order %s is still %q: %w", orderURL, order.Status, err)
+	}
+	return order, err
+}
+
+// FinalizeOrder sends the CSR to the order's finalize URL once the order
+// is ready, then waits for the CA to finish issuing.   The returned
+// order has the certificate URL set.
+//
+// An order that's already processing or valid has been finalized, most
+// likely by an earlier try whose response got lost, so FinalizeOrder
+// just waits for it rather than sending the CSR again.
+func (c *Client) FinalizeOrder(ctx context.Context, orderURL string, csr []byte) (CertResponse, error) {
+	order, err := c.waitForOrder(ctx, orderURL, StatusReady, true)
+	if err != nil {
+		return order, err
+	}
+
+	if order.Status == StatusReady {
+		res, err := c.post(ctx, resourceFinalize, CSRRequest{CSR: encodeCSR(csr)}, order.Finalize, false, "")
+		if err != nil {
+			return order, err
+		}
+		err = json.Unmarshal(res.Body, &order)
+		if err != nil {
+			return order, err
+		}
+		if order.Status != StatusValid {
+			if err := sleep(ctx, c.backoff().Delay(0, res.Header)); err != nil {
+				return order, err
+			}
+		}
+	} else {
+		c.log().Info("Order already finalized", logKeyOrder, orderURL, logKeyStatus, order.Status)
+	}
+
+	if order.Status != StatusValid {
+		order, err = c.WaitForOrder(ctx, orderURL, StatusValid)
+		if err != nil {
+			return order, err
+		}
+	}
+
+	if order.Certificate == "" {
+		return order, fmt.Errorf("Order %s is valid but has no certificate URL", orderURL)
+	}
+
+	return order, nil
+}
+
+// statusRank orders the non-terminal order statuses so the poller can
+// tell when it has overshot what it was waiting for.
+func statusRank(status string) int {
+	switch status {
+	case StatusPending:
+		return 0
+	case StatusReady:
+		return 1
+	case StatusProcessing:
+		return 2
+	case StatusValid:
+		return 3
+	}
+	return -1
+}
+
+// retryAfter reads a Retry-After header, which is either a number of
+// seconds or an HTTP date, falling back to def if it's missing or junk.
+func retryAfter(h http.Header, def time.Duration) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return def
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return def
+}
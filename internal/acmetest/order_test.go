@@ -0,0 +1,72 @@
+package acmetest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	const def = 5 * time.Second
+	tests := []struct {
+		Name     string
+		Header   string
+		Expected time.Duration
+	}{
+		{"Missing", "", def},
+		{"Seconds", "30", 30 * time.Second},
+		{"Zero", "0", 0},
+		{"Negative", "-3", def},
+		{"Junk", "soon", def},
+		{"Date in the past", "Mon, 02 Jan 2006 15:04:05 GMT", 0},
+	}
+
+	for _, test := range tests {
+		h := http.Header{}
+		if test.Header != "" {
+			h.Set("Retry-After", test.Header)
+		}
+		d := retryAfter(h, def)
+		if d != test.Expected {
+			t.Errorf("failed %q: expected %v, got %v", test.Name, test.Expected, d)
+		}
+	}
+
+	h := http.Header{}
+	h.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if d := retryAfter(h, def); d <= 0 || d > time.Minute {
+		t.Errorf("failed date in the future: expected up to a minute, got %v", d)
+	}
+}
+
+func TestFinalizeOrderAlreadyFinalized(t *testing.T) {
+	// The first try's finalize landed but its response didn't, so the
+	// order is already processing when the retry looks at it.
+	srv, requests := sequenceServer(t,
+		`{"status":"processing","finalize":"/finalize/1"}`,
+		`{"status":"valid","finalize":"/finalize/1","certificate":"/cert/1"}`,
+	)
+	c := testClient(t, srv)
+
+	order, err := c.FinalizeOrder(context.Background(), srv.URL+"/order/1", []byte("csr"))
+	if err != nil {
+		t.Fatalf("finalizing an order that's already processing should not have error'd, but it did: %v", err)
+	}
+	if order.Certificate != "/cert/1" {
+		t.Errorf("expected the certificate URL, got %q", order.Certificate)
+	}
+	if *requests != 2 {
+		t.Errorf("expected two polls and no finalize, got %d requests", *requests)
+	}
+
+	// And an order that's already valid needs nothing at all.
+	srv, requests = sequenceServer(t, `{"status":"valid","certificate":"/cert/1"}`)
+	c = testClient(t, srv)
+	if _, err := c.FinalizeOrder(context.Background(), srv.URL+"/order/1", []byte("csr")); err != nil {
+		t.Fatalf("finalizing a valid order should not have error'd, but it did: %v", err)
+	}
+	if *requests != 1 {
+		t.Errorf("expected one poll, got %d requests", *requests)
+	}
+}
@@ -0,0 +1,51 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrPollTimeout is returned (wrapped) when an order or authorization
+// is still not done after Backoff.MaxPolls fetches or Backoff.PollTimeout.
+var ErrPollTimeout = errors.New("Gave up waiting")
+
+// poll calls fetch until it reports done or fails, waiting between
+// calls per c.Backoff and honoring Retry-After.   It gives up after
+// MaxPolls calls or once PollTimeout has passed, whichever comes first;
+// the caller's ctx still applies on top of both.
+func (c *Client) poll(ctx context.Context, fetch func(ctx context.Context) (bool, http.Header, error)) error {
+	backoff := c.backoff()
+	pollCtx := ctx
+	if backoff.PollTimeout > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithTimeout(ctx, backoff.PollTimeout)
+		defer cancel()
+	}
+
+	// timedOut tells our own deadline apart from the caller's.
+	timedOut := func(err error) error {
+		if pollCtx.Err() != nil && ctx.Err() == nil {
+			return fmt.Errorf("%w after %s", ErrPollTimeout, backoff.PollTimeout)
+		}
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		done, header, err := fetch(pollCtx)
+		if err != nil {
+			return timedOut(err)
+		}
+		if done {
+			return nil
+		}
+
+		if backoff.MaxPolls > 0 && attempt+1 >= backoff.MaxPolls {
+			return fmt.Errorf("%w after %d polls", ErrPollTimeout, attempt+1)
+		}
+		if err := sleep(pollCtx, backoff.Delay(attempt, header)); err != nil {
+			return timedOut(err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// sequenceServer answers POSTs with bodies in turn, repeating the last
+// one once it runs out.
+func sequenceServer(t *testing.T, bodies ...string) (*httptest.Server, *int) {
+	t.Helper()
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if r.Method == "HEAD" {
+			return
+		}
+		body := bodies[len(bodies)-1]
+		if requests < len(bodies) {
+			body = bodies[requests]
+		}
+		requests++
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+const pendingAuthz = `{"status":"pending","identifier":{"type":"dns","value":"example.org"}}`
+
+func TestWaitForAuthorization(t *testing.T) {
+	srv, _ := sequenceServer(t, pendingAuthz, pendingAuthz, `{"status":"valid","identifier":{"type":"dns","value":"example.org"}}`)
+	c := testClient(t, srv)
+
+	authz, err := c.WaitForAuthorization(context.Background(), srv.URL+"/authz/1")
+	if err != nil {
+		t.Fatalf("test of an authorization going valid should not have error'd: %v", err)
+	}
+	if authz.Status != StatusValid || authz.URL != srv.URL+"/authz/1" {
+		t.Errorf("expected the valid authorization, got %+v", authz)
+	}
+}
+
+func TestWaitForAuthorizationFailures(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Body    string
+		Status  string
+		Problem string
+	}{
+		{"Invalid with challenge error", `{"status":"invalid","identifier":{"type":"dns","value":"example.org"},"challenges":[
+			{"type":"dns-01","status":"invalid","error":{"type":"urn:ietf:params:acme:error:unauthorized","detail":"Incorrect TXT record"}}]}`,
+			StatusInvalid, "urn:ietf:params:acme:error:unauthorized"},
+		{"Invalid without error", `{"status":"invalid","identifier":{"type":"dns","value":"example.org"}}`, StatusInvalid, ""},
+		{"Deactivated", `{"status":"deactivated","identifier":{"type":"dns","value":"example.org"}}`, StatusDeactivated, ""},
+		{"Expired", `{"status":"expired","identifier":{"type":"dns","value":"example.org"}}`, StatusExpired, ""},
+		{"Revoked", `{"status":"revoked","identifier":{"type":"dns","value":"example.org"}}`, StatusRevoked, ""},
+		{"Unknown status", `{"status":"confused","identifier":{"type":"dns","value":"example.org"}}`, "confused", ""},
+	}
+
+	for _, test := range tests {
+		srv, requests := sequenceServer(t, pendingAuthz, test.Body)
+		c := testClient(t, srv)
+
+		_, err := c.WaitForAuthorization(context.Background(), srv.URL+"/authz/1")
+		var authzErr *AuthorizationError
+		if !errors.As(err, &authzErr) {
+			t.Errorf("test %q should have error'd with an AuthorizationError, got %v", test.Name, err)
+			continue
+		}
+		if authzErr.Status != test.Status {
+			t.Errorf("test %q: expected status %q, got %q", test.Name, test.Status, authzErr.Status)
+		}
+		var p *Problem
+		switch {
+		case test.Problem == "" && errors.As(err, &p):
+			t.Errorf("test %q: expected no problem, got %v", test.Name, p)
+		case test.Problem != "" && (!errors.As(err, &p) || p.Type != test.Problem):
+			t.Errorf("test %q: expected problem %s, got %v", test.Name, test.Problem, err)
+		}
+		if *requests != 2 {
+			t.Errorf("test %q: expected to stop polling at the terminal status, got %d requests", test.Name, *requests)
+		}
+	}
+}
+
+func TestPollLimits(t *testing.T) {
+	srv, requests := sequenceServer(t, pendingAuthz)
+	c := testClient(t, srv)
+	c.Backoff.MaxPolls = 3
+
+	_, err := c.WaitForAuthorization(context.Background(), srv.URL+"/authz/1")
+	if !errors.Is(err, ErrPollTimeout) {
+		t.Errorf("test of a pending authorization past MaxPolls should have error'd with ErrPollTimeout, got %v", err)
+	}
+	if *requests != 3 {
+		t.Errorf("expected 3 polls, got %d", *requests)
+	}
+
+	srv, _ = sequenceServer(t, `{"status":"processing"}`)
+	c = testClient(t, srv)
+	c.Backoff.Initial = 10 * time.Millisecond
+	c.Backoff.Max = 10 * time.Millisecond
+	c.Backoff.PollTimeout = 50 * time.Millisecond
+
+	_, err = c.WaitForOrder(context.Background(), srv.URL+"/order/1", StatusValid)
+	if !errors.Is(err, ErrPollTimeout) {
+		t.Errorf("test of an order stuck processing past PollTimeout should have error'd with ErrPollTimeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c.Backoff.PollTimeout = time.Minute
+	_, err = c.WaitForOrder(ctx, srv.URL+"/order/1", StatusValid)
+	if errors.Is(err, ErrPollTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("test of the caller's deadline should have error'd with it, got %v", err)
+	}
+}
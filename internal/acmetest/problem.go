@@ -0,0 +1,69 @@
+package acmetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Problem types we act on.
+const (
+	ProblemBadNonce    = "urn:ietf:params:acme:error:badNonce"
+	ProblemRateLimited = "urn:ietf:params:acme:error:rateLimited"
+)
+
+// Problem is an RFC7807 problem document as returned by an ACME server
+// when a request fails.   See RFC8555 section 6.7.
+type Problem struct {
+	Type        string          `json:"type"`
+	Detail      string          `json:"detail"`
+	Status      int             `json:"status"`
+	Identifier  *CertIdentifier `json:"identifier,omitempty"`
+	Subproblems []Problem       `json:"subproblems,omitempty"`
+
+	// RetryAfter is how long the server asked us to wait before trying
+	// again, from the Retry-After header of a 429 or 503.   Zero if it
+	// didn't say.
+	RetryAfter time.Duration `json:"-"`
+}
+
+// Error satisfies the error interface so a Problem can be returned as-is.
+func (p *Problem) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s", p.Type, p.Detail)
+	for _, sub := range p.Subproblems {
+		b.WriteString("; ")
+		if sub.Identifier != nil {
+			fmt.Fprintf(&b, "%s: ", sub.Identifier.Value)
+		}
+		fmt.Fprintf(&b, "%s: %s", sub.Type, sub.Detail)
+	}
+	if p.RetryAfter > 0 {
+		fmt.Fprintf(&b, " (retry after %s)", p.RetryAfter)
+	}
+	return b.String()
+}
+
+// retryable reports whether the request can be sent again as-is once
+// the server has had a rest: it was rate limited or unavailable.
+func (p *Problem) retryable() bool {
+	return p.Type == ProblemRateLimited || p.Status == http.StatusTooManyRequests || p.Status == http.StatusServiceUnavailable
+}
+
+// parseProblem turns an error response into a *Problem.   If the body
+// isn't a problem document we still get something descriptive back.
+func parseProblem(statusCode int, body []byte) *Problem {
+	p := &Problem{}
+	if err := json.Unmarshal(body, p); err != nil || p.Type == "" {
+		p = &Problem{
+			Type:   "about:blank",
+			Detail: strings.TrimSpace(string(body)),
+		}
+	}
+	if p.Status == 0 {
+		p.Status = statusCode
+	}
+	return p
+}
@@ -0,0 +1,227 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// ErrIssuanceLimit is returned (wrapped) when an order would go over the
+// local issuance limits and the context won't last long enough to wait.
+var ErrIssuanceLimit = errors.New("Local issuance limit reached")
+
+// IssuanceLimits are local caps on how many orders we place, per
+// registered domain and per account, each over a sliding window.   Set
+// them at or a little under the CA's own limits so a bulk run pauses
+// before the CA starts refusing it.   A zero count means no limit.
+type IssuanceLimits struct {
+	PerDomain     int
+	DomainWindow  time.Duration
+	PerAccount    int
+	AccountWindow time.Duration
+}
+
+// LetsEncryptLimits are Let's Encrypt's certificates per registered
+// domain and new orders per account limits.
+var LetsEncryptLimits = IssuanceLimits{
+	PerDomain:     50,
+	DomainWindow:  7 * 24 * time.Hour,
+	PerAccount:    300,
+	AccountWindow: 3 * time.Hour,
+}
+
+// IssuanceTracker counts the orders placed through a Client so they can
+// be held to IssuanceLimits.   Only this process's orders are counted,
+// plus whatever is passed to Record.   A nil *IssuanceTracker doesn't
+// limit anything.
+type IssuanceTracker struct {
+	Limits IssuanceLimits
+
+	// Logger is as on Client.
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	account []time.Time
+	domains map[string][]time.Time
+	now     func() time.Time
+}
+
+// NewIssuanceTracker returns an IssuanceTracker enforcing limits.
+func NewIssuanceTracker(limits IssuanceLimits) *IssuanceTracker {
+	return &IssuanceTracker{Limits: limits}
+}
+
+// Wait blocks until an order for names fits within the limits and then
+// counts it.   If ctx would run out first it doesn't wait at all and
+// returns an error wrapping ErrIssuanceLimit.
+func (t *IssuanceTracker) Wait(ctx context.Context, names []string) error {
+	_, err := t.reserve(ctx, names)
+	return err
+}
+
+// reserve is Wait, returning the time the order was counted at so it
+// can be given back with release if the order isn't placed after all.
+func (t *IssuanceTracker) reserve(ctx context.Context, names []string) (time.Time, error) {
+	if t == nil {
+		return time.Time{}, nil
+	}
+
+	for {
+		t.mu.Lock()
+		d, reason := t.delay(names)
+		if d <= 0 {
+			at := t.clock()
+			t.record(names, at)
+			t.mu.Unlock()
+			return at, nil
+		}
+		t.mu.Unlock()
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+			return time.Time{}, fmt.Errorf("%w: %s for another %s", ErrIssuanceLimit, reason, d.Round(time.Second))
+		}
+		newLogger(t.Logger, false).Warn("Pausing for local issuance limit", logKeyDomain, names, "wait", d.Round(time.Second), "limit", reason)
+		if err := sleep(ctx, d); err != nil {
+			return time.Time{}, err
+		}
+	}
+}
+
+// release gives back an order reserve counted at at, for when placing
+// it failed.
+func (t *IssuanceTracker) release(names []string, at time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.account = removeTime(t.account, at)
+	for _, domain := range registeredDomains(names) {
+		t.domains[domain] = removeTime(t.domains[domain], at)
+	}
+}
+
+// Record counts an order for names placed at when, such as a certificate
+// already in a store, so that it's held against the limits.
+func (t *IssuanceTracker) Record(names []string, at time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record(names, at)
+}
+
+func (t *IssuanceTracker) record(names []string, at time.Time) {
+	if t.domains == nil {
+		t.domains = make(map[string][]time.Time)
+	}
+	t.account = insertTime(t.account, at)
+	for _, domain := range registeredDomains(names) {
+		t.domains[domain] = insertTime(t.domains[domain], at)
+	}
+}
+
+// delay returns how long until an order for names fits, and which limit
+// is in the way.   The caller holds t.mu.
+func (t *IssuanceTracker) delay(names []string) (time.Duration, string) {
+	now := t.clock()
+	var longest time.Duration
+	var reason string
+
+	if t.Limits.PerAccount > 0 {
+		t.account = pruneTimes(t.account, now.Add(-t.Limits.AccountWindow))
+		if d := windowDelay(t.account, t.Limits.PerAccount, t.Limits.AccountWindow, now); d > longest {
+			longest = d
+			reason = fmt.Sprintf("%d orders per %s for the account", t.Limits.PerAccount, t.Limits.AccountWindow)
+		}
+	}
+
+	if t.Limits.PerDomain > 0 {
+		for _, domain := range registeredDomains(names) {
+			times := pruneTimes(t.domains[domain], now.Add(-t.Limits.DomainWindow))
+			if t.domains != nil {
+				t.domains[domain] = times
+			}
+			if d := windowDelay(times, t.Limits.PerDomain, t.Limits.DomainWindow, now); d > longest {
+				longest = d
+				reason = fmt.Sprintf("%d orders per %s for %s", t.Limits.PerDomain, t.Limits.DomainWindow, domain)
+			}
+		}
+	}
+
+	return longest, reason
+}
+
+func (t *IssuanceTracker) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// windowDelay is how long until fewer than limit of the sorted times fall
+// within the window ending now.
+func windowDelay(times []time.Time, limit int, window time.Duration, now time.Time) time.Duration {
+	if len(times) < limit {
+		return 0
+	}
+	return times[len(times)-limit].Add(window).Sub(now)
+}
+
+// pruneTimes drops the sorted times before cutoff.
+func pruneTimes(times []time.Time, cutoff time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return !times[i].Before(cutoff) })
+	return times[i:]
+}
+
+// insertTime adds at to the sorted times.
+func insertTime(times []time.Time, at time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(at) })
+	times = append(times, time.Time{})
+	copy(times[i+1:], times[i:])
+	times[i] = at
+	return times
+}
+
+// removeTime drops one at from the sorted times, if it's there.
+func removeTime(times []time.Time, at time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return !times[i].Before(at) })
+	if i < len(times) && times[i].Equal(at) {
+		times = append(times[:i], times[i+1:]...)
+	}
+	return times
+}
+
+// registeredDomains returns the distinct registered domains the names
+// fall under, per the public suffix list, so a.example.co.uk and
+// b.other.co.uk are counted apart.   IP addresses, and names that are
+// nothing but a public suffix, count on their own.
+func registeredDomains(names []string) []string {
+	var domains []string
+	for _, name := range names {
+		domain := strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(name, ".")), "*.")
+		if net.ParseIP(domain) == nil {
+			if d, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+				domain = d
+			}
+		}
+		domains = appendUnique(domains, domain)
+	}
+	return domains
+}
+
+// IsRateLimited reports whether err is the CA refusing a request because
+// of one of its rate limits.
+func IsRateLimited(err error) bool {
+	var p *Problem
+	return errors.As(err, &p) && p.Type == ProblemRateLimited
+}
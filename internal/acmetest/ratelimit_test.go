@@ -0,0 +1,95 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swerveaux/acmetest/internal/acmetesting"
+)
+
+func TestRegisteredDomains(t *testing.T) {
+	domains := registeredDomains([]string{"example.org", "www.Example.org.", "*.api.example.org", "example.com", "192.0.2.1",
+		"a.example.co.uk", "b.other.co.uk", "www.other.co.uk", "co.uk"})
+	expected := []string{"example.org", "example.com", "192.0.2.1", "example.co.uk", "other.co.uk", "co.uk"}
+	if !reflect.DeepEqual(domains, expected) {
+		t.Errorf("expected %v, got %v", expected, domains)
+	}
+}
+
+func TestIssuanceTracker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker := NewIssuanceTracker(IssuanceLimits{
+		PerDomain:     2,
+		DomainWindow:  time.Hour,
+		PerAccount:    3,
+		AccountWindow: time.Minute,
+	})
+	tracker.now = func() time.Time { return now }
+
+	tracker.Record([]string{"a.example.org"}, now.Add(-30*time.Minute))
+	tracker.Record([]string{"b.example.org", "example.org"}, now.Add(-10*time.Minute))
+	tracker.Record([]string{"example.com"}, now.Add(-2*time.Hour))
+
+	tests := []struct {
+		Name     string
+		Names    []string
+		Expected time.Duration
+	}{
+		{"Domain at its limit", []string{"c.example.org"}, 30 * time.Minute},
+		{"Other domain", []string{"example.com"}, 0},
+		{"Worst domain wins", []string{"example.com", "www.example.org"}, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		d, _ := tracker.delay(test.Names)
+		if d != test.Expected {
+			t.Errorf("failed %q: expected %v, got %v", test.Name, test.Expected, d)
+		}
+	}
+
+	ctx := context.Background()
+	for _, domain := range []string{"example.net", "example.info", "example.biz"} {
+		if err := tracker.Wait(ctx, []string{domain}); err != nil {
+			t.Fatalf("order for %s should not have error'd: %v", domain, err)
+		}
+	}
+	if d, _ := tracker.delay([]string{"example.com"}); d != time.Minute {
+		t.Errorf("expected the account limit to hold for a minute, got %v", d)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	err := tracker.Wait(ctx, []string{"example.com"})
+	if !errors.Is(err, ErrIssuanceLimit) {
+		t.Errorf("test of waiting past the deadline should have error'd with ErrIssuanceLimit, got %v", err)
+	}
+
+	var nilTracker *IssuanceTracker
+	if err := nilTracker.Wait(ctx, []string{"example.com"}); err != nil {
+		t.Errorf("test of a nil tracker should not have error'd: %v", err)
+	}
+}
+
+func TestIssuanceTrackerFailedOrder(t *testing.T) {
+	srv, c := newTestCA(t)
+	c.Issuance = NewIssuanceTracker(IssuanceLimits{PerDomain: 1, DomainWindow: time.Hour})
+	srv.Inject(acmetesting.InternalError(acmetesting.ResourceNewOrder, 1))
+
+	// An order the CA turned down isn't held against the limits...
+	if _, err := c.CertApply(context.Background(), []string{"example.org"}, ""); err == nil {
+		t.Fatal("order with the CA failing should have error'd")
+	}
+	if d, _ := c.Issuance.delay([]string{"example.org"}); d != 0 {
+		t.Errorf("expected the failed order to be given back, but the next one has to wait %v", d)
+	}
+
+	// ...but one that was placed is.
+	if _, err := c.CertApply(context.Background(), []string{"example.org"}, ""); err != nil {
+		t.Fatalf("order should not have error'd, but it did: %v", err)
+	}
+	if d, _ := c.Issuance.delay([]string{"example.org"}); d <= 0 {
+		t.Errorf("expected the placed order to count against the limit")
+	}
+}
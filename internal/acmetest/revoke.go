@@ -0,0 +1,37 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+)
+
+// Revocation reason codes from RFC5280 section 5.3.1 that ACME CAs
+// generally accept.
+const (
+	ReasonUnspecified          = 0
+	ReasonKeyCompromise        = 1
+	ReasonSuperseded           = 4
+	ReasonCessationOfOperation = 5
+)
+
+// revokeRequest is the payload for a revokeCert request.
+type revokeRequest struct {
+	Certificate string `json:"certificate"`
+	Reason      int    `json:"reason"`
+}
+
+// RevokeCertificate asks the CA to revoke cert, which must have been
+// ordered by this account, with one of the Reason codes.   See RFC8555
+// section 7.6.
+func (c *Client) RevokeCertificate(ctx context.Context, cert *x509.Certificate, reason int) error {
+	_, err := c.post(ctx, resourceRevokeCert, revokeRequest{
+		Certificate: base64.RawURLEncoding.EncodeToString(cert.Raw),
+		Reason:      reason,
+	}, c.Directory.RevokeCert, false, "")
+	if err != nil {
+		return err
+	}
+	c.log().Info("Revoked certificate", logKeyStep, "revoke", "serial", cert.SerialNumber.String(), "reason", reason)
+	return nil
+}
@@ -1,120 +1,345 @@
 package acmetest
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/route53"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// AddTextRecord adds the ACME challenge text record to the DNS entry for a domain.
-// The text record is added to an entry for _acme-challenge.<domain>.
-func (c *Client) AddTextRecord(domain, token string) error {
-	hostedZoneID, err := findHostedZoneID(c.R53, domain)
+// Route53API is the part of route53iface.Route53API we use.
+// *route53.Route53 satisfies it, and so does awstest.Route53 for tests.
+type Route53API interface {
+	ListHostedZones(*route53.ListHostedZonesInput) (*route53.ListHostedZonesOutput, error)
+	ListHostedZonesByNameWithContext(aws.Context, *route53.ListHostedZonesByNameInput, ...request.Option) (*route53.ListHostedZonesByNameOutput, error)
+	ChangeResourceRecordSetsWithContext(aws.Context, *route53.ChangeResourceRecordSetsInput, ...request.Option) (*route53.ChangeResourceRecordSetsOutput, error)
+	WaitUntilResourceRecordSetsChangedWithContext(aws.Context, *route53.GetChangeInput, ...request.WaiterOption) error
+}
+
+// Route53Solver answers dns-01 challenges with TXT records in Route53.
+// Challenges are grouped by hosted zone so each zone gets one ChangeBatch
+// no matter how many names are on the order.
+//
+// A Route53Solver can be shared by orders running at once.   It counts
+// who's using each value of each _acme-challenge record, so an order
+// for example.org and another for *.example.org both get their value in
+// the record set, and cleaning up after one leaves the other's alone.
+type Route53Solver struct {
+	R53 Route53API
+
+	// PropagationDelay is how long to wait after Route53 reports every
+	// change INSYNC, to give the CA's resolvers a chance to catch up.
+	PropagationDelay time.Duration
+
+	// Logger, Metrics and TracerProvider are as on Client.
+	Logger         *slog.Logger
+	Metrics        *Metrics
+	TracerProvider trace.TracerProvider
+
+	// mu is held across each change so two of them can't each write
+	// a record set missing the other's value.
+	mu     sync.Mutex
+	values map[string]*txtValues // by record name
+}
+
+// txtValues are the values of one TXT record set in the order they were
+// added, and how many challenges are using each of them.
+type txtValues struct {
+	values []string
+	users  map[string]int
+}
+
+// ChallengeType returns dns-01.
+func (s *Route53Solver) ChallengeType() string {
+	return ChallengeDNS01
+}
+
+// Present upserts the TXT records for every challenge, then waits once
+// for all of the changes to propagate.
+func (s *Route53Solver) Present(ctx context.Context, challenges []PendingChallenge) error {
+	changeIDs, err := s.changeTextRecords(ctx, "UPSERT", dnsRecords(challenges))
 	if err != nil {
 		return err
 	}
 
-	input, err := createChangeRecordSetInput(hostedZoneID, domain, token, "UPSERT")
-	if err != nil {
-		return err
+	start := time.Now()
+	for _, id := range changeIDs {
+		waitCtx, span := tracer(s.TracerProvider).Start(ctx, "Route53 WaitUntilResourceRecordSetsChanged")
+		err = s.R53.WaitUntilResourceRecordSetsChangedWithContext(waitCtx, &route53.GetChangeInput{Id: aws.String(id)})
+		endSpan(span, err)
+		if err != nil {
+			s.Metrics.DNSError("wait")
+			return err
+		}
 	}
-	fmt.Println(input.String())
+	s.log().Info("Route53 changes in sync", logKeyStep, "propagation", "changes", len(changeIDs), "elapsed", time.Since(start), "delay", s.PropagationDelay)
 
-	_, err = c.R53.ChangeResourceRecordSets(input)
-	if err != nil {
-		return err
+	_, span := tracer(s.TracerProvider).Start(ctx, "DNS propagation delay")
+	err = sleep(ctx, s.PropagationDelay)
+	endSpan(span, err)
+	return err
+}
+
+// CleanUp deletes the TXT records Present added.
+func (s *Route53Solver) CleanUp(ctx context.Context, challenges []PendingChallenge) error {
+	_, err := s.changeTextRecords(ctx, "DELETE", dnsRecords(challenges))
+	return err
+}
+
+// txtRecord is a single value for the _acme-challenge record of a domain.
+type txtRecord struct {
+	Domain string
+	Value  string
+}
+
+func dnsRecords(challenges []PendingChallenge) []txtRecord {
+	records := make([]txtRecord, 0, len(challenges))
+	for _, ch := range challenges {
+		records = append(records, txtRecord{Domain: ch.Identifier.Value, Value: DNS01Value(ch.KeyAuth)})
 	}
+	return records
+}
 
-	return nil
+// AddTextRecord adds the ACME challenge text record to the DNS entry for a domain.
+// The text record is added to an entry for _acme-challenge.<domain>.
+func (c *Client) AddTextRecord(ctx context.Context, domain, token string) error {
+	_, err := c.route53Solver().changeTextRecords(ctx, "UPSERT", []txtRecord{{domain, token}})
+	return err
 }
 
 // RemoveTextRecord removes the ACME challenge text record for cleanup.
-func (c *Client) RemoveTextRecord(domain, token string) error {
-	hostedZoneID, err := findHostedZoneID(c.R53, domain)
-	if err != nil {
-		return err
+func (c *Client) RemoveTextRecord(ctx context.Context, domain, token string) error {
+	_, err := c.route53Solver().changeTextRecords(ctx, "DELETE", []txtRecord{{domain, token}})
+	return err
+}
+
+// FindHostedZoneID is a probably temporary exported function to find the HostedZoneID for a domain
+func (c *Client) FindHostedZoneID(domain string) (string, error) {
+	return findHostedZoneID(context.Background(), c.R53, domain)
+}
+
+// route53Solver is a Route53Solver sharing the Client's Route53 client,
+// logger and metrics.
+func (c *Client) route53Solver() *Route53Solver {
+	return &Route53Solver{R53: c.R53, Logger: c.Logger, Metrics: c.Metrics, TracerProvider: c.TracerProvider}
+}
+
+func (s *Route53Solver) log() *slog.Logger {
+	return newLogger(s.Logger, false)
+}
+
+// changeTextRecords applies action to the records with one ChangeBatch
+// per hosted zone, and returns the IDs of the changes.   Values for the
+// same name are merged into one record set, since Route53 won't take two
+// changes for the same name in a batch and an UPSERT replaces the whole
+// set anyway.   This is what lets example.org and *.example.org be
+// validated at the same time.
+//
+// The record set written for a name also has every value other calls
+// are still using, so a DELETE only deletes the set once nobody needs
+// any of it, and otherwise UPSERTs what's left.
+func (s *Route53Solver) changeTextRecords(ctx context.Context, action string, records []txtRecord) ([]string, error) {
+	zones := make(map[string]string)
+	byZone := make(map[string]map[string][]string)
+	for _, r := range records {
+		domain := strings.TrimPrefix(r.Domain, "*.")
+		zoneID, ok := zones[domain]
+		if !ok {
+			var err error
+			zoneID, err = findHostedZoneID(ctx, s.R53, domain)
+			if err != nil {
+				s.Metrics.DNSError("find_zone")
+				return nil, err
+			}
+			zones[domain] = zoneID
+		}
+
+		if byZone[zoneID] == nil {
+			byZone[zoneID] = make(map[string][]string)
+		}
+		name := challengeRecordName(r.Domain)
+		byZone[zoneID][name] = append(byZone[zoneID][name], r.Value)
 	}
 
-	input, err := createChangeRecordSetInput(hostedZoneID, domain, token, "DELETE")
-	if err != nil {
-		return err
+	zoneIDs := make([]string, 0, len(byZone))
+	for zoneID := range byZone {
+		zoneIDs = append(zoneIDs, zoneID)
 	}
-	fmt.Println(input.String())
-	_, err = c.R53.ChangeResourceRecordSets(input)
-	if err != nil {
-		return err
+	sort.Strings(zoneIDs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changeIDs []string
+	var errs []string
+	for _, zoneID := range zoneIDs {
+		input := &route53.ChangeResourceRecordSetsInput{
+			ChangeBatch:  &route53.ChangeBatch{Comment: aws.String("Text record for letsencrypt")},
+			HostedZoneId: aws.String(zoneID),
+		}
+		for _, name := range sortedKeys(byZone[zoneID]) {
+			change, values := s.track(action, name, byZone[zoneID][name])
+			input.ChangeBatch.Changes = append(input.ChangeBatch.Changes, txtChange(change, name, values))
+		}
+		s.log().Info("Changing TXT records", logKeyStep, "dns", logKeyZone, zoneID, "action", action, "records", len(byZone[zoneID]))
+
+		changeCtx, span := tracer(s.TracerProvider).Start(ctx, "Route53 ChangeResourceRecordSets",
+			trace.WithAttributes(attrZone.String(zoneID), attrDNSAction.String(action)))
+		out, err := s.R53.ChangeResourceRecordSetsWithContext(changeCtx, input)
+		endSpan(span, err)
+		if err != nil {
+			s.Metrics.DNSError(strings.ToLower(action))
+			s.log().Error("Route53 change failed", logKeyStep, "dns", logKeyZone, zoneID, "action", action, logKeyError, err)
+			// Keep going so a DELETE in one zone doesn't leave the
+			// records in every other zone behind.
+			errs = append(errs, fmt.Sprintf("%s: %v", zoneID, err))
+			continue
+		}
+		changeIDs = append(changeIDs, *out.ChangeInfo.Id)
 	}
 
-	return nil
-}
+	if len(errs) > 0 {
+		return changeIDs, fmt.Errorf("Failed changing records: %s", strings.Join(errs, "; "))
+	}
 
-// FindHostedZoneID is a probably temporary exported function to find the HostedZoneID for a domain
-func (c *Client) FindHostedZoneID(domain string) (string, error) {
-	return findHostedZoneID(c.R53, domain)
+	return changeIDs, nil
 }
 
-func createChangeRecordSetInput(hostedZoneID, domain, token, action string) (*route53.ChangeResourceRecordSetsInput, error) {
-	var input route53.ChangeResourceRecordSetsInput
+// track counts values in or out of the record called name, and returns
+// the change to make and the values to make it with: an UPSERT of every
+// value still in use, or a DELETE of the last set written once none are.
+// A DELETE of values this solver never added goes through as it is.
+// s.mu must be held.
+func (s *Route53Solver) track(action, name string, values []string) (string, []string) {
+	if s.values == nil {
+		s.values = make(map[string]*txtValues)
+	}
+	set := s.values[name]
+	if action == "DELETE" && set == nil {
+		return action, uniqueValues(values)
+	}
+	if set == nil {
+		set = &txtValues{users: make(map[string]int)}
+		s.values[name] = set
+	}
 
-	// Strip leading wildcard for text record if present.
-	if domain[:2] == "*." {
-		domain = domain[2:]
-	}
-
-	input = route53.ChangeResourceRecordSetsInput{
-		ChangeBatch: &route53.ChangeBatch{
-			Changes: []*route53.Change{
-				{
-					Action: aws.String(action),
-					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name: aws.String(fmt.Sprintf("_acme-challenge.%s", domain)),
-						ResourceRecords: []*route53.ResourceRecord{
-							{
-								Value: aws.String(fmt.Sprintf("%q", token)),
-							},
-						},
-						TTL:  aws.Int64(20),
-						Type: aws.String("TXT"),
-					},
-				},
-			},
-			Comment: aws.String("Text record for letsencrypt"),
-		},
-		HostedZoneId: aws.String(hostedZoneID),
+	written := set.values
+	for _, v := range values {
+		if action == "DELETE" {
+			set.users[v]--
+		} else {
+			set.users[v]++
+		}
+	}
+	set.values = nil
+	for _, v := range append(append([]string{}, written...), values...) {
+		if set.users[v] > 0 {
+			set.values = appendUnique(set.values, v)
+		} else {
+			delete(set.users, v)
+		}
 	}
 
-	return &input, nil
+	if len(set.values) == 0 {
+		delete(s.values, name)
+		return "DELETE", written
+	}
+	return "UPSERT", set.values
 }
 
-func findHostedZoneID(r53 *route53.Route53, hostname string) (string, error) {
-	var hostedZoneID string
+func challengeRecordName(domain string) string {
+	// Strip leading wildcard for text record if present.
+	domain = strings.TrimPrefix(domain, "*.")
+	return fmt.Sprintf("_acme-challenge.%s", domain)
+}
 
-	_, domain, err := splitHostname(hostname)
-	if err != nil {
-		return hostedZoneID, err
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
 	}
+	return append(values, value)
+}
 
-	fmt.Printf("Searching for %s\n", domain)
+func uniqueValues(values []string) []string {
+	var unique []string
+	for _, v := range values {
+		unique = appendUnique(unique, v)
+	}
+	return unique
+}
 
-	lhzbnInput := &route53.ListHostedZonesByNameInput{
-		DNSName:  aws.String(domain),
-		MaxItems: aws.String("1"),
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	lhzbnOutput, err := r53.ListHostedZonesByName(lhzbnInput)
-	if err != nil {
-		return hostedZoneID, err
+// txtChange is a change to the TXT record set called name.
+func txtChange(action, name string, values []string) *route53.Change {
+	records := make([]*route53.ResourceRecord, 0, len(values))
+	for _, v := range values {
+		records = append(records, &route53.ResourceRecord{Value: aws.String(fmt.Sprintf("%q", v))})
+	}
+	return &route53.Change{
+		Action: aws.String(action),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name:            aws.String(name),
+			ResourceRecords: records,
+			TTL:             aws.Int64(20),
+			Type:            aws.String("TXT"),
+		},
 	}
+}
 
-	if len(lhzbnOutput.HostedZones) != 1 {
-		return hostedZoneID, fmt.Errorf("Failed to find HostedZoneID for %s", domain)
+// findHostedZoneID finds the public hosted zone that hostname's records
+// go in: the zone for the longest suffix of hostname that has one, so
+// a delegated sub.example.org zone wins over example.org, and
+// example.co.uk is found even though co.uk isn't a zone.   Private zones
+// are skipped since the CA can't see them.
+func findHostedZoneID(ctx context.Context, r53 Route53API, hostname string) (string, error) {
+	name := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(hostname, "*."), "."))
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("%s is basically a great big TLD", hostname)
 	}
 
-	hostedZoneID = *lhzbnOutput.HostedZones[0].Id
+	for i := 0; i < len(labels)-1; i++ {
+		candidate := strings.Join(labels[i:], ".")
+		out, err := r53.ListHostedZonesByNameWithContext(ctx, &route53.ListHostedZonesByNameInput{
+			DNSName:  aws.String(candidate),
+			MaxItems: aws.String("10"),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		// Zones come back sorted by name starting at candidate, so any
+		// for candidate itself are first.
+		for _, zone := range out.HostedZones {
+			if strings.TrimSuffix(strings.ToLower(aws.StringValue(zone.Name)), ".") != candidate {
+				break
+			}
+			if zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone) {
+				continue
+			}
+			return aws.StringValue(zone.Id), nil
+		}
+	}
 
-	return hostedZoneID, nil
+	return "", fmt.Errorf("Failed to find a public hosted zone for %s", hostname)
 }
 
 // FindHostedZones returns all the hosted zones for the current AWS session
@@ -122,7 +347,7 @@ func (c *Client) FindHostedZones() (*route53.ListHostedZonesOutput, error) {
 	return findHostedZones(c.R53)
 }
 
-func findHostedZones(r53 *route53.Route53) (*route53.ListHostedZonesOutput, error) {
+func findHostedZones(r53 Route53API) (*route53.ListHostedZonesOutput, error) {
 	return r53.ListHostedZones(&route53.ListHostedZonesInput{})
 }
 
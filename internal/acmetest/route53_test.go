@@ -0,0 +1,255 @@
+package acmetest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+
+	"github.com/swerveaux/acmetest/internal/acmetesting"
+	"github.com/swerveaux/acmetest/internal/awstest"
+)
+
+func TestFindHostedZoneID(t *testing.T) {
+	r53 := awstest.NewRoute53()
+	example := r53.AddZone("example.org", false)
+	r53.AddZone("example.org", true)
+	sub := r53.AddZone("sub.example.org", false)
+	r53.AddZone("internal.example.org", true)
+	couk := r53.AddZone("example.co.uk", false)
+	r53.AddZone("example.orga", false)
+
+	tests := []struct {
+		Hostname string
+		ZoneID   string
+	}{
+		{"example.org", example},
+		{"*.example.org", example},
+		{"www.example.org", example},
+		{"sub.example.org", sub},
+		{"a.b.sub.example.org", sub},
+		{"db.internal.example.org", example},
+		{"www.example.co.uk", couk},
+		{"example.net", ""},
+		{"org", ""},
+	}
+
+	for _, test := range tests {
+		zoneID, err := findHostedZoneID(context.Background(), r53, test.Hostname)
+		if test.ZoneID == "" {
+			if err == nil {
+				t.Errorf("test %q should have error'd", test.Hostname)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %q should not have error'd: %v", test.Hostname, err)
+		}
+		if zoneID != test.ZoneID {
+			t.Errorf("test %q expected zone %s, got %s", test.Hostname, test.ZoneID, zoneID)
+		}
+	}
+}
+
+func TestRoute53SolverBatches(t *testing.T) {
+	r53 := awstest.NewRoute53()
+	r53.SyncPolls = 3
+	example := r53.AddZone("example.org", false)
+	other := r53.AddZone("example.net", false)
+	s := &Route53Solver{R53: r53}
+
+	challenges := []PendingChallenge{
+		{Identifier: CertIdentifier{IdentifierDNS, "example.org"}, KeyAuth: "apex"},
+		{Identifier: CertIdentifier{IdentifierDNS, "example.org"}, KeyAuth: "wildcard"},
+		{Identifier: CertIdentifier{IdentifierDNS, "www.example.org"}, KeyAuth: "www"},
+		{Identifier: CertIdentifier{IdentifierDNS, "example.net"}, KeyAuth: "net"},
+	}
+	err := s.Present(context.Background(), challenges)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := r53.Calls("ChangeResourceRecordSets"); n != 2 {
+		t.Errorf("expected one change batch per zone, got %d", n)
+	}
+	if n := r53.Calls("GetChange"); n != 0 {
+		t.Errorf("expected to wait on changes rather than poll them ourselves, got %d GetChange calls", n)
+	}
+	values, _ := r53.LookupTXT("_acme-challenge.example.org")
+	if len(values) != 2 || values[0] != DNS01Value("apex") || values[1] != DNS01Value("wildcard") {
+		t.Errorf("expected both values merged into one record set, got %q", values)
+	}
+	if sets := r53.Records(example, route53.RRTypeTxt); len(sets) != 2 {
+		t.Errorf("expected 2 TXT record sets in example.org, got %d", len(sets))
+	}
+	if sets := r53.Records(other, route53.RRTypeTxt); len(sets) != 1 || *sets[0].Name != "_acme-challenge.example.net." {
+		t.Errorf("expected the example.net record in its own zone, got %v", sets)
+	}
+
+	err = s.CleanUp(context.Background(), challenges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sets := r53.Records(example, route53.RRTypeTxt); len(sets) != 0 {
+		t.Errorf("expected the records to be deleted, got %v", sets)
+	}
+}
+
+func TestChangeTextRecords(t *testing.T) {
+	r53 := awstest.NewRoute53()
+	example := r53.AddZone("example.org", false)
+	s := &Route53Solver{R53: r53}
+
+	ids, err := s.changeTextRecords(context.Background(), "UPSERT", []txtRecord{
+		{Domain: "www.example.org", Value: "abc"},
+		{Domain: "example.org", Value: "def"},
+		{Domain: "*.example.org", Value: "ghi"},
+	})
+	if err != nil {
+		t.Fatalf("test of changing records should not have error'd, but it did: %v", err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("expected one change for the one zone, got %d", len(ids))
+	}
+
+	sets := r53.Records(example, route53.RRTypeTxt)
+	if len(sets) != 2 {
+		t.Fatalf("expected one record set per name, got %d", len(sets))
+	}
+	first := sets[0]
+	if *first.Name != "_acme-challenge.example.org." {
+		t.Errorf("expected the wildcard to share the apex's record, got %q first", *first.Name)
+	}
+	if len(first.ResourceRecords) != 2 {
+		t.Fatalf("expected values for the same name merged into one set, got %d records", len(first.ResourceRecords))
+	}
+	if *first.ResourceRecords[0].Value != `"def"` || *first.ResourceRecords[1].Value != `"ghi"` {
+		t.Errorf("expected quoted values, got %s and %s", *first.ResourceRecords[0].Value, *first.ResourceRecords[1].Value)
+	}
+	for _, set := range sets {
+		if *set.Type != route53.RRTypeTxt || *set.TTL != 20 {
+			t.Errorf("expected TXT records with a TTL of 20, got %s with %d", *set.Type, *set.TTL)
+		}
+	}
+}
+
+func TestRoute53SolverErrors(t *testing.T) {
+	challenges := []PendingChallenge{
+		{Identifier: CertIdentifier{IdentifierDNS, "example.org"}, KeyAuth: "org"},
+		{Identifier: CertIdentifier{IdentifierDNS, "example.net"}, KeyAuth: "net"},
+	}
+
+	r53 := awstest.NewRoute53()
+	example := r53.AddZone("example.org", false)
+	other := r53.AddZone("example.net", false)
+	s := &Route53Solver{R53: r53}
+	err := s.Present(context.Background(), challenges)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else changed the example.org record, so our DELETE doesn't
+	// match it, but example.net should still be cleaned up.
+	_, err = r53.ChangeResourceRecordSetsWithContext(context.Background(), &route53.ChangeResourceRecordSetsInput{
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: []*route53.Change{txtChange("UPSERT", "_acme-challenge.example.org", []string{"someone else's"})},
+		},
+		HostedZoneId: aws.String(example),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CleanUp(context.Background(), challenges)
+	if err == nil || !strings.Contains(err.Error(), route53.ErrCodeInvalidChangeBatch) {
+		t.Errorf("expected an InvalidChangeBatch error, got %v", err)
+	}
+	if sets := r53.Records(other, route53.RRTypeTxt); len(sets) != 0 {
+		t.Errorf("expected example.net to be cleaned up anyway, got %v", sets)
+	}
+
+	r53.FailNext("WaitUntilResourceRecordSetsChanged", awserr.New("ResourceNotReady", "Exceeded max wait attempts", nil))
+	err = s.Present(context.Background(), challenges[1:])
+	if err == nil {
+		t.Errorf("test of a change never going INSYNC should have error'd")
+	}
+
+	r53.FailNext("ListHostedZonesByName", awserr.New("Throttling", "Rate exceeded", nil))
+	err = s.Present(context.Background(), challenges[1:])
+	if err == nil {
+		t.Errorf("test of failing to list zones should have error'd")
+	}
+
+	_, err = r53.ChangeResourceRecordSetsWithContext(context.Background(), &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(example),
+		ChangeBatch: &route53.ChangeBatch{Changes: []*route53.Change{
+			{Action: aws.String("CREATE"), ResourceRecordSet: &route53.ResourceRecordSet{Name: aws.String("_acme-challenge.example.org"), Type: aws.String("TXT"), TTL: aws.Int64(20)}},
+		}},
+	})
+	if err == nil {
+		t.Errorf("test of creating a record that exists should have error'd")
+	}
+}
+
+func TestIssueRoute53(t *testing.T) {
+	r53 := awstest.NewRoute53()
+	r53.SyncPolls = 2
+	r53.AddZone("example.org", false)
+
+	srv, c := newTestCA(t)
+	srv.Validate = func(v acmetesting.Validation) error {
+		return acmetesting.CheckDNS01(r53.LookupTXT, v)
+	}
+
+	_, err := c.Issue(context.Background(), []string{"example.org", "*.example.org"}, "", testCertKey(t), &Route53Solver{R53: r53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, _ := r53.LookupTXT("_acme-challenge.example.org"); len(values) != 0 {
+		t.Errorf("expected the challenge records to be cleaned up, got %q", values)
+	}
+}
+
+func TestApplyRoute53SharedNames(t *testing.T) {
+	r53 := awstest.NewRoute53()
+	r53.AddZone("example.org", false)
+
+	srv, c := newTestCA(t)
+	srv.Validate = func(v acmetesting.Validation) error {
+		return acmetesting.CheckDNS01(r53.LookupTXT, v)
+	}
+
+	// Every certificate needs a value in _acme-challenge.example.org,
+	// and the propagation delay makes sure they're all presented before
+	// any of them is checked.
+	a := Applier{
+		Client:      c,
+		Solvers:     map[string]Solver{"route53": &Route53Solver{R53: r53, PropagationDelay: 200 * time.Millisecond}},
+		Stores:      map[string]CertStore{"asm": &memStore{}},
+		Concurrency: 4,
+	}
+	m := Manifest{Certificates: []CertSpec{
+		{Names: []string{"example.org"}, Solver: "route53", Store: "asm"},
+		{Names: []string{"*.example.org"}, Solver: "route53", Store: "asm", NameTemplate: "wildcard"},
+		{Names: []string{"example.org", "www.example.org"}, Solver: "route53", Store: "asm", NameTemplate: "both"},
+		{Names: []string{"*.example.org", "example.org"}, Solver: "route53", Store: "asm", NameTemplate: "wildcard_and_apex"},
+	}}
+
+	results, err := a.Apply(context.Background(), m)
+	if err != nil {
+		t.Fatalf("apply should not have error'd, but it did: %v", err)
+	}
+	for _, r := range results {
+		if r.Err != nil || r.Action != ActionIssued {
+			t.Errorf("expected %v to be issued, got %s: %v", r.Domains, r.Action, r.Err)
+		}
+	}
+	for _, name := range []string{"_acme-challenge.example.org", "_acme-challenge.www.example.org"} {
+		if values, _ := r53.LookupTXT(name); len(values) != 0 {
+			t.Errorf("expected %s to be cleaned up, got %q", name, values)
+		}
+	}
+}
@@ -1,44 +1,235 @@
 package acmetest
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 )
 
+// SecretsManagerAPI is the part of secretsmanageriface.SecretsManagerAPI
+// we use.   *secretsmanager.SecretsManager satisfies it, and so does
+// awstest.SecretsManager for tests.
+type SecretsManagerAPI interface {
+	CreateSecretWithContext(aws.Context, *secretsmanager.CreateSecretInput, ...request.Option) (*secretsmanager.CreateSecretOutput, error)
+	UpdateSecretWithContext(aws.Context, *secretsmanager.UpdateSecretInput, ...request.Option) (*secretsmanager.UpdateSecretOutput, error)
+	GetSecretValueWithContext(aws.Context, *secretsmanager.GetSecretValueInput, ...request.Option) (*secretsmanager.GetSecretValueOutput, error)
+	TagResourceWithContext(aws.Context, *secretsmanager.TagResourceInput, ...request.Option) (*secretsmanager.TagResourceOutput, error)
+	PutResourcePolicyWithContext(aws.Context, *secretsmanager.PutResourcePolicyInput, ...request.Option) (*secretsmanager.PutResourcePolicyOutput, error)
+}
+
 // Secret lets us marshal our secret into JSON.
 type Secret struct {
 	Type  string `json:"type"`
 	Value string `json:"value"`
 }
 
-const (
-	key = iota
-	cert
-)
+// SecretBundle is the one JSON secret SecretsManagerStore writes per
+// certificate with Bundle set.   NotAfter, Serial and SANs are there so
+// whatever reads the secret can tell when it needs renewing without
+// parsing the certificate.
+type SecretBundle struct {
+	Key      string    `json:"key"`
+	Cert     string    `json:"cert"`  // just the leaf
+	Chain    string    `json:"chain"` // intermediates, without the leaf
+	NotAfter time.Time `json:"not_after"`
+	Serial   string    `json:"serial"` // hex
+	SANs     []string  `json:"sans"`
+}
+
+// DefaultSecretsManagerPathTemplate names secrets after the certificate.
+const DefaultSecretsManagerPathTemplate = "{{.Name}}"
+
+// SecretsManagerStore keeps certificates in AWS Secrets Manager.   By
+// default that's a pair of secrets, <name>.key and <name>.crt, and the
+// .crt secret holds the full chain.   With Bundle set it's one secret,
+// <name>, holding a SecretBundle.   Either way Secrets Manager keeps the
+// version each write replaces as AWSPREVIOUS, which LoadPrevious reads.
+type SecretsManagerStore struct {
+	SM SecretsManagerAPI
+
+	// Bundle stores each certificate as one SecretBundle.   Load still
+	// reads a .key and .crt pair if there's no bundle yet, so turning
+	// it on doesn't mean reissuing everything.
+	Bundle bool
+
+	// NamePrefix goes in front of every secret name, and PathTemplate
+	// is the rest of it, run with StorePathData,
+	// DefaultSecretsManagerPathTemplate if empty.
+	NamePrefix   string
+	PathTemplate string
+
+	// KMSKeyID is the customer-managed KMS key to encrypt secrets with,
+	// instead of the account's aws/secretsmanager key.   Tags are put on
+	// every secret along with the bundle's own.   ResourcePolicy, if
+	// set, is the JSON resource policy every secret gets.   All three
+	// are applied on every Store, so changing them catches up existing
+	// secrets on their next renewal.
+	KMSKeyID       string
+	Tags           map[string]string
+	ResourcePolicy string
+
+	// mu keeps two Stores from interleaving, so the key and chain
+	// secrets always come from the same bundle.
+	mu sync.Mutex
+}
+
+// Store writes the certificate, creating the secrets if needed.
+func (s *SecretsManagerStore) Store(ctx context.Context, bundle CertBundle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secretName, err := s.secretName(bundle.Name)
+	if err != nil {
+		return err
+	}
+	opts := secretOptions{
+		KMSKeyID:       s.KMSKeyID,
+		Tags:           make(map[string]string),
+		ResourcePolicy: s.ResourcePolicy,
+	}
+	for k, v := range s.Tags {
+		opts.Tags[k] = v
+	}
+	for k, v := range bundle.Tags {
+		opts.Tags[k] = v
+	}
 
-func (c *Client) addSecrets(keyPEM, certPEM, domain string) error {
-	err := c.addSecret(keyPEM, domain, key)
+	if !s.Bundle {
+		err := putSecret(ctx, s.SM, secretName+".key", string(bundle.KeyPEM), opts)
+		if err != nil {
+			return err
+		}
+		return putSecret(ctx, s.SM, secretName+".crt", string(bundle.FullChainPEM()), opts)
+	}
+
+	leaf, err := bundle.Certificate()
+	if err != nil {
+		return fmt.Errorf("Failed parsing certificate for %s: %v", bundle.Name, err)
+	}
+	value, err := json.Marshal(SecretBundle{
+		Key:      string(bundle.KeyPEM),
+		Cert:     string(bundle.CertPEM),
+		Chain:    string(bundle.ChainPEM),
+		NotAfter: leaf.NotAfter.UTC(),
+		Serial:   leaf.SerialNumber.Text(16),
+		SANs:     certNames(leaf),
+	})
 	if err != nil {
 		return err
 	}
-	err = c.addSecret(certPEM, domain, cert)
-	return err
+	return writeSecret(ctx, s.SM, secretName, string(value), opts)
+}
+
+// Load reads back the certificate stored under name.
+func (s *SecretsManagerStore) Load(ctx context.Context, name string) (CertBundle, error) {
+	return s.load(ctx, name, "")
+}
+
+// LoadPrevious reads back the certificate that was stored under name
+// before the current one.
+func (s *SecretsManagerStore) LoadPrevious(ctx context.Context, name string) (CertBundle, error) {
+	return s.load(ctx, name, "AWSPREVIOUS")
+}
+
+// load reads the certificate at a version stage, or the current one if
+// stage is empty.
+func (s *SecretsManagerStore) load(ctx context.Context, name, stage string) (CertBundle, error) {
+	bundle := CertBundle{Name: name}
+	secretName, err := s.secretName(name)
+	if err != nil {
+		return bundle, err
+	}
+
+	// Hold the lock so a Store from this process can't land between
+	// the two reads.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Bundle {
+		bundle, err := s.loadBundle(ctx, name, secretName, stage)
+		if !errors.Is(err, ErrCertNotFound) || stage != "" {
+			return bundle, err
+		}
+		// Nothing's been stored as a bundle yet, but it may have
+		// been as a pair before Bundle was turned on.
+	}
+
+	certPEM, err := getSecret(ctx, s.SM, secretName+".crt", stage)
+	if err != nil {
+		return bundle, err
+	}
+	keyPEM, err := getSecret(ctx, s.SM, secretName+".key", stage)
+	if err != nil {
+		return bundle, err
+	}
+
+	chain, err := ParseChain([]byte(certPEM))
+	if err != nil {
+		return bundle, fmt.Errorf("Failed parsing %s.crt: %v", secretName, err)
+	}
+
+	bundle.Domains = certNames(chain.Leaf)
+	bundle.KeyPEM = []byte(keyPEM)
+	bundle.CertPEM = chain.LeafPEM()
+	bundle.ChainPEM = chain.ChainPEM()
+
+	return bundle, nil
+}
+
+// loadBundle reads a certificate stored as a SecretBundle.
+func (s *SecretsManagerStore) loadBundle(ctx context.Context, name, secretName, stage string) (CertBundle, error) {
+	bundle := CertBundle{Name: name}
+	value, err := getSecretString(ctx, s.SM, secretName, stage)
+	if err != nil {
+		return bundle, err
+	}
+
+	var sb SecretBundle
+	if err := json.Unmarshal([]byte(value), &sb); err != nil {
+		return bundle, fmt.Errorf("Failed unmarshalling secret %s: %v", secretName, err)
+	}
+	chain, err := ParseChain([]byte(sb.Cert + sb.Chain))
+	if err != nil {
+		return bundle, fmt.Errorf("Failed parsing the certificate in %s: %v", secretName, err)
+	}
+
+	bundle.Domains = certNames(chain.Leaf)
+	bundle.KeyPEM = []byte(sb.Key)
+	bundle.CertPEM = chain.LeafPEM()
+	bundle.ChainPEM = chain.ChainPEM()
+
+	return bundle, nil
 }
 
-func (c *Client) addSecret(pem, domain string, secretType int) error {
-	var secretName string
-	domain = strings.Replace(domain, "*", "_", 1)
-	switch secretType {
-	case key:
-		secretName = fmt.Sprintf("ssl_%s.key", domain)
-	case cert:
-		secretName = fmt.Sprintf("ssl_%s.crt", domain)
+// secretName is what the certificate under name is stored as, before
+// any .key or .crt.
+func (s *SecretsManagerStore) secretName(name string) (string, error) {
+	p, err := storePath(firstNonEmpty(s.PathTemplate, DefaultSecretsManagerPathTemplate), name)
+	if err != nil {
+		return "", err
 	}
+	return s.NamePrefix + p, nil
+}
+
+// secretOptions are the settings a secret gets besides its value.
+type secretOptions struct {
+	KMSKeyID       string
+	Tags           map[string]string
+	ResourcePolicy string
+}
 
+// putSecret writes a PEM as an opaque Secret.
+func putSecret(ctx context.Context, sm SecretsManagerAPI, secretName, pem string, opts secretOptions) error {
 	secret := Secret{
 		Type:  "opaque",
 		Value: pem,
@@ -47,34 +238,130 @@ func (c *Client) addSecret(pem, domain string, secretType int) error {
 
 	secretBytes, err := json.Marshal(secret)
 	if err != nil {
-		fmt.Printf("Failed marshalling secret into JSON: %v\n", err)
 		return err
 	}
+	return writeSecret(ctx, sm, secretName, string(secretBytes), opts)
+}
+
+// writeSecret writes value as a new version of a secret, creating it if
+// needed, and brings its KMS key, tags and resource policy up to date.
+func writeSecret(ctx context.Context, sm SecretsManagerAPI, secretName, value string, opts secretOptions) error {
+	var kmsKeyID *string
+	if opts.KMSKeyID != "" {
+		kmsKeyID = aws.String(opts.KMSKeyID)
+	}
 
 	// Try to update first.   This is likely going to be the
 	// most common use case, as a secret will be updated every
-	// couple of months or so but only created once.   If it
-	// errors, check to see if it's secretsmanager.ErrCodeResourceNotFoundException,
-	// and if so, go ahead and create the new secret.
-	_, err = c.SecretsManager.UpdateSecret(&secretsmanager.UpdateSecretInput{
-		SecretId:     aws.String(secretName),
-		SecretString: aws.String(string(secretBytes)),
-	})
+	// couple of months or so but only created once.   Only if the
+	// secret isn't there do we go ahead and create it, and if someone
+	// else created it in the meantime, update it after all.
+	update := func() error {
+		_, err := sm.UpdateSecretWithContext(ctx, &secretsmanager.UpdateSecretInput{
+			SecretId:     aws.String(secretName),
+			SecretString: aws.String(value),
+			KmsKeyId:     kmsKeyID,
+		})
+		if err != nil || len(opts.Tags) == 0 {
+			return err
+		}
+		// Tags are only set by CreateSecret, so an update adds them.
+		_, err = sm.TagResourceWithContext(ctx, &secretsmanager.TagResourceInput{
+			SecretId: aws.String(secretName),
+			Tags:     secretTags(opts.Tags),
+		})
+		if err != nil {
+			return fmt.Errorf("Updated %s but failed tagging it: %w", secretName, err)
+		}
+		return nil
+	}
 
-	if err != nil {
-		_, err2 := c.SecretsManager.CreateSecret(&secretsmanager.CreateSecretInput{
+	err := update()
+	if isAWSError(err, secretsmanager.ErrCodeResourceNotFoundException) {
+		_, err = sm.CreateSecretWithContext(ctx, &secretsmanager.CreateSecretInput{
 			Name:         aws.String(secretName),
-			SecretString: aws.String(string(secretBytes)),
+			SecretString: aws.String(value),
+			KmsKeyId:     kmsKeyID,
+			Tags:         secretTags(opts.Tags),
 		})
-		if err2 != nil {
-			fmt.Printf("Failed creating secret: %v\n", err)
-			return err
+		if isAWSError(err, secretsmanager.ErrCodeResourceExistsException) {
+			err = update()
 		}
 	}
+	if err != nil || opts.ResourcePolicy == "" {
+		return err
+	}
 
+	_, err = sm.PutResourcePolicyWithContext(ctx, &secretsmanager.PutResourcePolicyInput{
+		SecretId:          aws.String(secretName),
+		ResourcePolicy:    aws.String(opts.ResourcePolicy),
+		BlockPublicPolicy: aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("Stored %s but failed setting its resource policy: %w", secretName, err)
+	}
 	return nil
 }
 
+// isAWSError reports whether err is an AWS error with the given code.
+func isAWSError(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
+
+// getSecret reads back the PEM stored in a Secret, at a version stage
+// or AWSCURRENT if stage is empty.
+func getSecret(ctx context.Context, sm SecretsManagerAPI, secretName, stage string) (string, error) {
+	value, err := getSecretString(ctx, sm, secretName, stage)
+	if err != nil {
+		return "", err
+	}
+
+	var secret Secret
+	err = json.Unmarshal([]byte(value), &secret)
+	if err != nil {
+		return "", fmt.Errorf("Failed unmarshalling secret %s: %v", secretName, err)
+	}
+
+	return secret.Value, nil
+}
+
+// getSecretString reads back a secret's value as is, at a version stage
+// or AWSCURRENT if stage is empty.
+func getSecretString(ctx context.Context, sm SecretsManagerAPI, secretName, stage string) (string, error) {
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretName),
+	}
+	if stage != "" {
+		input.VersionStage = aws.String(stage)
+	}
+	out, err := sm.GetSecretValueWithContext(ctx, input)
+	if err != nil {
+		if isAWSError(err, secretsmanager.ErrCodeResourceNotFoundException) {
+			return "", ErrCertNotFound
+		}
+		return "", err
+	}
+	return aws.StringValue(out.SecretString), nil
+}
+
+func secretTags(tags map[string]string) []*secretsmanager.Tag {
+	if len(tags) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]*secretsmanager.Tag, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, &secretsmanager.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return out
+}
+
 func genSecretInput(name, value string) secretsmanager.CreateSecretInput {
 	return secretsmanager.CreateSecretInput{
 		Name:         aws.String(name),
@@ -0,0 +1,155 @@
+package acmetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+
+	"github.com/swerveaux/acmetest/internal/awstest"
+)
+
+const testPolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":"arn:aws:iam::123456789012:role/web"},"Action":"secretsmanager:GetSecretValue","Resource":"*"}]}`
+
+func TestSecretsManagerBundleStore(t *testing.T) {
+	testCertStore(t, func(t *testing.T) storeFixture {
+		sm := awstest.NewSecretsManager()
+		return storeFixture{
+			Store: &SecretsManagerStore{
+				SM:           sm,
+				Bundle:       true,
+				NamePrefix:   "prod/",
+				PathTemplate: "certs/{{.Name}}",
+				KMSKeyID:     "alias/certs",
+			},
+			Deny: func(name string) {
+				sm.Deny("prod/certs/" + name)
+			},
+		}
+	})
+}
+
+func TestSecretsManagerBundleSecret(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	sm := awstest.NewSecretsManager()
+	store := &SecretsManagerStore{
+		SM:             sm,
+		Bundle:         true,
+		NamePrefix:     "acme/",
+		KMSKeyID:       "arn:aws:kms:us-east-1:123456789012:key/certs",
+		Tags:           map[string]string{"team": "infra"},
+		ResourcePolicy: testPolicy,
+	}
+
+	b := ca.bundle(t, "ssl_example.org", "example.org", "www.example.org")
+	b.Tags = map[string]string{"env": "staging"}
+	if err := store.Store(ctx, b); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	if names := sm.Names(); fmt.Sprint(names) != "[acme/ssl_example.org]" {
+		t.Fatalf("expected one secret called acme/ssl_example.org, got %v", names)
+	}
+
+	out, err := sm.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String("acme/ssl_example.org")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb SecretBundle
+	if err := json.Unmarshal([]byte(aws.StringValue(out.SecretString)), &sb); err != nil {
+		t.Fatalf("expected a JSON bundle: %v", err)
+	}
+	leaf, err := b.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.Key != string(b.KeyPEM) || sb.Cert != string(b.CertPEM) || sb.Chain != string(b.ChainPEM) {
+		t.Errorf("expected the key, leaf and intermediates in the bundle")
+	}
+	if !sb.NotAfter.Equal(leaf.NotAfter) || sb.NotAfter.Location() != time.UTC {
+		t.Errorf("expected not_after %v in UTC, got %v", leaf.NotAfter, sb.NotAfter)
+	}
+	if sb.Serial != leaf.SerialNumber.Text(16) {
+		t.Errorf("expected serial %s, got %s", leaf.SerialNumber.Text(16), sb.Serial)
+	}
+	if fmt.Sprint(sb.SANs) != "[example.org www.example.org]" {
+		t.Errorf("expected both names in sans, got %v", sb.SANs)
+	}
+
+	if got := sm.KMSKeyID("acme/ssl_example.org"); got != store.KMSKeyID {
+		t.Errorf("expected the secret to use KMS key %s, got %q", store.KMSKeyID, got)
+	}
+	if got := sm.ResourcePolicy("acme/ssl_example.org"); got != testPolicy {
+		t.Errorf("expected the resource policy to be set, got %q", got)
+	}
+	tags := sm.Tags("acme/ssl_example.org")
+	if tags["team"] != "infra" || tags["env"] != "staging" {
+		t.Errorf("expected the store's and bundle's tags, got %v", tags)
+	}
+
+	// A renewal brings the tags up to date as well as the value.
+	renewed := ca.bundle(t, "ssl_example.org", "example.org", "www.example.org")
+	renewed.Tags = map[string]string{"env": "prod"}
+	if err := store.Store(ctx, renewed); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	if tags := sm.Tags("acme/ssl_example.org"); tags["env"] != "prod" {
+		t.Errorf("expected the renewal to update the tags, got %v", tags)
+	}
+	if n := sm.Versions("acme/ssl_example.org"); n != 2 {
+		t.Errorf("expected 2 versions, got %d", n)
+	}
+	prev, err := store.LoadPrevious(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load previous should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, prev, b)
+}
+
+func TestSecretsManagerBundleReadsPairs(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	sm := awstest.NewSecretsManager()
+
+	// Certificates stored as pairs before Bundle was turned on are still
+	// found, so they're renewed when they're due rather than at once.
+	old := ca.bundle(t, "ssl_example.org", "example.org")
+	if err := (&SecretsManagerStore{SM: sm}).Store(ctx, old); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	store := &SecretsManagerStore{SM: sm, Bundle: true}
+	got, err := store.Load(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, got, old)
+
+	renewed := ca.bundle(t, "ssl_example.org", "example.org")
+	if err := store.Store(ctx, renewed); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	got, err = store.Load(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, got, renewed)
+}
+
+func TestSecretsManagerBadPolicy(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	sm := awstest.NewSecretsManager()
+	store := &SecretsManagerStore{SM: sm, Bundle: true, ResourcePolicy: "{not json"}
+
+	err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org"))
+	if err == nil {
+		t.Fatalf("store with a malformed policy should have error'd")
+	}
+	if n := sm.Versions("ssl_example.org"); n != 1 {
+		t.Errorf("expected the secret to be stored before the policy failed, got %d versions", n)
+	}
+}
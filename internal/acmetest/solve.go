@@ -0,0 +1,228 @@
+package acmetest
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Issue gets a certificate for domains from start to finish: it places
+// the order with the given profile (empty for the CA's default), solves
+// every authorization with solver, finalizes with a CSR signed by
+// certKey and downloads the chain.
+func (c *Client) Issue(ctx context.Context, domains []string, profile string, certKey crypto.Signer, solver Solver) (chain CertChain, err error) {
+	ctx, span := c.tracer().Start(ctx, "Issue", trace.WithAttributes(attrDomains.StringSlice(domains), attrChallenge.String(solver.ChallengeType())))
+	defer func() { endSpan(span, err) }()
+
+	err = CheckChallengeTypes(domains, solver.ChallengeType())
+	if err != nil {
+		return CertChain{}, err
+	}
+
+	order, err := c.newOrder(ctx, domains, profile)
+	if err != nil {
+		c.Metrics.OrderFailed(err)
+		return CertChain{}, err
+	}
+	created := time.Now()
+	c.Metrics.OrderCreated()
+	span.SetAttributes(attrOrder.String(order.URL))
+
+	err = c.SolveAuthorizations(ctx, order.Authorizations, solver)
+	if err != nil {
+		c.Metrics.OrderFailed(err)
+		return CertChain{}, err
+	}
+
+	chain, err = c.finishOrder(ctx, order.URL, certKey)
+	if err != nil {
+		c.Metrics.OrderFailed(err)
+		return chain, err
+	}
+	c.Metrics.OrderSucceeded(created)
+	return chain, nil
+}
+
+// SolveAuthorizations gets every authorization in authzURLs validated
+// with solver.   All of the challenges are presented up front in one
+// batch, so something like DNS only has to propagate once, then the CA
+// is told they're ready with at most c.Workers requests in flight.
+// Everything is cleaned up together at the end, even on failure.
+// Authorizations we already know are valid are skipped.
+func (c *Client) SolveAuthorizations(ctx context.Context, authzURLs []string, solver Solver) (err error) {
+	ctx, span := c.tracer().Start(ctx, "SolveAuthorizations", trace.WithAttributes(attrChallenge.String(solver.ChallengeType())))
+	defer func() { endSpan(span, err) }()
+
+	found := make([]*PendingChallenge, len(authzURLs))
+	err = forEach(ctx, c.workers(), len(authzURLs), func(i int) error {
+		if _, ok := c.authzs.get(authzURLs[i]); ok {
+			c.log().Info("Reusing cached authorization", logKeyStep, "authorization", logKeyAuthz, authzURLs[i])
+			return nil
+		}
+
+		authz, err := c.fetchAuthorization(ctx, authzURLs[i])
+		if err != nil {
+			return err
+		}
+
+		switch authz.Status {
+		case StatusValid:
+			// The CA reused an authorization from an earlier order.
+			c.log().Info("Authorization is already valid", logKeyStep, "authorization", logKeyDomain, authz.Identifier.Value, logKeyAuthz, authz.URL)
+			c.authzs.put(authz)
+			return nil
+		case StatusPending:
+		default:
+			return authorizationError(authz)
+		}
+
+		identifier := authz.Identifier
+		if authz.Wildcard {
+			identifier.Value = "*." + identifier.Value
+		}
+		if err := CheckChallengeType(identifier, solver.ChallengeType()); err != nil {
+			return err
+		}
+
+		challenge, ok := findChallenge(authz.Challenges, solver.ChallengeType())
+		if !ok {
+			return fmt.Errorf("No %s challenge offered for %s", solver.ChallengeType(), authz.Identifier.Value)
+		}
+
+		keyAuth, err := c.acmeAuthString(challenge.Token)
+		if err != nil {
+			return err
+		}
+
+		found[i] = &PendingChallenge{
+			AuthzURL:   authzURLs[i],
+			Identifier: authz.Identifier,
+			Challenge:  challenge,
+			KeyAuth:    keyAuth,
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pending := make([]PendingChallenge, 0, len(found))
+	for _, p := range found {
+		if p != nil {
+			pending = append(pending, *p)
+		}
+	}
+	span.SetAttributes(attrChallenges.Int(len(pending)))
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Clean up even if ctx has been cancelled, otherwise a timeout
+	// leaves challenge records lying around.
+	defer func() {
+		ctx, span := c.tracer().Start(context.WithoutCancel(ctx), "CleanUp")
+		err := solver.CleanUp(ctx, pending)
+		if err != nil {
+			c.log().Error("Failed cleaning up challenges", logKeyStep, "cleanup", "challenges", len(pending), logKeyError, err)
+		}
+		endSpan(span, err)
+	}()
+
+	c.log().Info("Presenting challenges", logKeyStep, "present", "type", solver.ChallengeType(), "challenges", len(pending))
+	start := time.Now()
+	presentCtx, presentSpan := c.tracer().Start(ctx, "Present")
+	err = solver.Present(presentCtx, pending)
+	endSpan(presentSpan, err)
+	if err != nil {
+		return err
+	}
+	c.Metrics.ChallengesPresented(solver.ChallengeType(), time.Since(start))
+
+	return forEach(ctx, c.workers(), len(pending), func(i int) error {
+		p := pending[i]
+		logger := c.log().With(logKeyDomain, p.Identifier.Value, logKeyAuthz, p.AuthzURL)
+		err := c.ChallengeReady(ctx, p.Challenge.URL)
+		if err != nil {
+			logger.Error("Failed telling the CA the challenge is ready", logKeyStep, "challenge", logKeyError, err)
+			return fmt.Errorf("%s: %v", p.Identifier.Value, err)
+		}
+
+		authz, err := c.WaitForAuthorization(ctx, p.AuthzURL)
+		if err != nil {
+			logger.Error("Authorization failed", logKeyStep, "validate", logKeyError, err)
+			return err
+		}
+		logger.Info("Authorization is valid", logKeyStep, "validate")
+		c.authzs.put(authz)
+		return nil
+	})
+}
+
+// WaitForAuthorization polls an authorization until it's valid,
+// honoring Retry-After between polls and giving up once c.Backoff's
+// poll limits are reached.   If it ends up invalid, deactivated, expired
+// or revoked instead, the error is an *AuthorizationError carrying the
+// failed challenge's error from the CA.
+func (c *Client) WaitForAuthorization(ctx context.Context, authzURL string) (ChallengeResponse, error) {
+	var authz ChallengeResponse
+	err := c.poll(ctx, func(ctx context.Context) (bool, http.Header, error) {
+		authz = ChallengeResponse{}
+		res, err := c.post(ctx, resourceAuthz, nil, authzURL, true, "")
+		if err != nil {
+			return false, nil, err
+		}
+		err = json.Unmarshal(res.Body, &authz)
+		if err != nil {
+			return false, nil, err
+		}
+		authz.URL = authzURL
+
+		switch authz.Status {
+		case StatusValid:
+			return true, nil, nil
+		case StatusPending:
+			return false, res.Header, nil
+		default:
+			return false, nil, authorizationError(authz)
+		}
+	})
+	if errors.Is(err, ErrPollTimeout) {
+		err = fmt.Errorf("Authorization for %s is still %q: %w", authz.Identifier.Value, authz.Status, err)
+	}
+	return authz, err
+}
+
+// forEach calls fn for 0 through n-1 using at most limit goroutines,
+// and returns every error that came back.
+func forEach(ctx context.Context, limit, n int, fn func(i int) error) error {
+	sem := make(chan struct{}, limit)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+		if errs[i] != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,51 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachBoundsConcurrency(t *testing.T) {
+	var running, most int32
+
+	err := forEach(context.Background(), 3, 20, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("forEach should not have error'd, but it did: %v", err)
+	}
+	if most > 3 {
+		t.Errorf("expected at most 3 running at once, saw %d", most)
+	}
+}
+
+func TestForEachCollectsErrors(t *testing.T) {
+	errOdd := errors.New("odd")
+	var calls int32
+
+	err := forEach(context.Background(), 4, 10, func(i int) error {
+		atomic.AddInt32(&calls, 1)
+		if i%2 == 1 {
+			return errOdd
+		}
+		return nil
+	})
+	if calls != 10 {
+		t.Errorf("expected every item to be tried, got %d calls", calls)
+	}
+	if !errors.Is(err, errOdd) {
+		t.Errorf("expected the failures to be returned, got %v", err)
+	}
+}
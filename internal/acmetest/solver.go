@@ -0,0 +1,30 @@
+package acmetest
+
+import "context"
+
+// PendingChallenge is a challenge we've picked for an authorization,
+// along with everything a Solver needs to answer it.
+type PendingChallenge struct {
+	AuthzURL   string
+	Identifier CertIdentifier
+	Challenge  Challenge
+	KeyAuth    string // token.thumbprint, see RFC8555 section 8.1
+}
+
+// Solver answers one type of ACME challenge.   Solvers are handed every
+// challenge for an order at once so they can batch up whatever work is
+// needed, and Present shouldn't return until the CA could see them.
+type Solver interface {
+	ChallengeType() string
+	Present(ctx context.Context, challenges []PendingChallenge) error
+	CleanUp(ctx context.Context, challenges []PendingChallenge) error
+}
+
+func findChallenge(challenges []Challenge, challengeType string) (Challenge, bool) {
+	for _, c := range challenges {
+		if c.Type == challengeType {
+			return c, true
+		}
+	}
+	return Challenge{}, false
+}
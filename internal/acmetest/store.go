@@ -0,0 +1,136 @@
+package acmetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// ErrCertNotFound is returned by a CertStore when it has nothing under
+// the name asked for.
+var ErrCertNotFound = errors.New("Certificate not found")
+
+// CertBundle is an issued certificate with its key, in the shape it gets
+// handed to and back from a CertStore.
+type CertBundle struct {
+	Name     string
+	Domains  []string
+	KeyPEM   []byte
+	CertPEM  []byte // just the leaf
+	ChainPEM []byte // intermediates, without the leaf
+	Tags     map[string]string
+
+	// Metadata is anything a store has to say about where it put the
+	// certificate, like the ARN ACMStore imported it into.   Stores
+	// fill it in on Load and ignore it on Store.
+	Metadata map[string]string
+}
+
+// CertStore is somewhere issued certificates are kept.   Load returns
+// ErrCertNotFound if nothing has been stored under the name yet.
+type CertStore interface {
+	Store(ctx context.Context, bundle CertBundle) error
+	Load(ctx context.Context, name string) (CertBundle, error)
+}
+
+// VersionedCertStore is a CertStore that keeps what each Store replaced.
+// LoadPrevious returns the bundle stored before the current one, or
+// ErrCertNotFound if there's only been one.
+type VersionedCertStore interface {
+	CertStore
+	LoadPrevious(ctx context.Context, name string) (CertBundle, error)
+}
+
+// NewCertBundle puts a freshly issued chain and its key together.
+func NewCertBundle(name string, domains []string, keyPEM []byte, chain CertChain) CertBundle {
+	return CertBundle{
+		Name:     name,
+		Domains:  domains,
+		KeyPEM:   keyPEM,
+		CertPEM:  chain.LeafPEM(),
+		ChainPEM: chain.ChainPEM(),
+	}
+}
+
+// FullChainPEM returns the leaf followed by the intermediates.
+func (b CertBundle) FullChainPEM() []byte {
+	return append(append([]byte{}, b.CertPEM...), b.ChainPEM...)
+}
+
+// Certificate parses the leaf certificate out of the bundle.
+func (b CertBundle) Certificate() (*x509.Certificate, error) {
+	chain, err := ParseChain(b.CertPEM)
+	if err != nil {
+		return nil, err
+	}
+	return chain.Leaf, nil
+}
+
+// DefaultNameTemplate names stored certificates the way they always have
+// been, ssl_<first domain> with a leading wildcard turned into _.
+const DefaultNameTemplate = "ssl_{{.Domain}}"
+
+// NameData is what a store naming template gets to work with.
+type NameData struct {
+	Domain  string   // first domain, with * replaced by _
+	Domains []string // every domain on the certificate
+}
+
+// CertName runs a naming template for a certificate's domains.
+func CertName(nameTemplate string, domains []string) (string, error) {
+	if nameTemplate == "" {
+		nameTemplate = DefaultNameTemplate
+	}
+	if len(domains) == 0 {
+		return "", errors.New("Can't name a certificate with no domains")
+	}
+
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, NameData{
+		Domain:  strings.Replace(domains[0], "*", "_", 1),
+		Domains: domains,
+	})
+	return b.String(), err
+}
+
+// StorePathData is what a store's path template, like FileStore.Dir,
+// gets to work with.
+type StorePathData struct {
+	Name string // what the certificate is stored under
+}
+
+// storePath runs a store's path template for name.
+func storePath(pathTemplate, name string) (string, error) {
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(pathTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, StorePathData{Name: name})
+	return b.String(), err
+}
+
+// domainSetHash is a hash of a certificate's domains, lowercased and
+// sorted, for stores that can't fit every domain in a tag or metadata
+// value but want to find the certificate for the same set again.
+func domainSetHash(domains []string) string {
+	names := make([]string, len(domains))
+	for i, d := range domains {
+		names[i] = strings.ToLower(d)
+	}
+	sort.Strings(names)
+	sum := sha256.Sum256([]byte(strings.Join(names, ",")))
+	return hex.EncodeToString(sum[:])
+}
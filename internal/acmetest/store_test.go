@@ -0,0 +1,401 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+
+	"github.com/swerveaux/acmetest/internal/awstest"
+)
+
+// storeFixture is a CertStore under test.   Deny, if it's set, makes the
+// store's backend refuse every request for name, the way a missing IAM
+// or RBAC permission would.   WriteOnlyKeys is for stores that take a
+// key but never give it back, so Load isn't expected to return it.
+type storeFixture struct {
+	Store         CertStore
+	Deny          func(name string)
+	WriteOnlyKeys bool
+}
+
+// testCertStore runs the behaviour every CertStore has to have against
+// fresh stores from newStore.
+func testCertStore(t *testing.T, newStore func(t *testing.T) storeFixture) {
+	ca := newStoreTestCA(t)
+	ctx := context.Background()
+	writeOnlyKeys := newStore(t).WriteOnlyKeys
+	checkBundle := func(t *testing.T, got, want CertBundle) {
+		t.Helper()
+		if writeOnlyKeys {
+			got.KeyPEM = want.KeyPEM
+		}
+		checkBundle(t, got, want)
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		store := newStore(t).Store
+		want := ca.bundle(t, "ssl_example.org", "example.org", "www.example.org")
+		if err := store.Store(ctx, want); err != nil {
+			t.Fatalf("store should not have error'd, but it did: %v", err)
+		}
+		got, err := store.Load(ctx, "ssl_example.org")
+		if err != nil {
+			t.Fatalf("load should not have error'd, but it did: %v", err)
+		}
+		checkBundle(t, got, want)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t).Store
+		first := ca.bundle(t, "ssl_example.org", "example.org")
+		second := ca.bundle(t, "ssl_example.org", "example.org", "www.example.org")
+		for _, b := range []CertBundle{first, second} {
+			if err := store.Store(ctx, b); err != nil {
+				t.Fatalf("store should not have error'd, but it did: %v", err)
+			}
+		}
+		got, err := store.Load(ctx, "ssl_example.org")
+		if err != nil {
+			t.Fatalf("load should not have error'd, but it did: %v", err)
+		}
+		checkBundle(t, got, second)
+	})
+
+	t.Run("Versions", func(t *testing.T) {
+		store, ok := newStore(t).Store.(VersionedCertStore)
+		if !ok {
+			t.Skip("store doesn't keep versions")
+		}
+		bundles := []CertBundle{
+			ca.bundle(t, "ssl_example.org", "example.org"),
+			ca.bundle(t, "ssl_example.org", "example.org"),
+			ca.bundle(t, "ssl_example.org", "example.org"),
+		}
+
+		if err := store.Store(ctx, bundles[0]); err != nil {
+			t.Fatalf("store should not have error'd, but it did: %v", err)
+		}
+		if _, err := store.LoadPrevious(ctx, "ssl_example.org"); !errors.Is(err, ErrCertNotFound) {
+			t.Errorf("expected ErrCertNotFound with only one version, got %v", err)
+		}
+
+		for i := 1; i < len(bundles); i++ {
+			if err := store.Store(ctx, bundles[i]); err != nil {
+				t.Fatalf("store should not have error'd, but it did: %v", err)
+			}
+			prev, err := store.LoadPrevious(ctx, "ssl_example.org")
+			if err != nil {
+				t.Fatalf("load previous should not have error'd, but it did: %v", err)
+			}
+			checkBundle(t, prev, bundles[i-1])
+			cur, err := store.Load(ctx, "ssl_example.org")
+			if err != nil {
+				t.Fatalf("load should not have error'd, but it did: %v", err)
+			}
+			checkBundle(t, cur, bundles[i])
+		}
+	})
+
+	t.Run("SharedDomains", func(t *testing.T) {
+		// Two names for the same domains, like an RSA and an ECDSA
+		// certificate, are kept apart through renewals.
+		store := newStore(t).Store
+		var latest [2]CertBundle
+		for round := 0; round < 2; round++ {
+			for i, name := range []string{"rsa_example.org", "ecdsa_example.org"} {
+				latest[i] = ca.bundle(t, name, "example.org", "www.example.org")
+				if err := store.Store(ctx, latest[i]); err != nil {
+					t.Fatalf("store should not have error'd, but it did: %v", err)
+				}
+			}
+		}
+		for _, want := range latest {
+			got, err := store.Load(ctx, want.Name)
+			if err != nil {
+				t.Fatalf("load of %s should not have error'd, but it did: %v", want.Name, err)
+			}
+			checkBundle(t, got, want)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		store := newStore(t).Store
+		if err := store.Store(ctx, ca.bundle(t, "ssl_example.org", "example.org")); err != nil {
+			t.Fatalf("store should not have error'd, but it did: %v", err)
+		}
+		_, err := store.Load(ctx, "ssl_example.net")
+		if !errors.Is(err, ErrCertNotFound) {
+			t.Errorf("expected ErrCertNotFound, got %v", err)
+		}
+	})
+
+	t.Run("PermissionDenied", func(t *testing.T) {
+		f := newStore(t)
+		if f.Deny == nil {
+			t.Skip("store has no permissions to take away")
+		}
+		b := ca.bundle(t, "ssl_example.org", "example.org")
+		if err := f.Store.Store(ctx, b); err != nil {
+			t.Fatalf("store should not have error'd, but it did: %v", err)
+		}
+		f.Deny("ssl_example.org")
+
+		if err := f.Store.Store(ctx, b); err == nil {
+			t.Errorf("store without permission should have error'd")
+		}
+		_, err := f.Store.Load(ctx, "ssl_example.org")
+		if err == nil || errors.Is(err, ErrCertNotFound) {
+			t.Errorf("load without permission should have error'd with something other than ErrCertNotFound, got %v", err)
+		}
+	})
+
+	t.Run("ConcurrentWrites", func(t *testing.T) {
+		store := newStore(t).Store
+		const writers = 8
+
+		same := make([]CertBundle, writers)
+		other := make([]CertBundle, writers)
+		for i := range same {
+			same[i] = ca.bundle(t, "ssl_example.org", "example.org")
+			other[i] = ca.bundle(t, fmt.Sprintf("ssl_%d.example.org", i), fmt.Sprintf("%d.example.org", i))
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 2*writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(2)
+			go func(b CertBundle) {
+				defer wg.Done()
+				errs <- store.Store(ctx, b)
+			}(same[i])
+			go func(b CertBundle) {
+				defer wg.Done()
+				errs <- store.Store(ctx, b)
+			}(other[i])
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("concurrent store should not have error'd, but it did: %v", err)
+			}
+		}
+
+		// Whichever write won, the key and certificate have to be
+		// from the same one.
+		got, err := store.Load(ctx, "ssl_example.org")
+		if err != nil {
+			t.Fatalf("load should not have error'd, but it did: %v", err)
+		}
+		found := false
+		for _, b := range same {
+			if string(b.CertPEM) == string(got.CertPEM) {
+				checkBundle(t, got, b)
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("loaded a certificate none of the writers stored")
+		}
+		if !writeOnlyKeys {
+			checkKeyMatches(t, got)
+		}
+
+		for _, want := range other {
+			got, err := store.Load(ctx, want.Name)
+			if err != nil {
+				t.Fatalf("load %s should not have error'd, but it did: %v", want.Name, err)
+			}
+			checkBundle(t, got, want)
+		}
+	})
+}
+
+// checkBundle compares what a store gave back with what it was given.
+func checkBundle(t *testing.T, got, want CertBundle) {
+	t.Helper()
+	if got.Name != want.Name {
+		t.Errorf("expected name %q, got %q", want.Name, got.Name)
+	}
+	if string(got.KeyPEM) != string(want.KeyPEM) {
+		t.Errorf("%s: key doesn't match what was stored", want.Name)
+	}
+	if string(got.CertPEM) != string(want.CertPEM) {
+		t.Errorf("%s: certificate doesn't match what was stored", want.Name)
+	}
+	if string(got.ChainPEM) != string(want.ChainPEM) {
+		t.Errorf("%s: chain doesn't match what was stored", want.Name)
+	}
+	gotDomains := append([]string{}, got.Domains...)
+	wantDomains := append([]string{}, want.Domains...)
+	sort.Strings(gotDomains)
+	sort.Strings(wantDomains)
+	if fmt.Sprint(gotDomains) != fmt.Sprint(wantDomains) {
+		t.Errorf("%s: expected domains %v, got %v", want.Name, wantDomains, gotDomains)
+	}
+}
+
+// checkKeyMatches makes sure a bundle's key is the one its certificate
+// was issued for.
+func checkKeyMatches(t *testing.T, b CertBundle) {
+	t.Helper()
+	leaf, err := b.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b.KeyPEM)
+	if block == nil {
+		t.Fatalf("%s: no PEM in key", b.Name)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(leaf.PublicKey) {
+		t.Errorf("%s: key doesn't match the certificate", b.Name)
+	}
+}
+
+// storeTestCA issues the leaf certificates the store tests write, so
+// every bundle has a chain to store.
+type storeTestCA struct {
+	key    *ecdsa.PrivateKey
+	cert   *x509.Certificate
+	mu     sync.Mutex
+	serial int64
+}
+
+func newStoreTestCA(t *testing.T) *storeTestCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "store test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &storeTestCA{key: key, cert: cert, serial: 1}
+}
+
+// bundle issues a certificate for names with a new key.
+func (ca *storeTestCA) bundle(t *testing.T, name string, names ...string) CertBundle {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.mu.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mu.Unlock()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := EncodeKeyPEM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCertBundle(name, names, keyPEM, CertChain{Leaf: leaf, Intermediates: []*x509.Certificate{ca.cert}})
+}
+
+func TestMemStore(t *testing.T) {
+	testCertStore(t, func(t *testing.T) storeFixture {
+		return storeFixture{Store: &memStore{}}
+	})
+}
+
+func TestSecretsManagerStore(t *testing.T) {
+	testCertStore(t, func(t *testing.T) storeFixture {
+		sm := awstest.NewSecretsManager()
+		return storeFixture{
+			Store: &SecretsManagerStore{SM: sm},
+			Deny: func(name string) {
+				sm.Deny(name + ".key")
+				sm.Deny(name + ".crt")
+			},
+		}
+	})
+}
+
+func TestPutSecretErrors(t *testing.T) {
+	ctx := context.Background()
+
+	// Anything but "not found" from the update is returned as is,
+	// without trying to create the secret.
+	sm := awstest.NewSecretsManager()
+	sm.Deny("ssl_example.org.key")
+	err := putSecret(ctx, sm, "ssl_example.org.key", "pem", secretOptions{})
+	if !isAWSError(err, awstest.ErrCodeAccessDenied) {
+		t.Errorf("expected AccessDeniedException, got %v", err)
+	}
+	if n := sm.Calls("CreateSecret"); n != 0 {
+		t.Errorf("expected no CreateSecret after a denied update, got %d", n)
+	}
+
+	// If the create fails, that's the error we hear about.
+	sm = awstest.NewSecretsManager()
+	sm.FailNext("CreateSecret", awserr.New(secretsmanager.ErrCodeLimitExceededException, "too many secrets", nil))
+	err = putSecret(ctx, sm, "ssl_example.org.key", "pem", secretOptions{})
+	if !isAWSError(err, secretsmanager.ErrCodeLimitExceededException) {
+		t.Errorf("expected the create's LimitExceededException, got %v", err)
+	}
+
+	// Someone else creating the secret between our update and create
+	// means we update it after all.
+	sm = awstest.NewSecretsManager()
+	if err := putSecret(ctx, sm, "ssl_example.org.key", "first", secretOptions{}); err != nil {
+		t.Fatalf("put should not have error'd, but it did: %v", err)
+	}
+	sm.FailNext("UpdateSecret", awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "not yet", nil))
+	if err := putSecret(ctx, sm, "ssl_example.org.key", "second", secretOptions{}); err != nil {
+		t.Fatalf("put after losing the create race should not have error'd, but it did: %v", err)
+	}
+	got, err := getSecret(ctx, sm, "ssl_example.org.key", "")
+	if err != nil || got != "second" {
+		t.Errorf("expected the second value to win, got %q, %v", got, err)
+	}
+	if n := sm.Versions("ssl_example.org.key"); n != 2 {
+		t.Errorf("expected 2 versions, got %d", n)
+	}
+}
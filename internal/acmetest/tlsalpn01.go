@@ -0,0 +1,216 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acmeTLS1Protocol is the ALPN protocol the CA asks for, RFC8737 section 6.2.
+const acmeTLS1Protocol = "acme-tls/1"
+
+// idPeAcmeIdentifier is the OID of the acmeIdentifier extension holding
+// the SHA-256 of the key authorization, RFC8737 section 6.1.
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// TLSALPN01Solver answers tls-alpn-01 challenges by serving TLS on Addr
+// (":443" if empty) for as long as there are challenges outstanding.
+// For an ip identifier the CA sends the reverse-DNS name of the address
+// as SNI, so that's what the certificate is looked up by.
+//
+// Orders running at once can present challenges for the same identifier,
+// so each name keeps a stack of certificates, one per Present, with the
+// newest served.   CleanUp only takes off its own, and the name isn't
+// forgotten until the last one is cleaned up.
+type TLSALPN01Solver struct {
+	Addr string
+
+	mu       sync.Mutex
+	certs    map[string][]tlsALPN01Entry
+	listener net.Listener
+}
+
+// tlsALPN01Entry is one presented challenge's certificate.
+type tlsALPN01Entry struct {
+	keyAuth string
+	cert    *tls.Certificate
+}
+
+// ChallengeType returns tls-alpn-01.
+func (s *TLSALPN01Solver) ChallengeType() string {
+	return ChallengeTLSALPN01
+}
+
+// Present makes a validation certificate for every challenge and starts
+// serving them.
+func (s *TLSALPN01Solver) Present(ctx context.Context, challenges []PendingChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.certs == nil {
+		s.certs = make(map[string][]tlsALPN01Entry)
+	}
+	for _, ch := range challenges {
+		cert, err := tlsALPN01Cert(ch.Identifier, ch.KeyAuth)
+		if err != nil {
+			return err
+		}
+		name := tlsALPN01ServerName(ch.Identifier)
+		s.certs[name] = append(s.certs[name], tlsALPN01Entry{keyAuth: ch.KeyAuth, cert: cert})
+	}
+
+	if s.listener != nil {
+		return nil
+	}
+
+	addr := s.Addr
+	if addr == "" {
+		addr = ":443"
+	}
+	l, err := tls.Listen("tcp", addr, &tls.Config{
+		NextProtos:     []string{acmeTLS1Protocol},
+		GetCertificate: s.getCertificate,
+	})
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	go serveTLSALPN(l)
+
+	return nil
+}
+
+// CleanUp forgets the challenges' certificates, leaving any other
+// order's for the same names, and stops serving once there are none left.
+func (s *TLSALPN01Solver) CleanUp(ctx context.Context, challenges []PendingChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ch := range challenges {
+		name := tlsALPN01ServerName(ch.Identifier)
+		stack := s.certs[name]
+		for i := len(stack) - 1; i >= 0; i-- {
+			if stack[i].keyAuth == ch.KeyAuth {
+				stack = append(stack[:i], stack[i+1:]...)
+				break
+			}
+		}
+		if len(stack) == 0 {
+			delete(s.certs, name)
+		} else {
+			s.certs[name] = stack
+		}
+	}
+	if len(s.certs) > 0 || s.listener == nil {
+		return nil
+	}
+
+	err := s.listener.Close()
+	s.listener = nil
+	return err
+}
+
+// ListenAddr returns the address the solver is serving on, or nil if it
+// isn't.
+func (s *TLSALPN01Solver) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *TLSALPN01Solver) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acmeTLS1Protocol {
+		return nil, fmt.Errorf("Only %s is served here", acmeTLS1Protocol)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack := s.certs[strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))]
+	if len(stack) == 0 {
+		return nil, fmt.Errorf("No challenge for %q", hello.ServerName)
+	}
+	return stack[len(stack)-1].cert, nil
+}
+
+// serveTLSALPN completes handshakes and hangs up, which is all the CA
+// needs to see the certificate.
+func serveTLSALPN(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			conn.(*tls.Conn).Handshake()
+		}()
+	}
+}
+
+// tlsALPN01ServerName is the SNI the CA will send for an identifier.
+func tlsALPN01ServerName(identifier CertIdentifier) string {
+	if identifier.Type == IdentifierIP {
+		return reverseDNSName(net.ParseIP(identifier.Value))
+	}
+	return strings.ToLower(identifier.Value)
+}
+
+// tlsALPN01Cert makes the self-signed validation certificate for an
+// identifier: its only SAN is the identifier, and it carries the
+// critical acmeIdentifier extension with the key authorization's hash.
+func tlsALPN01Cert(identifier CertIdentifier, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(keyAuth))
+	extValue, err := asn1.Marshal(hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ACME challenge"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPeAcmeIdentifier, Critical: true, Value: extValue},
+		},
+	}
+	switch identifier.Type {
+	case IdentifierIP:
+		tmpl.IPAddresses = []net.IP{net.ParseIP(identifier.Value)}
+	default:
+		tmpl.DNSNames = []string{identifier.Value}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
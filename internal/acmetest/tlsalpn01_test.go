@@ -0,0 +1,176 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestTLSALPN01Solver(t *testing.T) {
+	ctx := context.Background()
+	s := &TLSALPN01Solver{Addr: "127.0.0.1:0"}
+	ch := PendingChallenge{
+		Identifier: NewIdentifier("192.0.2.1"),
+		Challenge:  Challenge{Type: ChallengeTLSALPN01, Token: "tok"},
+		KeyAuth:    "tok.thumb",
+	}
+
+	err := s.Present(ctx, []PendingChallenge{ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CleanUp(ctx, []PendingChallenge{ch})
+
+	conn, err := tls.Dial("tcp", s.ListenAddr().String(), &tls.Config{
+		ServerName:         "1.2.0.192.in-addr.arpa",
+		NextProtos:         []string{acmeTLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acmeTLS1Protocol {
+		t.Errorf("expected %s to be negotiated, got %q", acmeTLS1Protocol, state.NegotiatedProtocol)
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) != 0 || len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected only the IP as a SAN, got %v %v", cert.DNSNames, cert.IPAddresses)
+	}
+	checkAcmeIdentifier(t, cert, "tok.thumb")
+}
+
+func TestTLSALPN01SolverUnknownName(t *testing.T) {
+	ctx := context.Background()
+	s := &TLSALPN01Solver{Addr: "127.0.0.1:0"}
+	ch := PendingChallenge{
+		Identifier: NewIdentifier("example.org"),
+		Challenge:  Challenge{Type: ChallengeTLSALPN01, Token: "tok"},
+		KeyAuth:    "tok.thumb",
+	}
+
+	err := s.Present(ctx, []PendingChallenge{ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CleanUp(ctx, []PendingChallenge{ch})
+
+	conn, err := tls.Dial("tcp", s.ListenAddr().String(), &tls.Config{
+		ServerName:         "other.example.org",
+		NextProtos:         []string{acmeTLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		conn.Close()
+		t.Error("test of an unknown server name should have error'd")
+	}
+}
+
+func TestTLSALPN01SolverSharedNames(t *testing.T) {
+	ctx := context.Background()
+	s := &TLSALPN01Solver{Addr: "127.0.0.1:0"}
+	challenge := func(keyAuth string) PendingChallenge {
+		return PendingChallenge{
+			Identifier: NewIdentifier("example.org"),
+			Challenge:  Challenge{Type: ChallengeTLSALPN01, Token: "tok"},
+			KeyAuth:    keyAuth,
+		}
+	}
+	served := func() string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", s.ListenAddr().String(), &tls.Config{
+			ServerName:         "example.org",
+			NextProtos:         []string{acmeTLS1Protocol},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var got []byte
+		for _, ext := range conn.ConnectionState().PeerCertificates[0].Extensions {
+			if ext.Id.Equal(idPeAcmeIdentifier) {
+				asn1.Unmarshal(ext.Value, &got)
+			}
+		}
+		for _, keyAuth := range []string{"tok.first", "tok.second"} {
+			if sum := sha256.Sum256([]byte(keyAuth)); string(got) == string(sum[:]) {
+				return keyAuth
+			}
+		}
+		return ""
+	}
+
+	// Orders running at once present and clean up the same name, some
+	// with the same authorization and so the same key authorization.
+	holder := challenge("tok.first")
+	if err := s.Present(ctx, []PendingChallenge{holder}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		ch := challenge("tok.first")
+		if i%2 == 1 {
+			ch = challenge("tok.second")
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Present(ctx, []PendingChallenge{ch}); err != nil {
+				t.Error(err)
+			}
+			if err := s.CleanUp(ctx, []PendingChallenge{ch}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := served(); got != "tok.first" {
+		t.Errorf("expected the remaining order's certificate to still be served, got %q", got)
+	}
+
+	// The first order cleaning up doesn't take away the second's.
+	second := challenge("tok.second")
+	if err := s.Present(ctx, []PendingChallenge{second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanUp(ctx, []PendingChallenge{holder}); err != nil {
+		t.Fatal(err)
+	}
+	if got := served(); got != "tok.second" {
+		t.Errorf("expected the second order's certificate to be served, got %q", got)
+	}
+	if err := s.CleanUp(ctx, []PendingChallenge{second}); err != nil {
+		t.Fatal(err)
+	}
+	if s.ListenAddr() != nil {
+		t.Error("expected the server to stop once the last order cleaned up")
+	}
+}
+
+func checkAcmeIdentifier(t *testing.T, cert *x509.Certificate, keyAuth string) {
+	t.Helper()
+	want := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeAcmeIdentifier) {
+			continue
+		}
+		if !ext.Critical {
+			t.Error("expected the acmeIdentifier extension to be critical")
+		}
+		var got []byte
+		_, err := asn1.Unmarshal(ext.Value, &got)
+		if err != nil || string(got) != string(want[:]) {
+			t.Errorf("expected the key authorization hash in acmeIdentifier, got %x (%v)", got, err)
+		}
+		return
+	}
+	t.Error("expected an acmeIdentifier extension")
+}
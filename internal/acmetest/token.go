@@ -49,7 +49,7 @@ type publicKey struct {
 
 // JWSEncodeJSON signs a claimset using provided key and a nonce.
 // The result is serialized in JSON format.
-func (c *Client) JWSEncodeJSON(claimset interface{}, url string, postAsGet bool) ([]byte, error) {
+func (c *Client) JWSEncodeJSON(claimset interface{}, url, nonce string, postAsGet bool) ([]byte, error) {
 	var b []byte
 	jwk, err := jwkEncode(c.Key.Public())
 	if err != nil {
@@ -62,9 +62,9 @@ func (c *Client) JWSEncodeJSON(claimset interface{}, url string, postAsGet bool)
 	}
 	var phead string
 	if url == c.Directory.NewAccount {
-		phead = fmt.Sprintf(`{"alg":%q,"jwk":%s,"nonce":%q,"typ":%q,"url":%q}`, alg, jwk, c.Nonce, "JWT", url)
+		phead = fmt.Sprintf(`{"alg":%q,"jwk":%s,"nonce":%q,"typ":%q,"url":%q}`, alg, jwk, nonce, "JWT", url)
 	} else {
-		phead = fmt.Sprintf(`{"alg":%q,"kid":%q,"nonce":%q,"typ":%q,"url":%q}`, alg, c.KID, c.Nonce, "JWT", url)
+		phead = fmt.Sprintf(`{"alg":%q,"kid":%q,"nonce":%q,"typ":%q,"url":%q}`, alg, c.KID, nonce, "JWT", url)
 	}
 
 	phead = base64.RawURLEncoding.EncodeToString([]byte(phead))
@@ -74,7 +74,6 @@ func (c *Client) JWSEncodeJSON(claimset interface{}, url string, postAsGet bool)
 		return b, err
 	}
 
-	fmt.Printf("Encoding %s into base64\n", cs)
 	var payload string
 	if postAsGet {
 		payload = ""
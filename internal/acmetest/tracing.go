@@ -0,0 +1,74 @@
+package acmetest
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name spans are created under.
+const tracerName = "github.com/swerveaux/acmetest/internal/acmetest"
+
+// ACME resources, named as in the directory where there's a directory
+// entry for them.   Request spans are labelled with these.
+const (
+	resourceNewNonce    = "newNonce"
+	resourceNewAccount  = "newAccount"
+	resourceNewOrder    = "newOrder"
+	resourceNewAuthz    = "newAuthz"
+	resourceOrder       = "order"
+	resourceAuthz       = "authorization"
+	resourceChallenge   = "challenge"
+	resourceFinalize    = "finalize"
+	resourceCertificate = "certificate"
+	resourceRevokeCert  = "revokeCert"
+)
+
+// Span attribute keys.
+const (
+	attrResource   = attribute.Key("acme.resource")
+	attrProblem    = attribute.Key("acme.problem.type")
+	attrRetries    = attribute.Key("acme.retries")
+	attrOrder      = attribute.Key("acme.order.url")
+	attrAuthz      = attribute.Key("acme.authorization.url")
+	attrDomains    = attribute.Key("acme.domains")
+	attrChallenge  = attribute.Key("acme.challenge.type")
+	attrChallenges = attribute.Key("acme.challenges")
+	attrURL        = attribute.Key("url.full")
+	attrStatusCode = attribute.Key("http.response.status_code")
+	attrZone       = attribute.Key("dns.zone")
+	attrDNSAction  = attribute.Key("dns.action")
+	attrStore      = attribute.Key("store.name")
+	attrCertName   = attribute.Key("certificate.name")
+)
+
+// tracer returns the tracer from tp, or from the global TracerProvider
+// if tp is nil, which doesn't record anything unless the program has
+// set one up.
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// tracer returns the Client's tracer.
+func (c *Client) tracer() trace.Tracer {
+	return tracer(c.TracerProvider)
+}
+
+// endSpan records err on span, if there is one, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		var p *Problem
+		if errors.As(err, &p) {
+			span.SetAttributes(attrProblem.String(p.Type))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,140 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func testTracerProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), exporter
+}
+
+// spansNamed returns the finished spans called name.
+func spansNamed(exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStubs {
+	var spans tracetest.SpanStubs
+	for _, s := range exporter.GetSpans() {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func spanAttr(s tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestRequestSpans(t *testing.T) {
+	tp, exporter := testTracerProvider()
+	srv, _ := sequenceServer(t, pendingAuthz, `{"status":"valid","identifier":{"type":"dns","value":"example.org"}}`)
+	c := testClient(t, srv)
+	c.TracerProvider = tp
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	_, err := c.WaitForAuthorization(ctx, srv.URL+"/authz/1")
+	parent.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := spansNamed(exporter, "ACME "+resourceAuthz)
+	if len(spans) != 2 {
+		t.Fatalf("expected a span per poll, got %d", len(spans))
+	}
+	for _, s := range spans {
+		if s.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("expected the request span under the caller's span, got parent %s", s.Parent.SpanID())
+		}
+		if v, _ := spanAttr(s, attrResource); v.AsString() != resourceAuthz {
+			t.Errorf("expected acme.resource %q, got %q", resourceAuthz, v.AsString())
+		}
+		if v, _ := spanAttr(s, attrStatusCode); v.AsInt64() != http.StatusOK {
+			t.Errorf("expected status 200 on the span, got %d", v.AsInt64())
+		}
+	}
+
+	nonceSpans := spansNamed(exporter, "ACME "+resourceNewNonce)
+	if len(nonceSpans) != 1 || nonceSpans[0].Parent.SpanID() != spans[0].SpanContext.SpanID() {
+		t.Errorf("expected one nonce fetch under the first request, got %d", len(nonceSpans))
+	}
+}
+
+func TestRequestSpanErrors(t *testing.T) {
+	tp, exporter := testTracerProvider()
+	srv, _ := retryServer(t, "0", 429, 429, 429)
+	c := testClient(t, srv)
+	c.TracerProvider = tp
+
+	_, err := c.post(context.Background(), resourceNewOrder, nil, srv.URL+"/new-order", false, "")
+	if err == nil {
+		t.Fatal("test of running out of retries should have error'd")
+	}
+
+	spans := spansNamed(exporter, "ACME "+resourceNewOrder)
+	if len(spans) != 1 {
+		t.Fatalf("expected one span for the request and its retries, got %d", len(spans))
+	}
+	s := spans[0]
+	if s.Status.Code != codes.Error {
+		t.Errorf("expected an error status, got %v", s.Status)
+	}
+	if v, _ := spanAttr(s, attrProblem); v.AsString() != ProblemRateLimited {
+		t.Errorf("expected the problem type on the span, got %q", v.AsString())
+	}
+	if v, _ := spanAttr(s, attrRetries); v.AsInt64() != 2 {
+		t.Errorf("expected 2 retries on the span, got %d", v.AsInt64())
+	}
+	if v, _ := spanAttr(s, attrStatusCode); v.AsInt64() != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 on the span, got %d", v.AsInt64())
+	}
+}
+
+func TestApplySpans(t *testing.T) {
+	tp, exporter := testTracerProvider()
+	now := time.Now()
+	store := &memStore{}
+	store.Store(context.Background(), CertBundle{
+		Name:    "ssl_example.org",
+		CertPEM: encodeCerts([]*x509.Certificate{testLeaf(t, []string{"example.org"}, now.Add(60*24*time.Hour))}),
+	})
+
+	a := Applier{
+		Client:  &Client{TracerProvider: tp},
+		Solvers: map[string]Solver{"route53": &Route53Solver{}},
+		Stores:  map[string]CertStore{"asm": store},
+		now:     func() time.Time { return now },
+	}
+	m := Manifest{Certificates: []CertSpec{{Names: []string{"example.org"}}}}
+
+	_, err := a.Apply(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apply := spansNamed(exporter, "Apply")
+	certs := spansNamed(exporter, "ApplyCertificate")
+	loads := spansNamed(exporter, "Store Load")
+	if len(apply) != 1 || len(certs) != 1 || len(loads) != 1 {
+		t.Fatalf("expected one each of Apply, ApplyCertificate and Store Load, got %d, %d and %d", len(apply), len(certs), len(loads))
+	}
+	if certs[0].Parent.SpanID() != apply[0].SpanContext.SpanID() || loads[0].Parent.SpanID() != certs[0].SpanContext.SpanID() {
+		t.Error("expected Apply > ApplyCertificate > Store Load")
+	}
+	if v, _ := spanAttr(certs[0], attribute.Key("certificate.action")); v.AsString() != ActionCurrent {
+		t.Errorf("expected the action on the span, got %q", v.AsString())
+	}
+}
@@ -0,0 +1,413 @@
+package acmetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for VaultStore.
+const (
+	DefaultVaultMount        = "secret"
+	DefaultVaultPathTemplate = "{{.Name}}"
+	DefaultVaultAppRoleMount = "approle"
+)
+
+// VaultStore keeps certificates in a HashiCorp Vault KV version 2 engine,
+// one secret per name with the key under "key" and the full chain under
+// "crt", the same halves SecretsManagerStore writes as <name>.key and
+// <name>.crt.   The issuer, expiry, serial, how many domains there are and
+// a hash of them, and the bundle's tags go in the secret's custom
+// metadata, along with the domains themselves if they fit.   Tags that
+// would break Vault's custom metadata limits are refused before anything
+// is written.
+//
+// Every Store is a new KV version, so LoadPrevious and LoadVersion can
+// read back what a renewal replaced, as far back as the engine's
+// max_versions keeps.
+type VaultStore struct {
+	// Address is Vault's URL, like VAULT_ADDR.   Namespace is only
+	// for Vault Enterprise.
+	Address    string
+	Namespace  string
+	HTTPClient *http.Client
+
+	// Mount is where the KV v2 engine is mounted, DefaultVaultMount if
+	// empty.   PathTemplate is where in it each certificate goes, run
+	// with StorePathData, DefaultVaultPathTemplate if empty.
+	Mount        string
+	PathTemplate string
+
+	// Token is used as is.   If AppRole has a RoleID instead, the
+	// store logs in with it and logs in again when the token expires
+	// or is refused.
+	Token   string
+	AppRole VaultAppRole
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// VaultAppRole is how to log in with AppRole.
+type VaultAppRole struct {
+	Mount    string // DefaultVaultAppRoleMount if empty
+	RoleID   string
+	SecretID string
+}
+
+// vaultReservedMetadata are the custom metadata keys the store writes
+// itself, which tags can't use.
+var vaultReservedMetadata = []string{"domains", "domain_count", "domain_set", "issuer", "not_after", "serial"}
+
+// Vault's limits on KV v2 custom metadata.
+const (
+	vaultMaxMetadataKeys     = 64
+	vaultMaxMetadataKeyLen   = 128
+	vaultMaxMetadataValueLen = 512
+)
+
+// VaultVersion describes one version of a certificate in Vault.
+type VaultVersion struct {
+	Version   int
+	Created   time.Time
+	Deleted   bool
+	Destroyed bool
+}
+
+// Store writes the bundle as a new version and updates the metadata.
+func (s *VaultStore) Store(ctx context.Context, bundle CertBundle) error {
+	path, err := s.path(bundle.Name)
+	if err != nil {
+		return err
+	}
+	leaf, err := bundle.Certificate()
+	if err != nil {
+		return fmt.Errorf("Failed parsing certificate for %s: %v", bundle.Name, err)
+	}
+	metadata, err := vaultMetadata(bundle, leaf)
+	if err != nil {
+		return err
+	}
+
+	var written struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}
+	err = s.do(ctx, http.MethodPost, s.mount()+"/data/"+path, map[string]interface{}{
+		"data": map[string]string{
+			"key": string(bundle.KeyPEM),
+			"crt": string(bundle.FullChainPEM()),
+		},
+	}, &written)
+	if err != nil {
+		return err
+	}
+
+	err = s.do(ctx, http.MethodPost, s.mount()+"/metadata/"+path, map[string]interface{}{
+		"custom_metadata": metadata,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("Stored %s as version %d but failed updating its metadata: %w", bundle.Name, written.Data.Version, err)
+	}
+	return nil
+}
+
+// vaultMetadata is the custom metadata for a bundle, checked against
+// Vault's limits so a bad tag fails the Store before the data's written.
+// The domains only go in if they fit, since a certificate can have far
+// more than 512 bytes of them.
+func vaultMetadata(bundle CertBundle, leaf *x509.Certificate) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for k, v := range bundle.Tags {
+		if slices.Contains(vaultReservedMetadata, k) {
+			return nil, fmt.Errorf("Tag %q on %s can't be Vault custom metadata: the store writes it itself", k, bundle.Name)
+		}
+		metadata[k] = v
+	}
+	if domains := strings.Join(bundle.Domains, ","); len(domains) <= vaultMaxMetadataValueLen {
+		metadata["domains"] = domains
+	}
+	metadata["domain_count"] = strconv.Itoa(len(bundle.Domains))
+	metadata["domain_set"] = domainSetHash(bundle.Domains)
+	metadata["issuer"] = leaf.Issuer.CommonName
+	metadata["not_after"] = leaf.NotAfter.UTC().Format(time.RFC3339)
+	metadata["serial"] = leaf.SerialNumber.Text(16)
+
+	if len(metadata) > vaultMaxMetadataKeys {
+		return nil, fmt.Errorf("Too many tags on %s for Vault custom metadata: %d keys, at most %d", bundle.Name, len(metadata), vaultMaxMetadataKeys)
+	}
+	for k, v := range metadata {
+		if len(k) > vaultMaxMetadataKeyLen {
+			return nil, fmt.Errorf("Tag %q on %s is longer than Vault's %d byte custom metadata key limit", k, bundle.Name, vaultMaxMetadataKeyLen)
+		}
+		if len(v) > vaultMaxMetadataValueLen {
+			return nil, fmt.Errorf("Tag %s on %s is longer than Vault's %d byte custom metadata value limit", k, bundle.Name, vaultMaxMetadataValueLen)
+		}
+	}
+	return metadata, nil
+}
+
+// Load reads back the current version of the certificate under name.
+func (s *VaultStore) Load(ctx context.Context, name string) (CertBundle, error) {
+	return s.LoadVersion(ctx, name, 0)
+}
+
+// LoadPrevious reads back the newest version before the current one that
+// hasn't been deleted, for rolling back a bad renewal.
+func (s *VaultStore) LoadPrevious(ctx context.Context, name string) (CertBundle, error) {
+	versions, err := s.Versions(ctx, name)
+	if err != nil {
+		return CertBundle{Name: name}, err
+	}
+	for i := len(versions) - 2; i >= 0; i-- {
+		if !versions[i].Deleted && !versions[i].Destroyed {
+			return s.LoadVersion(ctx, name, versions[i].Version)
+		}
+	}
+	return CertBundle{Name: name}, ErrCertNotFound
+}
+
+// LoadVersion reads back a version of the certificate under name, or the
+// current one if version is 0.
+func (s *VaultStore) LoadVersion(ctx context.Context, name string, version int) (CertBundle, error) {
+	bundle := CertBundle{Name: name}
+	path, err := s.path(name)
+	if err != nil {
+		return bundle, err
+	}
+
+	resource := s.mount() + "/data/" + path
+	if version > 0 {
+		resource += "?version=" + strconv.Itoa(version)
+	}
+	var res struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	err = s.do(ctx, http.MethodGet, resource, nil, &res)
+	if err != nil {
+		return bundle, err
+	}
+
+	chain, err := ParseChain([]byte(res.Data.Data["crt"]))
+	if err != nil {
+		return bundle, fmt.Errorf("Failed parsing crt in Vault secret %s/%s: %v", s.mount(), path, err)
+	}
+
+	bundle.Domains = certNames(chain.Leaf)
+	bundle.KeyPEM = []byte(res.Data.Data["key"])
+	bundle.CertPEM = chain.LeafPEM()
+	bundle.ChainPEM = chain.ChainPEM()
+
+	return bundle, nil
+}
+
+// Versions lists the versions Vault has of the certificate under name,
+// oldest first.
+func (s *VaultStore) Versions(ctx context.Context, name string) ([]VaultVersion, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Data struct {
+			Versions map[string]struct {
+				CreatedTime  time.Time `json:"created_time"`
+				DeletionTime string    `json:"deletion_time"`
+				Destroyed    bool      `json:"destroyed"`
+			} `json:"versions"`
+		} `json:"data"`
+	}
+	err = s.do(ctx, http.MethodGet, s.mount()+"/metadata/"+path, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]VaultVersion, 0, len(res.Data.Versions))
+	for n, v := range res.Data.Versions {
+		version, err := strconv.Atoi(n)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, VaultVersion{
+			Version:   version,
+			Created:   v.CreatedTime,
+			Deleted:   v.DeletionTime != "",
+			Destroyed: v.Destroyed,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// path runs the path template for name, and won't let it climb out of
+// the mount.
+func (s *VaultStore) path(name string) (string, error) {
+	p, err := storePath(firstNonEmpty(s.PathTemplate, DefaultVaultPathTemplate), name)
+	if err != nil {
+		return "", err
+	}
+	p = strings.Trim(p, "/")
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("Bad Vault path %q for %q", p, name)
+		}
+	}
+	return p, nil
+}
+
+func (s *VaultStore) mount() string {
+	return strings.Trim(firstNonEmpty(s.Mount, DefaultVaultMount), "/")
+}
+
+// vaultErrors is the body Vault sends with an error.
+type vaultErrors struct {
+	Errors []string `json:"errors"`
+}
+
+// do sends a request to Vault's API at /v1/<resource>.   A 404 reading
+// a secret that isn't there is ErrCertNotFound.   With AppRole, a 403 means logging in again and
+// trying once more, since the token may have been revoked early.
+func (s *VaultStore) do(ctx context.Context, method, resource string, body, out interface{}) error {
+	status, err := s.send(ctx, method, resource, body, out)
+	if status == http.StatusForbidden && s.AppRole.RoleID != "" {
+		s.mu.Lock()
+		s.token = ""
+		s.mu.Unlock()
+		_, err = s.send(ctx, method, resource, body, out)
+	}
+	return err
+}
+
+func (s *VaultStore) send(ctx context.Context, method, resource string, body, out interface{}) (int, error) {
+	token, err := s.authToken(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return s.request(ctx, method, resource, token, body, out)
+}
+
+func (s *VaultStore) request(ctx context.Context, method, resource, token string, body, out interface{}) (int, error) {
+	u, err := url.Parse(strings.TrimRight(s.Address, "/") + "/v1/" + resource)
+	if err != nil {
+		return 0, err
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if s.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.Namespace)
+	}
+
+	httpClient := s.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, err
+	}
+
+	if res.StatusCode >= 400 {
+		var ve vaultErrors
+		json.Unmarshal(b, &ve)
+		// KV v2 answers a read of a missing secret or deleted version
+		// with a 404 and no errors.   Any other 404, like a mount or
+		// path prefix that isn't there, is a misconfiguration, not an
+		// empty store.
+		if res.StatusCode == http.StatusNotFound && method == http.MethodGet && len(ve.Errors) == 0 &&
+			strings.HasPrefix(resource, s.mount()+"/data/") {
+			return res.StatusCode, ErrCertNotFound
+		}
+		return res.StatusCode, fmt.Errorf("Vault said %d for %s %s: %s", res.StatusCode, method, u.Path, strings.Join(ve.Errors, "; "))
+	}
+	if out == nil || len(b) == 0 {
+		return res.StatusCode, nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return res.StatusCode, fmt.Errorf("Failed unmarshalling Vault's response to %s %s: %v", method, u.Path, err)
+	}
+	return res.StatusCode, nil
+}
+
+// authToken returns the token to use, logging in with AppRole if there's
+// no current token.
+func (s *VaultStore) authToken(ctx context.Context) (string, error) {
+	if s.AppRole.RoleID == "" {
+		if s.Token == "" {
+			return "", errors.New("No Vault token or AppRole to log in with")
+		}
+		return s.Token, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && (s.expires.IsZero() || time.Now().Before(s.expires)) {
+		return s.token, nil
+	}
+
+	var res struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	mount := strings.Trim(firstNonEmpty(s.AppRole.Mount, DefaultVaultAppRoleMount), "/")
+	_, err := s.request(ctx, http.MethodPost, "auth/"+mount+"/login", "", map[string]string{
+		"role_id":   s.AppRole.RoleID,
+		"secret_id": s.AppRole.SecretID,
+	}, &res)
+	if err != nil {
+		return "", fmt.Errorf("Failed logging in to Vault with AppRole: %v", err)
+	}
+	if res.Auth.ClientToken == "" {
+		return "", errors.New("Vault's AppRole login didn't return a token")
+	}
+
+	s.token = res.Auth.ClientToken
+	s.expires = time.Time{}
+	if res.Auth.LeaseDuration > 0 {
+		// Log in again a little before the token runs out.
+		lease := time.Duration(res.Auth.LeaseDuration) * time.Second
+		s.expires = time.Now().Add(lease - lease/10)
+	}
+	return s.token, nil
+}
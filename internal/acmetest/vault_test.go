@@ -0,0 +1,237 @@
+package acmetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swerveaux/acmetest/internal/vaulttest"
+)
+
+func TestVaultStore(t *testing.T) {
+	testCertStore(t, func(t *testing.T) storeFixture {
+		vault := vaulttest.NewServer(t)
+		return storeFixture{
+			Store: &VaultStore{Address: vault.URL(), Token: vaulttest.RootToken},
+			Deny:  func(name string) { vault.Deny("secret", name) },
+		}
+	})
+}
+
+func TestVaultStoreAppRole(t *testing.T) {
+	testCertStore(t, func(t *testing.T) storeFixture {
+		vault := vaulttest.NewServer(t)
+		vault.Mount("certs")
+		vault.AddAppRole("acmetest-role", "s3cret")
+		return storeFixture{
+			Store: &VaultStore{
+				Address:      vault.URL(),
+				Mount:        "certs",
+				PathTemplate: "acme/{{.Name}}",
+				AppRole:      VaultAppRole{RoleID: "acmetest-role", SecretID: "s3cret"},
+			},
+			Deny: func(name string) { vault.Deny("certs", "acme/"+name) },
+		}
+	})
+}
+
+func TestVaultStoreMetadata(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	vault := vaulttest.NewServer(t)
+	store := &VaultStore{Address: vault.URL(), Token: vaulttest.RootToken, PathTemplate: "tls/{{.Name}}"}
+
+	b := ca.bundle(t, "ssl_example.org", "example.org", "www.example.org")
+	b.Tags = map[string]string{"team": "infra"}
+	if err := store.Store(ctx, b); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+
+	data := vault.Data("secret", "tls/ssl_example.org", 0)
+	if data["key"] != string(b.KeyPEM) || data["crt"] != string(b.FullChainPEM()) {
+		t.Errorf("expected the key and full chain under key and crt, got %v", data)
+	}
+
+	leaf, err := b.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := vault.CustomMetadata("secret", "tls/ssl_example.org")
+	for k, v := range map[string]string{
+		"domains":      "example.org,www.example.org",
+		"domain_count": "2",
+		"domain_set":   domainSetHash([]string{"example.org", "www.example.org"}),
+		"issuer":       "store test CA",
+		"not_after":    leaf.NotAfter.UTC().Format(time.RFC3339),
+		"serial":       leaf.SerialNumber.Text(16),
+		"team":         "infra",
+	} {
+		if metadata[k] != v {
+			t.Errorf("expected custom metadata %s=%s, got %q", k, v, metadata[k])
+		}
+	}
+}
+
+func TestVaultStoreMetadataLimits(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	vault := vaulttest.NewServer(t)
+	store := &VaultStore{Address: vault.URL(), Token: vaulttest.RootToken}
+
+	// 40 domains are more than fit in one 512 byte metadata value, so
+	// only their count and hash go in.
+	var domains []string
+	for i := 0; i < 40; i++ {
+		domains = append(domains, fmt.Sprintf("host-%02d.long-subdomain.example.org", i))
+	}
+	if err := store.Store(ctx, ca.bundle(t, "ssl_example.org", domains...)); err != nil {
+		t.Fatalf("store with many domains should not have error'd, but it did: %v", err)
+	}
+	metadata := vault.CustomMetadata("secret", "ssl_example.org")
+	if _, ok := metadata["domains"]; ok {
+		t.Errorf("expected no domains in the metadata, got %d bytes of them", len(metadata["domains"]))
+	}
+	if metadata["domain_count"] != "40" || metadata["domain_set"] != domainSetHash(domains) {
+		t.Errorf("expected the domain count and hash, got %v", metadata)
+	}
+
+	tooMany := make(map[string]string)
+	for i := 0; i < vaultMaxMetadataKeys; i++ {
+		tooMany[fmt.Sprintf("tag%d", i)] = "x"
+	}
+	tests := []struct {
+		Name string
+		Tags map[string]string
+	}{
+		{"long value", map[string]string{"note": strings.Repeat("x", 513)}},
+		{"long key", map[string]string{strings.Repeat("k", 129): "x"}},
+		{"too many keys", tooMany},
+		{"reserved key", map[string]string{"issuer": "someone else"}},
+	}
+	for _, test := range tests {
+		b := ca.bundle(t, "ssl_example.org", "example.org")
+		b.Tags = test.Tags
+		if err := store.Store(ctx, b); err == nil {
+			t.Errorf("test %q should have error'd", test.Name)
+		}
+		// Refused before the data was written, not after.
+		if n := vault.Versions("secret", "ssl_example.org"); n != 1 {
+			t.Errorf("test %q: expected no new version, got %d", test.Name, n)
+		}
+	}
+}
+
+func TestVaultStoreMissingMount(t *testing.T) {
+	ctx := context.Background()
+	vault := vaulttest.NewServer(t)
+	store := &VaultStore{Address: vault.URL(), Token: vaulttest.RootToken, Mount: "kv"}
+
+	// A mount that isn't there is a misconfiguration, not an empty
+	// store, or apply would reissue everything on every pass.
+	_, err := store.Load(ctx, "ssl_example.org")
+	if err == nil || errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected an error other than ErrCertNotFound for a missing mount, got %v", err)
+	}
+
+	store.Mount = ""
+	if _, err := store.Load(ctx, "ssl_example.org"); !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected ErrCertNotFound for a missing secret, got %v", err)
+	}
+}
+
+func TestVaultStoreRollback(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	vault := vaulttest.NewServer(t)
+	store := &VaultStore{Address: vault.URL(), Token: vaulttest.RootToken}
+
+	var bundles []CertBundle
+	for i := 0; i < 3; i++ {
+		b := ca.bundle(t, "ssl_example.org", "example.org")
+		if err := store.Store(ctx, b); err != nil {
+			t.Fatalf("store should not have error'd, but it did: %v", err)
+		}
+		bundles = append(bundles, b)
+	}
+
+	versions, err := store.Versions(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("versions should not have error'd, but it did: %v", err)
+	}
+	if len(versions) != 3 || versions[0].Version != 1 || versions[2].Version != 3 || versions[0].Created.IsZero() {
+		t.Errorf("expected versions 1 to 3, got %+v", versions)
+	}
+
+	old, err := store.LoadVersion(ctx, "ssl_example.org", 1)
+	if err != nil {
+		t.Fatalf("load version should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, old, bundles[0])
+
+	// Once the current version is deleted there's nothing current, and
+	// the version before it is still there to roll back to.
+	req, err := http.NewRequest(http.MethodDelete, vault.URL()+"/v1/secret/data/ssl_example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Vault-Token", vaulttest.RootToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if _, err := store.Load(ctx, "ssl_example.org"); !errors.Is(err, ErrCertNotFound) {
+		t.Errorf("expected ErrCertNotFound with the current version deleted, got %v", err)
+	}
+	prev, err := store.LoadPrevious(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load previous should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, prev, bundles[1])
+}
+
+func TestVaultStoreAppRoleRelogin(t *testing.T) {
+	ctx := context.Background()
+	ca := newStoreTestCA(t)
+	vault := vaulttest.NewServer(t)
+	vault.AddAppRole("acmetest-role", "s3cret")
+	store := &VaultStore{Address: vault.URL(), AppRole: VaultAppRole{RoleID: "acmetest-role", SecretID: "s3cret"}}
+
+	b := ca.bundle(t, "ssl_example.org", "example.org")
+	if err := store.Store(ctx, b); err != nil {
+		t.Fatalf("store should not have error'd, but it did: %v", err)
+	}
+	if n := vault.Requests(http.MethodPost, "/v1/auth/approle/login"); n != 1 {
+		t.Errorf("expected one login for two requests, got %d", n)
+	}
+
+	vault.ExpireTokens()
+	got, err := store.Load(ctx, "ssl_example.org")
+	if err != nil {
+		t.Fatalf("load after the token expired should not have error'd, but it did: %v", err)
+	}
+	checkBundle(t, got, b)
+	if n := vault.Requests(http.MethodPost, "/v1/auth/approle/login"); n != 2 {
+		t.Errorf("expected logging in again once the token was refused, got %d logins", n)
+	}
+
+	bad := &VaultStore{Address: vault.URL(), AppRole: VaultAppRole{RoleID: "acmetest-role", SecretID: "wrong"}}
+	_, err = bad.Load(ctx, "ssl_example.org")
+	if err == nil || errors.Is(err, ErrCertNotFound) || !strings.Contains(err.Error(), "AppRole") {
+		t.Errorf("expected a login failure, got %v", err)
+	}
+}
+
+func TestVaultStoreBadPaths(t *testing.T) {
+	store := &VaultStore{Address: "http://127.0.0.1:8200", Token: vaulttest.RootToken}
+	for _, name := range []string{"", "..", "a/../../sys/policy"} {
+		if _, err := store.Load(context.Background(), name); err == nil || errors.Is(err, ErrCertNotFound) {
+			t.Errorf("test %q should have error'd", name)
+		}
+	}
+}
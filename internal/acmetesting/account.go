@@ -0,0 +1,119 @@
+package acmetesting
+
+import (
+	"encoding/json"
+	"net/http"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// account is an ACME account, keyed by its URL, which is also its kid.
+type account struct {
+	url        string
+	key        *jose.JSONWebKey
+	thumbprint string
+	status     string
+	contact    []string
+	eabKeyID   string
+}
+
+type accountJSON struct {
+	Status               string   `json:"status"`
+	Contact              []string `json:"contact,omitempty"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+}
+
+func (a *account) json() accountJSON {
+	return accountJSON{Status: a.status, Contact: a.contact, TermsOfServiceAgreed: true}
+}
+
+type newAccountRequest struct {
+	Contact                []string        `json:"contact"`
+	TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed"`
+	OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+}
+
+// handleNewAccount creates an account for the request's key, or returns
+// the one it already has, per RFC8555 section 7.3.
+func (s *Server) handleNewAccount(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	var payload newAccountRequest
+	if p := decodePayload(req, &payload); p != nil {
+		return p
+	}
+
+	tp := thumbprint(req.jwk)
+	for _, acct := range s.accounts {
+		if acct.thumbprint == tp {
+			w.Header().Set("Location", acct.url)
+			writeJSON(w, http.StatusOK, acct.json())
+			return nil
+		}
+	}
+
+	if payload.OnlyReturnExisting {
+		return newProblem(http.StatusBadRequest, ProblemAccountDoesNotExist, "No account exists with this key")
+	}
+	if !payload.TermsOfServiceAgreed {
+		return malformed("Must agree to the terms of service")
+	}
+
+	var keyID string
+	if s.ExternalAccountKeys != nil {
+		if len(payload.ExternalAccountBinding) == 0 {
+			return newProblem(http.StatusForbidden, ProblemExternalAccountRequired, "This CA requires external account binding")
+		}
+		var p *Problem
+		keyID, p = s.verifyEAB(payload.ExternalAccountBinding, req.jwk, req.url)
+		if p != nil {
+			return p
+		}
+	}
+
+	acct := &account{
+		url:        s.URL() + "/account/" + s.newID(),
+		key:        req.jwk,
+		thumbprint: tp,
+		status:     statusValid,
+		contact:    payload.Contact,
+		eabKeyID:   keyID,
+	}
+	s.accounts[acct.url] = acct
+
+	w.Header().Set("Location", acct.url)
+	writeJSON(w, http.StatusCreated, acct.json())
+	return nil
+}
+
+type accountUpdate struct {
+	Status  string   `json:"status"`
+	Contact []string `json:"contact"`
+}
+
+// handleAccount returns the account, or updates its contacts or
+// deactivates it, per RFC8555 section 7.3.2 and 7.3.6.
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	if req.account.url != req.url {
+		return unauthorized("Request signed by %s is for another account", req.account.url)
+	}
+
+	if !req.postAsGet() {
+		var update accountUpdate
+		if p := decodePayload(req, &update); p != nil {
+			return p
+		}
+		switch update.Status {
+		case "":
+		case statusDeactivated:
+			req.account.status = statusDeactivated
+		default:
+			return malformed("Account status can only be set to %q", statusDeactivated)
+		}
+		if update.Contact != nil {
+			req.account.contact = update.Contact
+		}
+	}
+
+	writeJSON(w, http.StatusOK, req.account.json())
+	return nil
+}
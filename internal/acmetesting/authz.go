@@ -0,0 +1,281 @@
+package acmetesting
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Challenge types.
+const (
+	ChallengeDNS01     = "dns-01"
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+type authz struct {
+	id         string
+	account    *account
+	identifier Identifier
+	wildcard   bool
+	status     string
+	expires    time.Time
+	challenges []*challenge
+}
+
+type challenge struct {
+	id        string
+	authz     *authz
+	typ       string
+	token     string
+	status    string
+	validated time.Time
+	err       *Problem
+	polls     int // left until it's validated, while processing
+}
+
+type authzJSON struct {
+	Status     string          `json:"status"`
+	Expires    time.Time       `json:"expires"`
+	Identifier Identifier      `json:"identifier"`
+	Challenges []challengeJSON `json:"challenges"`
+	Wildcard   bool            `json:"wildcard,omitempty"`
+}
+
+type challengeJSON struct {
+	Type      string     `json:"type"`
+	URL       string     `json:"url"`
+	Token     string     `json:"token"`
+	Status    string     `json:"status"`
+	Validated *time.Time `json:"validated,omitempty"`
+	Error     *Problem   `json:"error,omitempty"`
+}
+
+func (s *Server) authzURL(a *authz) string {
+	return s.URL() + "/authz/" + a.id
+}
+
+func (s *Server) authzJSON(a *authz) authzJSON {
+	j := authzJSON{
+		Status:     a.status,
+		Expires:    a.expires,
+		Identifier: a.identifier,
+		Wildcard:   a.wildcard,
+	}
+	for _, ch := range a.challenges {
+		j.Challenges = append(j.Challenges, s.challengeJSON(ch))
+	}
+	return j
+}
+
+func (s *Server) challengeJSON(ch *challenge) challengeJSON {
+	j := challengeJSON{
+		Type:   ch.typ,
+		URL:    s.URL() + "/chall/" + ch.id,
+		Token:  ch.token,
+		Status: ch.status,
+		Error:  ch.err,
+	}
+	if !ch.validated.IsZero() {
+		j.Validated = &ch.validated
+	}
+	return j
+}
+
+// refreshAuthz expires an authorization that's run out of time.
+func refreshAuthz(a *authz) {
+	if (a.status == statusPending || a.status == statusValid) && time.Now().After(a.expires) {
+		a.status = statusExpired
+	}
+}
+
+// authzFor returns the account's valid authorization for the identifier
+// if it has one, like Let's Encrypt does, or else a new pending one.
+func (s *Server) authzFor(acct *account, id Identifier, wildcard bool) *authz {
+	for _, a := range s.authzs {
+		refreshAuthz(a)
+		if a.account == acct && a.identifier == id && a.wildcard == wildcard && a.status == statusValid {
+			return a
+		}
+	}
+
+	a := &authz{
+		id:         s.newID(),
+		account:    acct,
+		identifier: id,
+		wildcard:   wildcard,
+		status:     statusPending,
+		expires:    time.Now().Add(authzLifetime),
+	}
+	for _, typ := range challengeTypes(id, wildcard) {
+		ch := &challenge{
+			id:     s.newID(),
+			authz:  a,
+			typ:    typ,
+			token:  randomString(32),
+			status: statusPending,
+		}
+		a.challenges = append(a.challenges, ch)
+		s.challenges[ch.id] = ch
+	}
+	s.authzs[a.id] = a
+	return a
+}
+
+// challengeTypes is what we offer for an identifier: only dns-01 for
+// wildcards and no dns-01 for IP addresses, per RFC8738.
+func challengeTypes(id Identifier, wildcard bool) []string {
+	switch {
+	case wildcard:
+		return []string{ChallengeDNS01}
+	case id.Type == "ip":
+		return []string{ChallengeHTTP01, ChallengeTLSALPN01}
+	}
+	return []string{ChallengeHTTP01, ChallengeDNS01, ChallengeTLSALPN01}
+}
+
+type newAuthzRequest struct {
+	Identifier Identifier `json:"identifier"`
+}
+
+// handleNewAuthz pre-authorizes an identifier, per RFC8555 section 7.4.1.
+func (s *Server) handleNewAuthz(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	var payload newAuthzRequest
+	if p := decodePayload(req, &payload); p != nil {
+		return p
+	}
+	id, p := checkIdentifier(payload.Identifier)
+	if p != nil {
+		return p
+	}
+	if id.Type == "dns" && id.Value[0] == '*' {
+		return newProblem(http.StatusBadRequest, ProblemRejectedIdentifier, "Wildcards can't be pre-authorized")
+	}
+
+	a := s.authzFor(req.account, id, false)
+	w.Header().Set("Location", s.authzURL(a))
+	writeJSON(w, http.StatusCreated, s.authzJSON(a))
+	return nil
+}
+
+type authzUpdate struct {
+	Status string `json:"status"`
+}
+
+// handleAuthz returns an authorization, or deactivates it per RFC8555
+// section 7.5.2.
+func (s *Server) handleAuthz(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	a, ok := s.authzs[r.PathValue("id")]
+	if !ok {
+		return notFound("No authorization at %s", req.url)
+	}
+	if a.account != req.account {
+		return unauthorized("Authorization %s belongs to another account", req.url)
+	}
+	refreshAuthz(a)
+
+	if req.postAsGet() {
+		s.advanceValidation(a)
+	} else {
+		var update authzUpdate
+		if p := decodePayload(req, &update); p != nil {
+			return p
+		}
+		if update.Status != statusDeactivated {
+			return malformed("Authorization status can only be set to %q", statusDeactivated)
+		}
+		if a.status != statusPending && a.status != statusValid {
+			return malformed("Authorization is %q and can't be deactivated", a.status)
+		}
+		a.status = statusDeactivated
+	}
+
+	s.writeRetryAfter(w, a.status == statusPending)
+	writeJSON(w, http.StatusOK, s.authzJSON(a))
+	return nil
+}
+
+// handleChallenge returns a challenge, or validates it if the payload
+// says the client is ready, per RFC8555 section 7.5.1.   Validation is
+// done by s.Validate before responding, so the authorization is valid
+// or invalid by the time the client polls it, unless s.ValidationPolls
+// says to keep the client waiting.
+func (s *Server) handleChallenge(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	ch, ok := s.challenges[r.PathValue("id")]
+	if !ok {
+		return notFound("No challenge at %s", req.url)
+	}
+	a := ch.authz
+	if a.account != req.account {
+		return unauthorized("Challenge %s belongs to another account", req.url)
+	}
+	refreshAuthz(a)
+
+	switch {
+	case req.postAsGet():
+		s.advanceValidation(a)
+	case ch.status == statusPending && a.status == statusPending && s.ValidationPolls > 0:
+		ch.status = statusProcessing
+		ch.polls = s.ValidationPolls
+	case ch.status == statusPending && a.status == statusPending:
+		s.validate(ch)
+	}
+
+	w.Header().Add("Link", link(s.authzURL(a), "up"))
+	writeJSON(w, http.StatusOK, s.challengeJSON(ch))
+	return nil
+}
+
+// advanceValidation counts a poll of an authorization against its
+// processing challenges, and validates them once they've been polled
+// enough.
+func (s *Server) advanceValidation(a *authz) {
+	for _, ch := range a.challenges {
+		if ch.status != statusProcessing {
+			continue
+		}
+		ch.polls--
+		if ch.polls <= 0 {
+			s.validate(ch)
+		}
+	}
+}
+
+// validate runs s.Validate for ch and settles the challenge and its
+// authorization with the result.
+func (s *Server) validate(ch *challenge) {
+	a := ch.authz
+	v := Validation{
+		Identifier:       a.identifier,
+		Wildcard:         a.wildcard,
+		Type:             ch.typ,
+		Token:            ch.token,
+		KeyAuthorization: ch.token + "." + a.account.thumbprint,
+	}
+
+	var err error
+	if s.Validate != nil {
+		err = s.Validate(v)
+	}
+	if err == nil {
+		ch.status = statusValid
+		ch.validated = time.Now()
+		a.status = statusValid
+		return
+	}
+
+	var p *Problem
+	if !errors.As(err, &p) {
+		p = newProblem(http.StatusForbidden, ProblemIncorrectResponse, "%v", err)
+	}
+	p = &Problem{Type: p.Type, Detail: p.Detail, Status: p.Status, Identifier: p.Identifier, Subproblems: p.Subproblems}
+	if p.Status == 0 {
+		p.Status = http.StatusForbidden
+	}
+	if p.Identifier == nil {
+		p.Identifier = &a.identifier
+	}
+	ch.status = statusInvalid
+	ch.err = p
+	a.status = statusInvalid
+}
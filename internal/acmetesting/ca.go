@@ -0,0 +1,160 @@
+package acmetesting
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"time"
+)
+
+// Common names of the throwaway CA's certificates.   The intermediate
+// is also cross-signed by AlternateRootName, which is what's served as
+// the alternate chain.
+const (
+	RootName          = "acmetesting Root CA"
+	AlternateRootName = "acmetesting Alternate Root CA"
+	IntermediateName  = "acmetesting Intermediate CA"
+)
+
+// ca is a throwaway certificate authority made fresh for every Server:
+// a root, an intermediate it signs, and a second root that cross-signs
+// the same intermediate.
+type ca struct {
+	root         *x509.Certificate
+	altRoot      *x509.Certificate
+	intermediate *x509.Certificate
+	crossSigned  *x509.Certificate
+	key          crypto.Signer
+}
+
+func newCA() (*ca, error) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	altRootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := selfSign(RootName, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	altRoot, err := selfSign(AlternateRootName, altRootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := caTemplate(IntermediateName)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.MaxPathLenZero = true
+	intermediate, err := createCertificate(tmpl, root, key.Public(), rootKey)
+	if err != nil {
+		return nil, err
+	}
+	crossSigned, err := createCertificate(tmpl, altRoot, key.Public(), altRootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ca{
+		root:         root,
+		altRoot:      altRoot,
+		intermediate: intermediate,
+		crossSigned:  crossSigned,
+		key:          key,
+	}, nil
+}
+
+// issue signs a leaf certificate for csr's key and names.
+func (a *ca) issue(csr *x509.CertificateRequest, lifetime time.Duration) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(lifetime),
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if len(csr.DNSNames) > 0 && len(csr.DNSNames[0]) <= 64 {
+		tmpl.Subject.CommonName = csr.DNSNames[0]
+	}
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	return createCertificate(tmpl, a.intermediate, csr.PublicKey, a.key)
+}
+
+// chain returns the PEM chain for leaf, with the intermediate signed by
+// the alternate root if alternate is set.
+func (a *ca) chain(leaf *x509.Certificate, alternate bool) []byte {
+	intermediate := a.intermediate
+	if alternate {
+		intermediate = a.crossSigned
+	}
+
+	var buf bytes.Buffer
+	for _, cert := range []*x509.Certificate{leaf, intermediate} {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+func selfSign(name string, key crypto.Signer) (*x509.Certificate, error) {
+	tmpl, err := caTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+	return createCertificate(tmpl, tmpl, key.Public(), key)
+}
+
+func caTemplate(name string) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil
+}
+
+func createCertificate(tmpl, parent *x509.Certificate, pub crypto.PublicKey, key crypto.Signer) (*x509.Certificate, error) {
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,101 @@
+package acmetesting
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+type certificate struct {
+	id      string
+	order   *order
+	leaf    *x509.Certificate
+	revoked bool
+	reason  int
+}
+
+func (s *Server) certURL(c *certificate) string {
+	return s.URL() + "/cert/" + c.id
+}
+
+// handleCertificate serves an issued certificate, per RFC8555 section
+// 7.4.2.   The default chain links to the one with the cross-signed
+// intermediate as its alternate, and vice versa.
+func (s *Server) handleCertificate(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	c, ok := s.certs[r.PathValue("id")]
+	if !ok || c.order.status != statusValid {
+		return notFound("No certificate at %s", req.url)
+	}
+	if c.order.account != req.account {
+		return unauthorized("Certificate %s belongs to another account", req.url)
+	}
+	if !req.postAsGet() {
+		return malformed("Certificates can only be fetched with POST-as-GET")
+	}
+
+	alternate := strings.HasSuffix(r.URL.Path, "/alternate")
+	if alternate {
+		w.Header().Add("Link", link(s.certURL(c), "alternate"))
+	} else {
+		w.Header().Add("Link", link(s.certURL(c)+"/alternate", "alternate"))
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(s.ca.chain(c.leaf, alternate))
+	return nil
+}
+
+type revokeRequest struct {
+	Certificate string `json:"certificate"`
+	Reason      *int   `json:"reason"`
+}
+
+// handleRevokeCert revokes a certificate, per RFC8555 section 7.6.   The
+// request has to be signed by the account that ordered it or by the
+// certificate's own key.
+func (s *Server) handleRevokeCert(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	var payload revokeRequest
+	if p := decodePayload(req, &payload); p != nil {
+		return p
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		return malformed("Certificate isn't base64url: %v", err)
+	}
+
+	var c *certificate
+	for _, cert := range s.certs {
+		if string(cert.leaf.Raw) == string(der) {
+			c = cert
+		}
+	}
+	if c == nil {
+		return notFound("Certificate wasn't issued by this CA")
+	}
+
+	switch {
+	case req.account != nil && req.account != c.order.account:
+		return unauthorized("Certificate was ordered by another account")
+	case req.jwk != nil && thumbprint(req.jwk) != thumbprint(&jose.JSONWebKey{Key: c.leaf.PublicKey}):
+		return unauthorized("Request isn't signed by the certificate's key")
+	}
+
+	reason := 0
+	if payload.Reason != nil {
+		reason = *payload.Reason
+	}
+	if reason < 0 || reason > 10 || reason == 7 {
+		return newProblem(http.StatusBadRequest, ProblemBadRevocationReason, "Revocation reason %d isn't allowed", reason)
+	}
+	if c.revoked {
+		return newProblem(http.StatusBadRequest, ProblemAlreadyRevoked, "Certificate is already revoked")
+	}
+
+	c.revoked = true
+	c.reason = reason
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,152 @@
+package acmetesting
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Fault breaks requests to a resource instead of handling them normally,
+// to test how a client copes.   Faults are checked in the order they
+// were added and the first one that fires wins.
+type Fault struct {
+	// Resource is one of the Resource constants.   Empty matches every
+	// signed request, but not the directory or newNonce.
+	Resource string
+
+	// After is how many matching requests get through before the fault
+	// starts firing, so After: 2 breaks the third.
+	After int
+
+	// Times is how many matching requests in a row it breaks once it
+	// starts.   Zero means one.
+	Times int
+
+	// Problem is the error to respond with, with its Status as the
+	// HTTP status.   Nil means the request is handled normally, which
+	// only makes sense with Truncate.
+	Problem *Problem
+
+	// RetryAfter, if set, is sent as a Retry-After header with Problem.
+	RetryAfter time.Duration
+
+	// Truncate cuts off the response body halfway, as if the connection
+	// dropped.
+	Truncate bool
+
+	seen  int
+	fired int
+}
+
+// Forever is a Fault.Times that never runs out.
+const Forever = int(^uint(0) >> 1)
+
+// BadNonce rejects the nth signed request, counting from 1, with a
+// badNonce error.
+func BadNonce(n int) Fault {
+	return Fault{
+		After:   n - 1,
+		Problem: newProblem(http.StatusBadRequest, ProblemBadNonce, "JWS has an invalid anti-replay nonce"),
+	}
+}
+
+// RateLimited turns away the next times requests to resource with a
+// rateLimited error asking for retryAfter, if that's set.
+func RateLimited(resource string, times int, retryAfter time.Duration) Fault {
+	return Fault{
+		Resource:   resource,
+		Times:      times,
+		Problem:    newProblem(http.StatusTooManyRequests, ProblemRateLimited, "Too many requests to %s", resource),
+		RetryAfter: retryAfter,
+	}
+}
+
+// InternalError fails the next times requests to resource with a 500.
+func InternalError(resource string, times int) Fault {
+	return Fault{
+		Resource: resource,
+		Times:    times,
+		Problem:  newProblem(http.StatusInternalServerError, ProblemServerInternal, "Something broke handling %s", resource),
+	}
+}
+
+// Truncated cuts off the body of the next response for resource.
+func Truncated(resource string) Fault {
+	return Fault{Resource: resource, Truncate: true}
+}
+
+// Inject adds faults to the server.
+func (s *Server) Inject(faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range faults {
+		f := faults[i]
+		s.faults = append(s.faults, &f)
+	}
+}
+
+// fault returns the fault to apply to this request to resource, if any.
+// Every fault matching the resource counts the request, whether or not
+// it ends up the one that fires.
+func (s *Server) fault(resource string, signed bool) *Fault {
+	var fire *Fault
+	for _, f := range s.faults {
+		if f.Resource != resource && (f.Resource != "" || !signed) {
+			continue
+		}
+		f.seen++
+		times := f.Times
+		if times == 0 {
+			times = 1
+		}
+		if fire == nil && f.seen > f.After && f.fired < times {
+			f.fired++
+			fire = f
+		}
+	}
+	return fire
+}
+
+// apply responds with the fault's problem and returns a nil func, or if
+// the fault only truncates, wraps w to do that when the func is called.
+func (f *Fault) apply(w http.ResponseWriter) (http.ResponseWriter, func()) {
+	if f.Problem != nil {
+		if f.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(f.RetryAfter/time.Second)))
+		}
+		p := *f.Problem
+		writeProblem(w, &p)
+		return w, nil
+	}
+	if f.Truncate {
+		t := &truncatingWriter{ResponseWriter: w}
+		return t, t.flush
+	}
+	return w, func() {}
+}
+
+// truncatingWriter holds on to a response until flush, then sends a
+// Content-Length for all of it but only half of the body.
+type truncatingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (t *truncatingWriter) WriteHeader(status int) {
+	t.status = status
+}
+
+func (t *truncatingWriter) Write(b []byte) (int, error) {
+	return t.body.Write(b)
+}
+
+func (t *truncatingWriter) flush() {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	t.Header().Set("Content-Length", strconv.Itoa(t.body.Len()))
+	t.ResponseWriter.WriteHeader(t.status)
+	t.ResponseWriter.Write(t.body.Bytes()[:t.body.Len()/2])
+}
@@ -0,0 +1,150 @@
+package acmetesting
+
+import (
+	"crypto"
+	"encoding/base64"
+	"io"
+	"net/http"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// maxRequestSize caps how much of a request body we'll read.
+const maxRequestSize = 1 << 20
+
+// signer is how a resource expects requests to it to be signed: with
+// the account's kid, with a jwk, or (for revocation) either.
+type signer int
+
+const (
+	signedByKID signer = iota
+	signedByJWK
+	signedByEither
+)
+
+// request is a verified JWS request.   Exactly one of account and jwk is
+// set, depending on how it was signed.
+type request struct {
+	url     string
+	account *account
+	jwk     *jose.JSONWebKey
+	payload []byte
+}
+
+// postAsGet reports whether the request had an empty payload, per
+// RFC8555 section 6.3.
+func (r *request) postAsGet() bool {
+	return len(r.payload) == 0
+}
+
+// verify checks the JWS in an incoming request per RFC8555 section 6.2:
+// the content type, a nonce we handed out and haven't seen back yet, a
+// url header matching where the request was sent, and a valid signature
+// by either a known account or the embedded jwk.
+func (s *Server) verify(r *http.Request, by signer) (*request, *Problem) {
+	if r.Header.Get("Content-Type") != "application/jose+json" {
+		return nil, newProblem(http.StatusUnsupportedMediaType, ProblemMalformed, "Content-Type must be application/jose+json")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		return nil, malformed("Failed reading request: %v", err)
+	}
+	jws, err := jose.ParseSigned(string(body))
+	if err != nil {
+		return nil, malformed("Failed parsing JWS: %v", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, malformed("JWS must have exactly one signature")
+	}
+	header := jws.Signatures[0].Protected
+
+	if !s.nonces[header.Nonce] {
+		return nil, newProblem(http.StatusBadRequest, ProblemBadNonce, "JWS has an invalid anti-replay nonce: %q", header.Nonce)
+	}
+	delete(s.nonces, header.Nonce)
+
+	url, _ := header.ExtraHeaders["url"].(string)
+	if want := s.URL() + r.URL.Path; url != want {
+		return nil, unauthorized("JWS url %q doesn't match the request URL %q", url, want)
+	}
+
+	req := &request{url: url}
+	var key interface{}
+	switch {
+	case header.JSONWebKey != nil && header.KeyID != "":
+		return nil, malformed("JWS must have either a jwk or a kid, not both")
+	case header.JSONWebKey != nil:
+		if by == signedByKID {
+			return nil, malformed("JWS for this resource must be signed with an account kid")
+		}
+		req.jwk = header.JSONWebKey
+		key = header.JSONWebKey
+	case header.KeyID != "":
+		if by == signedByJWK {
+			return nil, malformed("JWS for this resource must have a jwk")
+		}
+		acct, ok := s.accounts[header.KeyID]
+		if !ok {
+			return nil, newProblem(http.StatusBadRequest, ProblemAccountDoesNotExist, "No account at %s", header.KeyID)
+		}
+		if acct.status != statusValid {
+			return nil, unauthorized("Account %s is %s", acct.url, acct.status)
+		}
+		req.account = acct
+		key = acct.key
+	default:
+		return nil, malformed("JWS has neither a jwk nor a kid")
+	}
+
+	req.payload, err = jws.Verify(key)
+	if err != nil {
+		return nil, malformed("JWS signature is invalid: %v", err)
+	}
+	return req, nil
+}
+
+// verifyEAB checks an externalAccountBinding from a newAccount request:
+// an HS256 JWS over the account's jwk, MACed with a key we know by the
+// kid, per RFC8555 section 7.3.4.   It returns the key ID.
+func (s *Server) verifyEAB(binding []byte, jwk *jose.JSONWebKey, url string) (string, *Problem) {
+	jws, err := jose.ParseSigned(string(binding))
+	if err != nil || len(jws.Signatures) != 1 {
+		return "", malformed("Failed parsing externalAccountBinding")
+	}
+	header := jws.Signatures[0].Protected
+	if header.Algorithm != string(jose.HS256) {
+		return "", malformed("externalAccountBinding must use HS256, not %q", header.Algorithm)
+	}
+	if u, _ := header.ExtraHeaders["url"].(string); u != url {
+		return "", unauthorized("externalAccountBinding url %q isn't %q", u, url)
+	}
+
+	macKey, ok := s.ExternalAccountKeys[header.KeyID]
+	if !ok {
+		return "", unauthorized("Unknown external account key ID %q", header.KeyID)
+	}
+	payload, err := jws.Verify(macKey)
+	if err != nil {
+		return "", unauthorized("externalAccountBinding MAC is invalid")
+	}
+
+	var bound jose.JSONWebKey
+	if err := bound.UnmarshalJSON(payload); err != nil {
+		return "", malformed("externalAccountBinding payload isn't a JWK: %v", err)
+	}
+	if thumbprint(&bound) != thumbprint(jwk) {
+		return "", unauthorized("externalAccountBinding is for a different account key")
+	}
+	return header.KeyID, nil
+}
+
+// thumbprint is the RFC7638 thumbprint of jwk, base64url encoded, as
+// used in key authorizations.
+func thumbprint(jwk *jose.JSONWebKey) string {
+	b, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,363 @@
+package acmetesting
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Identifier is an ACME identifier, dns or ip.
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	id          string
+	account     *account
+	status      string
+	expires     time.Time
+	identifiers []Identifier
+	authzs      []*authz
+	profile     string
+	cert        *certificate
+	err         *Problem
+	polls       int // left until it's valid, while processing
+}
+
+type orderJSON struct {
+	Status         string       `json:"status"`
+	Expires        time.Time    `json:"expires"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Profile        string       `json:"profile,omitempty"`
+	Error          *Problem     `json:"error,omitempty"`
+}
+
+func (s *Server) orderURL(o *order) string {
+	return s.URL() + "/order/" + o.id
+}
+
+func (s *Server) orderJSON(o *order) orderJSON {
+	j := orderJSON{
+		Status:      o.status,
+		Expires:     o.expires,
+		Identifiers: o.identifiers,
+		Finalize:    s.URL() + "/finalize/" + o.id,
+		Profile:     o.profile,
+		Error:       o.err,
+	}
+	for _, a := range o.authzs {
+		j.Authorizations = append(j.Authorizations, s.authzURL(a))
+	}
+	if o.cert != nil && o.status == statusValid {
+		j.Certificate = s.certURL(o.cert)
+	}
+	return j
+}
+
+// refreshOrder moves a pending order along once its authorizations are
+// all valid, or to invalid if any of them won't ever be, with the
+// failed challenges' errors as subproblems.
+func (s *Server) refreshOrder(o *order) {
+	if o.status != statusPending {
+		return
+	}
+
+	ready := true
+	var failed []Problem
+	for _, a := range o.authzs {
+		refreshAuthz(a)
+		switch a.status {
+		case statusValid:
+		case statusPending:
+			ready = false
+		default:
+			p := newProblem(http.StatusForbidden, ProblemUnauthorized, "Authorization for %s is %s", a.identifier.Value, a.status)
+			for _, ch := range a.challenges {
+				if ch.err != nil {
+					p = ch.err
+				}
+			}
+			failed = append(failed, *p)
+		}
+	}
+
+	switch {
+	case len(failed) > 0:
+		o.status = statusInvalid
+		o.err = &Problem{
+			Type:        ProblemUnauthorized,
+			Detail:      "Some of the order's authorizations failed",
+			Status:      http.StatusForbidden,
+			Subproblems: failed,
+		}
+	case ready:
+		o.status = statusReady
+	}
+}
+
+// advanceProcessing counts a poll of a processing order, and makes it
+// valid once it's been polled enough.
+func (o *order) advanceProcessing() {
+	if o.status != statusProcessing {
+		return
+	}
+	o.polls--
+	if o.polls <= 0 {
+		o.status = statusValid
+	}
+}
+
+type newOrderRequest struct {
+	Identifiers []Identifier `json:"identifiers"`
+	Profile     string       `json:"profile"`
+}
+
+// handleNewOrder places an order, reusing any valid authorizations the
+// account already has for its identifiers, per RFC8555 section 7.4.
+func (s *Server) handleNewOrder(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	var payload newOrderRequest
+	if p := decodePayload(req, &payload); p != nil {
+		return p
+	}
+	if len(payload.Identifiers) == 0 {
+		return malformed("Order has no identifiers")
+	}
+	if payload.Profile != "" {
+		if _, ok := s.Profiles[payload.Profile]; !ok {
+			return newProblem(http.StatusBadRequest, ProblemInvalidProfile, "Profile %q isn't offered", payload.Profile)
+		}
+	}
+
+	identifiers, p := checkIdentifiers(payload.Identifiers)
+	if p != nil {
+		return p
+	}
+
+	o := &order{
+		id:          s.newID(),
+		account:     req.account,
+		status:      statusPending,
+		expires:     time.Now().Add(orderLifetime),
+		identifiers: identifiers,
+		profile:     payload.Profile,
+	}
+	for _, id := range identifiers {
+		wildcard := strings.HasPrefix(id.Value, "*.")
+		id.Value = strings.TrimPrefix(id.Value, "*.")
+		o.authzs = append(o.authzs, s.authzFor(req.account, id, wildcard))
+	}
+	s.refreshOrder(o)
+	s.orders[o.id] = o
+
+	w.Header().Set("Location", s.orderURL(o))
+	writeJSON(w, http.StatusCreated, s.orderJSON(o))
+	return nil
+}
+
+func (s *Server) lookupOrder(r *http.Request, req *request) (*order, *Problem) {
+	o, ok := s.orders[r.PathValue("id")]
+	if !ok {
+		return nil, notFound("No order at %s", req.url)
+	}
+	if o.account != req.account {
+		return nil, unauthorized("Order %s belongs to another account", req.url)
+	}
+	return o, nil
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	o, p := s.lookupOrder(r, req)
+	if p != nil {
+		return p
+	}
+	if !req.postAsGet() {
+		return malformed("Orders can only be fetched with POST-as-GET")
+	}
+
+	s.refreshOrder(o)
+	o.advanceProcessing()
+	s.writeRetryAfter(w, o.status == statusProcessing)
+	writeJSON(w, http.StatusOK, s.orderJSON(o))
+	return nil
+}
+
+type finalizeRequest struct {
+	CSR string `json:"csr"`
+}
+
+// handleFinalize issues the certificate for a ready order, if the CSR
+// asks for exactly the order's identifiers, per RFC8555 section 7.4.
+// The order stays processing for s.ProcessingPolls polls.
+func (s *Server) handleFinalize(w http.ResponseWriter, r *http.Request, req *request) *Problem {
+	o, p := s.lookupOrder(r, req)
+	if p != nil {
+		return p
+	}
+	var payload finalizeRequest
+	if p := decodePayload(req, &payload); p != nil {
+		return p
+	}
+
+	s.refreshOrder(o)
+	if o.status != statusReady {
+		return newProblem(http.StatusForbidden, ProblemOrderNotReady, "Order is %q, not %q", o.status, statusReady)
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, ProblemBadCSR, "CSR isn't base64url: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, ProblemBadCSR, "Failed parsing CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return newProblem(http.StatusBadRequest, ProblemBadCSR, "CSR signature is invalid: %v", err)
+	}
+	if got, want := identifierSet(csrIdentifiers(csr)), identifierSet(o.identifiers); got != want {
+		return newProblem(http.StatusBadRequest, ProblemBadCSR, "CSR is for %s, but the order is for %s", got, want)
+	}
+
+	lifetime := s.CertificateLifetime
+	if lifetime == 0 {
+		lifetime = defaultCertificateLifetime
+	}
+	leaf, err := s.ca.issue(csr, lifetime)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, ProblemServerInternal, "Failed issuing certificate: %v", err)
+	}
+
+	o.cert = &certificate{id: o.id, order: o, leaf: leaf}
+	s.certs[o.id] = o.cert
+	o.status = statusValid
+	if s.ProcessingPolls > 0 {
+		o.status = statusProcessing
+		o.polls = s.ProcessingPolls
+	}
+
+	w.Header().Set("Location", s.orderURL(o))
+	s.writeRetryAfter(w, o.status == statusProcessing)
+	writeJSON(w, http.StatusOK, s.orderJSON(o))
+	return nil
+}
+
+// checkIdentifiers normalizes the identifiers in a new order and drops
+// duplicates.   Any that we won't issue for come back as subproblems of
+// a rejectedIdentifier problem.
+func checkIdentifiers(identifiers []Identifier) ([]Identifier, *Problem) {
+	var checked []Identifier
+	var rejected []Problem
+	seen := make(map[Identifier]bool)
+	for _, id := range identifiers {
+		norm, p := checkIdentifier(id)
+		if p != nil {
+			rejected = append(rejected, *p)
+			continue
+		}
+		if !seen[norm] {
+			seen[norm] = true
+			checked = append(checked, norm)
+		}
+	}
+
+	switch len(rejected) {
+	case 0:
+		return checked, nil
+	case 1:
+		return nil, &rejected[0]
+	}
+	return nil, &Problem{
+		Type:        ProblemRejectedIdentifier,
+		Detail:      "Order has identifiers that can't be issued for",
+		Status:      http.StatusBadRequest,
+		Subproblems: rejected,
+	}
+}
+
+func checkIdentifier(id Identifier) (Identifier, *Problem) {
+	reject := func(typ, format string, args ...interface{}) (Identifier, *Problem) {
+		p := newProblem(http.StatusBadRequest, typ, format, args...)
+		p.Identifier = &Identifier{Type: id.Type, Value: id.Value}
+		return id, p
+	}
+
+	switch id.Type {
+	case "dns":
+		name := strings.ToLower(strings.TrimSuffix(id.Value, "."))
+		if net.ParseIP(name) != nil {
+			return reject(ProblemMalformed, "%q is an IP address, not a DNS name", id.Value)
+		}
+		if !validDNSName(strings.TrimPrefix(name, "*.")) {
+			return reject(ProblemRejectedIdentifier, "%q isn't a valid DNS name", id.Value)
+		}
+		return Identifier{Type: "dns", Value: name}, nil
+	case "ip":
+		ip := net.ParseIP(id.Value)
+		if ip == nil {
+			return reject(ProblemMalformed, "%q isn't an IP address", id.Value)
+		}
+		return Identifier{Type: "ip", Value: ip.String()}, nil
+	}
+	return reject(ProblemUnsupportedIdentifier, "Identifier type %q isn't supported", id.Type)
+}
+
+// validDNSName reports whether name is a fully qualified name made of
+// LDH labels, with no wildcards left in it.
+func validDNSName(name string) bool {
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 || len(name) > 253 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// csrIdentifiers returns the identifiers a CSR asks for: its DNS names,
+// the subject common name if it isn't among them, and its IP addresses.
+func csrIdentifiers(csr *x509.CertificateRequest) []Identifier {
+	var ids []Identifier
+	for _, name := range csr.DNSNames {
+		ids = append(ids, Identifier{Type: "dns", Value: strings.ToLower(name)})
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" && net.ParseIP(cn) == nil {
+		ids = append(ids, Identifier{Type: "dns", Value: cn})
+	}
+	for _, ip := range csr.IPAddresses {
+		ids = append(ids, Identifier{Type: "ip", Value: ip.String()})
+	}
+	return ids
+}
+
+// identifierSet is a canonical description of a set of identifiers, for
+// comparing them and for error messages.
+func identifierSet(ids []Identifier) string {
+	seen := make(map[string]bool)
+	var values []string
+	for _, id := range ids {
+		v := fmt.Sprintf("%s:%s", id.Type, id.Value)
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	return "[" + strings.Join(values, ", ") + "]"
+}
@@ -0,0 +1,71 @@
+package acmetesting
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Problem types the server sends, from RFC8555 section 6.7 and the
+// profiles draft.
+const (
+	ProblemAccountDoesNotExist     = "urn:ietf:params:acme:error:accountDoesNotExist"
+	ProblemAlreadyRevoked          = "urn:ietf:params:acme:error:alreadyRevoked"
+	ProblemBadCSR                  = "urn:ietf:params:acme:error:badCSR"
+	ProblemBadNonce                = "urn:ietf:params:acme:error:badNonce"
+	ProblemBadRevocationReason     = "urn:ietf:params:acme:error:badRevocationReason"
+	ProblemConnection              = "urn:ietf:params:acme:error:connection"
+	ProblemDNS                     = "urn:ietf:params:acme:error:dns"
+	ProblemExternalAccountRequired = "urn:ietf:params:acme:error:externalAccountRequired"
+	ProblemIncorrectResponse       = "urn:ietf:params:acme:error:incorrectResponse"
+	ProblemInvalidProfile          = "urn:ietf:params:acme:error:invalidProfile"
+	ProblemMalformed               = "urn:ietf:params:acme:error:malformed"
+	ProblemOrderNotReady           = "urn:ietf:params:acme:error:orderNotReady"
+	ProblemRateLimited             = "urn:ietf:params:acme:error:rateLimited"
+	ProblemRejectedIdentifier      = "urn:ietf:params:acme:error:rejectedIdentifier"
+	ProblemServerInternal          = "urn:ietf:params:acme:error:serverInternal"
+	ProblemUnauthorized            = "urn:ietf:params:acme:error:unauthorized"
+	ProblemUnsupportedIdentifier   = "urn:ietf:params:acme:error:unsupportedIdentifier"
+)
+
+// Problem is an RFC7807 problem document.   A Validator can return one
+// to control exactly what error a failed challenge carries.
+type Problem struct {
+	Type        string      `json:"type"`
+	Detail      string      `json:"detail,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	Identifier  *Identifier `json:"identifier,omitempty"`
+	Subproblems []Problem   `json:"subproblems,omitempty"`
+}
+
+// Error satisfies the error interface.
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Type, p.Detail)
+}
+
+func newProblem(status int, typ, format string, args ...interface{}) *Problem {
+	return &Problem{Type: typ, Detail: fmt.Sprintf(format, args...), Status: status}
+}
+
+func malformed(format string, args ...interface{}) *Problem {
+	return newProblem(http.StatusBadRequest, ProblemMalformed, format, args...)
+}
+
+func unauthorized(format string, args ...interface{}) *Problem {
+	return newProblem(http.StatusForbidden, ProblemUnauthorized, format, args...)
+}
+
+func notFound(format string, args ...interface{}) *Problem {
+	return newProblem(http.StatusNotFound, ProblemMalformed, format, args...)
+}
+
+// writeProblem sends p as an application/problem+json response.
+func writeProblem(w http.ResponseWriter, p *Problem) {
+	if p.Status == 0 {
+		p.Status = http.StatusBadRequest
+	}
+	b, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(b)
+}
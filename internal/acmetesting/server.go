@@ -0,0 +1,377 @@
+// Package acmetesting is an in-memory ACME server for tests.   It speaks
+// enough of RFC8555 for a client to go from a directory to a downloaded
+// and revoked certificate with no network: nonces, accounts (with
+// optional external account binding), orders, pre-authorization,
+// authorizations whose challenges pass or fail as the test decides,
+// finalize, certificate download with an alternate chain, and
+// revocation.   Certificates are signed by a throwaway CA made fresh for
+// each Server.
+//
+// Tests can also script trouble: Faults that answer with badNonce,
+// rateLimited, 500s or truncated bodies, challenges that fail with
+// whatever problem the Validator returns, and authorizations and orders
+// that take a number of polls to settle.
+//
+// It is not a CA to test against for compliance, there's Pebble for
+// that.   Key rollover isn't implemented.
+package acmetesting
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Resources, named as in the directory where there's a directory entry
+// for them, for counting requests with Server.Requests.
+const (
+	ResourceDirectory   = "directory"
+	ResourceNewNonce    = "newNonce"
+	ResourceNewAccount  = "newAccount"
+	ResourceNewOrder    = "newOrder"
+	ResourceNewAuthz    = "newAuthz"
+	ResourceRevokeCert  = "revokeCert"
+	ResourceAccount     = "account"
+	ResourceOrder       = "order"
+	ResourceAuthz       = "authorization"
+	ResourceChallenge   = "challenge"
+	ResourceFinalize    = "finalize"
+	ResourceCertificate = "certificate"
+)
+
+// Statuses from RFC8555 section 7.1.6.
+const (
+	statusPending     = "pending"
+	statusReady       = "ready"
+	statusProcessing  = "processing"
+	statusValid       = "valid"
+	statusInvalid     = "invalid"
+	statusDeactivated = "deactivated"
+	statusExpired     = "expired"
+	statusRevoked     = "revoked"
+)
+
+// Lifetimes of the things the server hands out.
+const (
+	defaultCertificateLifetime = 90 * 24 * time.Hour
+	authzLifetime              = 30 * 24 * time.Hour
+	orderLifetime              = 7 * 24 * time.Hour
+)
+
+// Server is an in-memory ACME server.   The exported fields can be set
+// any time before the requests they affect are made.
+type Server struct {
+	// Validate decides whether a challenge passes.   Nil passes every
+	// challenge without looking at anything.
+	Validate Validator
+
+	// Profiles are advertised in the directory and are the only
+	// profiles new orders may ask for.
+	Profiles map[string]string
+
+	// ExternalAccountKeys maps EAB key IDs to HMAC keys.   If it's set,
+	// the directory says external account binding is required and new
+	// accounts need one made with one of these keys.
+	ExternalAccountKeys map[string][]byte
+
+	// CertificateLifetime is how long certificates are good for.   Zero
+	// means 90 days.
+	CertificateLifetime time.Duration
+
+	// ValidationPolls is how many times an authorization has to be
+	// polled after the client says a challenge is ready before the
+	// challenge is validated.   Until then the challenge is processing
+	// and the authorization pending.
+	ValidationPolls int
+
+	// ProcessingPolls is how many times an order has to be polled
+	// after it's finalized before it's valid.   Until then it's
+	// processing.
+	ProcessingPolls int
+
+	// RetryAfter, if set, is sent as Retry-After with pending
+	// authorizations and processing orders.
+	RetryAfter time.Duration
+
+	srv *httptest.Server
+	ca  *ca
+
+	mu         sync.Mutex
+	nextID     int
+	nonces     map[string]bool
+	accounts   map[string]*account // by URL
+	orders     map[string]*order   // by ID
+	authzs     map[string]*authz   // by ID
+	challenges map[string]*challenge
+	certs      map[string]*certificate
+	requests   map[string]int
+	faults     []*Fault
+}
+
+// NewServer starts a Server, which is closed when the test finishes.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	authority, err := newCA()
+	if err != nil {
+		t.Fatalf("Failed creating test CA: %v", err)
+	}
+
+	s := &Server{
+		ca:         authority,
+		nonces:     make(map[string]bool),
+		accounts:   make(map[string]*account),
+		orders:     make(map[string]*order),
+		authzs:     make(map[string]*authz),
+		challenges: make(map[string]*challenge),
+		certs:      make(map[string]*certificate),
+		requests:   make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", s.handleDirectory)
+	mux.HandleFunc("HEAD /new-nonce", s.handleNewNonce)
+	mux.HandleFunc("GET /new-nonce", s.handleNewNonce)
+	mux.HandleFunc("POST /new-account", s.post(ResourceNewAccount, signedByJWK, s.handleNewAccount))
+	mux.HandleFunc("POST /new-order", s.post(ResourceNewOrder, signedByKID, s.handleNewOrder))
+	mux.HandleFunc("POST /new-authz", s.post(ResourceNewAuthz, signedByKID, s.handleNewAuthz))
+	mux.HandleFunc("POST /revoke-cert", s.post(ResourceRevokeCert, signedByEither, s.handleRevokeCert))
+	mux.HandleFunc("POST /account/{id}", s.post(ResourceAccount, signedByKID, s.handleAccount))
+	mux.HandleFunc("POST /order/{id}", s.post(ResourceOrder, signedByKID, s.handleOrder))
+	mux.HandleFunc("POST /authz/{id}", s.post(ResourceAuthz, signedByKID, s.handleAuthz))
+	mux.HandleFunc("POST /chall/{id}", s.post(ResourceChallenge, signedByKID, s.handleChallenge))
+	mux.HandleFunc("POST /finalize/{id}", s.post(ResourceFinalize, signedByKID, s.handleFinalize))
+	mux.HandleFunc("POST /cert/{id}", s.post(ResourceCertificate, signedByKID, s.handleCertificate))
+	mux.HandleFunc("POST /cert/{id}/alternate", s.post(ResourceCertificate, signedByKID, s.handleCertificate))
+	mux.HandleFunc("GET /terms", s.handleTerms)
+
+	s.srv = httptest.NewTLSServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// URL is the server's base URL.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// DirectoryURL is where the directory is.
+func (s *Server) DirectoryURL() string {
+	return s.srv.URL + "/directory"
+}
+
+// Client returns an HTTP client that trusts the server's TLS
+// certificate.
+func (s *Server) Client() *http.Client {
+	return s.srv.Client()
+}
+
+// Root is the root of the default chain.
+func (s *Server) Root() *x509.Certificate {
+	return s.ca.root
+}
+
+// AlternateRoot is the root of the alternate chain.
+func (s *Server) AlternateRoot() *x509.Certificate {
+	return s.ca.altRoot
+}
+
+// Roots is a pool with both roots in it, for verifying issued
+// certificates.
+func (s *Server) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.ca.root)
+	pool.AddCert(s.ca.altRoot)
+	return pool
+}
+
+// Requests returns how many requests have been made to resource, one of
+// the Resource constants, including ones that failed.
+func (s *Server) Requests(resource string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[resource]
+}
+
+// Revoked reports whether cert has been revoked, and if so with what
+// reason code.
+func (s *Server) Revoked(cert *x509.Certificate) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.certs {
+		if c.leaf.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return c.reason, c.revoked
+		}
+	}
+	return 0, false
+}
+
+type directory struct {
+	NewNonce   string        `json:"newNonce"`
+	NewAccount string        `json:"newAccount"`
+	NewOrder   string        `json:"newOrder"`
+	NewAuthz   string        `json:"newAuthz"`
+	RevokeCert string        `json:"revokeCert"`
+	Meta       directoryMeta `json:"meta"`
+}
+
+type directoryMeta struct {
+	TermsOfService          string            `json:"termsOfService"`
+	CAAIdentities           []string          `json:"caaIdentities"`
+	ExternalAccountRequired bool              `json:"externalAccountRequired"`
+	Profiles                map[string]string `json:"profiles,omitempty"`
+}
+
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, finish := s.start(w, ResourceDirectory, false)
+	if finish == nil {
+		return
+	}
+	defer finish()
+
+	writeJSON(w, http.StatusOK, directory{
+		NewNonce:   s.URL() + "/new-nonce",
+		NewAccount: s.URL() + "/new-account",
+		NewOrder:   s.URL() + "/new-order",
+		NewAuthz:   s.URL() + "/new-authz",
+		RevokeCert: s.URL() + "/revoke-cert",
+		Meta: directoryMeta{
+			TermsOfService:          s.URL() + "/terms",
+			CAAIdentities:           []string{"acmetesting.invalid"},
+			ExternalAccountRequired: s.ExternalAccountKeys != nil,
+			Profiles:                s.Profiles,
+		},
+	})
+}
+
+func (s *Server) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeHeaders(w)
+	w, finish := s.start(w, ResourceNewNonce, false)
+	if finish == nil {
+		return
+	}
+	defer finish()
+
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleTerms(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("There are no terms, this CA is for tests.\n"))
+}
+
+// post wraps the handler for a resource that takes signed POSTs.   The
+// request is verified first and the handler is called with the server
+// locked, so handlers only have to write a successful response or
+// return a problem.
+func (s *Server) post(resource string, by signer, fn func(w http.ResponseWriter, r *http.Request, req *request) *Problem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.writeHeaders(w)
+		w, finish := s.start(w, resource, true)
+		if finish == nil {
+			return
+		}
+		defer finish()
+
+		req, p := s.verify(r, by)
+		if p == nil {
+			p = fn(w, r, req)
+		}
+		if p != nil {
+			writeProblem(w, p)
+		}
+	}
+}
+
+// start counts a request to resource and applies whatever fault is due.
+// It returns the writer to respond through and a func to call once the
+// response is written, or a nil func if the fault has already responded.
+func (s *Server) start(w http.ResponseWriter, resource string, signed bool) (http.ResponseWriter, func()) {
+	s.requests[resource]++
+	f := s.fault(resource, signed)
+	if f == nil {
+		return w, func() {}
+	}
+	return f.apply(w)
+}
+
+// writeHeaders sets what every response gets: a fresh nonce and a link
+// to the directory.
+func (s *Server) writeHeaders(w http.ResponseWriter) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Link", link(s.DirectoryURL(), "index"))
+}
+
+// writeRetryAfter sets Retry-After to s.RetryAfter, if it's set and the
+// client has reason to wait.
+func (s *Server) writeRetryAfter(w http.ResponseWriter, waiting bool) {
+	if waiting && s.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.RetryAfter/time.Second)))
+	}
+}
+
+func (s *Server) newNonce() string {
+	nonce := randomString(16)
+	s.nonces[nonce] = true
+	return nonce
+}
+
+// newID hands out the next ID for an account, order, authorization or
+// challenge.
+func (s *Server) newID() string {
+	s.nextID++
+	return strconv.Itoa(s.nextID)
+}
+
+// decodePayload unmarshals a request's payload into v, treating an
+// empty payload (POST-as-GET) as an error.
+func decodePayload(req *request, v interface{}) *Problem {
+	if req.postAsGet() {
+		return malformed("Request needs a payload")
+	}
+	if err := json.Unmarshal(req.payload, v); err != nil {
+		return malformed("Failed parsing payload: %v", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusInternalServerError, ProblemServerInternal, "Failed encoding response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func link(url, rel string) string {
+	return "<" + url + `>;rel="` + rel + `"`
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,246 @@
+package acmetesting
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// testAccount is a bare bones client for poking at the server.
+type testAccount struct {
+	t   *testing.T
+	srv *Server
+	key *ecdsa.PrivateKey
+	kid string
+}
+
+func newTestAccount(t *testing.T, srv *Server) *testAccount {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &testAccount{t: t, srv: srv, key: key}
+	res, _ := a.post("/new-account", `{"termsOfServiceAgreed":true}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected a new account, got status %d", res.StatusCode)
+	}
+	a.kid = res.Header.Get("Location")
+	return a
+}
+
+func (a *testAccount) nonce() string {
+	res, err := a.srv.Client().Head(a.srv.URL() + "/new-nonce")
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.Header.Get("Replay-Nonce")
+}
+
+// post signs payload for path with a fresh nonce.
+func (a *testAccount) post(path, payload string) (*http.Response, []byte) {
+	return a.postSigned(path, a.srv.URL()+path, a.nonce(), payload)
+}
+
+func (a *testAccount) postSigned(path, url, nonce, payload string) (*http.Response, []byte) {
+	a.t.Helper()
+	res, err := a.srv.Client().Post(a.srv.URL()+path, "application/jose+json", strings.NewReader(a.sign(url, nonce, payload)))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return res, body
+}
+
+func (a *testAccount) sign(url, nonce, payload string) string {
+	a.t.Helper()
+	opts := (&jose.SignerOptions{}).WithHeader("url", url).WithHeader("nonce", nonce)
+	if a.kid == "" {
+		opts.EmbedJWK = true
+	} else {
+		opts = opts.WithHeader("kid", a.kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: a.key}, opts)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	jws, err := signer.Sign([]byte(payload))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return jws.FullSerialize()
+}
+
+func problemType(body []byte) string {
+	var p Problem
+	json.Unmarshal(body, &p)
+	return p.Type
+}
+
+func TestDirectory(t *testing.T) {
+	srv := NewServer(t)
+	srv.ExternalAccountKeys = map[string][]byte{}
+
+	res, err := srv.Client().Get(srv.DirectoryURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var d directory
+	err = json.NewDecoder(res.Body).Decode(&d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.NewAuthz != srv.URL()+"/new-authz" || !d.Meta.ExternalAccountRequired {
+		t.Errorf("expected newAuthz and externalAccountRequired in the directory, got %+v", d)
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	srv := NewServer(t)
+	a := newTestAccount(t, srv)
+	res, _ := a.post("/new-order", `{"identifiers":[{"type":"dns","value":"example.org"}]}`)
+	order := res.Header.Get("Location")
+	finalize := strings.Replace(order, "/order/", "/finalize/", 1)
+
+	reused := a.nonce()
+	a.postSigned("/new-order", srv.URL()+"/new-order", reused, `{"identifiers":[{"type":"dns","value":"example.org"}]}`)
+
+	stranger := newTestAccount(t, srv)
+	nobody := &testAccount{t: t, srv: srv, key: a.key, kid: srv.URL() + "/account/999"}
+
+	tests := []struct {
+		Name    string
+		Account *testAccount
+		Path    string
+		URL     string
+		Nonce   string
+		Payload string
+		Status  int
+		Problem string
+	}{
+		{"reused nonce", a, "/new-order", "", reused, `{}`, http.StatusBadRequest, ProblemBadNonce},
+		{"made up nonce", a, "/new-order", "", "bm9uY2U", `{}`, http.StatusBadRequest, ProblemBadNonce},
+		{"wrong url", a, "/new-order", srv.URL() + "/new-authz", "", `{}`, http.StatusForbidden, ProblemUnauthorized},
+		{"unknown account", nobody, "/new-order", "", "", `{}`, http.StatusBadRequest, ProblemAccountDoesNotExist},
+		{"someone else's order", stranger, strings.TrimPrefix(order, srv.URL()), "", "", ``, http.StatusForbidden, ProblemUnauthorized},
+		{"no identifiers", a, "/new-order", "", "", `{"identifiers":[]}`, http.StatusBadRequest, ProblemMalformed},
+		{"bad names", a, "/new-order", "", "", `{"identifiers":[{"type":"dns","value":"-bad-.example.org"},{"type":"dns","value":"foo.*.example.org"}]}`, http.StatusBadRequest, ProblemRejectedIdentifier},
+		{"ip as dns", a, "/new-order", "", "", `{"identifiers":[{"type":"dns","value":"192.0.2.1"}]}`, http.StatusBadRequest, ProblemMalformed},
+		{"unknown type", a, "/new-order", "", "", `{"identifiers":[{"type":"email","value":"ops@example.org"}]}`, http.StatusBadRequest, ProblemUnsupportedIdentifier},
+		{"unknown profile", a, "/new-order", "", "", `{"identifiers":[{"type":"dns","value":"example.org"}],"profile":"shortlived"}`, http.StatusBadRequest, ProblemInvalidProfile},
+		{"wildcard pre-authorization", a, "/new-authz", "", "", `{"identifier":{"type":"dns","value":"*.example.org"}}`, http.StatusBadRequest, ProblemRejectedIdentifier},
+		{"finalize too soon", a, strings.TrimPrefix(finalize, srv.URL()), "", "", `{"csr":""}`, http.StatusForbidden, ProblemOrderNotReady},
+	}
+
+	for _, test := range tests {
+		url, nonce := test.URL, test.Nonce
+		if url == "" {
+			url = srv.URL() + test.Path
+		}
+		if nonce == "" {
+			nonce = test.Account.nonce()
+		}
+		res, body := test.Account.postSigned(test.Path, url, nonce, test.Payload)
+		if res.StatusCode != test.Status || problemType(body) != test.Problem {
+			t.Errorf("test %q expected %d %s, got %d %s", test.Name, test.Status, test.Problem, res.StatusCode, body)
+		}
+		if res.Header.Get("Replay-Nonce") == "" {
+			t.Errorf("test %q got no fresh nonce", test.Name)
+		}
+	}
+}
+
+func TestChallengeValidation(t *testing.T) {
+	srv := NewServer(t)
+	var validated []Validation
+	srv.Validate = func(v Validation) error {
+		validated = append(validated, v)
+		return &Problem{Type: ProblemConnection, Detail: "Connection refused"}
+	}
+	a := newTestAccount(t, srv)
+
+	res, body := a.post("/new-order", `{"identifiers":[{"type":"dns","value":"*.Example.org"}]}`)
+	var o orderJSON
+	json.Unmarshal(body, &o)
+	if res.StatusCode != http.StatusCreated || len(o.Authorizations) != 1 || o.Identifiers[0].Value != "*.example.org" {
+		t.Fatalf("expected an order for *.example.org, got %d %s", res.StatusCode, body)
+	}
+
+	_, body = a.post(strings.TrimPrefix(o.Authorizations[0], srv.URL()), "")
+	var authz authzJSON
+	json.Unmarshal(body, &authz)
+	if !authz.Wildcard || len(authz.Challenges) != 1 || authz.Challenges[0].Type != ChallengeDNS01 {
+		t.Fatalf("expected a wildcard authorization with only dns-01, got %s", body)
+	}
+
+	res, body = a.post(strings.TrimPrefix(authz.Challenges[0].URL, srv.URL()), "{}")
+	var ch challengeJSON
+	json.Unmarshal(body, &ch)
+	if ch.Status != statusInvalid || ch.Error == nil || ch.Error.Type != ProblemConnection || ch.Error.Identifier.Value != "example.org" {
+		t.Errorf("expected the challenge to fail with the validator's problem, got %s", body)
+	}
+	if !strings.Contains(strings.Join(res.Header.Values("Link"), ","), `rel="up"`) {
+		t.Errorf("expected a link up to the authorization, got %q", res.Header.Values("Link"))
+	}
+	if len(validated) != 1 || !strings.HasPrefix(validated[0].KeyAuthorization, authz.Challenges[0].Token+".") {
+		t.Errorf("expected one validation with the key authorization, got %+v", validated)
+	}
+
+	_, body = a.post("/order/"+strings.TrimPrefix(o.Finalize, srv.URL()+"/finalize/"), "")
+	json.Unmarshal(body, &o)
+	if o.Status != statusInvalid {
+		t.Errorf("expected the order to be invalid once its authorization is, got %q", o.Status)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	srv := NewServer(t)
+	srv.Inject(
+		BadNonce(2),
+		RateLimited(ResourceNewOrder, 2, 30*time.Second),
+		Truncated(ResourceAccount),
+	)
+	a := newTestAccount(t, srv)
+	order := `{"identifiers":[{"type":"dns","value":"example.org"}]}`
+
+	res, body := a.post("/new-order", order)
+	if problemType(body) != ProblemBadNonce {
+		t.Errorf("expected the second signed request to get badNonce, got %s", body)
+	}
+	res, body = a.post("/new-order", order)
+	if res.StatusCode != http.StatusTooManyRequests || problemType(body) != ProblemRateLimited || res.Header.Get("Retry-After") != "30" {
+		t.Errorf("expected rateLimited with Retry-After: 30, got %d %q %s", res.StatusCode, res.Header.Get("Retry-After"), body)
+	}
+	res, _ = a.post("/new-order", order)
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected to be rate limited twice, got %d", res.StatusCode)
+	}
+	res, _ = a.post("/new-order", order)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("expected the order once the faults ran out, got %d", res.StatusCode)
+	}
+
+	res, err := srv.Client().Post(a.kid, "application/jose+json", strings.NewReader(a.sign(a.kid, a.nonce(), "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	if err == nil {
+		t.Errorf("expected reading a truncated response to fail")
+	}
+}
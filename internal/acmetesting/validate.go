@@ -0,0 +1,163 @@
+package acmetesting
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Validation is a challenge the client says is ready to be checked.
+type Validation struct {
+	Identifier Identifier
+	Wildcard   bool
+	Type       string
+	Token      string
+
+	// KeyAuthorization is what the client should be serving, token and
+	// account key thumbprint per RFC8555 section 8.1.
+	KeyAuthorization string
+}
+
+// Validator decides whether a challenge passes.   Returning a *Problem
+// sets exactly what error the challenge carries, any other error is
+// reported as incorrectResponse.
+type Validator func(v Validation) error
+
+// validationTimeout bounds how long the Check functions wait on the
+// client's solver.
+const validationTimeout = 10 * time.Second
+
+// idPeAcmeIdentifier is the OID of the acmeIdentifier extension in a
+// tls-alpn-01 certificate, RFC8737 section 6.1.
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// CheckHTTP01 validates an http-01 challenge the way a CA would, except
+// that it connects to addr rather than to whatever the identifier
+// resolves to.   The Host header is still the identifier.
+func CheckHTTP01(addr string, v Validation) error {
+	host := v.Identifier.Value
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	req, err := http.NewRequest("GET", "http://"+addr+"/.well-known/acme-challenge/"+v.Token, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+
+	client := http.Client{Timeout: validationTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, ProblemConnection, "Fetching http-01 response from %s: %v", addr, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+	if err != nil {
+		return newProblem(http.StatusBadRequest, ProblemConnection, "Reading http-01 response from %s: %v", addr, err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return newProblem(http.StatusForbidden, ProblemIncorrectResponse, "http-01 response from %s had status %d", addr, res.StatusCode)
+	}
+	if got := strings.TrimSpace(string(body)); got != v.KeyAuthorization {
+		return newProblem(http.StatusForbidden, ProblemIncorrectResponse, "http-01 response from %s was %q, not %q", addr, got, v.KeyAuthorization)
+	}
+	return nil
+}
+
+// CheckTLSALPN01 validates a tls-alpn-01 challenge the way a CA would,
+// per RFC8737 and RFC8738, connecting to addr.
+func CheckTLSALPN01(addr string, v Validation) error {
+	serverName := v.Identifier.Value
+	if v.Identifier.Type == "ip" {
+		serverName = reverseDNSName(net.ParseIP(v.Identifier.Value))
+	}
+
+	dialer := net.Dialer{Timeout: validationTimeout}
+	conn, err := tls.DialWithDialer(&dialer, "tcp", addr, &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return newProblem(http.StatusBadRequest, ProblemConnection, "tls-alpn-01 handshake with %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" {
+		return newProblem(http.StatusForbidden, ProblemIncorrectResponse, "%s didn't negotiate acme-tls/1", addr)
+	}
+	cert := state.PeerCertificates[0]
+	if !certCovers(cert, v.Identifier) {
+		return newProblem(http.StatusForbidden, ProblemIncorrectResponse, "tls-alpn-01 certificate from %s isn't for %s", addr, v.Identifier.Value)
+	}
+
+	want := sha256.Sum256([]byte(v.KeyAuthorization))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeAcmeIdentifier) {
+			continue
+		}
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil || !ext.Critical || string(got) != string(want[:]) {
+			return newProblem(http.StatusForbidden, ProblemIncorrectResponse, "tls-alpn-01 certificate from %s has the wrong acmeIdentifier", addr)
+		}
+		return nil
+	}
+	return newProblem(http.StatusForbidden, ProblemIncorrectResponse, "tls-alpn-01 certificate from %s has no acmeIdentifier", addr)
+}
+
+// CheckDNS01 validates a dns-01 challenge by looking up the TXT records
+// at _acme-challenge.<domain> with lookupTXT, which could be
+// net.LookupTXT, or a fake DNS provider.
+func CheckDNS01(lookupTXT func(name string) ([]string, error), v Validation) error {
+	name := "_acme-challenge." + v.Identifier.Value
+	records, err := lookupTXT(name)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, ProblemDNS, "Looking up TXT records for %s: %v", name, err)
+	}
+
+	h := sha256.Sum256([]byte(v.KeyAuthorization))
+	want := base64.RawURLEncoding.EncodeToString(h[:])
+	for _, r := range records {
+		if strings.Trim(r, `"`) == want {
+			return nil
+		}
+	}
+	return newProblem(http.StatusForbidden, ProblemIncorrectResponse, "No TXT record at %s matches the key authorization, found %d others", name, len(records))
+}
+
+// certCovers reports whether cert is for exactly the identifier.
+func certCovers(cert *x509.Certificate, id Identifier) bool {
+	if id.Type == "ip" {
+		ip := net.ParseIP(id.Value)
+		return len(cert.IPAddresses) == 1 && cert.IPAddresses[0].Equal(ip) && len(cert.DNSNames) == 0
+	}
+	return len(cert.DNSNames) == 1 && strings.EqualFold(cert.DNSNames[0], id.Value) && len(cert.IPAddresses) == 0
+}
+
+// reverseDNSName is the in-addr.arpa or ip6.arpa name for ip, which
+// tls-alpn-01 uses as the SNI for IP identifiers.
+func reverseDNSName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+
+	const hex = "0123456789abcdef"
+	ip = ip.To16()
+	labels := make([]string, 0, 2*len(ip)+1)
+	for i := len(ip) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[ip[i]&0x0f]), string(hex[ip[i]>>4]))
+	}
+	labels = append(labels, "ip6.arpa")
+	return strings.Join(labels, ".")
+}
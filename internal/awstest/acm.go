@@ -0,0 +1,334 @@
+package awstest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/acm"
+)
+
+// listPageSize is how many certificates ListCertificates returns at a
+// time, small so paging gets exercised.
+const listPageSize = 2
+
+// ACM is an in-memory AWS Certificate Manager that only knows about
+// imported certificates.   It checks imports the way ACM does: the key
+// has to match the certificate, and tags can only be given on the first
+// import, not a reimport into an existing ARN.   Like ACM, ListCertificates
+// only lists RSA_2048 certificates unless it's asked for other key types.
+type ACM struct {
+	mu     sync.Mutex
+	nextID int
+	certs  map[string]*acmCert // by ARN
+	denied map[string]bool     // by operation
+	calls  map[string]int
+	fail   map[string][]error
+}
+
+type acmCert struct {
+	arn      string
+	leaf     *x509.Certificate
+	certPEM  []byte
+	chainPEM []byte
+	keyPEM   []byte
+	keyAlg   string
+	tags     map[string]string
+	imported time.Time
+	imports  int
+}
+
+// NewACM returns an empty ACM.
+func NewACM() *ACM {
+	return &ACM{
+		certs:  make(map[string]*acmCert),
+		denied: make(map[string]bool),
+		calls:  make(map[string]int),
+		fail:   make(map[string][]error),
+	}
+}
+
+// Deny makes every call to op (like "ImportCertificate") fail with
+// AccessDeniedException, as if IAM didn't allow it.
+func (a *ACM) Deny(op string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.denied[op] = true
+}
+
+// FailNext makes the next call to op return err.   Several errors for the
+// same op are returned in order.
+func (a *ACM) FailNext(op string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fail[op] = append(a.fail[op], err)
+}
+
+// Calls returns how many times op has been called.
+func (a *ACM) Calls(op string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.calls[op]
+}
+
+// ARNs returns the ARN of every certificate, sorted.
+func (a *ACM) ARNs() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	arns := make([]string, 0, len(a.certs))
+	for arn := range a.certs {
+		arns = append(arns, arn)
+	}
+	sort.Strings(arns)
+	return arns
+}
+
+// Imports returns how many times a certificate has been imported into
+// arn, counting the first time.
+func (a *ACM) Imports(arn string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c, ok := a.certs[arn]; ok {
+		return c.imports
+	}
+	return 0
+}
+
+// PrivateKey returns the key last imported into arn, which the real ACM
+// never hands back.
+func (a *ACM) PrivateKey(arn string) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c, ok := a.certs[arn]; ok {
+		return c.keyPEM
+	}
+	return nil
+}
+
+// call counts a call to op and returns the error it should fail with,
+// if any.   a.mu must be held.
+func (a *ACM) call(op string) error {
+	a.calls[op]++
+	if errs := a.fail[op]; len(errs) > 0 {
+		a.fail[op] = errs[1:]
+		return errs[0]
+	}
+	if a.denied[op] {
+		return awserr.New(acm.ErrCodeAccessDeniedException, fmt.Sprintf("User is not authorized to perform: acm:%s", op), nil)
+	}
+	return nil
+}
+
+func (a *ACM) lookup(arn *string) (*acmCert, error) {
+	c, ok := a.certs[aws.StringValue(arn)]
+	if !ok {
+		return nil, awserr.New(acm.ErrCodeResourceNotFoundException, fmt.Sprintf("Could not find certificate with ARN %s", aws.StringValue(arn)), nil)
+	}
+	return c, nil
+}
+
+// ImportCertificateWithContext imports a certificate, into a new ARN or
+// over the one in CertificateArn.
+func (a *ACM) ImportCertificateWithContext(ctx aws.Context, input *acm.ImportCertificateInput, opts ...request.Option) (*acm.ImportCertificateOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.call("ImportCertificate"); err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(input.Certificate, input.PrivateKey)
+	if err != nil {
+		return nil, awserr.New(acm.ErrCodeValidationException, "The certificate and private key don't match or couldn't be parsed: "+err.Error(), nil)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, awserr.New(acm.ErrCodeValidationException, "Could not parse certificate: "+err.Error(), nil)
+	}
+	if len(input.CertificateChain) > 0 {
+		if block, _ := pem.Decode(input.CertificateChain); block == nil {
+			return nil, awserr.New(acm.ErrCodeValidationException, "Could not parse certificate chain", nil)
+		}
+	}
+	keyAlg, err := keyAlgorithm(pair.PrivateKey)
+	if err != nil {
+		return nil, awserr.New(acm.ErrCodeValidationException, err.Error(), nil)
+	}
+
+	var c *acmCert
+	if input.CertificateArn != nil {
+		if len(input.Tags) > 0 {
+			return nil, awserr.New(acm.ErrCodeInvalidParameterException, "Tags can't be applied when reimporting a certificate", nil)
+		}
+		c, err = a.lookup(input.CertificateArn)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		a.nextID++
+		c = &acmCert{
+			arn:  fmt.Sprintf("arn:aws:acm:us-east-1:123456789012:certificate/00000000-0000-0000-0000-%012d", a.nextID),
+			tags: make(map[string]string),
+		}
+		for _, t := range input.Tags {
+			c.tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+		a.certs[c.arn] = c
+	}
+
+	c.leaf = leaf
+	c.certPEM = input.Certificate
+	c.chainPEM = input.CertificateChain
+	c.keyPEM = input.PrivateKey
+	c.keyAlg = keyAlg
+	c.imported = time.Now()
+	c.imports++
+
+	return &acm.ImportCertificateOutput{CertificateArn: aws.String(c.arn)}, nil
+}
+
+// ListCertificatesWithContext lists certificates a page at a time,
+// filtered by Includes.KeyTypes or RSA_2048 if none are given.
+func (a *ACM) ListCertificatesWithContext(ctx aws.Context, input *acm.ListCertificatesInput, opts ...request.Option) (*acm.ListCertificatesOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.call("ListCertificates"); err != nil {
+		return nil, err
+	}
+
+	keyTypes := map[string]bool{acm.KeyAlgorithmRsa2048: true}
+	if input.Includes != nil && len(input.Includes.KeyTypes) > 0 {
+		keyTypes = make(map[string]bool)
+		for _, kt := range input.Includes.KeyTypes {
+			keyTypes[aws.StringValue(kt)] = true
+		}
+	}
+
+	var arns []string
+	for arn, c := range a.certs {
+		if keyTypes[c.keyAlg] {
+			arns = append(arns, arn)
+		}
+	}
+	sort.Strings(arns)
+
+	start := 0
+	if input.NextToken != nil {
+		start, _ = strconv.Atoi(*input.NextToken)
+	}
+	out := &acm.ListCertificatesOutput{}
+	for i := start; i < len(arns) && i < start+listPageSize; i++ {
+		c := a.certs[arns[i]]
+		out.CertificateSummaryList = append(out.CertificateSummaryList, &acm.CertificateSummary{
+			CertificateArn: aws.String(c.arn),
+			DomainName:     aws.String(c.leaf.Subject.CommonName),
+			ImportedAt:     aws.Time(c.imported),
+			KeyAlgorithm:   aws.String(c.keyAlg),
+			NotAfter:       aws.Time(c.leaf.NotAfter),
+			Status:         aws.String(acm.CertificateStatusIssued),
+			Type:           aws.String(acm.CertificateTypeImported),
+		})
+	}
+	if start+listPageSize < len(arns) {
+		out.NextToken = aws.String(strconv.Itoa(start + listPageSize))
+	}
+	return out, nil
+}
+
+// ListTagsForCertificateWithContext returns a certificate's tags.
+func (a *ACM) ListTagsForCertificateWithContext(ctx aws.Context, input *acm.ListTagsForCertificateInput, opts ...request.Option) (*acm.ListTagsForCertificateOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.call("ListTagsForCertificate"); err != nil {
+		return nil, err
+	}
+	c, err := a.lookup(input.CertificateArn)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(c.tags))
+	for k := range c.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := &acm.ListTagsForCertificateOutput{}
+	for _, k := range keys {
+		out.Tags = append(out.Tags, &acm.Tag{Key: aws.String(k), Value: aws.String(c.tags[k])})
+	}
+	return out, nil
+}
+
+// AddTagsToCertificateWithContext adds tags to a certificate, replacing
+// the values of any it already has.
+func (a *ACM) AddTagsToCertificateWithContext(ctx aws.Context, input *acm.AddTagsToCertificateInput, opts ...request.Option) (*acm.AddTagsToCertificateOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.call("AddTagsToCertificate"); err != nil {
+		return nil, err
+	}
+	c, err := a.lookup(input.CertificateArn)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range input.Tags {
+		c.tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return &acm.AddTagsToCertificateOutput{}, nil
+}
+
+// GetCertificateWithContext returns a certificate and its chain, but not
+// its key.
+func (a *ACM) GetCertificateWithContext(ctx aws.Context, input *acm.GetCertificateInput, opts ...request.Option) (*acm.GetCertificateOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.call("GetCertificate"); err != nil {
+		return nil, err
+	}
+	c, err := a.lookup(input.CertificateArn)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &acm.GetCertificateOutput{Certificate: aws.String(string(c.certPEM))}
+	if len(c.chainPEM) > 0 {
+		out.CertificateChain = aws.String(string(c.chainPEM))
+	}
+	return out, nil
+}
+
+// keyAlgorithm names a key the way ACM does.
+func keyAlgorithm(key crypto.PrivateKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return acm.KeyAlgorithmRsa2048, nil
+		case 3072:
+			return acm.KeyAlgorithmRsa3072, nil
+		case 4096:
+			return acm.KeyAlgorithmRsa4096, nil
+		}
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return acm.KeyAlgorithmEcPrime256v1, nil
+		case elliptic.P384():
+			return acm.KeyAlgorithmEcSecp384r1, nil
+		case elliptic.P521():
+			return acm.KeyAlgorithmEcSecp521r1, nil
+		}
+	}
+	return "", fmt.Errorf("Unsupported key type %T", key)
+}
@@ -0,0 +1,408 @@
+// Package awstest has in-memory fakes of the AWS APIs the acmetest
+// package uses, for tests that shouldn't need an AWS account.
+package awstest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// maxWaitAttempts is how many times WaitUntilResourceRecordSetsChanged
+// checks a change before giving up, like the SDK's waiter.
+const maxWaitAttempts = 60
+
+// Route53 is an in-memory Route53 with hosted zones, record sets and
+// changes that go INSYNC after being checked SyncPolls times.   Change
+// batches are validated and applied all or nothing the way Route53
+// does, so CREATEing a record that exists, DELETEing one that doesn't
+// or doesn't match, and changing the same record twice in a batch are
+// InvalidChangeBatch errors.   Waiting doesn't sleep.
+type Route53 struct {
+	// SyncPolls is how many times a change is reported PENDING before
+	// it's INSYNC.
+	SyncPolls int
+
+	mu      sync.Mutex
+	nextID  int
+	zones   map[string]*zone // by ID
+	changes map[string]int   // change ID to polls left while PENDING
+	calls   map[string]int
+	fail    map[string][]error
+}
+
+type zone struct {
+	id      string
+	name    string
+	private bool
+	records map[recordKey]*route53.ResourceRecordSet
+}
+
+type recordKey struct {
+	name string
+	typ  string
+}
+
+// NewRoute53 returns an empty Route53.
+func NewRoute53() *Route53 {
+	return &Route53{
+		zones:   make(map[string]*zone),
+		changes: make(map[string]int),
+		calls:   make(map[string]int),
+		fail:    make(map[string][]error),
+	}
+}
+
+// AddZone creates a hosted zone for name and returns its ID, which is
+// in the /hostedzone/<id> form the API returns.
+func (r *Route53) AddZone(name string, private bool) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	z := &zone{
+		id:      fmt.Sprintf("/hostedzone/Z%04d", r.nextID),
+		name:    canonicalName(name),
+		private: private,
+		records: make(map[recordKey]*route53.ResourceRecordSet),
+	}
+	r.zones[z.id] = z
+	return z.id
+}
+
+// FailNext makes the next call to op (the API operation's name, like
+// "ChangeResourceRecordSets") return err instead of doing anything.
+// Several errors for the same op are returned in order.
+func (r *Route53) FailNext(op string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fail[op] = append(r.fail[op], err)
+}
+
+// Calls returns how many times op has been called.
+func (r *Route53) Calls(op string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[op]
+}
+
+// Records returns the record sets of type typ in a zone, sorted by name.
+func (r *Route53) Records(zoneID, typ string) []*route53.ResourceRecordSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	z, ok := r.zones[zoneIDPath(zoneID)]
+	if !ok {
+		return nil
+	}
+	var sets []*route53.ResourceRecordSet
+	for key, rrs := range z.records {
+		if key.typ == typ {
+			sets = append(sets, rrs)
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool { return *sets[i].Name < *sets[j].Name })
+	return sets
+}
+
+// LookupTXT resolves the TXT record at name the way a public resolver
+// would: from the public zone with the longest name that contains it,
+// with the quotes taken off.   It fits acmetesting.CheckDNS01.
+func (r *Route53) LookupTXT(name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = canonicalName(name)
+	var best *zone
+	for _, z := range r.zones {
+		if !z.private && inZone(name, z.name) && (best == nil || len(z.name) > len(best.name)) {
+			best = z
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("No zone for %s", name)
+	}
+
+	rrs, ok := best.records[recordKey{name, route53.RRTypeTxt}]
+	if !ok {
+		return nil, nil
+	}
+	values := make([]string, 0, len(rrs.ResourceRecords))
+	for _, rr := range rrs.ResourceRecords {
+		if v, err := strconv.Unquote(aws.StringValue(rr.Value)); err == nil {
+			values = append(values, v)
+		} else {
+			values = append(values, aws.StringValue(rr.Value))
+		}
+	}
+	return values, nil
+}
+
+// call counts a call to op and returns the error it should fail with,
+// if any.   r.mu must be held.
+func (r *Route53) call(op string) error {
+	r.calls[op]++
+	if errs := r.fail[op]; len(errs) > 0 {
+		r.fail[op] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// ListHostedZones returns every zone, sorted the way Route53 sorts them.
+func (r *Route53) ListHostedZones(input *route53.ListHostedZonesInput) (*route53.ListHostedZonesOutput, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("ListHostedZones"); err != nil {
+		return nil, err
+	}
+	return &route53.ListHostedZonesOutput{HostedZones: r.sortedZones(""), IsTruncated: aws.Bool(false)}, nil
+}
+
+// ListHostedZonesByNameWithContext returns zones in Route53's order,
+// which is by name with the labels reversed, starting from DNSName.
+func (r *Route53) ListHostedZonesByNameWithContext(ctx aws.Context, input *route53.ListHostedZonesByNameInput, opts ...request.Option) (*route53.ListHostedZonesByNameOutput, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("ListHostedZonesByName"); err != nil {
+		return nil, err
+	}
+
+	max := 100
+	if input.MaxItems != nil {
+		n, err := strconv.Atoi(*input.MaxItems)
+		if err != nil || n < 1 {
+			return nil, awserr.New(route53.ErrCodeInvalidInput, "MaxItems must be a positive number", nil)
+		}
+		max = n
+	}
+
+	zones := r.sortedZones(aws.StringValue(input.DNSName))
+	out := &route53.ListHostedZonesByNameOutput{DNSName: input.DNSName, MaxItems: input.MaxItems, IsTruncated: aws.Bool(false)}
+	if len(zones) > max {
+		out.IsTruncated = aws.Bool(true)
+		out.NextDNSName = zones[max].Name
+		out.NextHostedZoneId = zones[max].Id
+		zones = zones[:max]
+	}
+	out.HostedZones = zones
+	return out, nil
+}
+
+// sortedZones returns the zones at or after from in Route53's order.
+func (r *Route53) sortedZones(from string) []*route53.HostedZone {
+	var zones []*zone
+	for _, z := range r.zones {
+		if from == "" || reversedName(z.name) >= reversedName(canonicalName(from)) {
+			zones = append(zones, z)
+		}
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		if a, b := reversedName(zones[i].name), reversedName(zones[j].name); a != b {
+			return a < b
+		}
+		return zones[i].id < zones[j].id
+	})
+
+	out := make([]*route53.HostedZone, 0, len(zones))
+	for _, z := range zones {
+		out = append(out, &route53.HostedZone{
+			Id:                     aws.String(z.id),
+			Name:                   aws.String(z.name),
+			Config:                 &route53.HostedZoneConfig{PrivateZone: aws.Bool(z.private)},
+			ResourceRecordSetCount: aws.Int64(int64(len(z.records))),
+		})
+	}
+	return out
+}
+
+// ChangeResourceRecordSetsWithContext checks every change in the batch,
+// then applies them all, or none of them if any is invalid.
+func (r *Route53) ChangeResourceRecordSetsWithContext(ctx aws.Context, input *route53.ChangeResourceRecordSetsInput, opts ...request.Option) (*route53.ChangeResourceRecordSetsOutput, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("ChangeResourceRecordSets"); err != nil {
+		return nil, err
+	}
+
+	z, ok := r.zones[zoneIDPath(aws.StringValue(input.HostedZoneId))]
+	if !ok {
+		return nil, awserr.New(route53.ErrCodeNoSuchHostedZone, fmt.Sprintf("No hosted zone found with ID: %s", aws.StringValue(input.HostedZoneId)), nil)
+	}
+	if input.ChangeBatch == nil || len(input.ChangeBatch.Changes) == 0 {
+		return nil, awserr.New(route53.ErrCodeInvalidInput, "ChangeBatch must have at least one change", nil)
+	}
+
+	var problems []string
+	seen := make(map[recordKey]bool)
+	for _, change := range input.ChangeBatch.Changes {
+		rrs := change.ResourceRecordSet
+		if rrs == nil || rrs.Name == nil || rrs.Type == nil {
+			problems = append(problems, "Change is missing its record set, name or type")
+			continue
+		}
+		key := recordKey{canonicalName(*rrs.Name), *rrs.Type}
+		if seen[key] {
+			problems = append(problems, fmt.Sprintf("Duplicate Resource Record: '%s %s'", key.name, key.typ))
+		}
+		seen[key] = true
+
+		if !inZone(key.name, z.name) {
+			problems = append(problems, fmt.Sprintf("RRSet with DNS name %s is not permitted in zone %s", key.name, z.name))
+			continue
+		}
+
+		existing, exists := z.records[key]
+		switch aws.StringValue(change.Action) {
+		case route53.ChangeActionCreate:
+			if exists {
+				problems = append(problems, fmt.Sprintf("Tried to create resource record set [name='%s', type='%s'] but it already exists", key.name, key.typ))
+			}
+		case route53.ChangeActionDelete:
+			if !exists {
+				problems = append(problems, fmt.Sprintf("Tried to delete resource record set [name='%s', type='%s'] but it was not found", key.name, key.typ))
+			} else if !sameRecords(existing, rrs) {
+				problems = append(problems, fmt.Sprintf("Tried to delete resource record set [name='%s', type='%s'] but the values provided do not match the current values", key.name, key.typ))
+			}
+		case route53.ChangeActionUpsert:
+		default:
+			problems = append(problems, fmt.Sprintf("Unknown action %q", aws.StringValue(change.Action)))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, awserr.New(route53.ErrCodeInvalidChangeBatch, "["+strings.Join(problems, ", ")+"]", nil)
+	}
+
+	for _, change := range input.ChangeBatch.Changes {
+		rrs := change.ResourceRecordSet
+		key := recordKey{canonicalName(*rrs.Name), *rrs.Type}
+		if aws.StringValue(change.Action) == route53.ChangeActionDelete {
+			delete(z.records, key)
+			continue
+		}
+		stored := *rrs
+		stored.Name = aws.String(key.name)
+		stored.ResourceRecords = append([]*route53.ResourceRecord(nil), rrs.ResourceRecords...)
+		z.records[key] = &stored
+	}
+
+	r.nextID++
+	id := fmt.Sprintf("/change/C%04d", r.nextID)
+	r.changes[id] = r.SyncPolls
+	return &route53.ChangeResourceRecordSetsOutput{ChangeInfo: r.changeInfo(id)}, nil
+}
+
+// GetChangeWithContext reports a change as PENDING until it's been
+// checked SyncPolls times, then INSYNC.
+func (r *Route53) GetChangeWithContext(ctx aws.Context, input *route53.GetChangeInput, opts ...request.Option) (*route53.GetChangeOutput, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("GetChange"); err != nil {
+		return nil, err
+	}
+	return r.getChange(aws.StringValue(input.Id))
+}
+
+func (r *Route53) getChange(id string) (*route53.GetChangeOutput, error) {
+	if !strings.HasPrefix(id, "/change/") {
+		id = "/change/" + id
+	}
+	left, ok := r.changes[id]
+	if !ok {
+		return nil, awserr.New(route53.ErrCodeNoSuchChange, fmt.Sprintf("A change with the specified change ID does not exist: %s", id), nil)
+	}
+	info := r.changeInfo(id)
+	if left > 0 {
+		r.changes[id] = left - 1
+	}
+	return &route53.GetChangeOutput{ChangeInfo: info}, nil
+}
+
+func (r *Route53) changeInfo(id string) *route53.ChangeInfo {
+	status := route53.ChangeStatusInsync
+	if r.changes[id] > 0 {
+		status = route53.ChangeStatusPending
+	}
+	return &route53.ChangeInfo{Id: aws.String(id), Status: aws.String(status)}
+}
+
+// WaitUntilResourceRecordSetsChangedWithContext checks the change until
+// it's INSYNC, without waiting in between.
+func (r *Route53) WaitUntilResourceRecordSetsChangedWithContext(ctx aws.Context, input *route53.GetChangeInput, opts ...request.WaiterOption) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.call("WaitUntilResourceRecordSetsChanged"); err != nil {
+		return err
+	}
+
+	for i := 0; i < maxWaitAttempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return awserr.New(request.CanceledErrorCode, "Waiter context canceled", err)
+		}
+		out, err := r.getChange(aws.StringValue(input.Id))
+		if err != nil {
+			return err
+		}
+		if aws.StringValue(out.ChangeInfo.Status) == route53.ChangeStatusInsync {
+			return nil
+		}
+	}
+	return awserr.New(request.WaiterResourceNotReadyErrorCode, "Exceeded max wait attempts", nil)
+}
+
+// canonicalName lowercases name and makes sure it ends with a dot.
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// reversedName is name with its labels reversed, which is how Route53
+// orders hosted zones.
+func reversedName(name string) string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+func inZone(name, zoneName string) bool {
+	return name == zoneName || strings.HasSuffix(name, "."+zoneName)
+}
+
+// zoneIDPath puts a bare zone ID in the /hostedzone/<id> form.
+func zoneIDPath(id string) string {
+	if strings.HasPrefix(id, "/hostedzone/") {
+		return id
+	}
+	return "/hostedzone/" + id
+}
+
+// sameRecords reports whether a DELETE's record set matches what's
+// there, which Route53 insists on.
+func sameRecords(a, b *route53.ResourceRecordSet) bool {
+	if aws.Int64Value(a.TTL) != aws.Int64Value(b.TTL) || len(a.ResourceRecords) != len(b.ResourceRecords) {
+		return false
+	}
+	values := make(map[string]int)
+	for _, rr := range a.ResourceRecords {
+		values[aws.StringValue(rr.Value)]++
+	}
+	for _, rr := range b.ResourceRecords {
+		values[aws.StringValue(rr.Value)]--
+	}
+	for _, n := range values {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,425 @@
+package awstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// Version stages Secrets Manager moves between versions itself.
+const (
+	StageCurrent  = "AWSCURRENT"
+	StagePrevious = "AWSPREVIOUS"
+)
+
+// ErrCodeAccessDenied is what Secrets Manager says when IAM says no.
+const ErrCodeAccessDenied = "AccessDeniedException"
+
+// SecretsManager is an in-memory Secrets Manager.   Every write makes a
+// new version that takes AWSCURRENT, and the version that had it gets
+// AWSPREVIOUS, so history can be read back by stage or version ID.
+type SecretsManager struct {
+	mu      sync.Mutex
+	nextID  int
+	secrets map[string]*secret // by name
+	denied  map[string]bool
+	calls   map[string]int
+	fail    map[string][]error
+}
+
+type secret struct {
+	name     string
+	arn      string
+	kmsKeyID string
+	policy   string
+	tags     []*secretsmanager.Tag
+	versions []*secretVersion // oldest first
+	created  time.Time
+}
+
+type secretVersion struct {
+	id      string
+	value   *string
+	binary  []byte
+	stages  []string
+	created time.Time
+}
+
+// NewSecretsManager returns an empty SecretsManager.
+func NewSecretsManager() *SecretsManager {
+	return &SecretsManager{
+		secrets: make(map[string]*secret),
+		denied:  make(map[string]bool),
+		calls:   make(map[string]int),
+		fail:    make(map[string][]error),
+	}
+}
+
+// Deny makes every call touching the secret called name fail with
+// AccessDeniedException, as if IAM didn't allow it.
+func (sm *SecretsManager) Deny(name string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.denied[name] = true
+}
+
+// FailNext makes the next call to op (like "UpdateSecret") return err.
+// Several errors for the same op are returned in order.
+func (sm *SecretsManager) FailNext(op string, err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.fail[op] = append(sm.fail[op], err)
+}
+
+// Calls returns how many times op has been called.
+func (sm *SecretsManager) Calls(op string) int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.calls[op]
+}
+
+// Names returns the names of every secret, sorted.
+func (sm *SecretsManager) Names() []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	names := make([]string, 0, len(sm.secrets))
+	for name := range sm.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Versions returns how many versions the secret called name has.
+func (sm *SecretsManager) Versions(name string) int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.secrets[name]; ok {
+		return len(s.versions)
+	}
+	return 0
+}
+
+// KMSKeyID returns the KMS key the secret called name is encrypted with,
+// or "" for the account's default key.
+func (sm *SecretsManager) KMSKeyID(name string) string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.secrets[name]; ok {
+		return s.kmsKeyID
+	}
+	return ""
+}
+
+// Tags returns the tags on the secret called name.
+func (sm *SecretsManager) Tags(name string) map[string]string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	tags := make(map[string]string)
+	if s, ok := sm.secrets[name]; ok {
+		for _, t := range s.tags {
+			tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+	}
+	return tags
+}
+
+// ResourcePolicy returns the resource policy on the secret called name.
+func (sm *SecretsManager) ResourcePolicy(name string) string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.secrets[name]; ok {
+		return s.policy
+	}
+	return ""
+}
+
+// call counts a call to op on the secret called id and returns the
+// error it should fail with, if any.   sm.mu must be held.
+func (sm *SecretsManager) call(op, id string) error {
+	sm.calls[op]++
+	if errs := sm.fail[op]; len(errs) > 0 {
+		sm.fail[op] = errs[1:]
+		return errs[0]
+	}
+	if s, ok := sm.lookup(id); (ok && sm.denied[s.name]) || sm.denied[id] {
+		return awserr.New(ErrCodeAccessDenied, fmt.Sprintf("User is not authorized to perform: secretsmanager:%s on resource: %s", op, id), nil)
+	}
+	return nil
+}
+
+// lookup finds a secret by name or ARN.
+func (sm *SecretsManager) lookup(id string) (*secret, bool) {
+	if s, ok := sm.secrets[id]; ok {
+		return s, true
+	}
+	for _, s := range sm.secrets {
+		if s.arn == id {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func notFound(id string) error {
+	return awserr.New(secretsmanager.ErrCodeResourceNotFoundException, fmt.Sprintf("Secrets Manager can't find the specified secret: %s", id), nil)
+}
+
+// CreateSecretWithContext creates a secret, with a first version if it's
+// given a value.
+func (sm *SecretsManager) CreateSecretWithContext(ctx aws.Context, input *secretsmanager.CreateSecretInput, opts ...request.Option) (*secretsmanager.CreateSecretOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	name := aws.StringValue(input.Name)
+	if err := sm.call("CreateSecret", name); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, awserr.New(secretsmanager.ErrCodeInvalidParameterException, "Name is required", nil)
+	}
+	if _, ok := sm.secrets[name]; ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceExistsException, fmt.Sprintf("The operation failed because the secret %s already exists.", name), nil)
+	}
+
+	sm.nextID++
+	s := &secret{
+		name:     name,
+		arn:      fmt.Sprintf("arn:aws:secretsmanager:us-east-1:123456789012:secret:%s-%06d", name, sm.nextID),
+		kmsKeyID: aws.StringValue(input.KmsKeyId),
+		tags:     input.Tags,
+		created:  time.Now(),
+	}
+	sm.secrets[name] = s
+
+	out := &secretsmanager.CreateSecretOutput{ARN: aws.String(s.arn), Name: aws.String(name)}
+	if input.SecretString != nil || input.SecretBinary != nil {
+		v := sm.addVersion(s, input.SecretString, input.SecretBinary, nil)
+		out.VersionId = aws.String(v.id)
+	}
+	return out, nil
+}
+
+// UpdateSecretWithContext changes a secret's settings and, if it's given
+// a value, adds a version.
+func (sm *SecretsManager) UpdateSecretWithContext(ctx aws.Context, input *secretsmanager.UpdateSecretInput, opts ...request.Option) (*secretsmanager.UpdateSecretOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	id := aws.StringValue(input.SecretId)
+	if err := sm.call("UpdateSecret", id); err != nil {
+		return nil, err
+	}
+	s, ok := sm.lookup(id)
+	if !ok {
+		return nil, notFound(id)
+	}
+
+	if input.KmsKeyId != nil {
+		s.kmsKeyID = *input.KmsKeyId
+	}
+	out := &secretsmanager.UpdateSecretOutput{ARN: aws.String(s.arn), Name: aws.String(s.name)}
+	if input.SecretString != nil || input.SecretBinary != nil {
+		v := sm.addVersion(s, input.SecretString, input.SecretBinary, nil)
+		out.VersionId = aws.String(v.id)
+	}
+	return out, nil
+}
+
+// PutSecretValueWithContext adds a version to a secret, with the stages
+// asked for or AWSCURRENT.
+func (sm *SecretsManager) PutSecretValueWithContext(ctx aws.Context, input *secretsmanager.PutSecretValueInput, opts ...request.Option) (*secretsmanager.PutSecretValueOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	id := aws.StringValue(input.SecretId)
+	if err := sm.call("PutSecretValue", id); err != nil {
+		return nil, err
+	}
+	s, ok := sm.lookup(id)
+	if !ok {
+		return nil, notFound(id)
+	}
+
+	v := sm.addVersion(s, input.SecretString, input.SecretBinary, aws.StringValueSlice(input.VersionStages))
+	return &secretsmanager.PutSecretValueOutput{
+		ARN:           aws.String(s.arn),
+		Name:          aws.String(s.name),
+		VersionId:     aws.String(v.id),
+		VersionStages: aws.StringSlice(v.stages),
+	}, nil
+}
+
+// addVersion adds a version with the given stages, AWSCURRENT if none,
+// taking them from whichever versions had them.   If AWSCURRENT moves,
+// the version that had it gets AWSPREVIOUS.
+func (sm *SecretsManager) addVersion(s *secret, value *string, binary []byte, stages []string) *secretVersion {
+	if len(stages) == 0 {
+		stages = []string{StageCurrent}
+	}
+	for _, stage := range stages {
+		for _, old := range s.versions {
+			if !hasStage(old.stages, stage) {
+				continue
+			}
+			old.stages = removeStage(old.stages, stage)
+			if stage == StageCurrent {
+				for _, o := range s.versions {
+					o.stages = removeStage(o.stages, StagePrevious)
+				}
+				old.stages = append(old.stages, StagePrevious)
+			}
+		}
+	}
+
+	sm.nextID++
+	v := &secretVersion{
+		id:      fmt.Sprintf("00000000-0000-0000-0000-%012d", sm.nextID),
+		value:   value,
+		binary:  binary,
+		stages:  stages,
+		created: time.Now(),
+	}
+	s.versions = append(s.versions, v)
+	return v
+}
+
+// GetSecretValueWithContext returns a version of a secret, by version ID
+// or stage, or AWSCURRENT if it's asked for neither.
+func (sm *SecretsManager) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	id := aws.StringValue(input.SecretId)
+	if err := sm.call("GetSecretValue", id); err != nil {
+		return nil, err
+	}
+	s, ok := sm.lookup(id)
+	if !ok {
+		return nil, notFound(id)
+	}
+
+	stage := aws.StringValue(input.VersionStage)
+	if stage == "" && input.VersionId == nil {
+		stage = StageCurrent
+	}
+	for _, v := range s.versions {
+		if (input.VersionId != nil && v.id == *input.VersionId) || (stage != "" && hasStage(v.stages, stage)) {
+			return &secretsmanager.GetSecretValueOutput{
+				ARN:           aws.String(s.arn),
+				Name:          aws.String(s.name),
+				VersionId:     aws.String(v.id),
+				VersionStages: aws.StringSlice(v.stages),
+				SecretString:  v.value,
+				SecretBinary:  v.binary,
+				CreatedDate:   aws.Time(v.created),
+			}, nil
+		}
+	}
+	return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, fmt.Sprintf("Secrets Manager can't find the specified secret value for %s", id), nil)
+}
+
+// DescribeSecretWithContext returns a secret's settings, tags and which
+// stages each version has.
+func (sm *SecretsManager) DescribeSecretWithContext(ctx aws.Context, input *secretsmanager.DescribeSecretInput, opts ...request.Option) (*secretsmanager.DescribeSecretOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	id := aws.StringValue(input.SecretId)
+	if err := sm.call("DescribeSecret", id); err != nil {
+		return nil, err
+	}
+	s, ok := sm.lookup(id)
+	if !ok {
+		return nil, notFound(id)
+	}
+
+	stages := make(map[string][]*string)
+	for _, v := range s.versions {
+		if len(v.stages) > 0 {
+			stages[v.id] = aws.StringSlice(v.stages)
+		}
+	}
+	out := &secretsmanager.DescribeSecretOutput{
+		ARN:                aws.String(s.arn),
+		Name:               aws.String(s.name),
+		Tags:               s.tags,
+		VersionIdsToStages: stages,
+		CreatedDate:        aws.Time(s.created),
+	}
+	if s.kmsKeyID != "" {
+		out.KmsKeyId = aws.String(s.kmsKeyID)
+	}
+	return out, nil
+}
+
+// TagResourceWithContext adds tags to a secret, replacing the values of
+// any it already has.
+func (sm *SecretsManager) TagResourceWithContext(ctx aws.Context, input *secretsmanager.TagResourceInput, opts ...request.Option) (*secretsmanager.TagResourceOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	id := aws.StringValue(input.SecretId)
+	if err := sm.call("TagResource", id); err != nil {
+		return nil, err
+	}
+	s, ok := sm.lookup(id)
+	if !ok {
+		return nil, notFound(id)
+	}
+
+	for _, t := range input.Tags {
+		replaced := false
+		for _, existing := range s.tags {
+			if aws.StringValue(existing.Key) == aws.StringValue(t.Key) {
+				existing.Value = t.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			s.tags = append(s.tags, &secretsmanager.Tag{Key: t.Key, Value: t.Value})
+		}
+	}
+	return &secretsmanager.TagResourceOutput{}, nil
+}
+
+// PutResourcePolicyWithContext sets a secret's resource policy, which
+// has to at least be JSON.
+func (sm *SecretsManager) PutResourcePolicyWithContext(ctx aws.Context, input *secretsmanager.PutResourcePolicyInput, opts ...request.Option) (*secretsmanager.PutResourcePolicyOutput, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	id := aws.StringValue(input.SecretId)
+	if err := sm.call("PutResourcePolicy", id); err != nil {
+		return nil, err
+	}
+	s, ok := sm.lookup(id)
+	if !ok {
+		return nil, notFound(id)
+	}
+	if !json.Valid([]byte(aws.StringValue(input.ResourcePolicy))) {
+		return nil, awserr.New(secretsmanager.ErrCodeMalformedPolicyDocumentException, "The resource policy isn't valid JSON", nil)
+	}
+
+	s.policy = aws.StringValue(input.ResourcePolicy)
+	return &secretsmanager.PutResourcePolicyOutput{ARN: aws.String(s.arn), Name: aws.String(s.name)}, nil
+}
+
+func hasStage(stages []string, stage string) bool {
+	for _, s := range stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func removeStage(stages []string, stage string) []string {
+	out := stages[:0]
+	for _, s := range stages {
+		if s != stage {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,402 @@
+// Package vaulttest is an in-memory HashiCorp Vault for tests.   It
+// speaks enough of the HTTP API for a client to log in with a token or
+// AppRole and read and write KV version 2 secrets: data, versions,
+// soft deletes, check-and-set and custom metadata.   Policies are all or
+// nothing, except that Deny can take a path away.
+//
+// It's no substitute for `vault server -dev` when checking what a real
+// Vault does, but it needs no binary and can expire tokens on demand.
+package vaulttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RootToken is the token the Server accepts from the start.
+const RootToken = "root"
+
+// Server is an in-memory Vault with KV v2 engines at secret/ and
+// wherever Mount puts them, and AppRole auth at auth/approle.
+type Server struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	mounts   map[string]map[string]*kvSecret // mount, then path
+	roles    map[string]string               // role ID to secret ID
+	tokens   map[string]bool                 // valid tokens
+	denied   map[string]bool                 // mount/path
+	requests map[string]int                  // by "METHOD /v1/..." without the query
+	nextID   int
+}
+
+type kvSecret struct {
+	versions       []*kvVersion // version n is versions[n-1]
+	customMetadata map[string]string
+	maxVersions    int
+}
+
+type kvVersion struct {
+	data      map[string]interface{}
+	created   time.Time
+	deleted   time.Time
+	destroyed bool
+}
+
+// NewServer starts a Server with KV v2 mounted at secret/, the way a
+// dev server starts, and closes it when the test is done.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		mounts:   map[string]map[string]*kvSecret{"secret": {}},
+		roles:    make(map[string]string),
+		tokens:   map[string]bool{RootToken: true},
+		denied:   make(map[string]bool),
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/auth/approle/login", s.login)
+	mux.HandleFunc("/v1/{mount}/data/{path...}", s.data)
+	mux.HandleFunc("/v1/{mount}/metadata/{path...}", s.metadata)
+	s.srv = httptest.NewServer(s.count(mux))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+// URL is the server's address, for VAULT_ADDR.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Mount enables another KV v2 engine at path.
+func (s *Server) Mount(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mounts[strings.Trim(path, "/")] = make(map[string]*kvSecret)
+}
+
+// AddAppRole lets roleID and secretID log in through auth/approle.
+func (s *Server) AddAppRole(roleID, secretID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles[roleID] = secretID
+}
+
+// ExpireTokens revokes every token but the root token, as if their TTLs
+// had run out.
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = map[string]bool{RootToken: true}
+}
+
+// Deny refuses every request for the secret at mount/path, as a policy
+// without it would.
+func (s *Server) Deny(mount, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[strings.Trim(mount, "/")+"/"+strings.Trim(path, "/")] = true
+}
+
+// Requests returns how many requests there have been for method and
+// path, like "POST /v1/auth/approle/login".
+func (s *Server) Requests(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method+" "+path]
+}
+
+// Versions returns how many versions the secret at mount/path has.
+func (s *Server) Versions(mount, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sec, ok := s.mounts[mount][strings.Trim(path, "/")]; ok {
+		return len(sec.versions)
+	}
+	return 0
+}
+
+// Data returns a version of the secret at mount/path, or the current one
+// if version is 0.
+func (s *Server) Data(mount, path string, version int) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sec, ok := s.mounts[mount][strings.Trim(path, "/")]
+	if !ok || len(sec.versions) == 0 {
+		return nil
+	}
+	if version == 0 {
+		version = len(sec.versions)
+	}
+	if version > len(sec.versions) {
+		return nil
+	}
+	return sec.versions[version-1].data
+}
+
+// CustomMetadata returns the custom metadata on the secret at mount/path.
+func (s *Server) CustomMetadata(mount, path string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sec, ok := s.mounts[mount][strings.Trim(path, "/")]; ok {
+		return sec.customMetadata
+	}
+	return nil
+}
+
+func (s *Server) count(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.Method+" "+r.URL.Path]++
+		s.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoleID   string `json:"role_id"`
+		SecretID string `json:"secret_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrors(w, http.StatusBadRequest, "failed to parse JSON input: "+err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if want, ok := s.roles[req.RoleID]; !ok || want != req.SecretID {
+		writeErrors(w, http.StatusBadRequest, "invalid role or secret ID")
+		return
+	}
+	s.nextID++
+	token := fmt.Sprintf("hvs.approle%04d", s.nextID)
+	s.tokens[token] = true
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   token,
+			"lease_duration": 3600,
+			"renewable":      true,
+			"policies":       []string{"default", "acmetest"},
+		},
+	})
+}
+
+// secret checks the token and policy for a KV request and returns the
+// mount's secrets and the path, or writes the error and returns false.
+// s.mu must be held.
+func (s *Server) secret(w http.ResponseWriter, r *http.Request) (map[string]*kvSecret, string, bool) {
+	mount, path := r.PathValue("mount"), strings.Trim(r.PathValue("path"), "/")
+	if !s.tokens[r.Header.Get("X-Vault-Token")] || s.denied[mount+"/"+path] {
+		writeErrors(w, http.StatusForbidden, "permission denied")
+		return nil, "", false
+	}
+	secrets, ok := s.mounts[mount]
+	if !ok || path == "" {
+		writeErrors(w, http.StatusNotFound, fmt.Sprintf("no handler for route %q", strings.TrimPrefix(r.URL.Path, "/v1/")))
+		return nil, "", false
+	}
+	return secrets, path, true
+}
+
+func (s *Server) data(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, path, ok := s.secret(w, r)
+	if !ok {
+		return
+	}
+	sec := secrets[path]
+
+	switch r.Method {
+	case http.MethodGet:
+		if sec == nil || len(sec.versions) == 0 {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		n := len(sec.versions)
+		if v := r.URL.Query().Get("version"); v != "" && v != "0" {
+			var err error
+			n, err = strconv.Atoi(v)
+			if err != nil || n < 1 {
+				writeErrors(w, http.StatusBadRequest, "invalid version")
+				return
+			}
+		}
+		if n > len(sec.versions) {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		v := sec.versions[n-1]
+		body := map[string]interface{}{"data": nil, "metadata": versionMetadata(v, n)}
+		if !v.deleted.IsZero() || v.destroyed {
+			// Vault answers 404 for deleted versions, but still
+			// says which version it was.
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"data": body})
+			return
+		}
+		body["data"] = v.data
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": body})
+
+	case http.MethodPost, http.MethodPut:
+		var req struct {
+			Data    map[string]interface{} `json:"data"`
+			Options struct {
+				CAS *int `json:"cas"`
+			} `json:"options"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Data == nil {
+			writeErrors(w, http.StatusBadRequest, "no data provided")
+			return
+		}
+		if sec == nil {
+			sec = &kvSecret{}
+			secrets[path] = sec
+		}
+		if req.Options.CAS != nil && *req.Options.CAS != len(sec.versions) {
+			writeErrors(w, http.StatusBadRequest, "check-and-set parameter did not match the current version")
+			return
+		}
+		v := &kvVersion{data: req.Data, created: time.Now().UTC()}
+		sec.versions = append(sec.versions, v)
+		if sec.maxVersions > 0 {
+			for i := 0; i < len(sec.versions)-sec.maxVersions; i++ {
+				sec.versions[i].destroyed = true
+				sec.versions[i].data = nil
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": versionMetadata(v, len(sec.versions))})
+
+	case http.MethodDelete:
+		if sec != nil && len(sec.versions) > 0 {
+			sec.versions[len(sec.versions)-1].deleted = time.Now().UTC()
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+func (s *Server) metadata(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets, path, ok := s.secret(w, r)
+	if !ok {
+		return
+	}
+	sec := secrets[path]
+
+	switch r.Method {
+	case http.MethodGet:
+		if sec == nil {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		versions := make(map[string]interface{})
+		for i, v := range sec.versions {
+			versions[strconv.Itoa(i+1)] = versionMetadata(v, i+1)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{
+				"current_version": len(sec.versions),
+				"oldest_version":  oldestVersion(sec),
+				"max_versions":    sec.maxVersions,
+				"custom_metadata": sec.customMetadata,
+				"versions":        versions,
+			},
+		})
+
+	case http.MethodPost, http.MethodPut:
+		var req struct {
+			CustomMetadata map[string]string `json:"custom_metadata"`
+			MaxVersions    *int              `json:"max_versions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrors(w, http.StatusBadRequest, "failed to parse JSON input: "+err.Error())
+			return
+		}
+		if err := checkCustomMetadata(req.CustomMetadata); err != "" {
+			writeErrors(w, http.StatusBadRequest, err)
+			return
+		}
+		if sec == nil {
+			sec = &kvSecret{}
+			secrets[path] = sec
+		}
+		if req.CustomMetadata != nil {
+			sec.customMetadata = req.CustomMetadata
+		}
+		if req.MaxVersions != nil {
+			sec.maxVersions = *req.MaxVersions
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		delete(secrets, path)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// checkCustomMetadata applies Vault's limits on custom metadata: at most
+// 64 keys, keys up to 128 bytes and values up to 512.
+func checkCustomMetadata(m map[string]string) string {
+	if len(m) > 64 {
+		return fmt.Sprintf("custom_metadata validation failed: %d keys exceeds the limit of 64", len(m))
+	}
+	for k, v := range m {
+		if len(k) > 128 {
+			return fmt.Sprintf("custom_metadata validation failed: length of key %q is %d but max is 128", k, len(k))
+		}
+		if len(v) > 512 {
+			return fmt.Sprintf("custom_metadata validation failed: length of value for key %q is %d but max is 512", k, len(v))
+		}
+	}
+	return ""
+}
+
+func versionMetadata(v *kvVersion, n int) map[string]interface{} {
+	deleted := ""
+	if !v.deleted.IsZero() {
+		deleted = v.deleted.Format(time.RFC3339Nano)
+	}
+	return map[string]interface{}{
+		"version":       n,
+		"created_time":  v.created.Format(time.RFC3339Nano),
+		"deletion_time": deleted,
+		"destroyed":     v.destroyed,
+	}
+}
+
+func oldestVersion(sec *kvSecret) int {
+	for i, v := range sec.versions {
+		if !v.destroyed {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func writeErrors(w http.ResponseWriter, status int, errs ...string) {
+	if errs == nil {
+		errs = []string{}
+	}
+	writeJSON(w, status, map[string]interface{}{"errors": errs})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}